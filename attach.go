@@ -0,0 +1,50 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/grailbio/base/errors"
+)
+
+// Attach adopts running machines that were launched by external
+// tooling (for example Terraform or autoscaling groups) and that run
+// the bigmachine supervisor. Machines are selected by their tags in the
+// underlying infrastructure: a machine is selected if it has each of
+// the provided tags. Attach then manages the selected machines as if
+// they were returned by Start with the provided parameters: the
+// driver's binary is uploaded to them, their services are registered,
+// and b maintains keepalives to them. Machines that b already manages
+// are skipped. Attach returns the adopted machines, which may be in
+// Starting state; it returns an error of kind errors.NotExist if no
+// new machines were selected. The System must support selection by
+// tags; Attach fails with an error of kind errors.NotSupported
+// otherwise.
+func (b *B) Attach(ctx context.Context, tags Labels, params ...Param) ([]*Machine, error) {
+	if err := b.Err(); err != nil {
+		return nil, err
+	}
+	if len(tags) == 0 {
+		return nil, errors.E(errors.Invalid, "attach: no tags provided")
+	}
+	if _, err := checkParams(params); err != nil {
+		return nil, err
+	}
+	selector, ok := b.system.(machineSelector)
+	if !ok {
+		return nil, errors.E(errors.NotSupported, fmt.Sprintf("system %s does not support selecting machines by tags", b.system.Name()))
+	}
+	selected, err := selector.SelectMachines(ctx, tags)
+	if err != nil {
+		return nil, errors.E(fmt.Sprintf("attach %s", tags), err)
+	}
+	machines := b.manage(selected, params, 0, "attaching to")
+	if len(machines) == 0 {
+		return nil, errors.E(errors.NotExist, fmt.Sprintf("attach %s: no machines found", tags))
+	}
+	return machines, nil
+}
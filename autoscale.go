@@ -0,0 +1,300 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+)
+
+const (
+	// DefaultAutoscalePeriod is the default interval at which an
+	// autoscaler evaluates its load.
+	defaultAutoscalePeriod = 30 * time.Second
+	// DefaultScaleDownDelay is the default amount of time for which
+	// an autoscaler's target must remain below its machine count
+	// before machines are retired.
+	defaultScaleDownDelay = 5 * time.Minute
+	// RetireTimeout is the timeout for shutting down retired machines.
+	retireTimeout = 30 * time.Second
+)
+
+// An AutoscalePolicy determines how an Autoscaler sizes its set of
+// machines. The policy's load signal is evaluated periodically to
+// compute a target number of machines, bounded by Min and Max;
+// exactly one of Load and Utilization must be provided.
+type AutoscalePolicy struct {
+	// Min and Max bound the number of machines maintained by the
+	// autoscaler.
+	Min, Max int
+	// Load returns the current load, measured in machines: the number
+	// of machines needed to serve it. For example, a queue-driven
+	// application might return its queue depth divided by the number of
+	// tasks that a machine processes concurrently.
+	Load func() float64
+	// Utilization returns the current utilization of the
+	// autoscaler's machines, between 0 and 1. The target number of
+	// machines is that which would bring utilization to
+	// TargetUtilization.
+	Utilization func() float64
+	// TargetUtilization is the utilization that the autoscaler
+	// maintains when Utilization is provided. It defaults to 0.8.
+	TargetUtilization float64
+	// Period is the interval at which the load is evaluated. It
+	// defaults to 30 seconds.
+	Period time.Duration
+	// ScaleDownDelay is the amount of time for which the target must
+	// remain below the number of machines before machines are retired,
+	// so that brief lulls do not cause churn. It defaults to 5
+	// minutes.
+	ScaleDownDelay time.Duration
+	// WarmTime is the amount of time for which retired machines are
+	// kept running, so that they may be reused, instead of starting
+	// new machines, if the load increases again. Retired machines are
+	// shut down immediately if WarmTime is zero.
+	WarmTime time.Duration
+}
+
+// An Autoscaler maintains a set of machines whose size tracks the
+// load signal of an AutoscalePolicy. Autoscalers are created by
+// B.Autoscale.
+type Autoscaler struct {
+	b      *B
+	policy AutoscalePolicy
+	params []Param
+
+	mu sync.Mutex
+	// active are the machines currently in service.
+	active []*Machine
+	// warm are retired machines that are kept running, and the times at
+	// which they were retired.
+	warm map[*Machine]time.Time
+	// target is the most recently computed target.
+	target int
+	// below is the time since which the target has been below the
+	// number of active machines.
+	below time.Time
+}
+
+// Autoscale starts an autoscaler that maintains a set of machines,
+// configured by the provided parameters, according to the provided
+// policy. Machines are started when the target exceeds the number of
+// machines in service, reusing warm (recently retired) machines
+// before starting new ones; machines are retired when the target
+// remains below the number of machines in service for the policy's
+// scale-down delay. Machines that stop are replaced. The autoscaler
+// runs until the provided context is done, at which point its warm
+// machines are shut down; the machines in service are left running.
+func (b *B) Autoscale(ctx context.Context, policy AutoscalePolicy, params ...Param) (*Autoscaler, error) {
+	if (policy.Load == nil) == (policy.Utilization == nil) {
+		return nil, errors.E(errors.Invalid, "autoscale: exactly one of Load and Utilization must be provided")
+	}
+	if policy.Min < 0 || policy.Max < policy.Min || policy.Max == 0 {
+		return nil, errors.E(errors.Invalid, "autoscale: invalid bounds")
+	}
+	if policy.TargetUtilization == 0 {
+		policy.TargetUtilization = 0.8
+	}
+	if policy.Period == 0 {
+		policy.Period = defaultAutoscalePeriod
+	}
+	if policy.ScaleDownDelay == 0 {
+		policy.ScaleDownDelay = defaultScaleDownDelay
+	}
+	if _, err := checkParams(params); err != nil {
+		return nil, err
+	}
+	a := &Autoscaler{
+		b:      b,
+		policy: policy,
+		params: params,
+		warm:   make(map[*Machine]time.Time),
+	}
+	go a.run(ctx)
+	return a, nil
+}
+
+// Machines returns the machines currently in service. Machines may
+// still be starting.
+func (a *Autoscaler) Machines() []*Machine {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]*Machine(nil), a.active...)
+}
+
+// Target returns the most recently computed target number of
+// machines.
+func (a *Autoscaler) Target() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.target
+}
+
+func (a *Autoscaler) run(ctx context.Context) {
+	tick := time.NewTicker(a.policy.Period)
+	defer tick.Stop()
+	for {
+		a.scale(ctx)
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			a.mu.Lock()
+			var warm []*Machine
+			for m := range a.warm {
+				warm = append(warm, m)
+			}
+			a.warm = nil
+			a.mu.Unlock()
+			for _, m := range warm {
+				retire(m)
+			}
+			return
+		}
+	}
+}
+
+// Scale evaluates the policy's load signal and starts or retires
+// machines to track the resulting target.
+func (a *Autoscaler) scale(ctx context.Context) {
+	a.mu.Lock()
+	// Stopped machines are no longer in service, and are replaced
+	// below, as needed.
+	active := a.active[:0]
+	for _, m := range a.active {
+		if m.State() != Stopped {
+			active = append(active, m)
+		}
+	}
+	a.active = active
+	now := time.Now()
+	for m, t := range a.warm {
+		if m.State() == Stopped || now.Sub(t) > a.policy.WarmTime {
+			delete(a.warm, m)
+			go retire(m)
+		}
+	}
+	target := a.computeTarget(len(a.active))
+	a.target = target
+	n := len(a.active)
+	switch {
+	case target > n:
+		a.below = time.Time{}
+		// Reuse warm machines first.
+		for m := range a.warm {
+			if n == target {
+				break
+			}
+			if m.State() != Running || !m.Healthy() {
+				continue
+			}
+			delete(a.warm, m)
+			a.active = append(a.active, m)
+			n++
+		}
+	case target < n:
+		if a.below.IsZero() {
+			a.below = now
+		}
+		if now.Sub(a.below) < a.policy.ScaleDownDelay {
+			break
+		}
+		a.below = time.Time{}
+		a.retireLocked(n - target)
+	default:
+		a.below = time.Time{}
+	}
+	need := target - len(a.active)
+	a.mu.Unlock()
+	if need <= 0 {
+		return
+	}
+	log.Printf("autoscale: starting %d machines (target %d)", need, target)
+	machines, err := a.b.Start(ctx, need, a.params...)
+	if err != nil {
+		log.Error.Printf("autoscale: failed to start machines: %v", err)
+		return
+	}
+	a.mu.Lock()
+	a.active = append(a.active, machines...)
+	a.mu.Unlock()
+}
+
+// ComputeTarget returns the target number of machines given the
+// current number of machines in service, n.
+func (a *Autoscaler) computeTarget(n int) int {
+	var want float64
+	if a.policy.Load != nil {
+		want = a.policy.Load()
+	} else {
+		// When no machines are in service, there is no utilization
+		// to measure; maintain at least one machine.
+		util := a.policy.Utilization()
+		want = math.Max(1, float64(n)*util/a.policy.TargetUtilization)
+	}
+	target := int(math.Ceil(want))
+	if target < a.policy.Min {
+		target = a.policy.Min
+	}
+	if target > a.policy.Max {
+		target = a.policy.Max
+	}
+	return target
+}
+
+// RetireLocked removes n machines from service. Unhealthy and
+// still-starting machines are retired first, followed by the most
+// recently started machines. It must be called while holding a.mu.
+func (a *Autoscaler) retireLocked(n int) {
+	sort.SliceStable(a.active, func(i, j int) bool {
+		ri, rj := retireRank(a.active[i]), retireRank(a.active[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return a.active[i].StartTime().After(a.active[j].StartTime())
+	})
+	retired := a.active[:n]
+	a.active = append([]*Machine(nil), a.active[n:]...)
+	log.Printf("autoscale: retiring %d machines (target %d)", n, a.target)
+	now := time.Now()
+	for _, m := range retired {
+		if a.policy.WarmTime > 0 && m.State() == Running && m.Healthy() {
+			a.warm[m] = now
+		} else {
+			go retire(m)
+		}
+	}
+}
+
+// RetireRank orders machines by their preference for retirement:
+// lower ranks are retired first.
+func retireRank(m *Machine) int {
+	switch {
+	case !m.Healthy():
+		return 0
+	case m.State() != Running:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// Retire shuts down the machine m and cancels its keepalive.
+func retire(m *Machine) {
+	if m.State() == Running {
+		ctx, cancel := context.WithTimeout(context.Background(), retireTimeout)
+		err := m.call(ctx, "Supervisor.Shutdown", shutdownRequest{Delay: time.Second, Message: string(logSyncMarker)}, nil)
+		cancel()
+		if err != nil {
+			log.Error.Printf("%s: failed to shut down retired machine: %v", m.Name(), err)
+		}
+	}
+	m.Cancel()
+}
@@ -0,0 +1,186 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+// WaitAll waits for each of the provided machines, or, if none are
+// provided, each of b's machines, to reach the provided state (or a
+// later one; see Machine.WaitFor). Unless the state is Stopped, WaitAll
+// fails as soon as a machine stops without reaching it, with an error
+// of kind errors.Unavailable that includes the machine's error. It
+// also fails if the context is done first.
+func (b *B) WaitAll(ctx context.Context, state State, machines ...*Machine) error {
+	if len(machines) == 0 {
+		machines = b.Machines()
+	}
+	g, ctx := errgroup.WithContext(ctx)
+	for _, m := range machines {
+		m := m
+		g.Go(func() error {
+			fired, err := m.WaitFor(ctx, state, Stopped)
+			switch {
+			case fired == state:
+				return nil
+			case fired == Stopped:
+				return errors.E(errors.Unavailable, fmt.Sprintf("machine %s stopped before it was %s", m.Addr, state), err)
+			default:
+				return err
+			}
+		})
+	}
+	return g.Wait()
+}
+
+// A Barrier synchronizes a fixed number of parties, for example the
+// services of a cluster's machines and the driver, through a sequence
+// of phases: parties that wait on a phase of the barrier (see
+// Barrier.Wait) are released once all of the parties have reached it,
+// so that "wait until every worker reaches phase N" does not require
+// bespoke coordination. A barrier is hosted by one of the cluster's
+// machines (see Barriers), and is identified by the host's address and
+// a name; since it consists only of these, it may be passed to
+// services as a call argument.
+type Barrier struct {
+	// Addr is the address of the machine that hosts the barrier.
+	Addr string
+	// Name is the barrier's name, which is unique to its host.
+	Name string
+	// Parties is the number of parties that must reach each phase of
+	// the barrier before they are released.
+	Parties int
+}
+
+// NewBarrier returns a barrier with the provided name for the provided
+// number of parties, hosted by machine host. The barrier's state is
+// created on the host when the barrier is first waited on.
+func NewBarrier(host *Machine, name string, parties int) Barrier {
+	return Barrier{Addr: host.Addr, Name: name, Parties: parties}
+}
+
+// Wait joins the barrier at the provided phase, and returns once all
+// of the barrier's parties have joined it at that phase, or once the
+// context is done, in which case the party leaves the phase. Each
+// party should join each phase once, in increasing order of phases;
+// Wait returns immediately for phases that were already completed.
+// Services (see Services) join barriers through the B with which they
+// were initialized. Wait fails with an error of kind errors.Invalid if
+// the barrier's host knows it with a different number of parties.
+func (br Barrier) Wait(ctx context.Context, b *B, phase int) error {
+	m, err := b.Dial(ctx, br.Addr)
+	if err != nil {
+		return err
+	}
+	err = m.Call(ctx, "Barriers.Wait", barrierRequest{br.Name, br.Parties, phase}, nil)
+	if err != nil && errors.Is(errors.Remote, err) {
+		if cause := errors.Recover(err).Err; errors.Is(errors.Invalid, cause) {
+			return cause
+		}
+	}
+	return err
+}
+
+// A barrierRequest is the argument of Barriers.Wait.
+type barrierRequest struct {
+	Name    string
+	Parties int
+	Phase   int
+}
+
+// Barriers is the built-in service, registered as "Barriers" on every
+// machine, that hosts the state of the barriers whose host is the
+// machine (see Barrier).
+type Barriers struct {
+	mu       sync.Mutex
+	barriers map[string]*barrierState
+}
+
+// NewBarriers returns a new barrier service. It is registered by the
+// machine's process, and should not otherwise be instantiated.
+func NewBarriers() *Barriers {
+	return &Barriers{barriers: make(map[string]*barrierState)}
+}
+
+// A barrierState is the state of a barrier on its host.
+type barrierState struct {
+	parties int
+	// phases are the phases of the barrier that parties have joined,
+	// but that are not yet completed.
+	phases map[int]*barrierPhase
+	// completed indicates whether a phase was completed, and last is
+	// the latest completed phase.
+	completed bool
+	last      int
+}
+
+// A barrierPhase is a phase of a barrier that is not yet completed.
+type barrierPhase struct {
+	// arrived is the number of parties that have joined the phase.
+	arrived int
+	// done is closed once the phase is completed.
+	done chan struct{}
+}
+
+// Wait joins the named barrier at the requested phase, and replies
+// once all of the barrier's parties have joined it (see Barrier.Wait).
+func (s *Barriers) Wait(ctx context.Context, req barrierRequest, _ *struct{}) error {
+	if req.Parties <= 0 {
+		return errors.E(errors.Invalid, fmt.Sprintf("barrier %s: invalid number of parties %d", req.Name, req.Parties))
+	}
+	s.mu.Lock()
+	br := s.barriers[req.Name]
+	if br == nil {
+		br = &barrierState{parties: req.Parties, phases: make(map[int]*barrierPhase)}
+		s.barriers[req.Name] = br
+	}
+	if br.parties != req.Parties {
+		s.mu.Unlock()
+		return errors.E(errors.Invalid, fmt.Sprintf("barrier %s has %d parties, not %d", req.Name, br.parties, req.Parties))
+	}
+	if br.completed && req.Phase <= br.last {
+		s.mu.Unlock()
+		return nil
+	}
+	phase := br.phases[req.Phase]
+	if phase == nil {
+		phase = &barrierPhase{done: make(chan struct{})}
+		br.phases[req.Phase] = phase
+	}
+	phase.arrived++
+	if phase.arrived == br.parties {
+		close(phase.done)
+		delete(br.phases, req.Phase)
+		if !br.completed || req.Phase > br.last {
+			br.completed, br.last = true, req.Phase
+		}
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+	select {
+	case <-phase.done:
+		return nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-phase.done:
+		return nil
+	default:
+	}
+	phase.arrived--
+	if phase.arrived == 0 {
+		delete(br.phases, req.Phase)
+	}
+	return ctx.Err()
+}
@@ -19,6 +19,7 @@ import (
 	// fingerprinting binaries.
 	_ "crypto/sha256"
 	"os"
+	"path/filepath"
 	"sync"
 
 	"github.com/grailbio/base/diagnostic/dump"
@@ -44,15 +45,106 @@ type B struct {
 	// name is a human-usable name for this B that can be provided by clients.
 	// Like index, it is useful for distinguishing logs or diagnostic
 	// information, but may be set to something contextually meaningful.
+	// It is also used to name the machines started by the B.
 	name string
 
 	server *rpc.Server
 	client *rpc.Client
 
+	// registrar, if not nil, is used to register owned machines in an
+	// external service registry.
+	registrar Registrar
+
+	// keepalive is the default keepalive configuration of the machines
+	// started by the B (see DefaultKeepalive).
+	keepalive Keepalive
+
+	// telemetry bounds the overhead of the B's telemetry (see
+	// LimitTelemetry).
+	telemetry Telemetry
+
+	// quota limits the number of machines that the B runs at once (see
+	// MaxMachines).
+	quota *machineQuota
+	// fanout distributes the driver's binary to the B's machines
+	// peer-to-peer, if not nil (see BinaryFanout).
+	fanout *binaryFanout
+	// maxBinarySize is the maximum size of the binaries executed on
+	// the B's machines, if positive (see MaxBinarySize).
+	maxBinarySize int64
+
+	// tokenKey is the key with which the B signs the tokens it vends
+	// (see VendToken); tokens are the tokens vended to this machine,
+	// keyed by scope (see Credentials).
+	tokenKeyOnce sync.Once
+	tokenKey     []byte
+	tokensMu     sync.Mutex
+	tokens       map[string]string
+
 	mu       sync.Mutex
 	machines map[string]*Machine
 	driver   bool
 	running  bool
+	// shutdown is set when the B is shutting down.
+	shutdown bool
+	// inputs are the digests of the inputs recorded by RecordInput.
+	inputs map[string]string
+	// nextMachine is the sequence number of the next machine
+	// started by the B; it is used to name machines.
+	nextMachine int
+
+	// subs are the subscribers to machine updates (see Subscribe);
+	// eventSubs are the subscribers to machine lifecycle events (see
+	// Events).
+	subsMu    sync.Mutex
+	subs      map[*subscriber]bool
+	eventSubs map[*eventSubscriber]bool
+
+	// panics are the panics that occurred on the B's machines, keyed
+	// by signature (see Panics).
+	panicsMu sync.Mutex
+	panics   map[string]*Panic
+
+	// budget is the error budget of the B, if any (see AbortOnErrors).
+	budget *errorBudget
+	// retries limits the retries of the B's machines, if not nil (see
+	// LimitRetries).
+	retries *retryLimiter
+	// breaker configures the circuit breakers of the B's client, if
+	// not nil (see BreakCircuits).
+	breaker *CircuitBreaker
+	// messageLimits limits the sizes of the arguments and replies of
+	// the B's calls (see LimitMessages).
+	messageLimits MessageLimits
+	// abortErr is the error with which the B was aborted; abortc is
+	// closed when the B is aborted.
+	abortMu  sync.Mutex
+	abortErr error
+	abortc   chan struct{}
+
+	// cluster is the name of the B's persistent cluster, if any, and
+	// lease is the keepalive lease of its machines (see Cluster).
+	cluster string
+	lease   time.Duration
+
+	// hooks are the hooks invoked for each of the B's machines (see
+	// MachineHooks); hooksOnce starts the hook dispatcher.
+	hooks     []Hooks
+	hooksOnce sync.Once
+
+	// driverLocation is the location of the driver, as reported by
+	// the B's system, if driverLocated is true; it is determined once,
+	// under driverLocationOnce.
+	driverLocationOnce sync.Once
+	driverLocation     Location
+	driverLocated      bool
+
+	// boots is the histogram of the boot durations of the B's machines
+	// (see HandleDebug).
+	boots bootHistogram
+	// dashboard retains the samples graphed by the B's dashboard (see
+	// HandleDebug).
+	dashboard dashboardSamples
 }
 
 // Option is an option that can be provided when starting a new B. It is a
@@ -66,6 +158,16 @@ func Name(name string) Option {
 	}
 }
 
+// JobName returns the name used as the prefix of the names of
+// machines started by b: b's name, if it has one, or else the name of
+// the running binary.
+func (b *B) jobName() string {
+	if b.name != "" {
+		return b.name
+	}
+	return filepath.Base(os.Args[0])
+}
+
 // nextBIndex is the index of the next B that is started.
 var nextBIndex int32
 
@@ -86,17 +188,27 @@ func Start(system System, opts ...Option) *B {
 		index:    atomic.AddInt32(&nextBIndex, 1) - 1,
 		system:   system,
 		machines: make(map[string]*Machine),
+		abortc:   make(chan struct{}),
+
+		messageLimits: defaultMessageLimits,
 	}
 	for _, opt := range opts {
 		opt(b)
 	}
+	if b.telemetry.StatsInterval > 0 {
+		rpc.SetStatsInterval(b.telemetry.StatsInterval)
+	}
 	b.run()
+	if len(b.hooks) > 0 {
+		b.startHooks()
+	}
 	// Test systems run in a single process space and thus
 	// expvar would panic with duplicate key errors.
 	//
 	// TODO(marius): allow multiple sessions to share a single expvar
 	if system.Name() != "testsystem" && expvar.Get("machines") == nil {
 		expvar.Publish("machines", &machineVars{b})
+		expvar.Publish("traffic", expvar.Func(func() interface{} { return b.Traffic() }))
 	}
 
 	if system.Name() != "testsystem" {
@@ -138,8 +250,14 @@ func (b *B) run() {
 	if err := b.system.Init(b); err != nil {
 		log.Fatal(err)
 	}
+	clientOpts := []rpc.ClientOption{
+		rpc.ClientLimits(b.messageLimits.MaxArg, b.messageLimits.MaxReply),
+	}
+	if b.breaker != nil {
+		clientOpts = append(clientOpts, rpc.Breaker(b.breaker.Threshold, b.breaker.Cooldown))
+	}
 	var err error
-	b.client, err = rpc.NewClient(func() *http.Client { return b.system.HTTPClient() }, RpcPrefix)
+	b.client, err = rpc.NewClient(func() *http.Client { return b.system.HTTPClient() }, RpcPrefix, clientOpts...)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -149,11 +267,21 @@ func (b *B) run() {
 	if b.driver {
 		return
 	}
-	b.server = rpc.NewServer()
+	b.server = rpc.NewServer(rpc.ServerLimits(b.messageLimits.MaxArg, b.messageLimits.MaxReply))
 	supervisor := StartSupervisor(context.Background(), b, b.system, b.server)
+	supervisor.output, supervisor.history = captureOutput()
+	if shipper, ok := b.system.(logShipper); ok && supervisor.history != nil {
+		go shipOutput(context.Background(), shipper, supervisor.history)
+	}
 	if err := b.server.Register("Supervisor", supervisor); err != nil {
 		log.Fatal(err)
 	}
+	if err := b.server.Register("Blobs", NewBlobs()); err != nil {
+		log.Fatal(err)
+	}
+	if err := b.server.Register("Barriers", NewBarriers()); err != nil {
+		log.Fatal(err)
+	}
 	if err := maybeInit(supervisor, b); err != nil {
 		log.Fatal(err)
 	}
@@ -181,9 +309,10 @@ func (b *B) Dial(ctx context.Context, addr string) (*Machine, error) {
 		m = &Machine{Addr: addr, owner: false}
 		b.machines[addr] = m
 		m.start(b)
+		b.notify(m)
 		go func() {
 			<-m.Wait(Stopped)
-			log.Error.Printf("%s: machine stopped with error %s", m.Addr, m.Err())
+			log.Error.Printf("%s: machine stopped with error %s", m.Name(), m.Err())
 			b.mu.Lock()
 			delete(b.machines, addr)
 			b.mu.Unlock()
@@ -202,6 +331,21 @@ type Param interface {
 // Services is a machine parameter that specifies the set of services
 // that should be served by the machine. Each machine should have at
 // least one service. Multiple Services parameters may be passed.
+//
+// Services are registered, and initialized if they implement the
+// method
+//
+//	Init(*B) error
+//
+// in an unspecified order, unless they declare dependencies on other
+// services of the machine by implementing the method
+//
+//	InitAfter() []string
+//
+// which returns the names of the services that must be initialized
+// first. B.Start fails with an error of kind errors.Invalid if a
+// service depends on a service that is not provided, or if
+// dependencies are cyclic.
 type Services map[string]interface{}
 
 func (s Services) applyParam(m *Machine) {
@@ -222,37 +366,187 @@ func (e Environ) applyParam(m *Machine) {
 	m.environ = append(m.environ, e...)
 }
 
+// A MachineSpec is a machine parameter that selects the shape of the
+// machines to be started, overriding the configuration of the B's
+// System. For example, a driver may start a few high-memory
+// coordinators and many small workers. The System must support
+// machine specs; B.Start fails with an error of kind
+// errors.NotSupported otherwise. Zero-valued fields default to the
+// System's configuration.
+type MachineSpec struct {
+	// InstanceType is the system-specific type of the machines, e.g.,
+	// an EC2 instance type.
+	InstanceType string
+	// Diskspace is the amount of disk space, in GiB, of the machines.
+	Diskspace int
+}
+
+func (s MachineSpec) applyParam(m *Machine) {
+	m.spec = &s
+}
+
 // Start launches up to n new machines and returns them. The machines are
-// configured according to the provided parameters. Each machine must
+// configured according to the provided parameters; a MachineSpec
+// parameter selects the shape of the machines, so that a B may
+// manage machines of different shapes. Each machine must
 // have at least one service exported, or else Start returns an
-// error. The new machines may be in Starting state when they are
+// error. Services (and their methods' arguments and replies) must be
+// encodable by gob; Start checks this before any machines are
+// started. The new machines may be in Starting state when they are
 // returned. Start maintains a keepalive to the returned machines,
 // thus tying the machines' lifetime with the caller process.
 //
-// Start returns at least one machine, or else an error.
+// Start returns at least one machine, or else an error. Start fails
+// if b was aborted (see AbortOnErrors).
 func (b *B) Start(ctx context.Context, n int, params ...Param) ([]*Machine, error) {
-	machines, err := b.system.Start(ctx, n)
+	return b.start(ctx, n, params, 0)
+}
+
+// start implements Start. Generation is the number of times that the
+// machines being started replace stopped machines (see AutoReplace).
+func (b *B) start(ctx context.Context, n int, params []Param, generation int) ([]*Machine, error) {
+	if err := b.Err(); err != nil {
+		return nil, err
+	}
+	// Check the services before starting any machines, so that
+	// problems are reported without waiting for (or paying for)
+	// machines to boot.
+	probe, err := checkParams(params)
 	if err != nil {
 		return nil, err
 	}
+	if err = b.checkBinarySize(); err != nil {
+		return nil, err
+	}
+	if err = b.quota.Acquire(ctx, n); err != nil {
+		return nil, err
+	}
+	var machines []*Machine
+	if probe.spec != nil {
+		starter, ok := b.system.(specStarter)
+		if !ok {
+			b.quota.Release(n)
+			return nil, errors.E(errors.NotSupported, fmt.Sprintf("system %s does not support machine specs", b.system.Name()))
+		}
+		machines, err = starter.StartSpec(ctx, n, *probe.spec)
+	} else {
+		machines, err = b.system.Start(ctx, n)
+	}
+	if err != nil {
+		b.quota.Release(n)
+		return nil, err
+	}
 	if len(machines) == 0 {
+		b.quota.Release(n)
 		return nil, errors.E(errors.Unavailable, "no machines started")
 	}
+	managed := b.manage(machines, params, generation, "starting")
+	// Quota is released as the managed machines stop; the remainder,
+	// reserved for machines that were not started, is released now.
+	b.quota.Release(n - len(managed))
+	for _, m := range managed {
+		go func(m *Machine) {
+			<-m.Wait(Stopped)
+			b.quota.Release(1)
+		}(m)
+	}
+	return managed, nil
+}
+
+// Manage takes ownership of the provided machines, which are
+// configured with the provided parameters: the machines are named and
+// started, and b maintains them from then on. Machines that b already
+// manages are skipped. Manage returns the machines that it took
+// ownership of; verb describes the operation in b's log.
+func (b *B) manage(machines []*Machine, params []Param, generation int, verb string) []*Machine {
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	var managed []*Machine
 	for _, m := range machines {
+		if _, ok := b.machines[m.Addr]; ok {
+			continue
+		}
+		m.cluster, m.lease = b.cluster, b.lease
 		for _, p := range params {
 			p.applyParam(m)
 		}
-		if len(m.services) == 0 {
-			return nil, errors.E(errors.Invalid, "no services provided")
+		managed = append(managed, m)
+	}
+	for _, m := range managed {
+		m.name = fmt.Sprintf("%s-%04d", b.jobName(), b.nextMachine)
+		b.nextMachine++
+		log.Printf("%s: %s machine at %s", m.name, verb, m.Addr)
+	}
+	if namer, ok := b.system.(machineNamer); ok && len(managed) > 0 {
+		go namer.NameMachines(context.Background(), managed)
+	}
+	if pricer, ok := b.system.(machinePricer); ok {
+		for _, m := range managed {
+			m.pricing, m.priced = pricer.MachinePricing(m)
+		}
+	}
+	if locator, ok := b.system.(machineLocator); ok {
+		b.locate(locator, managed)
+	}
+	for _, m := range managed {
+		if len(m.hooks) > 0 {
+			b.startHooks()
 		}
 		m.owner = true
 		m.tailDone = make(chan struct{})
+		m.generation = generation
+		b.budget.MachineStarted()
 		m.start(b)
 		b.machines[m.Addr] = m
+		b.notify(m)
+		if m.replace != nil {
+			go b.replace(m, params)
+		}
+		if m.lifetime != nil {
+			go m.reap()
+		}
+		if m.credentials != nil {
+			go m.vendCredentials(b)
+		}
+	}
+	return managed
+}
+
+// StartStream is like Start, but instead of returning machines that
+// may still be starting, it delivers machines on the returned
+// channel as each reaches Running state, so that drivers may begin
+// work on the first machines to boot while others are still
+// starting. Machines that stop before they are running are not
+// delivered. The channel is closed once every machine has been
+// delivered or has stopped, or when the provided context is done.
+// StartStream returns an error if the machines could not be started
+// (see Start).
+func (b *B) StartStream(ctx context.Context, n int, params ...Param) (<-chan *Machine, error) {
+	machines, err := b.Start(ctx, n, params...)
+	if err != nil {
+		return nil, err
+	}
+	c := make(chan *Machine)
+	var wg sync.WaitGroup
+	wg.Add(len(machines))
+	for _, m := range machines {
+		m := m
+		go func() {
+			defer wg.Done()
+			if state, _ := m.WaitFor(ctx, Running, Stopped); state != Running {
+				return
+			}
+			select {
+			case c <- m:
+			case <-ctx.Done():
+			}
+		}()
 	}
-	return machines, nil
+	go func() {
+		wg.Wait()
+		close(c)
+	}()
+	return c, nil
 }
 
 // Machines returns a snapshot of the current set machines known to this B.
@@ -275,7 +569,16 @@ func (b *B) HandleDebug(mux *http.ServeMux) {
 // ServeMux under the provided prefix.
 func (b *B) HandleDebugPrefix(prefix string, mux *http.ServeMux) {
 	mux.HandleFunc(prefix+"pprof/", b.pprofIndex)
+	mux.Handle(prefix+"profile", &profileQueryHandler{b})
 	mux.Handle(prefix+"status", &statusHandler{b})
+	mux.Handle(prefix+"services", &servicesHandler{b})
+	mux.Handle(prefix+"panics", &panicsHandler{b})
+	mux.Handle(prefix+"cost", &costHandler{b})
+	mux.Handle(prefix+"provenance", &provenanceHandler{b})
+	mux.Handle(prefix+"describe", &describeHandler{b})
+	mux.Handle(prefix+"metrics", &metricsHandler{b})
+	mux.Handle(prefix+"dashboard", &dashboardHandler{b})
+	mux.Handle(prefix+"output", &outputHandler{b})
 }
 
 var indexTmpl = template.Must(template.New("index").Parse(`<html>
@@ -330,7 +633,7 @@ func (b *B) pprofIndex(w http.ResponseWriter, r *http.Request) {
 			defer cancel()
 			var mstats []profileStat
 			if err := m.Call(ctxCall, "Supervisor.Profiles", struct{}{}, &mstats); err != nil {
-				log.Error.Printf("%q.\"Supervisor.Profiles\": %v", m.Addr, err)
+				log.Error.Printf("%q.\"Supervisor.Profiles\": %v", m.Name(), err)
 				return nil
 			}
 			mu.Lock()
@@ -369,18 +672,34 @@ func (b *B) pprofIndex(w http.ResponseWriter, r *http.Request) {
 }
 
 func shutdownAllMachines(ctx context.Context, duration time.Duration, machines []*Machine) {
+	// Give the machines' calls in flight their grace periods, if any,
+	// to complete.
+	var grace sync.WaitGroup
+	grace.Add(len(machines))
+	for _, m := range machines {
+		go func(m *Machine) {
+			defer grace.Done()
+			m.awaitCalls()
+		}(m)
+	}
+	grace.Wait()
 	// Shutdown all of the existing machines.
 	for _, m := range machines {
 		// shutdown is best effort
-		err := m.Call(ctx, "Supervisor.Shutdown",
-			shutdownRequest{
-				Delay:   time.Second,
-				Message: string(logSyncMarker),
-			},
-			nil)
+		req := shutdownRequest{
+			Delay:   time.Second,
+			Message: string(logSyncMarker),
+		}
+		var err error
+		if m.Draining() && m.State() == Running {
+			// Draining machines accept no new calls (see Machine.Drain).
+			err = m.call(ctx, "Supervisor.Shutdown", req, nil)
+		} else {
+			err = m.Call(ctx, "Supervisor.Shutdown", req, nil)
+		}
 		if err != nil {
 			log.Error.Printf("failed to invoke Supervisor.Shutdown on %v: %v\n",
-				m.Addr, err)
+				m.Name(), err)
 		}
 	}
 	ctx, cancel := context.WithTimeout(ctx, duration)
@@ -410,7 +729,14 @@ func shutdownAllMachines(ctx context.Context, duration time.Duration, machines [
 //	defer b.Shutdown()
 //	// driver code
 func (b *B) Shutdown() {
+	b.mu.Lock()
+	b.shutdown = true
+	b.mu.Unlock()
+	b.budget.Stop()
 	shutdownAllMachines(context.Background(), time.Second*20, b.Machines())
+	if report := b.CostReport(); len(report.Machines) > 0 {
+		log.Printf("bigmachine: %s", report)
+	}
 	b.system.Shutdown()
 }
 
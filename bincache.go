@@ -0,0 +1,123 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/base/fatbin"
+	"github.com/grailbio/base/log"
+)
+
+// BinaryCacheDir is the directory in which supervisors cache the
+// binaries uploaded to them, by digest, so that binaries that were
+// uploaded before, to any supervisor that shares the directory, need
+// not be uploaded again (see Supervisor.UseBinary). It may be set by
+// the environment variable BIGMACHINE_BINARYCACHE, for example to a
+// path shared by the machines of a host.
+var binaryCacheDir = func() string {
+	if dir := os.Getenv("BIGMACHINE_BINARYCACHE"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "bigmachine-binaries")
+}()
+
+// BinaryCachePath returns the path of the cached binary with the
+// provided digest.
+func binaryCachePath(d digest.Digest) string {
+	return filepath.Join(binaryCacheDir, d.Name()+"-"+d.Hex())
+}
+
+// CacheBinary adds the binary at the provided path, which has the
+// provided size, to the binary cache. Failures are logged: they
+// result only in future uploads.
+func cacheBinary(path string, size int64) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Error.Printf("cache binary %s: %v", path, err)
+		return
+	}
+	d, err := digestPolicy.digest(f, size)
+	f.Close()
+	if err != nil {
+		log.Error.Printf("cache binary %s: %v", path, err)
+		return
+	}
+	if err := os.MkdirAll(binaryCacheDir, 0755); err != nil {
+		log.Error.Printf("cache binary %s: %v", path, err)
+		return
+	}
+	// The binary is linked into the cache, so that it is not copied,
+	// under a temporary name, so that it appears atomically.
+	cachePath := binaryCachePath(d)
+	tmp := cachePath + ".tmp" + filepath.Base(path)
+	if err := os.Link(path, tmp); err != nil {
+		log.Debug.Printf("cache binary %s: %v", path, err)
+		return
+	}
+	if err := os.Rename(tmp, cachePath); err != nil {
+		log.Error.Printf("cache binary %s: %v", path, err)
+		os.Remove(tmp)
+	}
+}
+
+// UseBinary sets the binary that is run by Supervisor.Exec to a
+// binary with the provided digest, if the supervisor has one: either
+// the binary that the supervisor itself runs, or one in the binary
+// cache (see binaryCacheDir). The reply tells whether such a binary
+// was found; if not, the binary must be uploaded (see
+// Supervisor.Setbinary).
+func (s *Supervisor) UseBinary(ctx context.Context, d digest.Digest, found *bool) error {
+	*found = false
+	path, err := findBinary(d)
+	if err != nil || path == "" {
+		return err
+	}
+	s.mu.Lock()
+	s.binaryPath, s.execDigest = path, d
+	s.mu.Unlock()
+	*found = true
+	return nil
+}
+
+// FindBinary returns the path of a binary with the provided digest:
+// either the binary of the running process, or one in the binary
+// cache. The path is empty if there is no such binary.
+func findBinary(d digest.Digest) (string, error) {
+	if d.IsZero() {
+		return "", nil
+	}
+	if LocalInfo().Digest == d {
+		return os.Executable()
+	}
+	path := binaryCachePath(d)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// UseCachedBinary tells the machine's supervisor to use its cached
+// copy of the provided binary image, if it has one. It returns false
+// if the binary must be uploaded, including if the supervisor does
+// not support binary caching.
+func (m *Machine) useCachedBinary(ctx context.Context, bin *fatbin.Reader, goos, goarch string) bool {
+	d, err := cachedImageDigest(bin, goos, goarch)
+	if err != nil {
+		log.Error.Printf("%s: digest binary: %v", m.Name(), err)
+		return false
+	}
+	var found bool
+	if err := m.call(ctx, "Supervisor.UseBinary", d, &found); err != nil {
+		log.Debug.Printf("%s: Supervisor.UseBinary: %v", m.Name(), err)
+		return false
+	}
+	return found
+}
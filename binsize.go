@@ -0,0 +1,58 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/grailbio/base/data"
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/fatbin"
+)
+
+// MaxBinarySize is an option that limits the size of the binaries
+// that the B executes on its machines to the provided number of
+// bytes. B.Start checks the size of the driver's binary before
+// starting any machines, and machines check the size of the binary
+// for their platform before it is uploaded, so that oversized binaries
+// fail quickly, with an error of kind errors.Invalid, instead of
+// timing out midway through uploads over slow links.
+func MaxBinarySize(max int64) Option {
+	return func(b *B) {
+		b.maxBinarySize = max
+	}
+}
+
+// CheckBinarySize returns an error if the binary image described by
+// info is larger than max bytes. A max of zero means no limit.
+func checkBinarySize(max int64, info fatbin.Info) error {
+	if max <= 0 || info.Size <= max {
+		return nil
+	}
+	return errors.E(errors.Invalid, fmt.Sprintf(
+		"binary for %s/%s is %s, which exceeds the maximum binary size of %s (see MaxBinarySize); "+
+			"reduce its size, for example by stripping symbols (-ldflags='-s -w'), or, to avoid uploading it "+
+			"to each machine over the driver's link, stage it in an object store (e.g., ec2system's "+
+			"BinaryStagingURL) or distribute it peer-to-peer (see BinaryFanout), and raise the limit",
+		info.Goos, info.Goarch, data.Size(info.Size), data.Size(max)))
+}
+
+// CheckBinarySize checks the size of the driver's own binary image
+// against b's maximum binary size (see MaxBinarySize).
+func (b *B) checkBinarySize() error {
+	if b.maxBinarySize <= 0 {
+		return nil
+	}
+	self, err := fatbin.Self()
+	if err != nil {
+		return err
+	}
+	info, ok := self.Stat(runtime.GOOS, runtime.GOARCH)
+	if !ok {
+		return nil
+	}
+	return checkBinarySize(b.maxBinarySize, info)
+}
@@ -0,0 +1,198 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/fatbin"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/bigmachine/rpc"
+)
+
+// MaxBinaryRepairs is the number of times that a driver repairs a
+// corrupted binary upload before giving up.
+const maxBinaryRepairs = 3
+
+// A verifyBinaryRequest is the argument of Supervisor.Verifybinary.
+type verifyBinaryRequest struct {
+	// Size and Digest are the expected size and digest (see
+	// DigestPolicy) of the uploaded binary.
+	Size   int64
+	Digest digest.Digest
+	// ChunkSize is the size of the chunks whose checksums are
+	// returned if the uploaded binary does not have the expected
+	// digest.
+	ChunkSize int64
+}
+
+// Verifybinary verifies that the binary being uploaded by
+// Supervisor.SetbinaryChunk has the expected size and digest, before
+// it is committed by Supervisor.Commitbinary. If it does not have the
+// expected digest, the reply contains the CRC-32C checksums of the
+// uploaded data, in chunks of the requested size, so that the caller
+// may find and resend the corrupted chunks (see
+// Supervisor.RepairbinaryChunk). The reply is empty if the upload is
+// verified, in which case the binary is verified again before it is
+// run by Supervisor.Exec.
+func (s *Supervisor) Verifybinary(ctx context.Context, req verifyBinaryRequest, checksums *[]uint32) error {
+	if req.ChunkSize <= 0 {
+		return errors.E(errors.Invalid, fmt.Sprintf("Supervisor.Verifybinary: invalid chunk size %d", req.ChunkSize))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.upload == nil {
+		return errors.E(errors.Invalid, "Supervisor.Verifybinary: no upload in progress")
+	}
+	if req.Size != s.uploadSize {
+		return errors.E(errors.Precondition, fmt.Sprintf("Supervisor.Verifybinary: uploaded %d bytes, expected %d", s.uploadSize, req.Size))
+	}
+	d, err := digestPolicy.digest(io.NewSectionReader(s.upload, 0, req.Size), req.Size)
+	if err != nil {
+		return err
+	}
+	*checksums = nil
+	if d == req.Digest {
+		s.uploadDigest = d
+		return nil
+	}
+	log.Error.Printf("Supervisor.Verifybinary: uploaded binary %s, expected %s", d.Short(), req.Digest.Short())
+	buf := make([]byte, req.ChunkSize)
+	for off := int64(0); off < req.Size; off += req.ChunkSize {
+		n, err := s.upload.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		*checksums = append(*checksums, rpc.NewChunk(off, buf[:n]).Checksum)
+	}
+	return nil
+}
+
+// RepairbinaryChunk rewrites a chunk of the binary being uploaded by
+// Supervisor.SetbinaryChunk, for example one found to be corrupted by
+// Supervisor.Verifybinary. Unlike Supervisor.SetbinaryChunk, the chunk
+// may be at any offset within the data written so far. The upload must
+// be verified again before it is committed.
+func (s *Supervisor) RepairbinaryChunk(ctx context.Context, chunk rpc.Chunk, _ *struct{}) error {
+	if err := chunk.Verify(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.upload == nil {
+		return errors.E(errors.Invalid, "Supervisor.RepairbinaryChunk: no upload in progress")
+	}
+	if chunk.Offset < 0 || chunk.End() > s.uploadSize {
+		return errors.E(errors.Invalid, fmt.Sprintf("Supervisor.RepairbinaryChunk: chunk [%d, %d) is outside of the %d bytes uploaded", chunk.Offset, chunk.End(), s.uploadSize))
+	}
+	s.uploadDigest = digest.Digest{}
+	_, err := s.upload.WriteAt(chunk.Data, chunk.Offset)
+	return err
+}
+
+// VerifyExecBinary verifies that the binary at the provided path,
+// which is about to be run by Supervisor.Exec, has the provided
+// digest, so that a binary that was truncated or corrupted after it
+// was verified is never run. A corrupted binary is removed from the
+// binary cache.
+func verifyExecBinary(path string, d digest.Digest) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	got, err := digestPolicy.digest(f, info.Size())
+	if err != nil {
+		return err
+	}
+	if got == d {
+		return nil
+	}
+	if path == binaryCachePath(d) {
+		if err := os.Remove(path); err != nil {
+			log.Error.Printf("remove corrupted binary %s: %v", path, err)
+		}
+	}
+	return errors.E(errors.Integrity, fmt.Sprintf("Supervisor.Exec: binary %s is corrupted: digest %s, expected %s", path, got.Short(), d.Short()))
+}
+
+// VerifyUpload verifies the binary image uploaded by uploadBinary on
+// the machine's supervisor before it is committed, resending the
+// chunks that were corrupted. Supervisors that do not support
+// verification commit the binary unverified.
+func (m *Machine) verifyUpload(ctx context.Context, self *fatbin.Reader, binInfo fatbin.Info) error {
+	d, err := cachedImageDigest(self, binInfo.Goos, binInfo.Goarch)
+	if err != nil {
+		log.Error.Printf("%s: digest binary: %v; committing unverified binary", m.Name(), err)
+		return nil
+	}
+	req := verifyBinaryRequest{Size: binInfo.Size, Digest: d, ChunkSize: int64(binaryChunkSize)}
+	for repairs := 0; ; repairs++ {
+		var checksums []uint32
+		err := m.retryCall(ctx, time.Minute, 30*time.Second, "Supervisor.Verifybinary", req, &checksums)
+		if err != nil && repairs == 0 && errors.Is(errors.Invalid, err) {
+			// The supervisor does not support verification, for example
+			// because it is running an older bootstrap binary.
+			log.Printf("%s: binary verification failed: %v; committing unverified binary", m.Name(), err)
+			return nil
+		}
+		if err != nil || len(checksums) == 0 {
+			return err
+		}
+		if repairs == maxBinaryRepairs {
+			return errors.E(errors.Integrity, fmt.Sprintf("uploaded binary is still corrupted after %d repairs", repairs))
+		}
+		n, err := m.repairUpload(ctx, self, binInfo, req.ChunkSize, checksums)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return errors.E(errors.Integrity, fmt.Sprintf("uploaded binary does not have digest %s, but no chunk is corrupted; is the digest policy the same?", d.Short()))
+		}
+		log.Printf("%s: repaired %d corrupted chunks of uploaded binary", m.Name(), n)
+	}
+}
+
+// RepairUpload resends the chunks of the provided binary image whose
+// checksums, as uploaded, do not match those of the image. It returns
+// the number of chunks resent.
+func (m *Machine) repairUpload(ctx context.Context, self *fatbin.Reader, binInfo fatbin.Info, chunkSize int64, checksums []uint32) (int, error) {
+	const floor = 100 << 10 // bps
+	chunkTimeout := time.Duration(chunkSize/floor)*time.Second + 10*time.Second
+	rc, err := self.Open(binInfo.Goos, binInfo.Goarch)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	var (
+		buf = make([]byte, chunkSize)
+		n   int
+	)
+	for i, off := 0, int64(0); off < binInfo.Size; i, off = i+1, off+chunkSize {
+		size, err := io.ReadFull(rc, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return n, err
+		}
+		chunk := rpc.NewChunk(off, buf[:size])
+		if i < len(checksums) && checksums[i] == chunk.Checksum {
+			continue
+		}
+		if err := m.retryCall(ctx, 5*time.Minute, chunkTimeout, "Supervisor.RepairbinaryChunk", chunk, nil); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,257 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/data"
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+)
+
+// DefaultBlobQuota is the default maximum total size of the blobs
+// stored on a machine.
+const defaultBlobQuota = 10 << 30
+
+// BlobDigester computes the digests by which blobs are addressed.
+var blobDigester = digest.Digester(crypto.SHA256)
+
+// BlobDir is the directory in which machines store blobs (see Blobs).
+// Since it outlives the machine's process, blobs are reused across
+// restarts of the process. It may be set by the environment variable
+// BIGMACHINE_BLOBDIR.
+var blobDir = func() string {
+	if dir := os.Getenv("BIGMACHINE_BLOBDIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "bigmachine-blobs")
+}()
+
+// BlobCache is a machine parameter that configures the machine's blob
+// store (see Blobs).
+type BlobCache struct {
+	// MaxBytes is the maximum total size of the blobs stored on the
+	// machine, beyond which the least recently used blobs are evicted.
+	// It defaults to 10 GiB.
+	MaxBytes int64
+}
+
+func (c BlobCache) applyParam(m *Machine) {
+	m.blobCache = &c
+}
+
+// A BlobInfo describes a blob stored on a machine.
+type BlobInfo struct {
+	// Digest is the blob's SHA256 digest, by which it is addressed.
+	Digest digest.Digest
+	// Size is the blob's size in bytes.
+	Size int64
+}
+
+// Blobs is the built-in service, registered as "Blobs" on every
+// machine, that stores and serves immutable blobs by digest, so that
+// drivers may distribute large reference data, such as models or
+// indexes, once, and reuse it across restarts of the machine's
+// process (see Machine.PutBlob). Blobs are evicted in least recently
+// used order when their total size exceeds the machine's quota (see
+// BlobCache). Services read blobs through OpenBlob.
+type Blobs struct {
+	mu    sync.Mutex
+	quota int64
+}
+
+// NewBlobs returns a new blob store, backed by the machine's blob
+// directory. It is registered by the machine's process, and should
+// not otherwise be instantiated.
+func NewBlobs() *Blobs {
+	return &Blobs{quota: defaultBlobQuota}
+}
+
+// BlobPath returns the path of the blob with the provided digest.
+func blobPath(d digest.Digest) string {
+	return filepath.Join(blobDir, d.Name()+"-"+d.Hex())
+}
+
+// OpenBlob opens the blob with the provided digest stored on the
+// current machine, and marks it as recently used. It returns an error
+// of kind errors.NotExist if the machine does not store the blob.
+func OpenBlob(d digest.Digest) (*os.File, error) {
+	path := blobPath(d)
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); os.IsNotExist(err) {
+		return nil, errors.E(errors.NotExist, fmt.Sprintf("blob %s does not exist", d.Short()))
+	} else if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// Put stores the blob read from the argument, and replies with its
+// digest. Storing a blob that is already stored only marks it as
+// recently used.
+func (b *Blobs) Put(ctx context.Context, arg io.Reader, d *digest.Digest) error {
+	if err := os.MkdirAll(blobDir, 0777); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(blobDir, ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	b.mu.Lock()
+	quota := b.quota
+	b.mu.Unlock()
+	w := blobDigester.NewWriter()
+	n, err := io.Copy(io.MultiWriter(f, w), io.LimitReader(arg, quota+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if n > quota {
+		return errors.E(errors.Unavailable, fmt.Sprintf("Blobs.Put: blob exceeds the quota of %s", data.Size(quota)))
+	}
+	*d = w.Digest()
+	if err = os.Rename(f.Name(), blobPath(*d)); err != nil {
+		return err
+	}
+	b.evict(*d)
+	return nil
+}
+
+// Stat replies with the description of the blob with the provided
+// digest. It fails with an error of kind errors.NotExist if the blob
+// is not stored.
+func (b *Blobs) Stat(ctx context.Context, d digest.Digest, info *BlobInfo) error {
+	fi, err := os.Stat(blobPath(d))
+	if os.IsNotExist(err) {
+		return errors.E(errors.NotExist, fmt.Sprintf("Blobs.Stat: blob %s does not exist", d.Short()))
+	} else if err != nil {
+		return err
+	}
+	*info = BlobInfo{Digest: d, Size: fi.Size()}
+	return nil
+}
+
+// Get replies with the contents of the blob with the provided digest.
+func (b *Blobs) Get(ctx context.Context, d digest.Digest, reply *io.ReadCloser) error {
+	f, err := OpenBlob(d)
+	if err != nil {
+		return err
+	}
+	*reply = f
+	return nil
+}
+
+// Delete removes the blob with the provided digest, if it is stored.
+func (b *Blobs) Delete(ctx context.Context, d digest.Digest, _ *struct{}) error {
+	if err := os.Remove(blobPath(d)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Configure applies the provided blob cache configuration, evicting
+// blobs as needed.
+func (b *Blobs) Configure(ctx context.Context, c BlobCache, _ *struct{}) error {
+	b.mu.Lock()
+	b.quota = c.MaxBytes
+	if b.quota <= 0 {
+		b.quota = defaultBlobQuota
+	}
+	b.mu.Unlock()
+	b.evict(digest.Digest{})
+	return nil
+}
+
+// Evict removes the least recently used blobs, other than the blob
+// with the provided digest, while the total size of the stored blobs
+// exceeds the quota. Recency is tracked by the blobs' modification
+// times, so that it survives restarts of the process.
+func (b *Blobs) evict(keep digest.Digest) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	infos, err := ioutil.ReadDir(blobDir)
+	if err != nil {
+		log.Error.Printf("Blobs: evict: %v", err)
+		return
+	}
+	var (
+		blobs []os.FileInfo
+		total int64
+		kept  string
+	)
+	if !keep.IsZero() {
+		kept = filepath.Base(blobPath(keep))
+	}
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), ".") || info.IsDir() {
+			continue
+		}
+		total += info.Size()
+		if info.Name() != kept {
+			blobs = append(blobs, info)
+		}
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].ModTime().Before(blobs[j].ModTime())
+	})
+	for _, info := range blobs {
+		if total <= b.quota {
+			break
+		}
+		if err := os.Remove(filepath.Join(blobDir, info.Name())); err != nil {
+			log.Error.Printf("Blobs: evict %s: %v", info.Name(), err)
+			continue
+		}
+		log.Printf("Blobs: evicted %s (%s)", info.Name(), data.Size(info.Size()))
+		total -= info.Size()
+	}
+}
+
+// PutBlob stores the blob read from r on the machine (see Blobs), and
+// returns its digest.
+func (m *Machine) PutBlob(ctx context.Context, r io.Reader) (digest.Digest, error) {
+	var d digest.Digest
+	err := m.Call(ctx, "Blobs.Put", r, &d)
+	return d, err
+}
+
+// HasBlob returns whether the machine stores the blob with the
+// provided digest, so that drivers may skip distributing blobs that
+// machines already store.
+func (m *Machine) HasBlob(ctx context.Context, d digest.Digest) (bool, error) {
+	var info BlobInfo
+	err := m.RetryCall(ctx, "Blobs.Stat", d, &info)
+	if err != nil && errors.Is(errors.Remote, err) {
+		if cause := errors.Recover(err).Err; errors.Is(errors.NotExist, cause) {
+			return false, nil
+		}
+	}
+	return err == nil, err
+}
+
+// GetBlob returns the contents of the blob with the provided digest
+// stored on the machine. The caller must close the returned reader.
+func (m *Machine) GetBlob(ctx context.Context, d digest.Digest) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	if err := m.Call(ctx, "Blobs.Get", d, &rc); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
@@ -0,0 +1,266 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+)
+
+const (
+	// DefaultBudgetWindow is the default window over which failures are
+	// counted against an error budget.
+	defaultBudgetWindow = 10 * time.Minute
+	// DefaultBudgetMinCalls is the default minimum number of calls
+	// required before call error rates are evaluated.
+	defaultBudgetMinCalls = 100
+	// BudgetBuckets is the number of buckets into which a budget's
+	// window is divided.
+	budgetBuckets = 60
+	// MaxBudgetErrors is the maximum number of error messages retained
+	// to describe an exceeded budget.
+	maxBudgetErrors = 5
+)
+
+// An ErrorBudget limits the failures that a B tolerates before it
+// gives up: once the budget is exceeded, the B aborts (see
+// AbortOnErrors). Failures are counted within a sliding window, so
+// that a steady trickle of failures, as is expected in large
+// clusters, does not exceed the budget, while a burst of failures,
+// which usually indicates a systemic problem, does. Zero-valued
+// limits are not enforced.
+type ErrorBudget struct {
+	// Window is the duration of the sliding window over which
+	// failures are counted. It defaults to 10 minutes.
+	Window time.Duration
+	// MaxMachineFailures is the number of the B's machines that may
+	// fail within the window.
+	MaxMachineFailures int
+	// MaxMachineFailureRate is the fraction of the machines started by
+	// the B that may fail within the window.
+	MaxMachineFailureRate float64
+	// MaxCallErrorRate is the fraction of calls (see Machine.Call)
+	// that may fail within the window. Calls that fail because their
+	// context is done are not counted.
+	MaxCallErrorRate float64
+	// MinCalls is the number of calls that must be made within the
+	// window before MaxCallErrorRate is enforced. It defaults to 100.
+	MinCalls int
+}
+
+// AbortOnErrors is an option that aborts the B when the provided
+// error budget is exceeded. When a B aborts, it shuts down the
+// machines it owns; subsequent calls to B.Start and Machine.Call fail
+// with an error that describes the exceeded budget, as does B.Err.
+// This keeps drivers from running (and paying for) clusters that are
+// failing systemically.
+func AbortOnErrors(budget ErrorBudget) Option {
+	if budget.Window == 0 {
+		budget.Window = defaultBudgetWindow
+	}
+	if budget.MinCalls == 0 {
+		budget.MinCalls = defaultBudgetMinCalls
+	}
+	return func(b *B) {
+		b.budget = &errorBudget{ErrorBudget: budget, b: b}
+	}
+}
+
+// Err returns the error with which b was aborted, or nil if b has not
+// been aborted.
+func (b *B) Err() error {
+	b.abortMu.Lock()
+	defer b.abortMu.Unlock()
+	return b.abortErr
+}
+
+// Aborted returns a channel that is closed when b is aborted.
+func (b *B) Aborted() <-chan struct{} {
+	return b.abortc
+}
+
+// Abort aborts b with the provided error: it shuts down the machines
+// that b owns, and fails subsequent calls. Only the first abort takes
+// effect.
+func (b *B) abort(err error) {
+	b.abortMu.Lock()
+	if b.abortErr != nil {
+		b.abortMu.Unlock()
+		return
+	}
+	b.abortErr = err
+	close(b.abortc)
+	b.abortMu.Unlock()
+	log.Error.Printf("aborting: %v", err)
+	b.system.Event("bigmachine:abort", "error", err.Error())
+	var owned []*Machine
+	for _, m := range b.Machines() {
+		if m.Owned() {
+			owned = append(owned, m)
+		}
+	}
+	go shutdownAllMachines(context.Background(), 20*time.Second, owned)
+}
+
+// An errorBudget tracks the failures of a B's machines and calls
+// against an ErrorBudget, and aborts the B when the budget is
+// exceeded. Its methods may be called on a nil errorBudget, in which
+// case they are no-ops.
+type errorBudget struct {
+	ErrorBudget
+	b *B
+
+	mu sync.Mutex
+	// started is the number of machines started by the B.
+	started int
+	// machines and calls count machine failures and calls,
+	// respectively.
+	machines, calls slidingWindow
+	// errors are the most recent error messages.
+	errors []string
+	// stopped is set when the budget is no longer enforced.
+	stopped bool
+}
+
+// MachineStarted records that the B started a machine.
+func (e *errorBudget) MachineStarted() {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.started++
+	e.mu.Unlock()
+}
+
+// MachineFailed records that machine m failed with the provided
+// error.
+func (e *errorBudget) MachineFailed(m *Machine, err error) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	now := time.Now()
+	e.machines.Add(e.Window, now, true)
+	e.record(m, err)
+	_, failures := e.machines.Counts(e.Window, now)
+	var exceeded string
+	switch {
+	case e.MaxMachineFailures > 0 && failures > e.MaxMachineFailures:
+		exceeded = fmt.Sprintf("%d machines failed in the last %s (limit %d)",
+			failures, e.Window, e.MaxMachineFailures)
+	case e.MaxMachineFailureRate > 0 && e.started > 0 &&
+		float64(failures)/float64(e.started) > e.MaxMachineFailureRate:
+		exceeded = fmt.Sprintf("%d of %d machines failed in the last %s (limit %.1f%%)",
+			failures, e.started, e.Window, 100*e.MaxMachineFailureRate)
+	}
+	e.maybeAbort(exceeded)
+}
+
+// CallDone records the outcome of a call to machine m.
+func (e *errorBudget) CallDone(m *Machine, err error) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	now := time.Now()
+	e.calls.Add(e.Window, now, err != nil)
+	if err != nil {
+		e.record(m, err)
+	}
+	var exceeded string
+	if calls, failures := e.calls.Counts(e.Window, now); e.MaxCallErrorRate > 0 && calls >= e.MinCalls &&
+		float64(failures)/float64(calls) > e.MaxCallErrorRate {
+		exceeded = fmt.Sprintf("%d of %d calls failed in the last %s (limit %.1f%%)",
+			failures, calls, e.Window, 100*e.MaxCallErrorRate)
+	}
+	e.maybeAbort(exceeded)
+}
+
+// Stop stops enforcing the budget, for example because the B is
+// shutting down.
+func (e *errorBudget) Stop() {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.stopped = true
+	e.mu.Unlock()
+}
+
+// Record retains the provided error to describe an exceeded budget.
+// It must be called while holding e.mu.
+func (e *errorBudget) record(m *Machine, err error) {
+	e.errors = append(e.errors, fmt.Sprintf("%s: %v", m.Name(), err))
+	if n := len(e.errors); n > maxBudgetErrors {
+		e.errors = e.errors[n-maxBudgetErrors:]
+	}
+}
+
+// MaybeAbort aborts the B if exceeded describes an exceeded limit. It
+// must be called while holding e.mu, which it releases.
+func (e *errorBudget) maybeAbort(exceeded string) {
+	if exceeded == "" || e.stopped {
+		e.mu.Unlock()
+		return
+	}
+	e.stopped = true
+	msg := fmt.Sprintf("error budget exceeded: %s; recent errors:\n\t%s",
+		exceeded, strings.Join(e.errors, "\n\t"))
+	e.mu.Unlock()
+	e.b.abort(errors.E(errors.Fatal, msg))
+}
+
+// A slidingWindow counts events, some of which are failures, within
+// a sliding time window. The window is divided into a fixed number of
+// buckets, so that counts are maintained in constant space.
+type slidingWindow struct {
+	// epochs are the epochs of the buckets: the times at which they
+	// start, in units of the bucket width.
+	epochs [budgetBuckets]int64
+	// total and failed are the number of events and failures in each
+	// bucket.
+	total, failed [budgetBuckets]int
+}
+
+// Add adds an event that occurred at the provided time to a window of
+// the provided duration.
+func (w *slidingWindow) Add(window time.Duration, now time.Time, failed bool) {
+	epoch := w.epoch(window, now)
+	i := epoch % budgetBuckets
+	if w.epochs[i] != epoch {
+		w.epochs[i], w.total[i], w.failed[i] = epoch, 0, 0
+	}
+	w.total[i]++
+	if failed {
+		w.failed[i]++
+	}
+}
+
+// Counts returns the number of events and failures that occurred
+// within the window that ends at the provided time.
+func (w *slidingWindow) Counts(window time.Duration, now time.Time) (total, failed int) {
+	epoch := w.epoch(window, now)
+	for i := range w.epochs {
+		if epoch-w.epochs[i] < budgetBuckets {
+			total += w.total[i]
+			failed += w.failed[i]
+		}
+	}
+	return
+}
+
+func (w *slidingWindow) epoch(window time.Duration, now time.Time) int64 {
+	width := int64(window) / budgetBuckets
+	if width == 0 {
+		width = 1
+	}
+	return now.UnixNano() / width
+}
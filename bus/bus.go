@@ -0,0 +1,174 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package bus implements a lightweight message bus for intra-cluster
+// messaging. The bus is a bigmachine service, hosted on a designated
+// machine:
+//
+//	machines, err := b.Start(ctx, 1, bigmachine.Services{
+//		"Bus": &bus.Service{},
+//	})
+//
+// Other machines (and the driver) communicate through the bus using
+// a Client. The bus supports publish/subscribe, where every
+// subscriber to a topic receives the messages published to it, and
+// request/reply, where a request is published to a topic and the
+// requester waits for the first reply.
+//
+// Delivery is at-most-once: messages are buffered per subscriber, and
+// messages published to a subscriber whose buffer is full are
+// dropped. Messages are not persisted, and are lost if the machine
+// hosting the bus fails.
+package bus
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/bigmachine"
+	"github.com/grailbio/bigmachine/rpc"
+)
+
+// DefaultBuffer is the default number of messages buffered for
+// each subscriber.
+const defaultBuffer = 1024
+
+func init() {
+	gob.Register(&Service{})
+}
+
+// A Message is a message sent through the bus.
+type Message struct {
+	// Topic is the topic to which the message was published.
+	Topic string
+	// ReplyTo is the topic to which replies to the message should be
+	// published. It is set only for requests.
+	ReplyTo string
+	// Data is the message's payload.
+	Data []byte
+}
+
+// Service is a bigmachine service that implements the message bus.
+type Service struct {
+	// Buffer is the number of messages buffered for each subscriber.
+	// If 0, a default of 1024 is used.
+	Buffer int
+
+	mu        sync.Mutex
+	subs      map[string]map[*subscriber]bool
+	nextInbox int
+}
+
+type subscriber struct {
+	c       chan Message
+	dropped int
+}
+
+// Init initializes the service when it is instantiated on a
+// machine.
+func (s *Service) Init(b *bigmachine.B) error {
+	if s.Buffer == 0 {
+		s.Buffer = defaultBuffer
+	}
+	s.subs = make(map[string]map[*subscriber]bool)
+	return nil
+}
+
+// Publish publishes a message to its topic. The reply is the number
+// of subscribers to which the message was delivered.
+func (s *Service) Publish(ctx context.Context, msg Message, n *int) error {
+	*n = s.publish(msg)
+	return nil
+}
+
+// Subscribe subscribes to the provided topic. The reply is a stream
+// of gob-encoded messages published to the topic. The subscription
+// lasts until the stream is closed.
+func (s *Service) Subscribe(ctx context.Context, topic string, reply *io.ReadCloser) error {
+	sub := s.subscribe(topic)
+	r, w := io.Pipe()
+	go func() {
+		defer s.unsubscribe(topic, sub)
+		enc := gob.NewEncoder(w)
+		for {
+			select {
+			case msg := <-sub.c:
+				if err := enc.Encode(msg); err != nil {
+					w.CloseWithError(err)
+					return
+				}
+			case <-ctx.Done():
+				w.CloseWithError(ctx.Err())
+				return
+			}
+		}
+	}()
+	*reply = rpc.Flush(r)
+	return nil
+}
+
+// Request publishes a request message to its topic and replies
+// with the first reply to it. Request fails with an error of kind
+// errors.NotExist if there are no subscribers to the topic.
+func (s *Service) Request(ctx context.Context, msg Message, reply *Message) error {
+	s.mu.Lock()
+	msg.ReplyTo = fmt.Sprintf("_INBOX.%d", s.nextInbox)
+	s.nextInbox++
+	s.mu.Unlock()
+	sub := s.subscribe(msg.ReplyTo)
+	defer s.unsubscribe(msg.ReplyTo, sub)
+	if s.publish(msg) == 0 {
+		return errors.E(errors.NotExist, fmt.Sprintf("no subscribers for topic %s", msg.Topic))
+	}
+	select {
+	case *reply = <-sub.c:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Service) publish(msg Message) (n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sub := range s.subs[msg.Topic] {
+		select {
+		case sub.c <- msg:
+			n++
+		default:
+			if sub.dropped++; sub.dropped == 1 {
+				log.Error.Printf("bus: subscriber to topic %s is not keeping up; dropping messages", msg.Topic)
+			}
+		}
+	}
+	return
+}
+
+func (s *Service) subscribe(topic string) *subscriber {
+	sub := &subscriber{c: make(chan Message, s.Buffer)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subs[topic] == nil {
+		s.subs[topic] = make(map[*subscriber]bool)
+	}
+	s.subs[topic][sub] = true
+	return sub
+}
+
+func (s *Service) unsubscribe(topic string, sub *subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subs[topic], sub)
+	if len(s.subs[topic]) == 0 {
+		delete(s.subs, topic)
+	}
+	if sub.dropped > 0 {
+		log.Error.Printf("bus: subscriber to topic %s dropped %d messages", topic, sub.dropped)
+	}
+}
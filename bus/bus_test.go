@@ -0,0 +1,75 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bus
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigmachine"
+	"github.com/grailbio/bigmachine/testsystem"
+)
+
+func TestBus(t *testing.T) {
+	b := bigmachine.Start(testsystem.New())
+	defer b.Shutdown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	machines, err := b.Start(ctx, 1, bigmachine.Services{"Bus": &Service{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(machines[0], "Bus")
+
+	sub, err := client.Subscribe(ctx, "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	for _, data := range []string{"a", "b"} {
+		if err = client.Publish(ctx, "topic", []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"a", "b"} {
+		msg, err := sub.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(msg.Data); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+
+	_, err = client.Request(ctx, "echo", []byte("hello"))
+	if !errors.Is(errors.NotExist, err) {
+		t.Errorf("error %v is not NotExist", err)
+	}
+	echo, err := client.Subscribe(ctx, "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			msg, err := echo.Next()
+			if err != nil {
+				return
+			}
+			if err := client.Reply(ctx, msg, bytes.ToUpper(msg.Data)); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	reply, err := client.Request(ctx, "echo", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(reply.Data), "HELLO"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bus
+
+import (
+	"context"
+	"encoding/gob"
+	"io"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigmachine"
+)
+
+// A Client communicates with a bus hosted on a machine.
+type Client struct {
+	machine *bigmachine.Machine
+	service string
+}
+
+// NewClient returns a client for the bus served by the provided
+// machine under the given service name. Machines other than the
+// driver may obtain the bus machine by dialing it (see B.Dial).
+func NewClient(machine *bigmachine.Machine, service string) *Client {
+	return &Client{machine, service}
+}
+
+// Publish publishes data to the provided topic.
+func (c *Client) Publish(ctx context.Context, topic string, data []byte) error {
+	var n int
+	return c.machine.Call(ctx, c.service+".Publish", Message{Topic: topic, Data: data}, &n)
+}
+
+// Subscribe subscribes to the provided topic. Messages published to
+// the topic after Subscribe returns are delivered to the returned
+// subscription. The subscription lasts until it is closed or the
+// provided context is canceled.
+func (c *Client) Subscribe(ctx context.Context, topic string) (*Subscription, error) {
+	var rc io.ReadCloser
+	if err := c.machine.Call(ctx, c.service+".Subscribe", topic, &rc); err != nil {
+		return nil, err
+	}
+	return &Subscription{rc: rc, dec: gob.NewDecoder(rc)}, nil
+}
+
+// Request publishes a request with the provided data to a topic and
+// returns the first reply. Request fails with an error of kind
+// errors.NotExist if the topic has no subscribers.
+func (c *Client) Request(ctx context.Context, topic string, data []byte) (Message, error) {
+	var reply Message
+	err := c.machine.Call(ctx, c.service+".Request", Message{Topic: topic, Data: data}, &reply)
+	if err != nil && errors.Is(errors.Remote, err) {
+		if cause := errors.Recover(err).Err; errors.Is(errors.NotExist, cause) {
+			err = cause
+		}
+	}
+	return reply, err
+}
+
+// Reply replies to a request received through a subscription.
+func (c *Client) Reply(ctx context.Context, req Message, data []byte) error {
+	if req.ReplyTo == "" {
+		return errors.E(errors.Invalid, "message on topic ", req.Topic, " is not a request")
+	}
+	return c.Publish(ctx, req.ReplyTo, data)
+}
+
+// A Subscription is a subscription to a topic.
+type Subscription struct {
+	rc  io.ReadCloser
+	dec *gob.Decoder
+}
+
+// Next returns the next message published to the subscription's
+// topic, blocking until one is available. Next returns io.EOF if the
+// subscription has ended.
+func (s *Subscription) Next() (Message, error) {
+	var msg Message
+	err := s.dec.Decode(&msg)
+	return msg, err
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() error {
+	return s.rc.Close()
+}
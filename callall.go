@@ -0,0 +1,250 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigmachine/internal/filebuf"
+	"github.com/grailbio/bigmachine/rpc"
+)
+
+// DefaultCallAllConcurrency is the default maximum number of calls
+// made concurrently by CallAll.
+const defaultCallAllConcurrency = 64
+
+type callAllOptions struct {
+	concurrency int
+	failFast    bool
+	replyBudget int64
+	spill       bool
+}
+
+// A CallAllOption is an option that can be provided to CallAll and
+// CallMachines.
+type CallAllOption func(o *callAllOptions)
+
+// Concurrency limits the number of calls that are in flight at any
+// one time. The default is 64.
+func Concurrency(n int) CallAllOption {
+	return func(o *callAllOptions) {
+		o.concurrency = n
+	}
+}
+
+// FailFast aborts the remaining calls once a call fails. By default,
+// every call runs to completion, regardless of the others' outcomes.
+func FailFast() CallAllOption {
+	return func(o *callAllOptions) {
+		o.failFast = true
+	}
+}
+
+// ReplyBudget limits the size of each call's reply to n bytes, so
+// that collecting replies from many machines cannot exhaust the
+// caller's memory. Calls whose replies exceed the budget fail with
+// an error of kind errors.Precondition. The budget applies to
+// gob-encoded replies, and to streamed replies that are spilled (see
+// Spill).
+func ReplyBudget(n int64) CallAllOption {
+	return func(o *callAllOptions) {
+		o.replyBudget = n
+	}
+}
+
+// Spill buffers streamed replies in temporary files as they are
+// received, so that replies from many machines may be collected
+// without holding their connections open or buffering them in
+// memory. Spill requires replies of type *[]io.ReadCloser; the
+// returned readers read from the temporary files, which are removed
+// when the readers are closed.
+func Spill() CallAllOption {
+	return func(o *callAllOptions) {
+		o.spill = true
+	}
+}
+
+// CallAllError is the error returned by CallAll and CallMachines
+// when some of their calls fail. The replies of the calls that
+// succeeded are still returned, so that callers may tolerate partial
+// failures.
+type CallAllError struct {
+	// Machines are the machines that were called.
+	Machines []*Machine
+	// Errs contains the error of each call: Errs[i] is the error of
+	// the call to Machines[i], or nil if that call succeeded.
+	Errs []error
+}
+
+// Failed returns the number of calls that failed.
+func (e *CallAllError) Failed() int {
+	var n int
+	for _, err := range e.Errs {
+		if err != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Error implements error.
+func (e *CallAllError) Error() string {
+	var (
+		b     strings.Builder
+		first = true
+	)
+	fmt.Fprintf(&b, "%d of %d calls failed", e.Failed(), len(e.Errs))
+	for i, err := range e.Errs {
+		if err == nil {
+			continue
+		}
+		if first {
+			b.WriteString(": ")
+			first = false
+		} else {
+			b.WriteString("; ")
+		}
+		fmt.Fprintf(&b, "%s: %v", e.Machines[i].Addr, err)
+	}
+	return b.String()
+}
+
+// CallAll calls the method named by serviceMethod with the provided
+// argument on each of b's machines that have not stopped, and
+// returns the machines called, ordered by address. See CallMachines
+// for the semantics of the calls and their replies.
+func (b *B) CallAll(ctx context.Context, serviceMethod string, arg, replies interface{}, opts ...CallAllOption) ([]*Machine, error) {
+	var machines []*Machine
+	for _, m := range b.Machines() {
+		if m.State() != Stopped {
+			machines = append(machines, m)
+		}
+	}
+	sort.Slice(machines, func(i, j int) bool {
+		return machines[i].Addr < machines[j].Addr
+	})
+	return machines, CallMachines(ctx, machines, serviceMethod, arg, replies, opts...)
+}
+
+// CallMachines calls the method named by serviceMethod with the
+// provided argument on each of the provided machines, concurrently
+// (see Concurrency). The argument is encoded separately for each
+// call, and thus may not be a stream (io.Reader).
+//
+// Replies must be nil, in which case replies are discarded, or a
+// pointer to a slice whose element type is the method's reply type.
+// The slice is replaced by one with an element for each machine:
+// (*replies)[i] is the reply of machines[i].
+//
+// If any call fails, CallMachines returns a *CallAllError that
+// contains each call's error; the replies of the calls that
+// succeeded are still set. Streamed replies must be closed by the
+// caller in either case.
+func CallMachines(ctx context.Context, machines []*Machine, serviceMethod string, arg, replies interface{}, opts ...CallAllOption) error {
+	options := callAllOptions{concurrency: defaultCallAllConcurrency}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.concurrency <= 0 {
+		return errors.E(errors.Invalid, fmt.Sprintf("invalid concurrency %d", options.concurrency))
+	}
+	var repliesv reflect.Value
+	if replies != nil {
+		ptrv := reflect.ValueOf(replies)
+		if ptrv.Kind() != reflect.Ptr || ptrv.Elem().Kind() != reflect.Slice {
+			return errors.E(errors.Invalid, fmt.Sprintf("replies of type %T is not a pointer to a slice", replies))
+		}
+		repliesv = reflect.MakeSlice(ptrv.Elem().Type(), len(machines), len(machines))
+		ptrv.Elem().Set(repliesv)
+	}
+	if options.spill && (replies == nil || repliesv.Type().Elem() != typeOfReadCloser) {
+		return errors.E(errors.Invalid, fmt.Sprintf("cannot spill replies of type %T", replies))
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	callCtx := ctx
+	if options.replyBudget > 0 {
+		callCtx = rpc.WithMaxReply(ctx, options.replyBudget)
+	}
+	var (
+		errs   = make([]error, len(machines))
+		failed bool
+		wg     sync.WaitGroup
+		sema   = make(chan struct{}, options.concurrency)
+	)
+	for i := range machines {
+		var reply interface{}
+		if replies != nil {
+			reply = repliesv.Index(i).Addr().Interface()
+		}
+		wg.Add(1)
+		sema <- struct{}{}
+		go func(i int, reply interface{}) {
+			defer func() {
+				<-sema
+				wg.Done()
+			}()
+			if err := ctx.Err(); err != nil {
+				errs[i] = err
+				return
+			}
+			errs[i] = machines[i].Call(callCtx, serviceMethod, arg, reply)
+			if errs[i] == nil && options.spill {
+				errs[i] = spill(reply.(*io.ReadCloser), options.replyBudget)
+			}
+			if errs[i] != nil && options.failFast {
+				cancel()
+			}
+		}(i, reply)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			failed = true
+			break
+		}
+	}
+	if !failed {
+		return nil
+	}
+	return &CallAllError{Machines: machines, Errs: errs}
+}
+
+var typeOfReadCloser = reflect.TypeOf((*io.ReadCloser)(nil)).Elem()
+
+// Spill replaces the stream *rc with one that reads from a temporary
+// file containing the stream's contents, failing if the stream is
+// larger than max bytes (if max > 0).
+func spill(rc *io.ReadCloser, max int64) error {
+	r := *rc
+	*rc = nil
+	defer r.Close()
+	if max <= 0 {
+		buf, err := filebuf.New(r)
+		if err != nil {
+			return err
+		}
+		*rc = buf
+		return nil
+	}
+	lr := &io.LimitedReader{R: r, N: max + 1}
+	buf, err := filebuf.New(lr)
+	if err != nil {
+		return err
+	}
+	if lr.N == 0 {
+		buf.Close()
+		return errors.E(errors.Precondition, fmt.Sprintf("reply exceeds budget of %d bytes", max))
+	}
+	*rc = buf
+	return nil
+}
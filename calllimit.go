@@ -0,0 +1,116 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/grailbio/base/errors"
+)
+
+// CallLimit is a machine parameter that limits the number of calls
+// (see Machine.Call) that may be in flight to the machine at once,
+// protecting small machines from bursts of calls from the driver.
+// Calls beyond the limit wait for calls in flight to complete, or
+// fail immediately if FailFast is set. The limit applies to the calls
+// made through the driver's Machine; calls made by other processes
+// are not counted.
+type CallLimit struct {
+	// Max is the maximum number of calls in flight. Zero means no
+	// limit.
+	Max int
+	// FailFast causes calls beyond the limit to fail immediately with
+	// an error of kind errors.Unavailable, instead of waiting.
+	FailFast bool
+}
+
+func (l CallLimit) applyParam(m *Machine) {
+	m.callLimit = &l
+}
+
+// InFlight returns the number of calls to the machine that are in
+// flight.
+func (m *Machine) InFlight() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.inflight
+}
+
+// A callWaiter is a call that waits for a call slot.
+type callWaiter struct {
+	priority int
+	// Admitted is closed when the call is given a slot.
+	admitted chan struct{}
+}
+
+// AcquireCall acquires a call slot, as permitted by the machine's
+// call limit. Waiting calls are admitted in order of decreasing
+// priority. AcquireCall returns an error if the limit is reached and
+// calls fail fast, or if the context is done before a slot is
+// available.
+func (m *Machine) acquireCall(ctx context.Context, priority int) error {
+	if m.callLimit == nil || m.callLimit.Max <= 0 {
+		return nil
+	}
+	m.callMu.Lock()
+	if m.callsActive < m.callLimit.Max && len(m.callWaiters) == 0 {
+		m.callsActive++
+		m.callMu.Unlock()
+		return nil
+	}
+	if m.callLimit.FailFast {
+		m.callMu.Unlock()
+		return errors.E(errors.Unavailable, fmt.Sprintf("machine %s: too many calls in flight (limit %d)", m.Addr, m.callLimit.Max))
+	}
+	w := &callWaiter{priority: priority, admitted: make(chan struct{})}
+	i := sort.Search(len(m.callWaiters), func(i int) bool {
+		return m.callWaiters[i].priority < priority
+	})
+	m.callWaiters = append(m.callWaiters, nil)
+	copy(m.callWaiters[i+1:], m.callWaiters[i:])
+	m.callWaiters[i] = w
+	m.callMu.Unlock()
+	select {
+	case <-w.admitted:
+		return nil
+	case <-ctx.Done():
+	}
+	m.callMu.Lock()
+	select {
+	case <-w.admitted:
+		// The call was admitted concurrently; pass its slot on.
+		m.callMu.Unlock()
+		m.releaseCall()
+		return ctx.Err()
+	default:
+	}
+	for i := range m.callWaiters {
+		if m.callWaiters[i] == w {
+			m.callWaiters = append(m.callWaiters[:i], m.callWaiters[i+1:]...)
+			break
+		}
+	}
+	m.callMu.Unlock()
+	return ctx.Err()
+}
+
+// ReleaseCall releases a call slot acquired by acquireCall, admitting
+// the first waiting call, if any.
+func (m *Machine) releaseCall() {
+	if m.callLimit == nil || m.callLimit.Max <= 0 {
+		return
+	}
+	m.callMu.Lock()
+	defer m.callMu.Unlock()
+	if len(m.callWaiters) == 0 {
+		m.callsActive--
+		return
+	}
+	w := m.callWaiters[0]
+	m.callWaiters = m.callWaiters[1:]
+	close(w.admitted)
+}
@@ -0,0 +1,241 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/retry"
+	"github.com/grailbio/bigmachine/rpc"
+)
+
+// A CallOpt is an option that customizes the behavior of a single
+// call (see Machine.Call).
+type CallOpt func(o *callOpts)
+
+// CallOpts are the options of a call.
+type callOpts struct {
+	timeout        time.Duration
+	retry          retry.Policy
+	priority       int
+	codec          rpc.Codec
+	compress       bool
+	idempotencyKey string
+	maxReply       int64
+	hedge          time.Duration
+	redispatches   int
+	redispatch     Redispatcher
+}
+
+// CallTimeout sets a timeout for each attempt of the call.
+func CallTimeout(timeout time.Duration) CallOpt {
+	return func(o *callOpts) {
+		o.timeout = timeout
+	}
+}
+
+// CallRetry retries the call according to the provided policy when it
+// fails with a temporary error. Retries are subject to the B's retry
+// budget, if any (see LimitRetries). Calls whose arguments are
+// streamed (io.Reader) are not retried, since their arguments cannot
+// be sent again.
+func CallRetry(policy retry.Policy) CallOpt {
+	return func(o *callOpts) {
+		o.retry = policy
+	}
+}
+
+// CallPriority sets the priority of the call. When the machine's call
+// limit is reached (see CallLimit), waiting calls are admitted in
+// order of decreasing priority, and in the order in which they were
+// made among calls of equal priority. The default priority is 0.
+func CallPriority(priority int) CallOpt {
+	return func(o *callOpts) {
+		o.priority = priority
+	}
+}
+
+// CallCodec encodes the call's argument and reply with the provided
+// codec (see rpc.WithCodec).
+func CallCodec(codec rpc.Codec) CallOpt {
+	return func(o *callOpts) {
+		o.codec = codec
+	}
+}
+
+// CallCompression compresses the call's encoded argument and reply
+// (see rpc.WithCompression).
+func CallCompression() CallOpt {
+	return func(o *callOpts) {
+		o.compress = true
+	}
+}
+
+// CallIdempotencyKey transmits the provided idempotency key with the
+// call, so that the method is invoked at most once, even if the call
+// is retried or hedged (see rpc.WithIdempotencyKey).
+func CallIdempotencyKey(key string) CallOpt {
+	return func(o *callOpts) {
+		o.idempotencyKey = key
+	}
+}
+
+// CallMaxReply limits the size of the call's gob-encoded reply (see
+// rpc.WithMaxReply).
+func CallMaxReply(max int64) CallOpt {
+	return func(o *callOpts) {
+		o.maxReply = max
+	}
+}
+
+// CallHedge hedges the call: if it has not completed after the
+// provided delay, the call is issued again, and the first successful
+// reply is used; the other attempt is canceled. Hedging reduces tail
+// latency for methods that are safe to invoke more than once; it
+// should otherwise be combined with CallIdempotencyKey. Calls whose
+// arguments are streamed (io.Reader) are not hedged.
+func CallHedge(delay time.Duration) CallOpt {
+	return func(o *callOpts) {
+		o.hedge = delay
+	}
+}
+
+// CallWithOpts implements Call with the provided options.
+func (m *Machine) callWithOpts(ctx context.Context, serviceMethod string, arg, reply interface{}, opts []CallOpt) error {
+	var o callOpts
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.idempotencyKey != "" {
+		ctx = rpc.WithIdempotencyKey(ctx, o.idempotencyKey)
+	}
+	if o.maxReply > 0 {
+		ctx = rpc.WithMaxReply(ctx, o.maxReply)
+	}
+	if o.codec != rpc.Gob {
+		ctx = rpc.WithCodec(ctx, o.codec)
+	}
+	if o.compress {
+		ctx = rpc.WithCompression(ctx)
+	}
+	if _, ok := arg.(io.Reader); ok {
+		// The argument is consumed by the first attempt.
+		o.hedge = 0
+		o.retry = nil
+		o.redispatch = nil
+	}
+	for retries, redispatches := 0, 0; ; retries++ {
+		err := m.attempt(ctx, o, serviceMethod, arg, reply)
+		if err != nil && o.redispatch != nil && redispatches < o.redispatches && IsMachineLost(err) {
+			target, rerr := o.redispatch(ctx, m, serviceMethod)
+			if rerr != nil {
+				log.Error.Printf("%s: cannot redispatch %s: %v", m.Name(), serviceMethod, rerr)
+				return err
+			}
+			log.Printf("%s: redispatching %s to %s: %v", m.Name(), serviceMethod, target.Name(), err)
+			m = target
+			redispatches++
+			continue
+		}
+		if err == nil || o.retry == nil || !errors.IsTemporary(err) {
+			return err
+		}
+		if werr := retry.Wait(ctx, o.retry, retries); werr != nil {
+			return errors.E(errors.Fatal, werr, err)
+		}
+		if werr := m.retries.Wait(ctx); werr != nil {
+			return errors.E(errors.Fatal, errors.TooManyTries, serviceMethod+": retry budget exhausted", err)
+		}
+	}
+}
+
+// Attempt makes a single attempt of a call with the provided options.
+func (m *Machine) attempt(ctx context.Context, o callOpts, serviceMethod string, arg, reply interface{}) error {
+	if o.timeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+	if o.hedge <= 0 {
+		return m.runningCall(ctx, o.priority, serviceMethod, arg, reply)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		reply interface{}
+		err   error
+	}
+	results := make(chan result, 2)
+	launch := func() {
+		r := newReply(reply)
+		go func() {
+			err := m.runningCall(ctx, o.priority, serviceMethod, arg, r)
+			results <- result{r, err}
+		}()
+	}
+	launch()
+	timer := time.NewTimer(o.hedge)
+	defer timer.Stop()
+	var (
+		pending = 1
+		hedged  bool
+		err     error
+	)
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if !hedged {
+				hedged = true
+				pending++
+				launch()
+			}
+		case res := <-results:
+			pending--
+			if res.err != nil {
+				err = res.err
+				if !hedged {
+					// The call failed before it was hedged.
+					return err
+				}
+				continue
+			}
+			if reply != nil {
+				reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(res.reply).Elem())
+			}
+			if pending > 0 {
+				// Release the reply of the outstanding attempt, if it
+				// succeeds despite being canceled.
+				go func() {
+					if res := <-results; res.err == nil {
+						closeReply(res.reply)
+					}
+				}()
+			}
+			return nil
+		}
+	}
+	return err
+}
+
+// NewReply returns a new value of the type of the provided reply,
+// which must be a pointer or nil.
+func newReply(reply interface{}) interface{} {
+	if reply == nil {
+		return nil
+	}
+	return reflect.New(reflect.TypeOf(reply).Elem()).Interface()
+}
+
+// CloseReply closes the provided reply if it is a streamed reply.
+func closeReply(reply interface{}) {
+	if rc, ok := reply.(*io.ReadCloser); ok && *rc != nil {
+		(*rc).Close()
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/grailbio/base/data"
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+)
+
+// ResourceLimits is a machine parameter that confines the machine's
+// process to a cgroup (version 2) with the provided limits before its
+// binary is executed. Since the executed binary replaces the
+// supervisor's process, the limits apply to the process as a whole,
+// and to the commands that it runs (see Machine.Command): a runaway
+// worker is then killed, or throttled, by the kernel, instead of
+// starving the machine's system services, such as its SSH server or
+// log collector, and taking down the instance. Zero-valued limits are
+// not applied.
+//
+// ResourceLimits is supported only on Linux machines that use the
+// unified cgroup hierarchy, and requires that the machine's
+// supervisor run with the privileges to create cgroups.
+type ResourceLimits struct {
+	// Memory is the maximum amount of memory, in bytes, that the
+	// process may use (memory.max); beyond it, the kernel's
+	// out-of-memory killer kills the process.
+	Memory int64
+	// CPUWeight is the process's relative share of CPU time
+	// (cpu.weight), between 1 and 10000; the system default is 100.
+	CPUWeight int
+	// Pids is the maximum number of processes and threads
+	// (pids.max).
+	Pids int
+}
+
+func (l ResourceLimits) applyParam(m *Machine) {
+	m.resourceLimits = &l
+}
+
+// String returns a summary of the limits.
+func (l ResourceLimits) String() string {
+	var limits []string
+	if l.Memory > 0 {
+		limits = append(limits, fmt.Sprintf("memory %s", data.Size(l.Memory)))
+	}
+	if l.CPUWeight > 0 {
+		limits = append(limits, fmt.Sprintf("cpu weight %d", l.CPUWeight))
+	}
+	if l.Pids > 0 {
+		limits = append(limits, fmt.Sprintf("pids %d", l.Pids))
+	}
+	if len(limits) == 0 {
+		return "no resource limits"
+	}
+	return "resource limits: " + strings.Join(limits, ", ")
+}
+
+// CgroupName is the name of the cgroup, under the root of the cgroup
+// hierarchy, to which SetResourceLimits moves the process.
+const cgroupName = "bigmachine"
+
+// SetResourceLimits moves the process to a cgroup with the limits
+// described by its argument. It should be called before Exec; the
+// executed binary inherits the cgroup.
+func (s *Supervisor) SetResourceLimits(ctx context.Context, limits ResourceLimits, _ *struct{}) error {
+	if limits.Memory < 0 || limits.Pids < 0 {
+		return errors.E(errors.Invalid, fmt.Sprintf("invalid %s", limits))
+	}
+	if limits.CPUWeight < 0 || limits.CPUWeight > 10000 {
+		return errors.E(errors.Invalid, fmt.Sprintf("invalid cpu weight %d", limits.CPUWeight))
+	}
+	if err := applyCgroupLimits(cgroupName, limits); err != nil {
+		return errors.E("set resource limits", err)
+	}
+	log.Printf("applied %s", limits)
+	return nil
+}
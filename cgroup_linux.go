@@ -0,0 +1,138 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package bigmachine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/base/errors"
+)
+
+// CgroupRoot is the mount point of the unified cgroup hierarchy.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// ApplyCgroupLimits creates the named cgroup under the root of the
+// cgroup hierarchy, enabling the controllers needed by the provided
+// limits, sets the limits, and moves the process into the cgroup.
+func applyCgroupLimits(name string, limits ResourceLimits) error {
+	controllers, err := ioutil.ReadFile(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	if os.IsNotExist(err) {
+		return errors.E(errors.NotSupported, "the unified cgroup hierarchy (cgroup v2) is not mounted at "+cgroupRoot)
+	} else if err != nil {
+		return err
+	}
+	available := make(map[string]bool)
+	for _, c := range strings.Fields(string(controllers)) {
+		available[c] = true
+	}
+	type setting struct{ controller, file, value string }
+	var settings []setting
+	if limits.Memory > 0 {
+		settings = append(settings, setting{"memory", "memory.max", strconv.FormatInt(limits.Memory, 10)})
+	}
+	if limits.CPUWeight > 0 {
+		settings = append(settings, setting{"cpu", "cpu.weight", strconv.Itoa(limits.CPUWeight)})
+	}
+	if limits.Pids > 0 {
+		settings = append(settings, setting{"pids", "pids.max", strconv.Itoa(limits.Pids)})
+	}
+	for _, s := range settings {
+		if !available[s.controller] {
+			return errors.E(errors.NotSupported, fmt.Sprintf("cgroup controller %s is not available", s.controller))
+		}
+		if err := writeCgroupFile(cgroupRoot, "cgroup.subtree_control", "+"+s.controller); err != nil {
+			return err
+		}
+	}
+	dir := filepath.Join(cgroupRoot, name)
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	for _, s := range settings {
+		if err := writeCgroupFile(dir, s.file, s.value); err != nil {
+			return err
+		}
+	}
+	return writeCgroupFile(dir, "cgroup.procs", strconv.Itoa(os.Getpid()))
+}
+
+// CurrentCgroupLimits returns the limits of the cgroup to which the
+// process was moved by applyCgroupLimits, if it was.
+func currentCgroupLimits(name string) (*ResourceLimits, error) {
+	self, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return nil, err
+	}
+	// In the unified hierarchy, the process's cgroup is listed as
+	// "0::/path".
+	var member bool
+	for _, line := range strings.Split(string(self), "\n") {
+		if line == "0::/"+name {
+			member = true
+		}
+	}
+	if !member {
+		return nil, nil
+	}
+	dir := filepath.Join(cgroupRoot, name)
+	// ReadLimit reads the limit in the provided file, which is 0 if it
+	// is unset.
+	readLimit := func(file string) (int64, error) {
+		p, err := ioutil.ReadFile(filepath.Join(dir, file))
+		if os.IsNotExist(err) {
+			return 0, nil
+		} else if err != nil {
+			return 0, err
+		}
+		v := strings.TrimSpace(string(p))
+		if v == "max" {
+			return 0, nil
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, errors.E(fmt.Sprintf("parse %s", filepath.Join(dir, file)), err)
+		}
+		return n, nil
+	}
+	var limits ResourceLimits
+	if limits.Memory, err = readLimit("memory.max"); err != nil {
+		return nil, err
+	}
+	weight, err := readLimit("cpu.weight")
+	if err != nil {
+		return nil, err
+	}
+	pids, err := readLimit("pids.max")
+	if err != nil {
+		return nil, err
+	}
+	limits.CPUWeight, limits.Pids = int(weight), int(pids)
+	return &limits, nil
+}
+
+// WriteCgroupFile writes the provided value to a cgroup interface
+// file.
+func writeCgroupFile(dir, file, value string) error {
+	f, err := os.OpenFile(filepath.Join(dir, file), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(value)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.E(fmt.Sprintf("write %q to %s", value, filepath.Join(dir, file)), err)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package bigmachine
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/grailbio/base/errors"
+)
+
+func TestResourceLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	save := cgroupRoot
+	cgroupRoot = dir
+	defer func() { cgroupRoot = save }()
+
+	var (
+		s   = new(Supervisor)
+		ctx = context.Background()
+	)
+	limits := ResourceLimits{Memory: 1 << 30, Pids: 100}
+	if err = s.SetResourceLimits(ctx, limits, nil); !errors.Is(errors.NotSupported, err) {
+		t.Errorf("got %v, want NotSupported", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "cgroup.controllers"), []byte("cpu memory\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetResourceLimits(ctx, limits, nil); !errors.Is(errors.NotSupported, err) {
+		t.Errorf("got %v, want NotSupported", err)
+	}
+	if err = s.SetResourceLimits(ctx, ResourceLimits{CPUWeight: 1e5}, nil); !errors.Is(errors.Invalid, err) {
+		t.Errorf("got %v, want Invalid", err)
+	}
+	limits.CPUWeight = 50
+	limits.Pids = 0
+	if err = s.SetResourceLimits(ctx, limits, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []struct{ path, want string }{
+		{"cgroup.subtree_control", "+cpu"},
+		{"bigmachine/memory.max", "1073741824"},
+		{"bigmachine/cpu.weight", "50"},
+		{"bigmachine/cgroup.procs", strconv.Itoa(os.Getpid())},
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, file.path))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if got, want := string(b), file.want; got != want {
+			t.Errorf("%s: got %q, want %q", file.path, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bigmachine/pids.max")); !os.IsNotExist(err) {
+		t.Errorf("pids.max: got %v, want not exist", err)
+	}
+}
@@ -0,0 +1,18 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package bigmachine
+
+import "github.com/grailbio/base/errors"
+
+func applyCgroupLimits(name string, limits ResourceLimits) error {
+	return errors.E(errors.NotSupported, "resource limits are supported only on linux")
+}
+
+func currentCgroupLimits(name string) (*ResourceLimits, error) {
+	return nil, nil
+}
@@ -0,0 +1,32 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import "time"
+
+// A CircuitBreaker configures the circuit breakers that guard the
+// calls made by the driver to each of its machines (see BreakCircuits
+// and rpc.Breaker).
+type CircuitBreaker struct {
+	// Threshold is the number of consecutive network failures or
+	// timeouts after which calls to a machine fail fast.
+	Threshold int
+	// Cooldown is the time after which an open breaker admits a
+	// single call to probe the machine for recovery. A zero Cooldown
+	// means 5 seconds.
+	Cooldown time.Duration
+}
+
+// BreakCircuits is an option that enables circuit breakers for the
+// calls made to the B's machines, so that callers do not burn full
+// timeouts against a machine that is clearly dead: calls to a machine
+// that has failed Threshold consecutive calls fail fast, with an
+// error of kind errors.Net, until a probe call succeeds. A machine's
+// breaker is discarded when the machine stops.
+func BreakCircuits(breaker CircuitBreaker) Option {
+	return func(b *B) {
+		b.breaker = &breaker
+	}
+}
@@ -0,0 +1,354 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+/*
+	Bigmachine-gen generates typed clients for bigmachine services.
+	Given a service type, it generates a client type with a method
+	for each of the service's RPC methods (see package rpc); each
+	client method calls the corresponding service method on a
+	machine, with compile-time-checked arguments and replies. This
+	replaces stringly-typed calls such as
+
+		var count uint64
+		err := m.Call(ctx, "PI.Sample", n, &count)
+
+	with
+
+		count, err := newCirclePIClient(m, "PI").Sample(ctx, n)
+
+	Bigmachine-gen is intended to be used with go generate:
+
+		//go:generate bigmachine-gen -type circlePI
+
+	Its usage is:
+
+		bigmachine-gen -type T [-client name] [-o file] [dir]
+
+	Bigmachine-gen parses the package in dir (the current directory by
+	default) and writes the client for the service type T to the
+	provided file (t_client.go, by default, where t is T in lower
+	case). The client type is named TClient by default; it is
+	exported if T is. Clients are created by NewTClient (or newTClient,
+	if the client is not exported), which takes the machine and the
+	name under which the service is registered.
+*/
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const bigmachinePath = "github.com/grailbio/bigmachine"
+
+var (
+	typeName   = flag.String("type", "", "the service type for which to generate a client")
+	clientName = flag.String("client", "", "the name of the generated client type; TClient by default")
+	output     = flag.String("o", "", "the output file; t_client.go by default")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: bigmachine-gen -type T [-client name] [-o file] [dir]\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("bigmachine-gen: ")
+	flag.Usage = usage
+	flag.Parse()
+	if *typeName == "" || flag.NArg() > 1 {
+		flag.Usage()
+	}
+	dir := "."
+	if flag.NArg() == 1 {
+		dir = flag.Arg(0)
+	}
+	pkg, err := build.ImportDir(dir, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, name := range pkg.GoFiles {
+		file, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, parser.ParseComments)
+		if err != nil {
+			log.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	name := *clientName
+	if name == "" {
+		name = *typeName + "Client"
+	}
+	src, err := generate(pkg.Name, pkg.ImportPath, *typeName, name, files)
+	if err != nil {
+		log.Fatal(err)
+	}
+	path := *output
+	if path == "" {
+		path = filepath.Join(dir, strings.ToLower(*typeName)+"_client.go")
+	}
+	if err := ioutil.WriteFile(path, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// A method is an RPC method of a service.
+type method struct {
+	// Name is the name of the method.
+	Name string
+	// Doc is the method's doc comment, if any.
+	Doc string
+	// Arg and Reply are the source representations of the method's
+	// argument and reply types.
+	Arg, Reply string
+}
+
+// Generate returns the source of the client type clientName for the
+// service typeName, defined in the provided files of the package
+// pkgName.
+func generate(pkgName, pkgPath, typeName, clientName string, files []*ast.File) ([]byte, error) {
+	var (
+		methods []method
+		imports = make(map[string]string) // name -> path
+		found   bool
+	)
+	for _, file := range files {
+		fileImports := importsOf(file)
+		for _, decl := range file.Decls {
+			switch decl := decl.(type) {
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					if spec, ok := spec.(*ast.TypeSpec); ok && spec.Name.Name == typeName {
+						found = true
+					}
+				}
+			case *ast.FuncDecl:
+				if decl.Recv == nil || len(decl.Recv.List) != 1 || receiverName(decl.Recv.List[0].Type) != typeName {
+					continue
+				}
+				m, ok := rpcMethod(decl, fileImports)
+				if !ok {
+					continue
+				}
+				if decl.Doc != nil {
+					m.Doc = decl.Doc.Text()
+				}
+				methods = append(methods, m)
+				for _, expr := range []ast.Expr{decl.Type.Params.List[1].Type, decl.Type.Params.List[2].Type} {
+					for _, name := range qualifiers(expr) {
+						path, ok := fileImports[name]
+						if !ok {
+							return nil, fmt.Errorf("%s.%s: unresolved package %s", typeName, m.Name, name)
+						}
+						if other, ok := imports[name]; ok && other != path {
+							return nil, fmt.Errorf("%s.%s: package name %s refers to both %s and %s", typeName, m.Name, name, path, other)
+						}
+						imports[name] = path
+					}
+				}
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("type %s not found", typeName)
+	}
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("type %s has no RPC methods", typeName)
+	}
+	sort.Slice(methods, func(i, j int) bool { return methods[i].Name < methods[j].Name })
+
+	machine := "bigmachine.Machine"
+	if pkgPath == bigmachinePath {
+		machine = "Machine"
+	} else {
+		imports["bigmachine"] = bigmachinePath
+	}
+	imports["context"] = "context"
+	names := make([]string, 0, len(imports))
+	for name := range imports {
+		names = append(names, name)
+	}
+	// Standard library imports are listed first, as by goimports.
+	sort.Slice(names, func(i, j int) bool {
+		pi, pj := imports[names[i]], imports[names[j]]
+		if si, sj := isStd(pi), isStd(pj); si != sj {
+			return si
+		}
+		return pi < pj
+	})
+
+	newName := "New" + clientName
+	if !isExported(clientName) {
+		newName = "new" + upperFirst(clientName)
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by \"bigmachine-gen -type %s\"; DO NOT EDIT.\n\n", typeName)
+	fmt.Fprintf(&b, "package %s\n\n", pkgName)
+	b.WriteString("import (\n")
+	for i, name := range names {
+		path := imports[name]
+		if i > 0 && isStd(imports[names[i-1]]) && !isStd(path) {
+			b.WriteString("\n")
+		}
+		if name == filepath.Base(path) {
+			fmt.Fprintf(&b, "\t%q\n", path)
+		} else {
+			fmt.Fprintf(&b, "\t%s %q\n", name, path)
+		}
+	}
+	b.WriteString(")\n\n")
+	fmt.Fprintf(&b, "// %s is a typed client for the service %s.\n", clientName, typeName)
+	fmt.Fprintf(&b, "type %s struct {\n", clientName)
+	b.WriteString("\t// Machine is the machine on which the service is called.\n")
+	fmt.Fprintf(&b, "\tMachine *%s\n", machine)
+	b.WriteString("\t// Service is the name under which the service is registered.\n")
+	b.WriteString("\tService string\n")
+	b.WriteString("}\n\n")
+	fmt.Fprintf(&b, "// %s returns a client for the service %s, registered under\n", newName, typeName)
+	b.WriteString("// the provided name on machine m.\n")
+	fmt.Fprintf(&b, "func %s(m *%s, service string) %s {\n", newName, machine, clientName)
+	fmt.Fprintf(&b, "\treturn %s{m, service}\n", clientName)
+	b.WriteString("}\n")
+	for _, m := range methods {
+		b.WriteString("\n")
+		fmt.Fprintf(&b, "// %s calls %s.%s on the client's machine.\n", m.Name, typeName, m.Name)
+		if m.Doc != "" {
+			b.WriteString("//\n")
+			for _, line := range strings.Split(strings.TrimSpace(m.Doc), "\n") {
+				b.WriteString(strings.TrimRight("// "+line, " ") + "\n")
+			}
+		}
+		fmt.Fprintf(&b, "func (c %s) %s(ctx context.Context, arg %s) (%s, error) {\n", clientName, m.Name, m.Arg, m.Reply)
+		fmt.Fprintf(&b, "\tvar reply %s\n", m.Reply)
+		fmt.Fprintf(&b, "\terr := c.Machine.Call(ctx, c.Service+%q, arg, &reply)\n", "."+m.Name)
+		b.WriteString("\treturn reply, err\n")
+		b.WriteString("}\n")
+	}
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("generated invalid code: %v\n%s", err, b.String())
+	}
+	return src, nil
+}
+
+// RpcMethod returns the method described by the provided function
+// declaration, and whether it is an RPC method, that is, an
+// exported method of the form
+//
+//	Func(context.Context, argType, *replyType) error
+func rpcMethod(decl *ast.FuncDecl, imports map[string]string) (method, bool) {
+	if !decl.Name.IsExported() {
+		return method{}, false
+	}
+	var params []ast.Expr
+	for _, field := range decl.Type.Params.List {
+		n := len(field.Names)
+		if n == 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			params = append(params, field.Type)
+		}
+	}
+	if len(params) != 3 || len(decl.Type.Params.List) != 3 {
+		return method{}, false
+	}
+	if sel, ok := params[0].(*ast.SelectorExpr); !ok || sel.Sel.Name != "Context" || imports[types.ExprString(sel.X)] != "context" {
+		return method{}, false
+	}
+	reply, ok := params[2].(*ast.StarExpr)
+	if !ok {
+		return method{}, false
+	}
+	results := decl.Type.Results
+	if results == nil || len(results.List) != 1 || len(results.List[0].Names) > 1 || types.ExprString(results.List[0].Type) != "error" {
+		return method{}, false
+	}
+	return method{
+		Name:  decl.Name.Name,
+		Arg:   types.ExprString(params[1]),
+		Reply: types.ExprString(reply.X),
+	}, true
+}
+
+// ReceiverName returns the name of the type of the provided receiver
+// expression.
+func receiverName(expr ast.Expr) string {
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+	if ident, ok := expr.(*ast.Ident); ok {
+		return ident.Name
+	}
+	return ""
+}
+
+// ImportsOf returns the imports of the provided file, keyed by the
+// names by which they are referred to in the file.
+func importsOf(file *ast.File) map[string]string {
+	imports := make(map[string]string)
+	for _, spec := range file.Imports {
+		path, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			continue
+		}
+		name := filepath.Base(path)
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		imports[name] = path
+	}
+	return imports
+}
+
+// Qualifiers returns the package names that qualify identifiers in
+// the provided type expression.
+func qualifiers(expr ast.Expr) []string {
+	var names []string
+	ast.Inspect(expr, func(node ast.Node) bool {
+		if sel, ok := node.(*ast.SelectorExpr); ok {
+			if ident, ok := sel.X.(*ast.Ident); ok {
+				names = append(names, ident.Name)
+			}
+			return false
+		}
+		return true
+	})
+	return names
+}
+
+// IsStd tells whether the provided import path is that of a
+// standard library package.
+func isStd(path string) bool {
+	return !strings.Contains(strings.SplitN(path, "/", 2)[0], ".")
+}
+
+func isExported(name string) bool {
+	r, _ := utf8.DecodeRuneInString(name)
+	return unicode.IsUpper(r)
+}
+
+func upperFirst(name string) string {
+	r, n := utf8.DecodeRuneInString(name)
+	return string(unicode.ToUpper(r)) + name[n:]
+}
@@ -99,6 +99,8 @@ func init() {
 	gob.Register(circlePI{})
 }
 
+//go:generate bigmachine-gen -type circlePI
+
 type circlePI struct{}
 
 // Sample generates n points inside the unit square and reports
@@ -164,8 +166,7 @@ func main() {
 		for i := 0; i < m.Maxprocs; i++ {
 			cores++
 			g.Go(func() error {
-				var count uint64
-				err := m.Call(ctx, "PI.Sample", numPerMachine/uint64(m.Maxprocs), &count)
+				count, err := newCirclePIClient(m, "PI").Sample(ctx, numPerMachine/uint64(m.Maxprocs))
 				if err == nil {
 					atomic.AddUint64(&total, count)
 				}
@@ -0,0 +1,152 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigmachine/rpc"
+)
+
+// A Command is a command to be run on a machine (see Machine.Command).
+type Command struct {
+	// Args are the command's arguments, including the command name as
+	// the first element. The command is looked up in the machine's
+	// PATH if it contains no path separators.
+	Args []string
+	// Env are additional environment variables, of the form
+	// "key=value", with which the command is run, in addition to the
+	// machine's environment.
+	Env []string
+	// Dir is the command's working directory. It defaults to the
+	// supervisor's working directory.
+	Dir string
+}
+
+// A commandFrame is a frame of the stream with which a command's
+// output and exit status are replied.
+type commandFrame struct {
+	// Stream is 1 for data written to the command's standard output,
+	// and 2 for data written to its standard error.
+	Stream int
+	Data   []byte
+	// Exited is set in the final frame, which includes the command's
+	// exit code, or, if the command could not be run, Err.
+	Exited bool
+	Code   int
+	Err    string
+}
+
+// Command runs the provided command on the machine, streaming its
+// standard output and standard error to the provided writers, which
+// may be nil to discard output. Command returns the command's exit
+// code once it exits; a nonzero exit code is not an error. The error
+// is non-nil if the command could not be run, or if the call failed.
+// The command is killed if the context is canceled. Command lets
+// drivers invoke helper tools (for example, nvidia-smi or aws s3 cp)
+// without wrapping each in a service.
+func (m *Machine) Command(ctx context.Context, cmd Command, stdout, stderr io.Writer) (code int, err error) {
+	if len(cmd.Args) == 0 {
+		return -1, errors.E(errors.Invalid, "command has no arguments")
+	}
+	var rc io.ReadCloser
+	if err = m.Call(ctx, "Supervisor.Command", cmd, &rc); err != nil {
+		return -1, err
+	}
+	defer rc.Close()
+	dec := gob.NewDecoder(rc)
+	for {
+		var frame commandFrame
+		if err = dec.Decode(&frame); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return -1, errors.E(fmt.Sprintf("command %s", cmd.Args[0]), err)
+		}
+		if frame.Exited {
+			if frame.Err != "" {
+				return -1, errors.E(fmt.Sprintf("command %s", cmd.Args[0]), frame.Err)
+			}
+			return frame.Code, nil
+		}
+		w := stdout
+		if frame.Stream == 2 {
+			w = stderr
+		}
+		if w == nil {
+			continue
+		}
+		if _, err = w.Write(frame.Data); err != nil {
+			return -1, err
+		}
+	}
+}
+
+// Command runs a command on the machine, replying with a stream of
+// gob-encoded frames that carry the command's output, followed by a
+// final frame with its exit status (see Machine.Command). The command
+// is killed if the call is canceled.
+func (s *Supervisor) Command(ctx context.Context, cmd Command, reply *io.ReadCloser) error {
+	if len(cmd.Args) == 0 {
+		return errors.E(errors.Invalid, "Supervisor.Command: command has no arguments")
+	}
+	c := exec.CommandContext(ctx, cmd.Args[0], cmd.Args[1:]...)
+	c.Env = append(os.Environ(), cmd.Env...)
+	c.Dir = cmd.Dir
+	r, w := io.Pipe()
+	enc := &frameEncoder{enc: gob.NewEncoder(w)}
+	c.Stdout = &frameWriter{enc, 1}
+	c.Stderr = &frameWriter{enc, 2}
+	if err := c.Start(); err != nil {
+		return errors.E(fmt.Sprintf("Supervisor.Command %s", cmd.Args[0]), err)
+	}
+	go func() {
+		frame := commandFrame{Exited: true}
+		if err := c.Wait(); err != nil {
+			if exitErr, ok := err.(*exec.ExitError); ok && ctx.Err() == nil {
+				frame.Code = exitErr.ExitCode()
+			} else {
+				frame.Err = err.Error()
+			}
+		}
+		w.CloseWithError(enc.Encode(frame))
+	}()
+	*reply = rpc.Flush(r)
+	return nil
+}
+
+// A frameEncoder serializes the encoding of command frames.
+type frameEncoder struct {
+	mu  sync.Mutex
+	enc *gob.Encoder
+}
+
+// Encode encodes the provided frame.
+func (e *frameEncoder) Encode(frame commandFrame) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.enc.Encode(frame)
+}
+
+// A frameWriter writes a command's output stream as frames.
+type frameWriter struct {
+	enc    *frameEncoder
+	stream int
+}
+
+// Write implements io.Writer.
+func (w *frameWriter) Write(p []byte) (int, error) {
+	if err := w.enc.Encode(commandFrame{Stream: w.stream, Data: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
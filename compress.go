@@ -0,0 +1,117 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+)
+
+// A Compressor implements a compression format for the log streams
+// that are exchanged between machines and the driver (see
+// Machine.Tail). Since log streams are live, writers must support
+// flushing: data written before a flush must be decodable by the
+// reader without further input.
+type Compressor interface {
+	// Name returns the compressor's name, by which drivers and
+	// machines negotiate the compression of a stream.
+	Name() string
+	// NewWriter returns a writer that compresses data to w.
+	NewWriter(w io.Writer) (CompressWriter, error)
+	// NewReader returns a reader that decompresses data from r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// A CompressWriter is a compressing writer that can be flushed.
+type CompressWriter interface {
+	io.WriteCloser
+	// Flush writes any buffered data to the underlying writer.
+	Flush() error
+}
+
+var (
+	compressorsMu sync.Mutex
+	// compressors are the registered compressors, in order of
+	// preference.
+	compressors = []Compressor{gzipCompressor{}}
+)
+
+// RegisterCompressor registers a compressor for log streams. Drivers
+// and machines negotiate the compression of a stream among the
+// compressors registered by both; compressors registered later are
+// preferred. Thus, for example, a program may register a zstd
+// compressor, which is used in place of the built-in gzip compressor
+// wherever both sides of a stream support it. Compressors must be
+// registered by both drivers and machines, typically in an init
+// function. RegisterCompressor panics if a compressor with the same
+// name is already registered.
+func RegisterCompressor(c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	for _, existing := range compressors {
+		if existing.Name() == c.Name() {
+			panic(fmt.Sprintf("bigmachine: compressor %s registered twice", c.Name()))
+		}
+	}
+	compressors = append([]Compressor{c}, compressors...)
+}
+
+// CompressorNames returns the names of the registered compressors, in
+// order of preference.
+func compressorNames() []string {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	names := make([]string, len(compressors))
+	for i, c := range compressors {
+		names[i] = c.Name()
+	}
+	return names
+}
+
+// LookupCompressor returns the registered compressor with the
+// provided name, or nil if there is none.
+func lookupCompressor(name string) Compressor {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	for _, c := range compressors {
+		if c.Name() == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// NegotiateCompressor returns the first of the provided compressor
+// names that is registered, or nil if none is.
+func negotiateCompressor(names []string) Compressor {
+	for _, name := range names {
+		if c := lookupCompressor(name); c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// GzipCompressor is the built-in gzip compressor. It favors speed
+// over compression ratio, since log streams are compressed live.
+type gzipCompressor struct{}
+
+func (gzipCompressor) Name() string { return "gzip" }
+
+func (gzipCompressor) NewWriter(w io.Writer) (CompressWriter, error) {
+	return gzip.NewWriterLevel(w, gzip.BestSpeed)
+}
+
+func (gzipCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.E(errors.Invalid, "gzip", err)
+	}
+	return gz, nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/grailbio/base/data"
+	"github.com/grailbio/bigmachine/rpc"
+)
+
+// Pricing describes the price of a machine, as reported by its
+// System.
+type Pricing struct {
+	// InstanceType is the machine's instance type, if any.
+	InstanceType string
+	// Spot tells whether the machine is a spot (preemptible)
+	// instance.
+	Spot bool
+	// HourlyPrice is the price of the machine, in US dollars per hour.
+	// Systems that do not know the price actually paid for spot
+	// instances report an upper bound, such as the maximum price bid.
+	HourlyPrice float64
+}
+
+// MachineCost is the cost accrued by a single machine.
+type MachineCost struct {
+	// Name and Addr are the machine's name and address.
+	Name, Addr string
+	// Pricing is the price of the machine; Priced is false if the
+	// machine's system did not report a price.
+	Pricing
+	Priced bool
+	// Start and Stop are the times at which the machine was started
+	// and stopped; Stop is the zero time if the machine is still
+	// running.
+	Start, Stop time.Time
+	// Runtime is the amount of time that the machine has run.
+	Runtime time.Duration
+	// Cost is the machine's cost, in US dollars.
+	Cost float64
+	// Location is the machine's location, if known, and TrafficScope
+	// the scope of its traffic with the driver (see
+	// Machine.TrafficScope).
+	Location     Location
+	TrafficScope TrafficScope
+	// Traffic is the amount of call data that the driver has
+	// exchanged with the machine.
+	Traffic rpc.Traffic
+}
+
+// CostReport is a report of the costs accrued by a B's machines.
+type CostReport struct {
+	// Machines contains the cost of each machine, ordered by start
+	// time.
+	Machines []MachineCost
+	// Runtime is the total runtime of the machines.
+	Runtime time.Duration
+	// Cost is the total cost of the priced machines, in US dollars.
+	Cost float64
+	// Unpriced is the number of machines whose price is unknown; their
+	// costs are not included in Cost.
+	Unpriced int
+	// Traffic is the amount of call data that the driver has
+	// exchanged with the machines, by traffic scope.
+	Traffic map[TrafficScope]rpc.Traffic
+}
+
+// String returns a one-line summary of the report.
+func (r CostReport) String() string {
+	s := fmt.Sprintf("%d machines ran for %.2f machine-hours, costing $%.2f",
+		len(r.Machines), r.Runtime.Hours(), r.Cost)
+	if r.Unpriced > 0 {
+		s += fmt.Sprintf(" (%d machines unpriced)", r.Unpriced)
+	}
+	for _, scope := range []TrafficScope{TrafficCrossZone, TrafficCrossRegion} {
+		if t := r.Traffic[scope]; t.Total() > 0 {
+			s += fmt.Sprintf("; %s %s traffic", data.Size(t.Total()), scope)
+		}
+	}
+	return s
+}
+
+// CostReport returns a report of the costs accrued by the machines
+// that b has managed, based on their runtimes and on the prices
+// reported by b's System. Machines that are still running are
+// accounted up to the present. The report is also logged when b is
+// shut down, and served at /debug/bigmachine/cost (see HandleDebug).
+func (b *B) CostReport() CostReport {
+	var (
+		report = CostReport{Traffic: make(map[TrafficScope]rpc.Traffic)}
+		now    = time.Now()
+	)
+	for _, m := range b.Machines() {
+		if !m.Owned() {
+			continue
+		}
+		c := MachineCost{
+			Name:    m.Name(),
+			Addr:    m.Addr,
+			Pricing: m.pricing,
+			Priced:  m.priced,
+			Start:   m.StartTime(),
+			Stop:    m.StopTime(),
+
+			Location:     m.location,
+			TrafficScope: m.TrafficScope(),
+			Traffic:      m.Traffic(),
+		}
+		report.Traffic[c.TrafficScope] = report.Traffic[c.TrafficScope].Add(c.Traffic)
+		if c.Stop.IsZero() {
+			c.Runtime = now.Sub(c.Start)
+		} else {
+			c.Runtime = c.Stop.Sub(c.Start)
+		}
+		report.Runtime += c.Runtime
+		if c.Priced {
+			c.Cost = c.Runtime.Hours() * c.HourlyPrice
+			report.Cost += c.Cost
+		} else {
+			report.Unpriced++
+		}
+		report.Machines = append(report.Machines, c)
+	}
+	sort.Slice(report.Machines, func(i, j int) bool {
+		return report.Machines[i].Start.Before(report.Machines[j].Start)
+	})
+	return report
+}
+
+// CostHandler implements an HTTP handler that reports the costs
+// accrued by a B's machines (see B.CostReport).
+type costHandler struct{ *B }
+
+func (h *costHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	report := h.CostReport()
+	fmt.Fprintln(w, report)
+	if len(report.Machines) == 0 {
+		return
+	}
+	fmt.Fprintln(w)
+	var tw tabwriter.Writer
+	tw.Init(w, 4, 4, 1, ' ', 0)
+	fmt.Fprintln(&tw, "machine\tinstance type\tspot\t$/hour\tstart\truntime\tcost\tzone\ttraffic\tsent\treceived")
+	for _, c := range report.Machines {
+		price, cost := "unknown", "unknown"
+		if c.Priced {
+			price, cost = fmt.Sprintf("%.4f", c.HourlyPrice), fmt.Sprintf("%.4f", c.Cost)
+		}
+		runtime := c.Runtime.Round(time.Second).String()
+		if c.Stop.IsZero() {
+			runtime += " (running)"
+		}
+		zone := c.Location.Zone
+		if zone == "" {
+			zone = "unknown"
+		}
+		fmt.Fprintf(&tw, "%s\t%s\t%v\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			c.Name, c.InstanceType, c.Spot, price, c.Start.Format(time.RFC3339), runtime, cost,
+			zone, c.TrafficScope, data.Size(c.Traffic.Sent), data.Size(c.Traffic.Received))
+	}
+	tw.Flush()
+}
@@ -0,0 +1,184 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxCrashOutputLines is the number of a machine's most recent
+	// lines of log output that are retained for its crash report.
+	maxCrashOutputLines = 2 * maxPanicStackLines
+	// CrashExitWait is the amount of time for which a crash report
+	// waits for the System to report the exit status of the machine's
+	// process.
+	crashExitWait = 10 * time.Second
+)
+
+// An ExitStatus describes how a machine's process exited.
+type ExitStatus struct {
+	// Code is the process's exit code, or -1 if the process was
+	// terminated by a signal.
+	Code int
+	// Description describes the exit status, for example
+	// "exit status 2" or "signal: killed".
+	Description string
+}
+
+// A CrashReport describes the abnormal exit of a machine's process.
+// Crash reports are assembled by the driver when it loses the
+// keepalive of a machine that it owns: they contain the process's
+// exit status, if the machine's System reports it, and the last
+// panic and log output that the driver tailed from the machine.
+// Since the supervisor is replaced by the driver's binary (see
+// Supervisor.Exec), there is no process left on the machine to report
+// its crash; thus, output that is not tailed before the crash is lost.
+type CrashReport struct {
+	// Machine is the name of the machine that crashed.
+	Machine string
+	// Time is the time at which the crash was reported.
+	Time time.Time
+	// Exit is the exit status of the machine's process, or nil if it
+	// is unknown.
+	Exit *ExitStatus
+	// Panic is the message of the panic (or fatal error) that crashed
+	// the process, if any, and Stack is its stack trace.
+	Panic, Stack string
+	// Output contains the last lines of the process's log output.
+	Output []string
+}
+
+// Error summarizes the crash. CrashReport implements error so that
+// it may be the cause of a machine's error (see Machine.Err).
+func (r *CrashReport) Error() string {
+	msg := "machine crashed"
+	if r.Exit != nil {
+		msg += " (" + r.Exit.Description + ")"
+	}
+	if r.Panic != "" {
+		msg += ": " + r.Panic
+	}
+	return msg
+}
+
+// String returns the full crash report, including the panic's stack
+// trace and the process's last log output.
+func (r *CrashReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %s at %s\n", r.Machine, r.Error(), r.Time.Format(time.RFC3339))
+	if r.Stack != "" {
+		fmt.Fprintf(&b, "\n%s\n", r.Stack)
+	}
+	if len(r.Output) > 0 {
+		fmt.Fprintf(&b, "\nlast %d lines of output:\n", len(r.Output))
+		for _, line := range r.Output {
+			fmt.Fprintf(&b, "\t%s\n", line)
+		}
+	}
+	return b.String()
+}
+
+// CrashReport returns the report of the machine's crash, if its
+// process crashed. It is nil otherwise, or if the machine is not
+// owned by this process. The report is also the cause of the
+// machine's error (see Machine.Err).
+func (m *Machine) CrashReport() *CrashReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.crashReport
+}
+
+// ReportCrash assembles the report of the machine's crash, after
+// its keepalive was lost. It returns nil if there is no evidence that
+// the machine's process exited: that is, if the system does not
+// report an exit and no fatal panic was tailed.
+func (m *Machine) reportCrash(ctx context.Context, system System) *CrashReport {
+	report := &CrashReport{Machine: m.Name()}
+	if exiter, ok := system.(machineExiter); ok {
+		ctx, cancel := context.WithTimeout(ctx, crashExitWait)
+		exit, err := exiter.MachineExit(ctx, m)
+		cancel()
+		if err == nil {
+			report.Exit = &exit
+		}
+	}
+	report.Output, report.Panic, report.Stack = m.recent.Snapshot()
+	if report.Exit == nil && report.Panic == "" {
+		return nil
+	}
+	report.Time = time.Now()
+	m.mu.Lock()
+	m.crashReport = report
+	m.mu.Unlock()
+	return report
+}
+
+// An outputRecorder retains a machine's most recent log output, and
+// the last panic detected in it, for crash reports.
+type outputRecorder struct {
+	mu    sync.Mutex
+	lines []string
+	// next is the index in lines of the next line to be recorded,
+	// once lines is full.
+	next         int
+	panic, stack string
+}
+
+// Line records a line of output.
+func (r *outputRecorder) Line(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.lines) < maxCrashOutputLines {
+		r.lines = append(r.lines, line)
+		return
+	}
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % len(r.lines)
+}
+
+// Panic records a panic that was detected in the output, if it is
+// fatal.
+func (r *outputRecorder) Panic(message, stack string) {
+	if !fatalPanic(message) {
+		return
+	}
+	r.mu.Lock()
+	r.panic, r.stack = message, stack
+	r.mu.Unlock()
+}
+
+// Snapshot returns the recorded output, in order, and the last panic.
+// A panic whose stack trace ends the output is not yet detected by
+// the machine's panic scanner, which awaits the end of the trace;
+// thus the output is itself scanned for panics.
+func (r *outputRecorder) Snapshot() (lines []string, message, stack string) {
+	r.mu.Lock()
+	lines = append(lines, r.lines[r.next:]...)
+	lines = append(lines, r.lines[:r.next]...)
+	message, stack = r.panic, r.stack
+	r.mu.Unlock()
+	var scanner panicScanner
+	for _, line := range lines {
+		if m, s, ok := scanner.Line(line); ok && fatalPanic(m) {
+			message, stack = m, s
+		}
+	}
+	if m, s, ok := scanner.Flush(); ok && fatalPanic(m) {
+		message, stack = m, s
+	}
+	return
+}
+
+// FatalPanic tells whether the provided panic message is that of a
+// panic that crashes the process, as opposed to a panic in a service
+// method, which is recovered by the RPC server.
+func fatalPanic(message string) bool {
+	return strings.HasPrefix(message, "panic: ") || strings.HasPrefix(message, "fatal error: ")
+}
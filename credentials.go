@@ -0,0 +1,188 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/bigmachine/rpc"
+)
+
+// DefaultCredentialTTL is the default lifetime of the tokens vended
+// to machines (see Credentials).
+const defaultCredentialTTL = time.Hour
+
+// Credentials is a machine parameter that vends the machine scoped,
+// expiring tokens with which it accesses services hosted by the
+// driver, for example an ingestion endpoint, so that such services
+// need not be open to anything on the network. The driver vends a
+// token for each scope once the machine is running, and vends fresh
+// tokens to the machine before they expire. Machines obtain their
+// tokens through B.Token and present them to the driver, either by
+// calling with a context returned by rpc.WithCredential, or as HTTP
+// bearer tokens; driver-hosted services verify them with
+// B.VerifyCall or B.RequireToken.
+type Credentials struct {
+	// Scopes are the scopes for which tokens are vended.
+	Scopes []string
+	// TTL is the lifetime of each token. It defaults to an hour.
+	TTL time.Duration
+}
+
+func (c Credentials) applyParam(m *Machine) {
+	m.credentials = &c
+}
+
+// VendToken returns a token that grants access to the provided scope
+// until the provided lifetime elapses. Tokens are signed with a key
+// that is private to b, and may thus be verified only by b (see
+// VerifyToken).
+func (b *B) VendToken(scope string, ttl time.Duration) string {
+	expiry := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	payload := base64.RawURLEncoding.EncodeToString([]byte(scope)) + "." + expiry
+	return payload + "." + base64.RawURLEncoding.EncodeToString(b.signToken(payload))
+}
+
+// VerifyToken verifies that the provided token was vended by b for
+// the provided scope, and that it has not expired. It returns an
+// error of kind errors.NotAllowed otherwise.
+func (b *B) VerifyToken(token, scope string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.E(errors.NotAllowed, "malformed token")
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(mac, b.signToken(parts[0]+"."+parts[1])) {
+		return errors.E(errors.NotAllowed, "invalid token")
+	}
+	tokenScope, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || string(tokenScope) != scope {
+		return errors.E(errors.NotAllowed, fmt.Sprintf("token does not grant scope %s", scope))
+	}
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return errors.E(errors.NotAllowed, "malformed token")
+	}
+	if time.Now().Unix() >= expiry {
+		return errors.E(errors.NotAllowed, fmt.Sprintf("token for scope %s expired at %s", scope, time.Unix(expiry, 0)))
+	}
+	return nil
+}
+
+// VerifyCall verifies the credential transmitted with the call whose
+// context is provided (see rpc.WithCredential), as VerifyToken.
+// Driver-hosted services call it to admit only calls that present a
+// token vended by b for the provided scope.
+func (b *B) VerifyCall(ctx context.Context, scope string) error {
+	credential := rpc.Credential(ctx)
+	if credential == "" {
+		return errors.E(errors.NotAllowed, fmt.Sprintf("no credential for scope %s", scope))
+	}
+	return b.VerifyToken(credential, scope)
+}
+
+// RequireToken returns an HTTP handler that serves requests with the
+// provided handler only if they present a token vended by b for the
+// provided scope as a bearer token in their Authorization header.
+// Other requests are refused with status 401 (Unauthorized).
+func (b *B) RequireToken(scope string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			http.Error(w, "no bearer token", http.StatusUnauthorized)
+			return
+		}
+		if err := b.VerifyToken(strings.TrimPrefix(auth, "Bearer "), scope); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Token returns the current token vended to this machine for the
+// provided scope (see Credentials). It returns an error of kind
+// errors.NotExist if no token has been vended for the scope.
+func (b *B) Token(scope string) (string, error) {
+	b.tokensMu.Lock()
+	defer b.tokensMu.Unlock()
+	token, ok := b.tokens[scope]
+	if !ok {
+		return "", errors.E(errors.NotExist, fmt.Sprintf("no token for scope %s", scope))
+	}
+	return token, nil
+}
+
+// SignToken returns the MAC of the provided token payload under b's
+// token key, which is generated when first needed.
+func (b *B) signToken(payload string) []byte {
+	b.tokenKeyOnce.Do(func() {
+		b.tokenKey = make([]byte, 32)
+		if _, err := rand.Read(b.tokenKey); err != nil {
+			log.Panicf("generating token key: %v", err)
+		}
+	})
+	mac := hmac.New(sha256.New, b.tokenKey)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// SetTokens sets the tokens vended to the machine, keyed by scope (see
+// Credentials).
+func (s *Supervisor) SetTokens(ctx context.Context, tokens map[string]string, _ *struct{}) error {
+	s.b.tokensMu.Lock()
+	defer s.b.tokensMu.Unlock()
+	if s.b.tokens == nil {
+		s.b.tokens = make(map[string]string)
+	}
+	for scope, token := range tokens {
+		s.b.tokens[scope] = token
+	}
+	return nil
+}
+
+// VendCredentials vends the machine's tokens (see Credentials) once it
+// is running, and vends fresh tokens before they expire, until the
+// machine stops.
+func (m *Machine) vendCredentials(b *B) {
+	ttl := m.credentials.TTL
+	if ttl <= 0 {
+		ttl = defaultCredentialTTL
+	}
+	stopped := m.Wait(Stopped)
+	if state, _ := m.WaitFor(context.Background(), Running, Stopped); state == Stopped {
+		return
+	}
+	for {
+		tokens := make(map[string]string)
+		for _, scope := range m.credentials.Scopes {
+			tokens[scope] = b.VendToken(scope, ttl)
+		}
+		next := ttl / 2
+		ctx, cancel := context.WithTimeout(context.Background(), next)
+		err := m.RetryCall(ctx, "Supervisor.SetTokens", tokens, nil)
+		cancel()
+		if err != nil {
+			log.Error.Printf("%s: vending credentials: %v", m.Name(), err)
+			next = time.Second
+		}
+		select {
+		case <-time.After(next):
+		case <-stopped:
+			return
+		}
+	}
+}
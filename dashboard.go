@@ -0,0 +1,390 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/data"
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// DashboardRefresh is the default interval at which the dashboard
+	// reloads itself.
+	dashboardRefresh = 10 * time.Second
+	// DashboardHistory is the number of samples of the cluster's
+	// state that are retained for the dashboard's graphs.
+	dashboardHistory = 360
+	// DefaultOutputBytes is the amount of a machine's recent log
+	// output that is served by default.
+	defaultOutputBytes = 64 << 10
+)
+
+// A dashboardRow is the row of a machine in the dashboard's table.
+type dashboardRow struct {
+	Name, Addr string
+	State      State
+	// Running tells whether the machine is running, and thus whether
+	// its output, description, and profiles may be retrieved.
+	Running bool
+	Uptime  time.Duration
+	// Keepalive is the latency of the machine's most recent keepalive,
+	// if any.
+	Keepalive time.Duration
+	// Usage tells whether the machine's memory, disk, and load are
+	// known.
+	Usage                bool
+	MemUsed, MemTotal    uint64
+	MemPercent           float64
+	DiskUsed, DiskTotal  uint64
+	DiskPercent          float64
+	Load1, Load5, Load15 float64
+	// Err is the machine's error, if it is stopped, or the error with
+	// which its usage could not be retrieved.
+	Err string
+}
+
+// A dashboardSample is a sample of the cluster's state, as graphed by
+// the dashboard.
+type dashboardSample struct {
+	Time time.Time
+	// Running is the number of running machines.
+	Running int
+	// Load is the sum of the 1-minute load averages of the running
+	// machines, and MemPercent the percentage of their total memory
+	// that is used.
+	Load       float64
+	MemPercent float64
+}
+
+// A dashboardSamples retains the most recent samples of the cluster's
+// state.
+type dashboardSamples struct {
+	mu      sync.Mutex
+	samples []dashboardSample
+}
+
+// Add records a sample, dropping the oldest sample once
+// dashboardHistory samples are retained.
+func (s *dashboardSamples) add(sample dashboardSample) []dashboardSample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.samples) == dashboardHistory {
+		s.samples = append(s.samples[:0], s.samples[1:]...)
+	}
+	s.samples = append(s.samples, sample)
+	return append([]dashboardSample(nil), s.samples...)
+}
+
+// dashboardSorts are the keys by which the dashboard's table may be
+// sorted, and the corresponding orders.
+var dashboardSorts = map[string]func(a, b *dashboardRow) bool{
+	"name":      func(a, b *dashboardRow) bool { return a.Name < b.Name },
+	"state":     func(a, b *dashboardRow) bool { return a.State < b.State },
+	"uptime":    func(a, b *dashboardRow) bool { return a.Uptime < b.Uptime },
+	"keepalive": func(a, b *dashboardRow) bool { return a.Keepalive < b.Keepalive },
+	"memory":    func(a, b *dashboardRow) bool { return a.MemPercent < b.MemPercent },
+	"disk":      func(a, b *dashboardRow) bool { return a.DiskPercent < b.DiskPercent },
+	"load":      func(a, b *dashboardRow) bool { return a.Load1 < b.Load1 },
+	"error":     func(a, b *dashboardRow) bool { return a.Err < b.Err },
+}
+
+// DashboardHandler implements an HTTP handler that serves an HTML
+// dashboard of the B's cluster, for use during incidents: a table of
+// its machines, with their state, uptime, keepalive latency, memory,
+// disk, load, and error, linked to their log output, descriptions,
+// and profiles; and graphs of the number of running machines and of
+// their total load and memory usage. The handler takes the following
+// parameters:
+//
+//	sort     the column by which the table is sorted (default "name")
+//	desc     if nonzero, sort in descending order
+//	refresh  the interval, in seconds, at which the page reloads
+//	         (default 10; 0 disables reloading)
+//
+// The graphs are sampled each time the dashboard is rendered, so they
+// cover the period during which it is viewed.
+type dashboardHandler struct{ *B }
+
+func (h *dashboardHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.FormValue("sort")
+	less, ok := dashboardSorts[key]
+	if !ok {
+		key, less = "name", dashboardSorts["name"]
+	}
+	desc, _ := strconv.Atoi(r.FormValue("desc"))
+	refresh := int(dashboardRefresh / time.Second)
+	if v := r.FormValue("refresh"); v != "" {
+		refresh, _ = strconv.Atoi(v)
+	}
+
+	machines := h.Machines()
+	infos := make([]machineInfo, len(machines))
+	g, ctx := errgroup.WithContext(r.Context())
+	for i, m := range machines {
+		if state := m.State(); state != Running {
+			infos[i].err = fmt.Errorf("machine state %s", state)
+			continue
+		}
+		i, m := i, m
+		g.Go(func() error {
+			infos[i] = allInfo(ctx, m)
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	var (
+		now               = time.Now()
+		rows              = make([]*dashboardRow, len(machines))
+		sample            = dashboardSample{Time: now}
+		memUsed, memTotal uint64
+		counts            = make(map[State]int)
+	)
+	for i, m := range machines {
+		row := &dashboardRow{Name: m.Name(), Addr: m.Addr, State: m.State()}
+		row.Running = row.State == Running
+		counts[row.State]++
+		switch row.State {
+		case Starting, Running:
+			row.Uptime = now.Sub(m.StartTime())
+		case Stopped:
+			row.Uptime = m.StopTime().Sub(m.StartTime())
+			if err := m.Err(); err != nil {
+				row.Err = err.Error()
+			}
+		}
+		row.Uptime -= row.Uptime % time.Second
+		if times := m.KeepaliveReplyTimes(); len(times) > 0 {
+			row.Keepalive = times[0] - times[0]%time.Millisecond
+		}
+		if info := infos[i]; info.err == nil {
+			row.Usage = true
+			row.MemUsed, row.MemTotal = info.MemInfo.System.Used, info.MemInfo.System.Total
+			row.MemPercent = info.MemInfo.System.UsedPercent
+			row.DiskUsed, row.DiskTotal = info.DiskInfo.Usage.Used, info.DiskInfo.Usage.Total
+			row.DiskPercent = info.DiskInfo.Usage.UsedPercent
+			avg := info.LoadInfo.Averages
+			row.Load1, row.Load5, row.Load15 = avg.Load1, avg.Load5, avg.Load15
+			sample.Load += avg.Load1
+			memUsed += row.MemUsed
+			memTotal += row.MemTotal
+		} else if row.Running {
+			row.Err = info.err.Error()
+		}
+		rows[i] = row
+	}
+	sample.Running = counts[Running]
+	if memTotal > 0 {
+		sample.MemPercent = 100 * float64(memUsed) / float64(memTotal)
+	}
+	samples := h.dashboard.add(sample)
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		if desc != 0 {
+			return less(rows[j], rows[i])
+		}
+		return less(rows[i], rows[j])
+	})
+	var (
+		running  = make([]float64, len(samples))
+		load     = make([]float64, len(samples))
+		memory   = make([]float64, len(samples))
+		stateStr []string
+	)
+	for i, s := range samples {
+		running[i], load[i], memory[i] = float64(s.Running), s.Load, s.MemPercent
+	}
+	for _, state := range []State{Unstarted, Starting, Running, Stopped} {
+		stateStr = append(stateStr, fmt.Sprintf("%d %s", counts[state], strings.ToLower(state.String())))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := dashboardTemplate.Execute(w, map[string]interface{}{
+		"Name":    h.name,
+		"Time":    now.Format(time.RFC3339),
+		"Refresh": refresh,
+		"Sort":    key,
+		"Desc":    desc != 0,
+		"Rows":    rows,
+		"States":  strings.Join(stateStr, ", "),
+		"Graphs": []struct {
+			Title  string
+			Values []float64
+		}{
+			{"running machines", running},
+			{"total load (1m)", load},
+			{"memory used (%)", memory},
+		},
+	})
+	if err != nil {
+		log.Error.Printf("dashboard: %v", err)
+	}
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").
+	Funcs(template.FuncMap{
+		"human": func(v uint64) string { return data.Size(v).String() },
+		"sortlink": func(current string, desc bool, key string) string {
+			if key == current && !desc {
+				return "?sort=" + key + "&desc=1"
+			}
+			return "?sort=" + key
+		},
+		"graph": graphSVG,
+	}).
+	Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>bigmachine {{.Name}}</title>
+{{if .Refresh}}<meta http-equiv="refresh" content="{{.Refresh}}">{{end}}
+<style>
+body { font-family: sans-serif; font-size: 13px; }
+table { border-collapse: collapse; }
+th, td { padding: 2px 8px; text-align: right; border-bottom: 1px solid #ddd; }
+th:first-child, td:first-child, td.err { text-align: left; }
+td.err { color: #b00; max-width: 40em; overflow-wrap: anywhere; }
+.graph { display: inline-block; margin-right: 24px; }
+polyline { fill: none; stroke: #36c; stroke-width: 1.5; }
+</style>
+</head>
+<body>
+<h2>bigmachine {{.Name}}</h2>
+<p>{{.Time}}: {{len .Rows}} machines ({{.States}})
+&middot; <a href="status">status</a>
+&middot; <a href="metrics">metrics</a>
+&middot; <a href="panics">panics</a>
+&middot; <a href="cost">cost</a>
+&middot; <a href="pprof/">profiles</a></p>
+<div>
+{{range .Graphs}}<div class="graph"><div>{{.Title}}</div>{{graph .Values}}</div>
+{{end}}</div>
+<table>
+<tr>
+<th><a href="{{sortlink $.Sort $.Desc "name"}}">machine</a></th>
+<th><a href="{{sortlink $.Sort $.Desc "state"}}">state</a></th>
+<th><a href="{{sortlink $.Sort $.Desc "uptime"}}">uptime</a></th>
+<th><a href="{{sortlink $.Sort $.Desc "keepalive"}}">keepalive</a></th>
+<th><a href="{{sortlink $.Sort $.Desc "memory"}}">memory</a></th>
+<th><a href="{{sortlink $.Sort $.Desc "disk"}}">disk</a></th>
+<th><a href="{{sortlink $.Sort $.Desc "load"}}">load</a></th>
+<th><a href="{{sortlink $.Sort $.Desc "error"}}">error</a></th>
+<th></th>
+</tr>
+{{range .Rows}}<tr>
+<td>{{.Name}}{{if ne .Name .Addr}}<br><small>{{.Addr}}</small>{{end}}</td>
+<td>{{.State}}</td>
+<td>{{.Uptime}}</td>
+<td>{{if .Keepalive}}{{.Keepalive}}{{end}}</td>
+{{if .Usage}}<td>{{human .MemUsed}} / {{human .MemTotal}} ({{printf "%.1f%%" .MemPercent}})</td>
+<td>{{human .DiskUsed}} / {{human .DiskTotal}} ({{printf "%.1f%%" .DiskPercent}})</td>
+<td>{{printf "%.2f %.2f %.2f" .Load1 .Load5 .Load15}}</td>
+{{else}}<td></td><td></td><td></td>
+{{end}}<td class="err">{{.Err}}</td>
+<td>{{if .Running}}<a href="output?machine={{.Name}}">output</a>
+<a href="describe?machine={{.Name}}">describe</a>
+<a href="profile?machines={{.Addr}}&amp;which=heap&amp;debug=1">heap</a>
+<a href="profile?machines={{.Addr}}&amp;which=goroutine&amp;debug=1">goroutines</a>
+<a href="profile?machines={{.Addr}}&amp;seconds=30">cpu</a>{{end}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// GraphSVG renders the provided values as an SVG line graph, labeled
+// by the maximum value.
+func graphSVG(values []float64) template.HTML {
+	const width, height = 300, 60
+	var max float64
+	for _, v := range values {
+		if v > max {
+			max = v
+		}
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg width="%d" height="%d" viewBox="0 0 %d %d"><rect width="%d" height="%d" fill="#f6f6f6"/>`,
+		width, height+12, width, height+12, width, height)
+	if len(values) > 0 {
+		b.WriteString(`<polyline points="`)
+		for i, v := range values {
+			x := float64(width)
+			if len(values) > 1 {
+				x = float64(i) * width / float64(len(values)-1)
+			}
+			y := float64(height)
+			if max > 0 {
+				y -= v / max * height
+			}
+			fmt.Fprintf(&b, "%.1f,%.1f ", x, y)
+		}
+		b.WriteString(`"/>`)
+	}
+	fmt.Fprintf(&b, `<text x="0" y="%d" font-size="10">max %.4g, now %.4g</text></svg>`, height+11, max, last(values))
+	return template.HTML(b.String())
+}
+
+// Last returns the last of the provided values, or zero.
+func last(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	return values[len(values)-1]
+}
+
+// OutputHandler implements an HTTP handler that serves the recent log
+// output of a running machine (see Machine.TailRange). The handler
+// takes the following parameters:
+//
+//	machine  the name or address of the machine
+//	bytes    the amount of output to serve (default 64KiB)
+type outputHandler struct{ *B }
+
+func (h *outputHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("machine")
+	var machine *Machine
+	for _, m := range h.Machines() {
+		if name == m.Name() || name == m.Addr {
+			machine = m
+			break
+		}
+	}
+	if machine == nil {
+		http.Error(w, fmt.Sprintf("machine %q not found", name), http.StatusNotFound)
+		return
+	}
+	n := int64(defaultOutputBytes)
+	if v := r.FormValue("bytes"); v != "" {
+		var err error
+		if n, err = strconv.ParseInt(v, 10, 64); err != nil || n <= 0 {
+			http.Error(w, fmt.Sprintf("invalid bytes %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	rc, _, err := machine.TailRange(r.Context(), -n, 0)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(errors.NotSupported, err) || errors.Is(errors.Remote, err) && errors.Is(errors.NotSupported, errors.Recover(err).Err) {
+			code = http.StatusNotImplemented
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := io.Copy(w, rc); err != nil {
+		log.Error.Printf("%s: output: %v", machine.Name(), err)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/log"
+	"github.com/shirou/gopsutil/mem"
+)
+
+// A Description describes the effective configuration of a machine's
+// process, as reported by its supervisor (see Machine.Describe), so
+// that differences between machines may be diagnosed without logging
+// into them. Values of environment variables whose names suggest that
+// they hold secrets are scrubbed, as in provenance records (see
+// Provenance).
+type Description struct {
+	// Info is the machine's system information, including the digest
+	// of its binary and its tmpfs mounts.
+	Info Info
+	// GoVersion is the version of Go with which the binary was built.
+	GoVersion string
+	// Hostname is the machine's host name, and Pid is the process's ID.
+	Hostname string
+	Pid      int
+	// Start is the time at which the process started.
+	Start time.Time
+	// NumCPU and GOMAXPROCS are the number of the machine's CPUs and
+	// the number that the process uses.
+	NumCPU, GOMAXPROCS int
+	// Args and Environ are the process's (scrubbed) arguments and
+	// environment.
+	Args, Environ []string
+	// Services are the services registered with the supervisor.
+	Services []ServiceDescription
+	// ResourceLimits are the limits of the process's cgroup, if it was
+	// confined by a ResourceLimits parameter.
+	ResourceLimits *ResourceLimits `json:",omitempty"`
+	// SwapTotal is the amount of swap space, in bytes, available to
+	// the machine (see Swap).
+	SwapTotal uint64
+	// MemoryWatchdog is the machine's memory watchdog, if any.
+	MemoryWatchdog *MemoryWatchdog `json:",omitempty"`
+	// DiskWatchdog describes the volumes monitored for disk pressure,
+	// including the default ones, and the effective threshold.
+	DiskWatchdog *DiskWatchdog `json:",omitempty"`
+}
+
+// A ServiceDescription describes a service registered with a
+// machine's supervisor.
+type ServiceDescription struct {
+	// Name is the service's name and Type the name of its type.
+	Name, Type string
+	// Version is the service's version, if it declares one (see
+	// rpc.Versioned).
+	Version string `json:",omitempty"`
+}
+
+// Describe returns the effective configuration of the machine.
+func (m *Machine) Describe(ctx context.Context) (Description, error) {
+	var d Description
+	err := m.RetryCall(ctx, "Supervisor.Describe", struct{}{}, &d)
+	return d, err
+}
+
+// Describe describes the effective configuration of the process (see
+// Machine.Describe).
+func (s *Supervisor) Describe(ctx context.Context, _ struct{}, d *Description) error {
+	d.Info = LocalInfo()
+	d.GoVersion = runtime.Version()
+	d.Hostname, _ = os.Hostname()
+	d.Pid = os.Getpid()
+	d.Start = startTime
+	d.NumCPU = runtime.NumCPU()
+	d.GOMAXPROCS = runtime.GOMAXPROCS(0)
+	d.Args = append([]string{}, os.Args...)
+	d.Environ = scrubEnviron(os.Environ())
+	for _, svc := range s.server.Services() {
+		d.Services = append(d.Services, ServiceDescription{Name: svc.Name, Type: svc.Type, Version: svc.Version})
+	}
+	sort.Slice(d.Services, func(i, j int) bool {
+		return d.Services[i].Name < d.Services[j].Name
+	})
+	var err error
+	if d.ResourceLimits, err = currentCgroupLimits(cgroupName); err != nil {
+		log.Error.Printf("Supervisor.Describe: resource limits: %v", err)
+	}
+	if swap, err := mem.SwapMemory(); err == nil {
+		d.SwapTotal = swap.Total
+	}
+	s.memWatchMu.Lock()
+	d.MemoryWatchdog = s.memWatchdog
+	s.memWatchMu.Unlock()
+	paths, threshold := s.diskVolumes()
+	d.DiskWatchdog = &DiskWatchdog{Paths: paths, Threshold: threshold}
+	return nil
+}
+
+// DescribeHandler serves the descriptions of a B's running machines
+// (see Machine.Describe) as JSON, keyed by machine name. The
+// parameter "machine" selects a single machine.
+type describeHandler struct{ *B }
+
+func (h *describeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var machines []*Machine
+	for _, m := range h.Machines() {
+		if name := r.FormValue("machine"); name != "" && name != m.Name() && name != m.Addr {
+			continue
+		}
+		if m.State() == Running {
+			machines = append(machines, m)
+		}
+	}
+	type result struct {
+		Description *Description `json:",omitempty"`
+		Error       string       `json:",omitempty"`
+	}
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]result)
+	)
+	for _, m := range machines {
+		wg.Add(1)
+		go func(m *Machine) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+			d, err := m.Describe(ctx)
+			cancel()
+			var res result
+			if err != nil {
+				res.Error = err.Error()
+			} else {
+				res.Description = &d
+			}
+			mu.Lock()
+			results[m.Name()] = res
+			mu.Unlock()
+		}(m)
+	}
+	wg.Wait()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(results); err != nil {
+		log.Error.Printf("describe: %v", err)
+	}
+}
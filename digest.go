@@ -0,0 +1,202 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"bytes"
+	"crypto"
+	"debug/elf"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/base/fatbin"
+)
+
+// A ByteRange is a range of bytes in a binary.
+type ByteRange struct {
+	// Off is the offset of the first byte in the range.
+	Off int64
+	// Len is the number of bytes in the range.
+	Len int64
+}
+
+// A DigestPolicy determines how the identity of a binary is
+// computed: binaries with the same identity have the same digest, as
+// reported by Info.Digest. By default, binaries are identified by
+// the SHA-256 digest of their full contents. In environments with
+// reproducible builds, excluding nondeterministic parts of binaries
+// (such as build IDs or timestamps) from their identity allows
+// binaries built separately from the same sources to be identified.
+type DigestPolicy struct {
+	// Digester is the digest algorithm used to compute digests. It
+	// defaults to SHA-256.
+	Digester digest.Digester
+	// StripBuildID excludes build IDs from the identity of ELF
+	// binaries: the contents of their Go (.note.go.buildid) and GNU
+	// (.note.gnu.build-id) build ID notes are not digested.
+	StripBuildID bool
+	// Exclude, if not nil, returns additional ranges of the provided
+	// binary, whose size is given, that are excluded from its
+	// identity: for example, ranges that contain timestamps.
+	Exclude func(r io.ReaderAt, size int64) ([]ByteRange, error)
+}
+
+// DefaultDigestPolicy is the digest policy used unless one is set by
+// SetDigestPolicy.
+var defaultDigestPolicy = DigestPolicy{Digester: digest.Digester(crypto.SHA256)}
+
+var digestPolicy = defaultDigestPolicy
+
+// SetDigestPolicy sets the policy by which the identity of binaries
+// is computed. Since the policy must be the same in driver and
+// machine processes, it should be set at program initialization
+// (for example, in an init function, or in main before calling
+// driver.Start); it must be set before the first call to LocalInfo.
+func SetDigestPolicy(policy DigestPolicy) {
+	if policy.Digester == 0 {
+		policy.Digester = defaultDigestPolicy.Digester
+	}
+	digestPolicy = policy
+}
+
+// Digest computes the digest of the binary read from r, which has
+// the provided size. Excluded ranges are replaced by zeros. Build IDs
+// and ranges returned by p.Exclude are excluded only if r is also an
+// io.ReaderAt.
+func (p DigestPolicy) digest(r io.Reader, size int64) (digest.Digest, error) {
+	var excluded []ByteRange
+	if ra, ok := r.(io.ReaderAt); ok {
+		if p.StripBuildID {
+			excluded = append(excluded, elfBuildIDs(ra)...)
+		}
+		if p.Exclude != nil {
+			ranges, err := p.Exclude(ra, size)
+			if err != nil {
+				return digest.Digest{}, err
+			}
+			excluded = append(excluded, ranges...)
+		}
+	}
+	sort.Slice(excluded, func(i, j int) bool {
+		return excluded[i].Off < excluded[j].Off
+	})
+	w := p.Digester.NewWriter()
+	if _, err := io.Copy(w, &maskReader{r: r, excluded: excluded}); err != nil {
+		return digest.Digest{}, err
+	}
+	return w.Digest(), nil
+}
+
+// An imageKey identifies a binary image.
+type imageKey struct {
+	bin          *fatbin.Reader
+	goos, goarch string
+}
+
+// imageDigests caches the digests computed by cachedImageDigest,
+// keyed by image.
+var (
+	imageDigestsMu sync.Mutex
+	imageDigests   = make(map[imageKey]digest.Digest)
+)
+
+// ImageDigest returns the digest of the driver's binary image for the
+// provided OS and architecture, as reported by machines that run the
+// image (see Info.Digest). Image digests are cached.
+func imageDigest(goos, goarch string) (digest.Digest, error) {
+	self, err := fatbin.Self()
+	if err != nil {
+		return digest.Digest{}, err
+	}
+	return cachedImageDigest(self, goos, goarch)
+}
+
+// CachedImageDigest returns the digest of the provided binary's image
+// for the provided OS and architecture (see binaryImageDigest),
+// caching it.
+func cachedImageDigest(bin *fatbin.Reader, goos, goarch string) (digest.Digest, error) {
+	key := imageKey{bin, goos, goarch}
+	imageDigestsMu.Lock()
+	defer imageDigestsMu.Unlock()
+	if d, ok := imageDigests[key]; ok {
+		return d, nil
+	}
+	d, err := binaryImageDigest(bin, goos, goarch)
+	if err != nil {
+		return digest.Digest{}, err
+	}
+	imageDigests[key] = d
+	return d, nil
+}
+
+// BinaryImageDigest returns the digest of the provided binary's image
+// for the provided OS and architecture, as reported by machines that
+// run the image.
+func binaryImageDigest(bin *fatbin.Reader, goos, goarch string) (digest.Digest, error) {
+	rc, err := bin.Open(goos, goarch)
+	if err != nil {
+		return digest.Digest{}, err
+	}
+	defer rc.Close()
+	// Read the image into memory so that excluded ranges, which
+	// require an io.ReaderAt, are computed as they are on machines.
+	image, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return digest.Digest{}, err
+	}
+	return digestPolicy.digest(bytes.NewReader(image), int64(len(image)))
+}
+
+// ElfBuildIDs returns the ranges of the build ID notes of the ELF
+// binary read from r. It returns nil if r is not an ELF binary.
+func elfBuildIDs(r io.ReaderAt) []ByteRange {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil
+	}
+	var ranges []ByteRange
+	for _, name := range []string{".note.go.buildid", ".note.gnu.build-id"} {
+		if s := f.Section(name); s != nil && s.Type != elf.SHT_NOBITS {
+			ranges = append(ranges, ByteRange{int64(s.Offset), int64(s.Size)})
+		}
+	}
+	return ranges
+}
+
+// A maskReader reads from an underlying reader, replacing the bytes
+// in a set of excluded ranges, ordered by offset, with zeros.
+type maskReader struct {
+	r        io.Reader
+	off      int64
+	excluded []ByteRange
+}
+
+// Read implements io.Reader.
+func (m *maskReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	for _, x := range m.excluded {
+		start, end := x.Off-m.off, x.Off+x.Len-m.off
+		if end <= 0 {
+			continue
+		}
+		if start >= int64(n) {
+			break
+		}
+		if start < 0 {
+			start = 0
+		}
+		if end > int64(n) {
+			end = int64(n)
+		}
+		for i := start; i < end; i++ {
+			p[i] = 0
+		}
+	}
+	m.off += int64(n)
+	return n, err
+}
@@ -0,0 +1,178 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+	"github.com/shirou/gopsutil/disk"
+)
+
+// DefaultDiskThreshold is the percentage of a volume's space in use
+// above which a machine is marked unhealthy, unless a DiskWatchdog
+// parameter provides another threshold.
+const defaultDiskThreshold = 95
+
+// DiskUsage returns the usage of the volume on which the provided path
+// resides. It is a variable so that it may be overridden in tests.
+var diskUsage = disk.Usage
+
+// A DiskCleaner is a service that can free disk space when its
+// machine's volumes are nearly full. Services that implement
+// DiskCleaner are invoked by their machine's supervisor when the usage
+// of a monitored volume exceeds its threshold (see DiskWatchdog),
+// before the machine is marked unhealthy.
+type DiskCleaner interface {
+	// CleanupDisk frees space on the volume on which the provided path
+	// resides, for example by removing temporary files or evicting
+	// caches.
+	CleanupDisk(ctx context.Context, path string) error
+}
+
+// DiskWatchdog is a machine parameter that configures the machine's
+// disk-pressure monitoring. Supervisors monitor the usage of the
+// volumes on which the root directory and the temporary directory
+// reside, by default marking the machine unhealthy (see
+// Machine.Healthy) while either is more than 95% full, so that
+// workers do not fail with ENOSPC deep inside user code without
+// warning. Before a machine is marked unhealthy, its DiskCleaner
+// services are asked to free space. Monitored volumes are reported by
+// Machine.DiskInfo.
+type DiskWatchdog struct {
+	// Paths are the paths of additional volumes to monitor, for
+	// example data volumes.
+	Paths []string
+	// Threshold is the percentage of a volume's space in use above
+	// which the machine is unhealthy. It defaults to 95.
+	Threshold float64
+}
+
+func (w DiskWatchdog) applyParam(m *Machine) {
+	m.diskWatchdog = &w
+}
+
+// SetDiskWatchdog configures the supervisor's disk-pressure
+// monitoring, and checks disk usage immediately.
+func (s *Supervisor) SetDiskWatchdog(ctx context.Context, w DiskWatchdog, _ *struct{}) error {
+	s.diskMu.Lock()
+	s.diskWatchdog = w
+	s.diskMu.Unlock()
+	s.checkDisk(ctx)
+	return nil
+}
+
+// DiskVolumes returns the (sorted, distinct) paths of the volumes
+// monitored by the supervisor, together with the usage threshold.
+func (s *Supervisor) diskVolumes() (paths []string, threshold float64) {
+	s.diskMu.Lock()
+	w := s.diskWatchdog
+	s.diskMu.Unlock()
+	threshold = w.Threshold
+	if threshold <= 0 {
+		threshold = defaultDiskThreshold
+	}
+	seen := make(map[string]bool)
+	for _, path := range append([]string{"/", os.TempDir()}, w.Paths...) {
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths, threshold
+}
+
+// DiskVolumeUsage returns the usage of the volumes monitored by the
+// supervisor.
+func (s *Supervisor) diskVolumeUsage() ([]disk.UsageStat, error) {
+	paths, _ := s.diskVolumes()
+	volumes := make([]disk.UsageStat, len(paths))
+	for i, path := range paths {
+		usage, err := diskUsage(path)
+		if err != nil {
+			return nil, err
+		}
+		volumes[i] = *usage
+	}
+	return volumes, nil
+}
+
+// CheckDisk checks the usage of the volumes monitored by the
+// supervisor. Volumes above the usage threshold are cleaned up by the
+// supervisor's DiskCleaner services; those that remain above the
+// threshold render the machine unhealthy.
+func (s *Supervisor) checkDisk(ctx context.Context) {
+	paths, threshold := s.diskVolumes()
+	var problems []string
+	for _, path := range paths {
+		usage, err := diskUsage(path)
+		if err != nil {
+			// In the case of error, we don't change health status.
+			log.Error.Printf("disk usage %s: %v", path, err)
+			return
+		}
+		if usage.UsedPercent <= threshold {
+			continue
+		}
+		log.Error.Printf("disk %s is %.1f%% full; cleaning up", path, usage.UsedPercent)
+		s.cleanupDisk(ctx, path)
+		if usage, err = diskUsage(path); err != nil {
+			log.Error.Printf("disk usage %s: %v", path, err)
+			return
+		}
+		if usage.UsedPercent > threshold {
+			problems = append(problems, fmt.Sprintf("disk %s is %.1f%% full (threshold %.1f%%)", path, usage.UsedPercent, threshold))
+		}
+	}
+	var err error
+	if len(problems) > 0 {
+		err = errors.E(errors.Unavailable, strings.Join(problems, "; "))
+	}
+	s.diskMu.Lock()
+	if err != nil && s.diskErr == nil {
+		log.Error.Printf("marking machine unhealthy: %v", err)
+	} else if err == nil && s.diskErr != nil {
+		log.Printf("disk usage is below threshold; marking machine healthy")
+	}
+	s.diskErr = err
+	s.diskMu.Unlock()
+}
+
+// CleanupDisk invokes the supervisor's DiskCleaner services to free
+// space on the volume on which path resides.
+func (s *Supervisor) cleanupDisk(ctx context.Context, path string) {
+	cleaners := make(map[string]DiskCleaner)
+	s.servicesMu.Lock()
+	for name, iface := range s.services {
+		if cleaner, ok := iface.(DiskCleaner); ok {
+			cleaners[name] = cleaner
+		}
+	}
+	s.servicesMu.Unlock()
+	names := make([]string, 0, len(cleaners))
+	for name := range cleaners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := cleaners[name].CleanupDisk(ctx, path); err != nil {
+			log.Error.Printf("disk cleanup %s: %s: %v", path, name, err)
+		}
+	}
+}
+
+// DiskError returns an error describing the volumes that are above
+// their usage threshold, or nil if there are none.
+func (s *Supervisor) diskError() error {
+	s.diskMu.Lock()
+	defer s.diskMu.Unlock()
+	return s.diskErr
+}
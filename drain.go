@@ -0,0 +1,151 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+)
+
+// A Drainer is a service that is notified when its machine is
+// drained (see Machine.Drain), for example to flush buffered state or
+// to stop accepting work from sources other than the driver.
+type Drainer interface {
+	// Drain prepares the service for its machine to be shut down.
+	Drain(ctx context.Context) error
+}
+
+// Drain gracefully shuts down the machine m: the machine is marked as
+// draining, so that it accepts no new calls (see Machine.Draining);
+// the Drain methods of its services that implement Drainer are
+// invoked; calls in flight are allowed to complete; and finally the
+// machine is shut down and stopped. Drain returns an error if the
+// machine could not be drained before the provided context is done,
+// in which case the machine is left draining, but not stopped.
+func (m *Machine) Drain(ctx context.Context) error {
+	if m.State() != Running {
+		return errors.E(errors.Precondition, fmt.Sprintf("machine %s is not running", m.Addr))
+	}
+	drained := m.beginDrain()
+	m.emit(MachineDraining, nil, "")
+	log.Printf("%s: draining", m.Name())
+	if err := m.call(ctx, "Supervisor.Drain", struct{}{}, nil); err != nil {
+		return errors.E(fmt.Sprintf("drain %s", m.Name()), err)
+	}
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return errors.E(fmt.Sprintf("drain %s: waiting for calls in flight", m.Name()), ctx.Err())
+	}
+	err := m.call(ctx, "Supervisor.Shutdown", shutdownRequest{Message: string(logSyncMarker)}, nil)
+	if err != nil {
+		return errors.E(fmt.Sprintf("drain %s: shutdown", m.Name()), err)
+	}
+	// Wait for the machine's log output to be flushed, which indicates
+	// that it has exited.
+	if m.tailDone != nil {
+		select {
+		case <-m.tailDone:
+		case <-ctx.Done():
+			log.Error.Printf("%s: waiting for log to propagate: %v", m.Name(), ctx.Err())
+		}
+	}
+	m.Cancel()
+	<-m.Wait(Stopped)
+	return nil
+}
+
+// BeginDrain marks the machine as draining, so that it accepts no new
+// calls. The returned channel is closed once no calls are in flight.
+func (m *Machine) beginDrain() <-chan struct{} {
+	m.mu.Lock()
+	if !m.draining {
+		m.draining = true
+		m.drained = make(chan struct{})
+		if m.inflight == 0 {
+			close(m.drained)
+		}
+	}
+	drained := m.drained
+	m.mu.Unlock()
+	m.changed(m)
+	return drained
+}
+
+// EndDrain marks a draining machine as accepting calls again.
+func (m *Machine) endDrain() {
+	m.mu.Lock()
+	m.draining = false
+	m.drained = nil
+	m.mu.Unlock()
+	m.changed(m)
+}
+
+// Draining tells whether the machine is draining (see Machine.Drain).
+// Draining machines accept no new calls.
+func (m *Machine) Draining() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.draining
+}
+
+// BeginCall registers a call to the machine. It returns an error if
+// the machine is draining.
+func (m *Machine) beginCall() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.draining {
+		return errors.E(errors.Unavailable, fmt.Sprintf("machine %s is draining", m.Addr))
+	}
+	m.inflight++
+	m.lastCall = time.Now()
+	return nil
+}
+
+// EndCall unregisters a call registered by beginCall.
+func (m *Machine) endCall() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inflight--
+	m.lastCall = time.Now()
+	if m.draining && m.inflight == 0 {
+		close(m.drained)
+	}
+}
+
+// Drain invokes the Drain methods of the supervisor's services that
+// implement Drainer. The returned error lists the services whose Drain
+// methods failed.
+func (s *Supervisor) Drain(ctx context.Context, _ struct{}, _ *struct{}) error {
+	s.servicesMu.Lock()
+	drainers := make(map[string]Drainer)
+	for name, iface := range s.services {
+		if drainer, ok := iface.(Drainer); ok {
+			drainers[name] = drainer
+		}
+	}
+	s.servicesMu.Unlock()
+	names := make([]string, 0, len(drainers))
+	for name := range drainers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var problems []string
+	for _, name := range names {
+		if err := drainers[name].Drain(ctx); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.E("drain", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2system
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/retry"
+	"github.com/grailbio/bigmachine"
+)
+
+// groupPollPolicy is the policy with which the system polls its auto
+// scaling group for instances to adopt.
+var groupPollPolicy = retry.MaxTries(retry.Backoff(5*time.Second, 30*time.Second, 1.5), 40)
+
+// UserData returns the base64-encoded cloud-config user data with
+// which the system boots its instances. Launch templates of auto
+// scaling groups used by the system (see AutoScalingGroup) must
+// provide this user data. Init must be called first.
+func (s *System) UserData() (string, error) {
+	userData, err := s.cloudConfig(s.config).Marshal()
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal cloud-config: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(userData), nil
+}
+
+// startGroup starts count machines by raising the desired capacity of
+// the system's auto scaling group by count, and adopting the
+// instances that the group launches once they are in service.
+func (s *System) startGroup(ctx context.Context, count int) ([]*bigmachine.Machine, error) {
+	s.asgMu.Lock()
+	defer s.asgMu.Unlock()
+	group, err := s.describeGroup(ctx)
+	if err != nil {
+		return nil, err
+	}
+	desired := aws.Int64Value(group.DesiredCapacity) + int64(count)
+	if max := aws.Int64Value(group.MaxSize); desired > max {
+		return nil, errors.E(errors.Unavailable,
+			fmt.Sprintf("auto scaling group %s: desired capacity %d exceeds maximum size %d", s.AutoScalingGroup, desired, max))
+	}
+	_, err = s.asg.SetDesiredCapacityWithContext(ctx, &autoscaling.SetDesiredCapacityInput{
+		AutoScalingGroupName: aws.String(s.AutoScalingGroup),
+		DesiredCapacity:      aws.Int64(desired),
+		HonorCooldown:        aws.Bool(false),
+	})
+	if err != nil {
+		return nil, errors.E(fmt.Sprintf("auto scaling group %s: set desired capacity %d", s.AutoScalingGroup, desired), err)
+	}
+	// Instances that are in service but not adopted were launched
+	// independently of the system (or by a previous session) and are
+	// left alone.
+	existing := make(map[string]bool)
+	for _, instance := range group.Instances {
+		existing[aws.StringValue(instance.InstanceId)] = true
+	}
+	var ids []string
+	for retries := 0; ; retries++ {
+		ids = ids[:0]
+		s.mu.Lock()
+		for _, instance := range group.Instances {
+			id := aws.StringValue(instance.InstanceId)
+			if existing[id] || s.adopted[id] || aws.StringValue(instance.LifecycleState) != autoscaling.LifecycleStateInService {
+				continue
+			}
+			ids = append(ids, id)
+		}
+		s.mu.Unlock()
+		if len(ids) >= count {
+			ids = ids[:count]
+			break
+		}
+		if err = retry.Wait(ctx, groupPollPolicy, retries); err != nil {
+			return nil, errors.E(fmt.Sprintf("auto scaling group %s: waiting for %d instances (%d in service)", s.AutoScalingGroup, count, len(ids)), err)
+		}
+		if group, err = s.describeGroup(ctx); err != nil {
+			return nil, err
+		}
+	}
+	describe, err := s.ec2.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: aws.StringSlice(ids),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var (
+		machines    []*bigmachine.Machine
+		instanceIDs []string
+	)
+	for _, reserv := range describe.Reservations {
+		for _, instance := range reserv.Instances {
+			m, err := s.instanceMachine(instance)
+			if err != nil {
+				return nil, err
+			}
+			machines = append(machines, m)
+			instanceIDs = append(instanceIDs, aws.StringValue(instance.InstanceId))
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.instanceIDs == nil {
+		s.instanceIDs = make(map[*bigmachine.Machine]string)
+	}
+	if s.adopted == nil {
+		s.adopted = make(map[string]bool)
+	}
+	for i, m := range machines {
+		id := instanceIDs[i]
+		s.adopted[id] = true
+		s.instanceIDs[m] = id
+		s.Event("bigmachine:ec2:machineStart",
+			"autoScalingGroup", s.AutoScalingGroup,
+			"addr", m.Addr,
+			"instanceID", id)
+		go s.release(m, id)
+	}
+	return machines, nil
+}
+
+// release terminates the instance with the provided ID, which backs
+// the machine m, once the machine stops, and lowers the desired
+// capacity of the system's auto scaling group so that the instance is
+// not replaced. The machine's instance ID is then forgotten.
+func (s *System) release(m *bigmachine.Machine, id string) {
+	<-m.Wait(bigmachine.Stopped)
+	s.asgMu.Lock()
+	defer s.asgMu.Unlock()
+	_, err := s.asg.TerminateInstanceInAutoScalingGroupWithContext(context.Background(), &autoscaling.TerminateInstanceInAutoScalingGroupInput{
+		InstanceId:                     aws.String(id),
+		ShouldDecrementDesiredCapacity: aws.Bool(true),
+	})
+	if err != nil {
+		log.Error.Printf("%s: auto scaling group %s: terminate instance %s: %v", m.Name(), s.AutoScalingGroup, id, err)
+	}
+	s.mu.Lock()
+	delete(s.adopted, id)
+	delete(s.instanceIDs, m)
+	s.mu.Unlock()
+}
+
+// describeGroup describes the system's auto scaling group.
+func (s *System) describeGroup(ctx context.Context) (*autoscaling.Group, error) {
+	out, err := s.asg.DescribeAutoScalingGroupsWithContext(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: aws.StringSlice([]string{s.AutoScalingGroup}),
+	})
+	if err != nil {
+		return nil, errors.E(fmt.Sprintf("describe auto scaling group %s", s.AutoScalingGroup), err)
+	}
+	if len(out.AutoScalingGroups) != 1 {
+		return nil, errors.E(errors.NotExist, fmt.Sprintf("auto scaling group %s not found", s.AutoScalingGroup))
+	}
+	return out.AutoScalingGroups[0], nil
+}
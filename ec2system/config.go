@@ -6,6 +6,7 @@ package ec2system
 
 import (
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/grailbio/base/config"
@@ -45,6 +46,19 @@ func init() {
 		sshkeys := constr.String("sshkey", "", "comma-separated list of ssh keys to be installed")
 		constr.InstanceVar(&system.Eventer, "eventer", "", "the event logger used to log bigmachine events")
 		constr.StringVar(&system.Username, "username", "", "user name for tagging purposes")
+		constr.IntVar(&system.Transport.MaxConnsPerHost, "max-conns-per-host", 0,
+			"the maximum number of HTTP/1.x connections to each instance (0 means no limit)")
+		constr.IntVar(&system.Transport.MaxIdleConnsPerHost, "max-idle-conns-per-host", 0,
+			"the maximum number of idle HTTP/1.x connections kept for each instance (0 means Go's default)")
+		constr.StringVar(&system.AutoScalingGroup, "auto-scaling-group", "",
+			"the auto scaling group through which instances are started (empty means instances are launched directly)")
+		constr.StringVar(&system.BinaryStagingURL, "binary-staging-url", "",
+			"an S3 URL under which binaries are staged for machines to fetch (empty means binaries are uploaded to each machine)")
+		constr.StringVar(&system.LogShipping, "log-shipping", "",
+			"the destination, cloudwatch:group or an S3 URL, to which machines ship their log output (empty means output is not shipped)")
+		naming := constr.String("naming", "",
+			"the naming policy of the system's resources: one of {random, deterministic}, optionally followed by :prefix (empty means the default names)")
+		idleConnTimeout := constr.String("idle-conn-timeout", "0s", "the duration after which idle connections are closed (0 means never)")
 		var sess *session.Session
 		constr.InstanceVar(&sess, "aws", "aws", "AWS configuration for all EC2 calls")
 		constr.Doc = "bigmachine/ec2system configures the default instances settings used for bigmachine's ec2 backend"
@@ -57,6 +71,14 @@ func init() {
 			default:
 				return nil, errors.E(errors.Invalid, "flavor must be one of {flatcar, ubuntu}: ", *flavor)
 			}
+			var err error
+			system.Transport.IdleConnTimeout, err = time.ParseDuration(*idleConnTimeout)
+			if err != nil {
+				return nil, errors.E(errors.Invalid, "bad idle-conn-timeout ", *idleConnTimeout, err)
+			}
+			if system.NamingPolicy, err = parseNamingPolicy(*naming); err != nil {
+				return nil, err
+			}
 			system.Diskspace = uint(*diskspace)
 			system.Dataspace = uint(*dataspace)
 			system.SshKeys = strings.Split(*sshkeys, ",")
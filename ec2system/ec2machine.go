@@ -50,8 +50,14 @@ import (
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/grailbio/base/digest"
 	"github.com/grailbio/base/errors"
 	"github.com/grailbio/base/eventlog"
 	"github.com/grailbio/base/fatbin"
@@ -62,6 +68,7 @@ import (
 	"github.com/grailbio/bigmachine"
 	"github.com/grailbio/bigmachine/ec2system/instances"
 	"github.com/grailbio/bigmachine/internal/authority"
+	"github.com/grailbio/bigmachine/rpc"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/net/http2"
@@ -222,19 +229,102 @@ type System struct {
 	// AdditionalEC2Tags will be applied to this system's instances.
 	AdditionalEC2Tags []*ec2.Tag
 
+	// NamingPolicy, if not nil, determines the names and tags of the
+	// resources created by the system (see NamingPolicy). Instances
+	// are otherwise named after the user, binary, and arguments of
+	// the program, and their volumes are not tagged.
+	NamingPolicy NamingPolicy
+
 	// Eventer is used to log semi-structured events in service of analytics.
 	Eventer eventlog.Eventer
 
+	// Transport configures the HTTP transport used to communicate with
+	// the system's instances. Large clusters may need to limit the
+	// number of connections per instance, or close idle connections
+	// sooner, to conserve file descriptors and ports.
+	Transport rpc.TransportOptions
+
+	// AutoScalingGroup is the name of an EC2 Auto Scaling group
+	// through which the system's machines are started, so that
+	// group-level policies (warm pools, instance refresh, etc.) apply
+	// to them. If set, Start raises the group's desired capacity and
+	// adopts the instances that the group launches, instead of
+	// launching instances directly; stopped machines are terminated
+	// and the group's desired capacity lowered accordingly. The
+	// group's launch template must boot instances with the system's
+	// user data (see UserData).
+	AutoScalingGroup string
+
+	// BinaryStagingURL is an S3 URL (for example,
+	// "s3://bucket/bigmachine/binaries") under which the driver stages
+	// the binaries that its machines execute: each binary is uploaded
+	// once, and the machines fetch it directly from S3, through
+	// presigned URLs, instead of the driver uploading it to each
+	// machine. The bucket should be in the system's region. Machines
+	// whose supervisors cannot fetch staged binaries are uploaded the
+	// binary as usual.
+	BinaryStagingURL string
+
+	// LogShipping, if set, is the destination to which machines ship
+	// their log output, so that it survives the termination of their
+	// instances: either "cloudwatch:group", to ship output to the named
+	// CloudWatch Logs group, which must exist, in the system's region;
+	// or an S3 URL (for example, "s3://bucket/bigmachine/logs"), under
+	// which output is shipped as objects. Output is identified by the
+	// name of the machines' persistent cluster, if any (see
+	// bigmachine.Cluster), and by their instance IDs (see
+	// System.ShipLogs). The instances' profile must permit them to
+	// create log streams and put log events to the group, or to put
+	// objects under the URL. The bucket should be in the system's
+	// region.
+	LogShipping string
+
 	privateKey *rsa.PrivateKey
 
 	config instances.Type
 
 	ec2 ec2iface.EC2API
+	asg autoscalingiface.AutoScalingAPI
+	s3  s3iface.S3API
+	// logs is the CloudWatch Logs client with which machines ship
+	// their log output.
+	logs cloudwatchlogsiface.CloudWatchLogsAPI
+
+	// cluster is the name of the persistent cluster of the system's
+	// machines, if any.
+	cluster string
+
+	// staged contains the binaries staged by StageBinary, keyed by
+	// digest.
+	stagedMu sync.Mutex
+	staged   map[digest.Digest]*stagedBinary
+
+	// asgMu serializes changes to the desired capacity of the system's
+	// auto scaling group; adopted is the set of IDs of the group's
+	// instances that have been adopted by the system.
+	asgMu   sync.Mutex
+	adopted map[string]bool
 
 	authority *authority.T
 
+	// metadata is the EC2 instance metadata client, with which the
+	// system determines the location of the driver.
+	metadata *ec2metadata.EC2Metadata
+
 	clientOnce   once.Task
 	clientConfig *tls.Config
+
+	// instanceIDs maps the machines started by the system to the IDs
+	// of their instances, until they stop; pricing maps them to their pricing, until
+	// it is retrieved by MachinePricing, and locations to their
+	// locations, until they are retrieved by MachineLocation.
+	mu          sync.Mutex
+	instanceIDs map[*bigmachine.Machine]string
+	pricing     map[*bigmachine.Machine]bigmachine.Pricing
+	locations   map[*bigmachine.Machine]bigmachine.Location
+	// nextSeq is the sequence number of the next instance launched by
+	// the system (see Resource.Seq).
+	nextSeq int
 }
 
 // Name returns the name of this system ("ec2").
@@ -333,6 +423,19 @@ func (s *System) Init(b *bigmachine.B) error {
 		return err
 	}
 	s.ec2 = ec2.New(sess)
+	s.metadata = ec2metadata.New(sess)
+	if s.AutoScalingGroup != "" {
+		s.asg = autoscaling.New(sess)
+	}
+	if s.BinaryStagingURL != "" {
+		if _, _, err = parseStagingURL(s.BinaryStagingURL); err != nil {
+			return err
+		}
+		s.s3 = s3.New(sess)
+	}
+	if err = s.initLogShipping(b, sess); err != nil {
+		return err
+	}
 	s.authority, err = authority.New(authorityPath)
 	if err != nil {
 		return err
@@ -370,7 +473,41 @@ func readSshAgentKeys() []string {
 // with the bigmachine command line and binary, as well as other
 // runtime information.
 func (s *System) Start(ctx context.Context, count int) ([]*bigmachine.Machine, error) {
-	userData, err := s.cloudConfig().Marshal()
+	if s.AutoScalingGroup != "" {
+		return s.startGroup(ctx, count)
+	}
+	return s.start(ctx, count, s.InstanceType, s.config, s.Diskspace)
+}
+
+// StartSpec is like Start, but launches machines of the instance type
+// and disk space given by the provided spec, where they are set,
+// instead of those configured for the system.
+func (s *System) StartSpec(ctx context.Context, count int, spec bigmachine.MachineSpec) ([]*bigmachine.Machine, error) {
+	if s.AutoScalingGroup != "" {
+		return nil, errors.E(errors.NotSupported, fmt.Sprintf("machine specs are not supported with auto scaling group %s", s.AutoScalingGroup))
+	}
+	instanceType, config, diskspace := s.InstanceType, s.config, s.Diskspace
+	if spec.InstanceType != "" {
+		instanceType = spec.InstanceType
+		var ok bool
+		config, ok = instanceTypes[instanceType]
+		if !ok {
+			return nil, errors.E(errors.Invalid, fmt.Sprintf("invalid instance type %q", instanceType))
+		}
+		if config.Price[*s.AWSConfig.Region] == 0 {
+			return nil, errors.E(errors.Invalid, fmt.Sprintf("instance type %q not available in region %s", instanceType, *s.AWSConfig.Region))
+		}
+	}
+	if spec.Diskspace != 0 {
+		diskspace = uint(spec.Diskspace)
+	}
+	return s.start(ctx, count, instanceType, config, diskspace)
+}
+
+// start launches count machines of the provided instance type, with
+// the provided amount of disk space.
+func (s *System) start(ctx context.Context, count int, instanceType string, config instances.Type, diskspace uint) ([]*bigmachine.Machine, error) {
+	userData, err := s.cloudConfig(config).Marshal()
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal cloud-config: %v", err)
 	}
@@ -407,7 +544,7 @@ func (s *System) Start(ctx context.Context, count int) ([]*bigmachine.Machine, e
 			DeviceName: rootDeviceName,
 			Ebs: &ec2.EbsBlockDevice{
 				DeleteOnTermination: aws.Bool(true),
-				VolumeSize:          aws.Int64(int64(50 + s.Diskspace)),
+				VolumeSize:          aws.Int64(int64(50 + diskspace)),
 				VolumeType:          aws.String("gp2"),
 			},
 		},
@@ -451,12 +588,12 @@ func (s *System) Start(ctx context.Context, count int) ([]*bigmachine.Machine, e
 				BlockDeviceMappings:   blockDevices,
 				DisableApiTermination: aws.Bool(false),
 				DryRun:                aws.Bool(false),
-				EbsOptimized:          aws.Bool(s.config.EBSOptimized),
+				EbsOptimized:          aws.Bool(config.EBSOptimized),
 				IamInstanceProfile: &ec2.IamInstanceProfileSpecification{
 					Arn: aws.String(s.InstanceProfile),
 				},
 				InstanceInitiatedShutdownBehavior: aws.String("terminate"),
-				InstanceType:                      aws.String(s.config.Name),
+				InstanceType:                      aws.String(config.Name),
 				Monitoring: &ec2.RunInstancesMonitoringEnabled{
 					Enabled: aws.Bool(true), // Required
 				},
@@ -482,13 +619,13 @@ func (s *System) Start(ctx context.Context, count int) ([]*bigmachine.Machine, e
 		run = func() ([]string, error) {
 			resp, err2 := s.ec2.RequestSpotInstancesWithContext(ctx, &ec2.RequestSpotInstancesInput{
 				ValidUntil:    aws.Time(time.Now().Add(time.Minute)),
-				SpotPrice:     aws.String(fmt.Sprintf("%.3f", s.config.Price[*s.AWSConfig.Region])),
+				SpotPrice:     aws.String(fmt.Sprintf("%.3f", config.Price[*s.AWSConfig.Region])),
 				InstanceCount: aws.Int64(int64(count)),
 				LaunchSpecification: &ec2.RequestSpotLaunchSpecification{
 					SubnetId:            aws.String(s.Subnet),
 					ImageId:             aws.String(s.AMI),
-					EbsOptimized:        aws.Bool(s.config.EBSOptimized),
-					InstanceType:        aws.String(s.config.Name),
+					EbsOptimized:        aws.Bool(config.EBSOptimized),
+					InstanceType:        aws.String(config.Name),
 					BlockDeviceMappings: blockDevices,
 					UserData:            aws.String(base64.StdEncoding.EncodeToString(userData)),
 					IamInstanceProfile: &ec2.IamInstanceProfileSpecification{
@@ -564,28 +701,40 @@ func (s *System) Start(ctx context.Context, count int) ([]*bigmachine.Machine, e
 		instanceIdsp[i] = aws.String(instanceIds[i])
 	}
 
+	// TODO(marius): having a user would be nice here.
+	var (
+		local  = bigmachine.LocalInfo()
+		binary = filepath.Base(os.Args[0])
+		tag    = fmt.Sprintf("%s:%s(%s) %s (bigmachine)", s.Username, binary, local.Digest.Short(), strings.Join(os.Args[1:], " "))
+	)
+	if len(tag) > 250 { // EC2 tags are limited to 255 characters.
+		tag = tag[:250] + "..."
+	}
+	tags := append([]*ec2.Tag{
+		{Key: aws.String("Name"), Value: aws.String(tag)},
+		{Key: aws.String("GOARCH"), Value: aws.String(local.Goarch)},
+		{Key: aws.String("GOOS"), Value: aws.String(local.Goos)},
+		{Key: aws.String("Digest"), Value: aws.String(local.Digest.String())},
+		{Key: aws.String("bigmachine"), Value: aws.String("true")},
+		{Key: aws.String("bigmachine:binary"), Value: aws.String(binary)},
+	}, s.AdditionalEC2Tags...)
+	s.mu.Lock()
+	seq := s.nextSeq
+	s.nextSeq += len(instanceIds)
+	s.mu.Unlock()
 	// Asynhronously tag the instance so we don't hold up the process.
 	go func() {
-		// TODO(marius): there should be some abstraction that provides the name,
-		// so that it can be overriden, etc. Also, having a user would be nice here.
-		var (
-			info   = bigmachine.LocalInfo()
-			binary = filepath.Base(os.Args[0])
-			tag    = fmt.Sprintf("%s:%s(%s) %s (bigmachine)", s.Username, binary, info.Digest.Short(), strings.Join(os.Args[1:], " "))
-		)
-		if len(tag) > 250 { // EC2 tags are limited to 255 characters.
-			tag = tag[:250] + "..."
+		if s.NamingPolicy != nil {
+			resources := make([]Resource, len(instanceIds))
+			for i := range resources {
+				resources[i] = Resource{Kind: ResourceInstance, Seq: seq + i, Tags: tagMap(tags)}
+			}
+			s.tagResources(context.Background(), instanceIds, resources)
+			return
 		}
 		_, err2 := s.ec2.CreateTags(&ec2.CreateTagsInput{
 			Resources: instanceIdsp,
-			Tags: append([]*ec2.Tag{
-				{Key: aws.String("Name"), Value: aws.String(tag)},
-				{Key: aws.String("GOARCH"), Value: aws.String(info.Goarch)},
-				{Key: aws.String("GOOS"), Value: aws.String(info.Goos)},
-				{Key: aws.String("Digest"), Value: aws.String(info.Digest.String())},
-				{Key: aws.String("bigmachine"), Value: aws.String("true")},
-				{Key: aws.String("bigmachine:binary"), Value: aws.String(binary)},
-			}, s.AdditionalEC2Tags...),
+			Tags:      tags,
 		})
 		if err2 != nil {
 			log.Error.Printf("ec2.CreateTags: %v", err2)
@@ -628,14 +777,247 @@ func (s *System) Start(ctx context.Context, count int) ([]*bigmachine.Machine, e
 			machines[i].Addr += aws.StringValue(instance.InstanceId) + "/"
 		}
 		s.Event("bigmachine:ec2:machineStart",
-			"instanceType", s.InstanceType,
+			"instanceType", instanceType,
 			"addr", machines[i].Addr,
 			"instanceID", instance.InstanceId)
-		machines[i].Maxprocs = int(s.config.VCPU)
+		machines[i].Maxprocs = int(config.VCPU)
+	}
+	if s.NamingPolicy != nil {
+		// Volumes are tagged once they are attached to the running
+		// instances.
+		var (
+			volumeIDs []string
+			resources []Resource
+		)
+		for _, instance := range describeInstance.Reservations[0].Instances {
+			id := aws.StringValue(instance.InstanceId)
+			for _, dev := range instance.BlockDeviceMappings {
+				if dev.Ebs == nil {
+					continue
+				}
+				volumeTags := tagMap(tags)
+				volumeTags["bigmachine:instance"] = id
+				volumeIDs = append(volumeIDs, aws.StringValue(dev.Ebs.VolumeId))
+				resources = append(resources, Resource{
+					Kind:   ResourceVolume,
+					Seq:    seq + indexOf(instanceIds, id),
+					Device: aws.StringValue(dev.DeviceName),
+					Tags:   volumeTags,
+				})
+			}
+		}
+		go s.tagResources(context.Background(), volumeIDs, resources)
+	}
+	s.mu.Lock()
+	if s.instanceIDs == nil {
+		s.instanceIDs = make(map[*bigmachine.Machine]string)
+	}
+	for i, instance := range describeInstance.Reservations[0].Instances {
+		s.instanceIDs[machines[i]] = aws.StringValue(instance.InstanceId)
+		go s.forget(machines[i])
+		s.setPricing(machines[i], bigmachine.Pricing{
+			InstanceType: instanceType,
+			Spot:         !s.OnDemand,
+			HourlyPrice:  config.Price[*s.AWSConfig.Region],
+		})
+		s.setLocation(machines[i], instance)
+	}
+	s.mu.Unlock()
+	return machines, nil
+}
+
+// MachinePricing returns the pricing of the provided machine, which
+// was returned by the system. The prices of spot instances are the
+// maximum prices bid for them, which are the on-demand prices.
+func (s *System) MachinePricing(m *bigmachine.Machine) (bigmachine.Pricing, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pricing, ok := s.pricing[m]
+	delete(s.pricing, m)
+	return pricing, ok
+}
+
+// setPricing records the pricing of the machine m. It must be called
+// with s.mu held.
+func (s *System) setPricing(m *bigmachine.Machine, pricing bigmachine.Pricing) {
+	if s.pricing == nil {
+		s.pricing = make(map[*bigmachine.Machine]bigmachine.Pricing)
+	}
+	s.pricing[m] = pricing
+}
+
+// MachineLocation returns the location of the provided machine, which
+// was returned by the system: the availability zone in which its
+// instance was placed.
+func (s *System) MachineLocation(m *bigmachine.Machine) (bigmachine.Location, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	loc, ok := s.locations[m]
+	delete(s.locations, m)
+	return loc, ok
+}
+
+// setLocation records the location of the machine m, whose instance
+// is provided. It must be called with s.mu held.
+func (s *System) setLocation(m *bigmachine.Machine, instance *ec2.Instance) {
+	if instance.Placement == nil || instance.Placement.AvailabilityZone == nil {
+		return
+	}
+	if s.locations == nil {
+		s.locations = make(map[*bigmachine.Machine]bigmachine.Location)
+	}
+	s.locations[m] = bigmachine.Location{
+		Region: aws.StringValue(s.AWSConfig.Region),
+		Zone:   aws.StringValue(instance.Placement.AvailabilityZone),
+	}
+}
+
+// DriverLocation returns the location of the driver, if it runs on an
+// EC2 instance, as reported by the instance metadata service.
+func (s *System) DriverLocation() (bigmachine.Location, bool) {
+	if s.metadata == nil || !s.metadata.Available() {
+		return bigmachine.Location{}, false
+	}
+	doc, err := s.metadata.GetInstanceIdentityDocument()
+	if err != nil {
+		log.Error.Printf("ec2metadata.GetInstanceIdentityDocument: %v", err)
+		return bigmachine.Location{}, false
+	}
+	return bigmachine.Location{Region: doc.Region, Zone: doc.AvailabilityZone}, true
+}
+
+// NameMachines tags the instances of the provided machines with the
+// machines' names, under the "bigmachine:name" tag, and with the
+// names of their persistent clusters, if any, under the
+// "bigmachine:cluster" tag (see bigmachine.Cluster).
+func (s *System) NameMachines(ctx context.Context, machines []*bigmachine.Machine) {
+	for _, m := range machines {
+		s.mu.Lock()
+		id, ok := s.instanceIDs[m]
+		s.mu.Unlock()
+		if !ok {
+			continue
+		}
+		tags := []*ec2.Tag{
+			{Key: aws.String("bigmachine:name"), Value: aws.String(m.Name())},
+		}
+		if cluster := m.Cluster(); cluster != "" {
+			tags = append(tags, &ec2.Tag{Key: aws.String("bigmachine:cluster"), Value: aws.String(cluster)})
+		}
+		_, err := s.ec2.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+			Resources: []*string{aws.String(id)},
+			Tags:      tags,
+		})
+		if err != nil {
+			log.Error.Printf("%s: ec2.CreateTags: %v", m.Name(), err)
+		}
+	}
+}
+
+// Forget forgets the instance ID of the machine m once it stops,
+// whether or not it was named.
+func (s *System) forget(m *bigmachine.Machine) {
+	<-m.Wait(bigmachine.Stopped)
+	s.mu.Lock()
+	delete(s.instanceIDs, m)
+	s.mu.Unlock()
+}
+
+// RebootMachine reboots the instance of the provided machine, which
+// was started by the system. The machine's supervisor is restarted by
+// systemd when the instance boots.
+func (s *System) RebootMachine(ctx context.Context, m *bigmachine.Machine) error {
+	s.mu.Lock()
+	id, ok := s.instanceIDs[m]
+	s.mu.Unlock()
+	if !ok {
+		return errors.E(errors.NotExist, fmt.Sprintf("machine %s: unknown instance", m.Addr))
+	}
+	_, err := s.ec2.RebootInstancesWithContext(ctx, &ec2.RebootInstancesInput{
+		InstanceIds: []*string{aws.String(id)},
+	})
+	if err != nil {
+		return errors.E(fmt.Sprintf("ec2.RebootInstances %s", id), err)
+	}
+	s.Event("bigmachine:ec2:machineReboot",
+		"addr", m.Addr,
+		"instanceID", id)
+	return nil
+}
+
+// DiscoverMachines returns the running instances that are tagged as
+// members of the provided persistent cluster (see NameMachines).
+func (s *System) DiscoverMachines(ctx context.Context, cluster string) ([]*bigmachine.Machine, error) {
+	return s.SelectMachines(ctx, bigmachine.Labels{"bigmachine:cluster": cluster})
+}
+
+// SelectMachines returns the running instances that have each of the
+// provided tags, for example instances that were launched by an
+// autoscaling group and that run the bigmachine supervisor on the
+// system's port.
+func (s *System) SelectMachines(ctx context.Context, tags bigmachine.Labels) ([]*bigmachine.Machine, error) {
+	input := &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("instance-state-name"), Values: []*string{aws.String("running")}},
+		},
+	}
+	for k, v := range tags {
+		input.Filters = append(input.Filters, &ec2.Filter{
+			Name:   aws.String("tag:" + k),
+			Values: []*string{aws.String(v)},
+		})
+	}
+	var machines []*bigmachine.Machine
+	err := s.ec2.DescribeInstancesPagesWithContext(ctx, input, func(page *ec2.DescribeInstancesOutput, _ bool) bool {
+		for _, reserv := range page.Reservations {
+			for _, instance := range reserv.Instances {
+				m, err := s.instanceMachine(instance)
+				if err != nil {
+					log.Error.Print(err)
+					continue
+				}
+				machines = append(machines, m)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.E(fmt.Sprintf("select instances %s", tags), err)
 	}
 	return machines, nil
 }
 
+// instanceMachine returns a machine for the provided running
+// instance, which was not started by the system.
+func (s *System) instanceMachine(instance *ec2.Instance) (*bigmachine.Machine, error) {
+	addr := getAddress(instance)
+	if addr == "" {
+		return nil, fmt.Errorf("ec2.DescribeInstances %s: no dns name or ip address available", aws.StringValue(instance.InstanceId))
+	}
+	m := new(bigmachine.Machine)
+	m.Addr = fmt.Sprintf("https://%s/", addr)
+	if useInstanceIDSuffix {
+		m.Addr += aws.StringValue(instance.InstanceId) + "/"
+	}
+	s.mu.Lock()
+	s.setLocation(m, instance)
+	s.mu.Unlock()
+	instanceType := aws.StringValue(instance.InstanceType)
+	if config, ok := instanceTypes[instanceType]; ok {
+		m.Maxprocs = int(config.VCPU)
+		if price := config.Price[*s.AWSConfig.Region]; price > 0 {
+			s.mu.Lock()
+			s.setPricing(m, bigmachine.Pricing{
+				InstanceType: instanceType,
+				Spot:         aws.StringValue(instance.InstanceLifecycle) == ec2.InstanceLifecycleTypeSpot,
+				HourlyPrice:  price,
+			})
+			s.mu.Unlock()
+		}
+	}
+	return m, nil
+}
+
 func getAddress(instance *ec2.Instance) string {
 	for _, ptr := range []*string{
 		instance.PublicDnsName,
@@ -662,8 +1044,9 @@ func (s *System) sliceConfig() (nslice int, sliceSize int64) {
 	return
 }
 
-// CloudConfig returns the cloudConfig instance as configured by the current system.
-func (s *System) cloudConfig() *cloudConfig {
+// CloudConfig returns the cloudConfig instance as configured by the
+// current system, for instances of the provided type.
+func (s *System) cloudConfig(config instances.Type) *cloudConfig {
 	c := new(cloudConfig)
 	c.SshAuthorizedKeys = s.SshKeys
 	c.Flavor = s.Flavor
@@ -690,7 +1073,7 @@ func (s *System) cloudConfig() *cloudConfig {
 	case 1:
 		// No need to set up striping in this case.
 		dataDeviceName = "xvdb"
-		if s.config.NVMe {
+		if config.NVMe {
 			dataDeviceName = "nvme1n1"
 		}
 		c.AppendUnit(CloudUnit{
@@ -713,7 +1096,7 @@ func (s *System) cloudConfig() *cloudConfig {
 		devices = make([]string, nslice)
 		// Remap names for NVMe instances.
 		for idx := range devices {
-			if s.config.NVMe {
+			if config.NVMe {
 				devices[idx] = fmt.Sprintf("nvme%dn1", idx+1)
 			} else {
 				devices[idx] = fmt.Sprintf("xvd%c", 'b'+idx)
@@ -820,10 +1203,18 @@ func (s *System) cloudConfig() *cloudConfig {
 			export BIGMACHINE_MODE=machine
 			export BIGMACHINE_SYSTEM=ec2
 			export BIGMACHINE_ADDR=:{{443}}
+			export BIGMACHINE_EC2_LOGSHIPPING={{.logShipping}}
+			export BIGMACHINE_EC2_LOGREGION={{.region}}
+			export BIGMACHINE_EC2_CLUSTER={{.cluster}}
 			$bin -log=debug || true
 			sleep 30
 			exit 1
-		`, args{"binary": s.Binary}),
+		`, args{
+			"binary":      s.Binary,
+			"logShipping": s.LogShipping,
+			"region":      aws.StringValue(s.AWSConfig.Region),
+			"cluster":     s.cluster,
+		}),
 	})
 	c.AppendFile(CloudFile{
 		Permissions: "0644",
@@ -906,12 +1297,12 @@ func (s *System) HTTPClient() *http.Client {
 		// TODO: propagate error, or return error client
 		log.Fatalf("error build TLS configuration: %v", err)
 	}
-	transport := &http.Transport{
-		Dial:                (&net.Dialer{Timeout: httpTimeout}).Dial,
-		TLSClientConfig:     s.clientConfig,
-		TLSHandshakeTimeout: httpTimeout,
+	opts := s.Transport
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = httpTimeout
 	}
-	if err = http2.ConfigureTransport(transport); err != nil {
+	transport, err := rpc.NewTransport(opts, s.clientConfig, nil)
+	if err != nil {
 		// TODO: propagate error, or return error client
 		log.Fatalf("error configuring transport: %v", err)
 	}
@@ -5,7 +5,9 @@
 package ec2system
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"path/filepath"
@@ -13,6 +15,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
 	"github.com/grailbio/base/errors"
 	"github.com/grailbio/bigmachine/internal/authority"
 	"github.com/grailbio/testutil"
@@ -41,6 +47,154 @@ func TestDiskConfig(t *testing.T) {
 	}
 }
 
+func TestParseStagingURL(t *testing.T) {
+	for _, test := range []struct {
+		url            string
+		bucket, prefix string
+		ok             bool
+	}{
+		{"s3://bucket", "bucket", "", true},
+		{"s3://bucket/", "bucket", "", true},
+		{"s3://bucket/a/b/", "bucket", "a/b", true},
+		{"https://bucket/a", "", "", false},
+		{"s3:///a", "", "", false},
+	} {
+		bucket, prefix, err := parseStagingURL(test.url)
+		if got, want := err == nil, test.ok; got != want {
+			t.Errorf("%s: got %v, want %v", test.url, err, want)
+			continue
+		}
+		if got, want := bucket, test.bucket; got != want {
+			t.Errorf("%s: got %v, want %v", test.url, got, want)
+		}
+		if got, want := prefix, test.prefix; got != want {
+			t.Errorf("%s: got %v, want %v", test.url, got, want)
+		}
+	}
+}
+
+func TestParseLogShipping(t *testing.T) {
+	for _, test := range []struct {
+		dest                    string
+		service, target, prefix string
+		ok                      bool
+	}{
+		{"cloudwatch:bigmachine", "cloudwatch", "bigmachine", "", true},
+		{"s3://bucket/a/b/", "s3", "bucket", "a/b", true},
+		{"cloudwatch:", "", "", "", false},
+		{"https://bucket/a", "", "", "", false},
+	} {
+		service, target, prefix, err := parseLogShipping(test.dest)
+		if got, want := err == nil, test.ok; got != want {
+			t.Errorf("%s: got %v, want %v", test.dest, err, want)
+			continue
+		}
+		if got, want := service+" "+target+" "+prefix, test.service+" "+test.target+" "+test.prefix; got != want {
+			t.Errorf("%s: got %v, want %v", test.dest, got, want)
+		}
+	}
+}
+
+func TestShipLogLines(t *testing.T) {
+	var (
+		input   strings.Builder
+		shipped []string
+		batches int
+	)
+	for i := 0; i < maxLogBatchEvents+10; i++ {
+		fmt.Fprintf(&input, "line %d\n\n", i)
+	}
+	ship := func(ctx context.Context, lines []logLine) error {
+		batches++
+		for _, line := range lines {
+			shipped = append(shipped, line.text)
+		}
+		return nil
+	}
+	err := shipLogLines(context.Background(), strings.NewReader(input.String()), time.Hour, ship)
+	if err != io.EOF {
+		t.Fatal(err)
+	}
+	if got, want := batches, 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(shipped), maxLogBatchEvents+10; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i, line := range shipped {
+		if got, want := line, fmt.Sprintf("line %d", i); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+}
+
+type fakeCloudWatchLogs struct {
+	cloudwatchlogsiface.CloudWatchLogsAPI
+	token  string
+	events []string
+}
+
+func (f *fakeCloudWatchLogs) PutLogEventsWithContext(ctx aws.Context, in *cloudwatchlogs.PutLogEventsInput, _ ...request.Option) (*cloudwatchlogs.PutLogEventsOutput, error) {
+	if aws.StringValue(in.SequenceToken) != f.token {
+		return nil, &cloudwatchlogs.InvalidSequenceTokenException{ExpectedSequenceToken: aws.String(f.token)}
+	}
+	for _, event := range in.LogEvents {
+		f.events = append(f.events, aws.StringValue(event.Message))
+	}
+	f.token = fmt.Sprint(len(f.events))
+	return &cloudwatchlogs.PutLogEventsOutput{NextSequenceToken: aws.String(f.token)}, nil
+}
+
+func TestCloudWatchLogShipper(t *testing.T) {
+	// The stream was written before, for example by the process that
+	// execed the shipper's.
+	api := &fakeCloudWatchLogs{token: "previous"}
+	shipper := &cloudWatchLogShipper{api: api, group: "group", stream: "cluster/i-1234"}
+	ctx := context.Background()
+	for _, text := range []string{"a", "b"} {
+		if err := shipper.ship(ctx, []logLine{{time.Now(), text}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := strings.Join(api.events, ","), "a,b"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestNamingPolicy(t *testing.T) {
+	resource := func(kind ResourceKind, seq int, device string) Resource {
+		return Resource{Kind: kind, Seq: seq, Device: device, Tags: map[string]string{"Name": "user:binary(1234) (bigmachine)", "bigmachine": "true"}}
+	}
+	deterministic, err := parseNamingPolicy("deterministic:job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := deterministic(resource(ResourceInstance, 1, ""))["Name"]
+	if got, want := deterministic(resource(ResourceInstance, 1, ""))["Name"], name; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !strings.HasPrefix(name, "job-") || !strings.HasSuffix(name, "-1") {
+		t.Errorf("bad name %s", name)
+	}
+	if got, want := deterministic(resource(ResourceVolume, 1, "/dev/xvdb"))["Name"], name+"-xvdb"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	random, err := parseNamingPolicy("random")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := random(resource(ResourceInstance, 1, ""))
+	if got, want := tags["bigmachine"], "true"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if tags["Name"] == random(resource(ResourceInstance, 1, ""))["Name"] || !strings.HasPrefix(tags["Name"], "bigmachine-") {
+		t.Errorf("bad name %s", tags["Name"])
+	}
+	if _, err := parseNamingPolicy("sequential"); !errors.Is(errors.Invalid, err) {
+		t.Errorf("expected invalid error, got %v", err)
+	}
+}
+
 func TestMutualHTTPS(t *testing.T) {
 	save := useInstanceIDSuffix
 	useInstanceIDSuffix = false
@@ -0,0 +1,328 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2system
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/bigmachine"
+)
+
+const (
+	// CloudWatchShippingInterval and s3ShippingInterval are the
+	// intervals at which machines ship their log output to CloudWatch
+	// Logs and to S3, respectively. Each batch shipped to S3 is a new
+	// object, so batches are shipped to S3 less frequently.
+	cloudWatchShippingInterval = 5 * time.Second
+	s3ShippingInterval         = 30 * time.Second
+
+	// MaxLogBatchSize and maxLogBatchEvents are the maximum size and
+	// number of lines of a batch of log output, as limited by
+	// CloudWatch Logs' PutLogEvents. Each line is accounted
+	// logEventOverhead bytes in addition to its length.
+	maxLogBatchSize   = 1 << 20
+	maxLogBatchEvents = 10000
+	logEventOverhead  = 26
+	// MaxLogLineSize is the size beyond which lines of log output are
+	// truncated.
+	maxLogLineSize = 256<<10 - logEventOverhead
+)
+
+// Environment variables through which the driver passes its log
+// shipping configuration to its machines (see System.LogShipping).
+const (
+	logShippingEnv = "BIGMACHINE_EC2_LOGSHIPPING"
+	logRegionEnv   = "BIGMACHINE_EC2_LOGREGION"
+	clusterEnv     = "BIGMACHINE_EC2_CLUSTER"
+)
+
+// ParseLogShipping returns the service ("cloudwatch" or "s3") and the
+// target (the log group, or the bucket) of the provided LogShipping
+// configuration, and, for S3, the key prefix.
+func parseLogShipping(dest string) (service, target, prefix string, err error) {
+	if group := strings.TrimPrefix(dest, "cloudwatch:"); group != dest {
+		if group == "" {
+			return "", "", "", errors.E(errors.Invalid, fmt.Sprintf("ec2system: LogShipping %q: missing log group", dest))
+		}
+		return "cloudwatch", group, "", nil
+	}
+	u, err := url.Parse(dest)
+	if err != nil {
+		return "", "", "", errors.E(errors.Invalid, "ec2system: LogShipping", err)
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return "", "", "", errors.E(errors.Invalid, fmt.Sprintf("ec2system: LogShipping %q: expected cloudwatch:group or s3://bucket/prefix", dest))
+	}
+	return "s3", u.Host, strings.Trim(u.Path, "/"), nil
+}
+
+// InitLogShipping validates the system's log shipping configuration
+// (see LogShipping). On machines, to which the driver passes the
+// configuration through their environment, it also creates the
+// client through which output is shipped.
+func (s *System) initLogShipping(b *bigmachine.B, sess *session.Session) error {
+	if !b.IsDriver() {
+		s.LogShipping = os.Getenv(logShippingEnv)
+		s.cluster = os.Getenv(clusterEnv)
+	} else if s.LogShipping != "" {
+		s.cluster = b.Cluster()
+	}
+	if s.LogShipping == "" {
+		return nil
+	}
+	for _, v := range []string{s.LogShipping, s.cluster} {
+		if !safeEnvValue(v) {
+			return errors.E(errors.Invalid, fmt.Sprintf("ec2system: log shipping: %q contains unsupported characters", v))
+		}
+	}
+	service, _, _, err := parseLogShipping(s.LogShipping)
+	if err != nil || b.IsDriver() {
+		return err
+	}
+	if region := os.Getenv(logRegionEnv); region != "" {
+		sess = sess.Copy(&aws.Config{Region: aws.String(region)})
+	}
+	switch service {
+	case "cloudwatch":
+		s.logs = cloudwatchlogs.New(sess)
+	case "s3":
+		s.s3 = s3.New(sess)
+	}
+	return nil
+}
+
+// ShipLogs ships the machine's log output, as read from the provided
+// reader, to the system's LogShipping destination, in batches of lines
+// that are identified by the machine's cluster, if any, and by its
+// instance ID: as CloudWatch Logs stream "<cluster>/<instance-id>",
+// or as S3 objects under "<prefix>/<cluster>/<instance-id>/". It
+// returns an error of kind errors.NotSupported if the system does not
+// ship logs. Batches that fail to ship are dropped.
+func (s *System) ShipLogs(ctx context.Context, output io.Reader) error {
+	if s.LogShipping == "" {
+		return errors.E(errors.NotSupported, "ec2system: log shipping is not configured")
+	}
+	service, target, prefix, err := parseLogShipping(s.LogShipping)
+	if err != nil {
+		return err
+	}
+	if (service == "cloudwatch" && s.logs == nil) || (service == "s3" && s.s3 == nil) {
+		return errors.E(errors.NotSupported, "ec2system: log shipping is not initialized")
+	}
+	instanceID, err := s.metadata.GetMetadata("instance-id")
+	if err != nil {
+		return errors.E("ec2system: log shipping: instance ID", err)
+	}
+	name := path.Join(s.cluster, instanceID)
+	switch service {
+	case "cloudwatch":
+		shipper := &cloudWatchLogShipper{api: s.logs, group: target, stream: name}
+		if err := shipper.init(ctx); err != nil {
+			return err
+		}
+		log.Printf("ec2system: shipping log output to CloudWatch Logs group %s, stream %s", target, name)
+		return shipLogLines(ctx, output, cloudWatchShippingInterval, shipper.ship)
+	default:
+		shipper := &s3LogShipper{api: s.s3, bucket: target, prefix: path.Join(prefix, name)}
+		log.Printf("ec2system: shipping log output to s3://%s/%s/", target, shipper.prefix)
+		return shipLogLines(ctx, output, s3ShippingInterval, shipper.ship)
+	}
+}
+
+// A logLine is a line of log output, and the time at which it was
+// read.
+type logLine struct {
+	time time.Time
+	text string
+}
+
+// ShipLogLines reads lines of log output from the provided reader,
+// and calls ship with batches of them every interval, or as soon as a
+// batch reaches its maximum size, until reading fails or the context
+// is done. Batches that fail to ship are logged and dropped, so that
+// unavailable services do not stall the machine's logging.
+func shipLogLines(ctx context.Context, r io.Reader, interval time.Duration, ship func(context.Context, []logLine) error) error {
+	var (
+		lines = make(chan logLine, 1024)
+		errc  = make(chan error, 1)
+	)
+	go func() {
+		defer close(lines)
+		br := bufio.NewReader(r)
+		for {
+			text, err := br.ReadString('\n')
+			text = strings.TrimSuffix(text, "\n")
+			if len(text) > maxLogLineSize {
+				text = text[:maxLogLineSize]
+			}
+			// CloudWatch Logs does not accept empty events.
+			if text != "" {
+				select {
+				case lines <- logLine{time.Now(), text}:
+				case <-ctx.Done():
+					errc <- ctx.Err()
+					return
+				}
+			}
+			if err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	var (
+		batch  []logLine
+		size   int
+		ticker = time.NewTicker(interval)
+	)
+	defer ticker.Stop()
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := ship(ctx, batch); err != nil && ctx.Err() == nil {
+			log.Error.Printf("ec2system: dropped %d lines of log output: %v", len(batch), err)
+		}
+		batch, size = nil, 0
+	}
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				flush()
+				return <-errc
+			}
+			if len(batch) == maxLogBatchEvents || size+len(line.text)+logEventOverhead > maxLogBatchSize {
+				flush()
+			}
+			batch = append(batch, line)
+			size += len(line.text) + logEventOverhead
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// A cloudWatchLogShipper ships batches of log output to a CloudWatch
+// Logs stream.
+type cloudWatchLogShipper struct {
+	api           cloudwatchlogsiface.CloudWatchLogsAPI
+	group, stream string
+	// token is the sequence token of the next batch.
+	token *string
+}
+
+// Init creates the shipper's log stream, unless it exists, for
+// example because the machine's process was execed.
+func (c *cloudWatchLogShipper) init(ctx context.Context) error {
+	_, err := c.api.CreateLogStreamWithContext(ctx, &cloudwatchlogs.CreateLogStreamInput{
+		LogGroupName:  aws.String(c.group),
+		LogStreamName: aws.String(c.stream),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == cloudwatchlogs.ErrCodeResourceAlreadyExistsException {
+		err = nil
+	}
+	if err != nil {
+		return errors.E(fmt.Sprintf("ec2system: create log stream %s/%s", c.group, c.stream), err)
+	}
+	return nil
+}
+
+// Ship puts the provided batch of lines to the shipper's log stream.
+func (c *cloudWatchLogShipper) ship(ctx context.Context, lines []logLine) error {
+	events := make([]*cloudwatchlogs.InputLogEvent, len(lines))
+	for i, line := range lines {
+		events[i] = &cloudwatchlogs.InputLogEvent{
+			Message:   aws.String(line.text),
+			Timestamp: aws.Int64(line.time.UnixNano() / int64(time.Millisecond)),
+		}
+	}
+	for retried := false; ; retried = true {
+		out, err := c.api.PutLogEventsWithContext(ctx, &cloudwatchlogs.PutLogEventsInput{
+			LogGroupName:  aws.String(c.group),
+			LogStreamName: aws.String(c.stream),
+			LogEvents:     events,
+			SequenceToken: c.token,
+		})
+		switch err := err.(type) {
+		case nil:
+			c.token = out.NextSequenceToken
+			return nil
+		case *cloudwatchlogs.DataAlreadyAcceptedException:
+			c.token = err.ExpectedSequenceToken
+			return nil
+		case *cloudwatchlogs.InvalidSequenceTokenException:
+			// The stream was written by another process, for example
+			// before the machine's process was execed.
+			c.token = err.ExpectedSequenceToken
+			if !retried {
+				continue
+			}
+		}
+		return errors.E(fmt.Sprintf("ec2system: put log events %s/%s", c.group, c.stream), err)
+	}
+}
+
+// An s3LogShipper ships batches of log output to S3, as objects under
+// a prefix that are named by the time of their first line and by the
+// ID of the process, so that they sort by time.
+type s3LogShipper struct {
+	api            s3iface.S3API
+	bucket, prefix string
+}
+
+// Ship puts the provided batch of lines to a new object.
+func (c *s3LogShipper) ship(ctx context.Context, lines []logLine) error {
+	var b bytes.Buffer
+	for _, line := range lines {
+		b.WriteString(line.text)
+		b.WriteByte('\n')
+	}
+	key := path.Join(c.prefix, fmt.Sprintf("%020d-%d.log", lines[0].time.UnixNano(), os.Getpid()))
+	_, err := c.api.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(b.Bytes()),
+	})
+	if err != nil {
+		return errors.E(fmt.Sprintf("ec2system: put s3://%s/%s", c.bucket, key), err)
+	}
+	return nil
+}
+
+// SafeEnvValue tells whether the provided string may be included,
+// unquoted and unescaped, as the value of an environment variable in
+// the machines' bootmachine script.
+func safeEnvValue(s string) bool {
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("._/#:=@-", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,157 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2system
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+)
+
+// A ResourceKind is a kind of EC2 resource created by a System.
+type ResourceKind string
+
+const (
+	// ResourceInstance is the kind of the instances that back the
+	// system's machines.
+	ResourceInstance ResourceKind = ec2.ResourceTypeInstance
+	// ResourceVolume is the kind of the EBS volumes that are attached
+	// to the system's instances.
+	ResourceVolume ResourceKind = ec2.ResourceTypeVolume
+)
+
+// A Resource describes an EC2 resource created by a System, for its
+// naming policy (see NamingPolicy).
+type Resource struct {
+	// Kind is the resource's kind.
+	Kind ResourceKind
+	// Seq is the sequence number of the instance among the instances
+	// launched by the system; volumes share their instance's sequence
+	// number.
+	Seq int
+	// Device is the device name of a volume, for example "/dev/xvdb".
+	Device string
+	// Tags are the tags that the system applies to the resource by
+	// default, including its "Name" tag.
+	Tags map[string]string
+}
+
+// A NamingPolicy determines the tags, including the "Name" tag, of
+// the resources created by a System, for example to enforce the
+// naming conventions required by cloud governance tooling. It is
+// called for each resource that the system creates, and returns the
+// tags with which the resource is tagged; it may modify and return
+// the resource's default tags. The System creates instances and the
+// EBS volumes attached to them; it does not create security groups or
+// snapshots.
+type NamingPolicy func(r Resource) map[string]string
+
+// RandomNames returns a naming policy that names each resource by
+// the provided prefix followed by a random suffix, for example
+// "bigmachine-3f9a2c1d".
+func RandomNames(prefix string) NamingPolicy {
+	return func(r Resource) map[string]string {
+		var b [4]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			log.Error.Printf("ec2system: random name: %v", err)
+		}
+		r.Tags["Name"] = fmt.Sprintf("%s-%s", prefix, hex.EncodeToString(b[:]))
+		return r.Tags
+	}
+}
+
+// DeterministicNames returns a naming policy that names each resource
+// by the provided prefix, a digest of the resource's default name
+// (which comprises the user, the binary and its digest, and the
+// program's arguments), and the resource's sequence number, so that
+// the resources of repeated runs of a program are named identically,
+// for example "bigmachine-5d41402a-3" and "bigmachine-5d41402a-3-xvdb"
+// for one of its volumes.
+func DeterministicNames(prefix string) NamingPolicy {
+	return func(r Resource) map[string]string {
+		sum := sha256.Sum256([]byte(r.Tags["Name"]))
+		name := fmt.Sprintf("%s-%s-%d", prefix, hex.EncodeToString(sum[:4]), r.Seq)
+		if r.Kind == ResourceVolume {
+			name += "-" + path.Base(r.Device)
+		}
+		r.Tags["Name"] = name
+		return r.Tags
+	}
+}
+
+// ParseNamingPolicy parses a naming policy from its configuration
+// string: empty (the default names), "random[:prefix]", or
+// "deterministic[:prefix]". The prefix defaults to "bigmachine".
+func parseNamingPolicy(s string) (NamingPolicy, error) {
+	if s == "" {
+		return nil, nil
+	}
+	kind, prefix := s, "bigmachine"
+	if i := strings.Index(s, ":"); i >= 0 {
+		kind, prefix = s[:i], s[i+1:]
+	}
+	switch kind {
+	case "random":
+		return RandomNames(prefix), nil
+	case "deterministic":
+		return DeterministicNames(prefix), nil
+	default:
+		return nil, errors.E(errors.Invalid, fmt.Sprintf("naming policy %q must be one of {random, deterministic}[:prefix]", s))
+	}
+}
+
+// TagResources tags the resources with the provided IDs, which are
+// described by the provided resources, with the tags determined by
+// the system's naming policy.
+func (s *System) tagResources(ctx context.Context, ids []string, resources []Resource) {
+	for i, id := range ids {
+		tags := s.NamingPolicy(resources[i])
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		ec2Tags := make([]*ec2.Tag, len(keys))
+		for j, k := range keys {
+			ec2Tags[j] = &ec2.Tag{Key: aws.String(k), Value: aws.String(tags[k])}
+		}
+		_, err := s.ec2.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+			Resources: []*string{aws.String(id)},
+			Tags:      ec2Tags,
+		})
+		if err != nil {
+			log.Error.Printf("ec2.CreateTags %s %s: %v", resources[i].Kind, id, err)
+		}
+	}
+}
+
+// TagMap returns the provided tags as a map.
+func tagMap(tags []*ec2.Tag) map[string]string {
+	m := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		m[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return m
+}
+
+// IndexOf returns the index of the provided string in ss, or -1.
+func indexOf(ss []string, s string) int {
+	for i := range ss {
+		if ss[i] == s {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,122 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2system
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/fatbin"
+	"github.com/grailbio/base/log"
+)
+
+// StagedBinaryExpiry is the amount of time for which the presigned
+// URLs of staged binaries are valid.
+const stagedBinaryExpiry = 24 * time.Hour
+
+// A stagedBinary is a binary that is staged, once, to the system's
+// BinaryStagingURL.
+type stagedBinary struct {
+	once sync.Once
+	err  error
+}
+
+// StageBinary uploads the provided binary image, which has the
+// provided digest, to the system's BinaryStagingURL, unless it was
+// staged there before, and returns a presigned URL from which
+// machines may fetch it. StageBinary fails with an error of kind
+// errors.NotSupported if the system has no BinaryStagingURL.
+func (s *System) StageBinary(ctx context.Context, bin *fatbin.Reader, info fatbin.Info, d digest.Digest) (string, error) {
+	if s.BinaryStagingURL == "" {
+		return "", errors.E(errors.NotSupported, "ec2system: binary staging is not configured")
+	}
+	bucket, prefix, err := parseStagingURL(s.BinaryStagingURL)
+	if err != nil {
+		return "", err
+	}
+	key := path.Join(prefix, d.Name()+"-"+d.Hex())
+	s.stagedMu.Lock()
+	if s.staged == nil {
+		s.staged = make(map[digest.Digest]*stagedBinary)
+	}
+	staged := s.staged[d]
+	if staged == nil {
+		staged = new(stagedBinary)
+		s.staged[d] = staged
+	}
+	s.stagedMu.Unlock()
+	staged.once.Do(func() {
+		staged.err = s.stage(ctx, bin, info, bucket, key)
+	})
+	if staged.err != nil {
+		return "", staged.err
+	}
+	// URLs are presigned on each call, so that they remain valid for
+	// binaries that were staged long ago.
+	req, _ := s.s3.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	return req.Presign(stagedBinaryExpiry)
+}
+
+// Stage uploads the provided binary image to the provided S3 bucket
+// and key, unless an object of the image's size is already present.
+// Since keys are derived from the binaries' digests, such objects
+// contain the same binary.
+func (s *System) stage(ctx context.Context, bin *fatbin.Reader, info fatbin.Info, bucket, key string) error {
+	head, err := s.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err == nil && aws.Int64Value(head.ContentLength) == info.Size {
+		log.Debug.Printf("ec2system: binary %s/%s already staged at s3://%s/%s", info.Goos, info.Goarch, bucket, key)
+		return nil
+	}
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "NotFound" {
+			return errors.E(fmt.Sprintf("ec2system: stat s3://%s/%s", bucket, key), err)
+		}
+	}
+	rc, err := bin.Open(info.Goos, info.Goarch)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	log.Printf("ec2system: staging binary %s/%s (%d bytes) at s3://%s/%s", info.Goos, info.Goarch, info.Size, bucket, key)
+	_, err = s3manager.NewUploaderWithClient(s.s3).UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   rc,
+	})
+	if err != nil {
+		return errors.E(fmt.Sprintf("ec2system: upload s3://%s/%s", bucket, key), err)
+	}
+	return nil
+}
+
+// ParseStagingURL returns the bucket and key prefix of the provided
+// S3 URL.
+func parseStagingURL(rawurl string) (bucket, prefix string, err error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", "", errors.E(errors.Invalid, "ec2system: BinaryStagingURL", err)
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return "", "", errors.E(errors.Invalid, fmt.Sprintf("ec2system: BinaryStagingURL %q: expected s3://bucket/prefix", rawurl))
+	}
+	return u.Host, strings.Trim(u.Path, "/"), nil
+}
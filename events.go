@@ -0,0 +1,196 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A MachineEventType is the type of a machine lifecycle event.
+type MachineEventType int
+
+const (
+	// MachineBooting indicates that the machine has started to boot.
+	MachineBooting MachineEventType = iota
+	// MachineBinaryUploaded indicates that the driver's binary has
+	// been uploaded to the machine.
+	MachineBinaryUploaded
+	// MachineExeced indicates that the machine has executed the
+	// uploaded binary.
+	MachineExeced
+	// MachineRunning indicates that the machine is running: its
+	// services have been instantiated and it is ready to accept calls.
+	MachineRunning
+	// MachineUnhealthy indicates that the machine's supervisor reported
+	// the machine to be unhealthy.
+	MachineUnhealthy
+	// MachineHealthy indicates that a machine that was unhealthy
+	// became healthy again.
+	MachineHealthy
+	// MachineKeepaliveLost indicates that the machine failed to reply
+	// to keepalives. It is followed by MachineStopped.
+	MachineKeepaliveLost
+	// MachineStopped indicates that the machine stopped. The event's
+	// error is the cause.
+	MachineStopped
+	// MachineDraining indicates that the machine started to drain (see
+	// Machine.Drain).
+	MachineDraining
+	// MachineReplaced indicates that the machine, which stopped
+	// unexpectedly, was replaced by the event's Replacement (see
+	// AutoReplace). The event's error is the cause of the stop.
+	MachineReplaced
+	// MachineUpgraded indicates that the machine's binary was upgraded
+	// (see B.Upgrade).
+	MachineUpgraded
+	// MachineMemoryThreshold indicates that the machine crossed a
+	// memory threshold of its memory watchdog (see MemoryWatchdog).
+	// The event's Reason describes the threshold and its limit.
+	MachineMemoryThreshold
+	// MachineRebooted indicates that the machine was rebooted (see
+	// Machine.Reboot).
+	MachineRebooted
+	// MachineServiceQuarantined indicates that a service of the
+	// machine was quarantined because it panicked repeatedly (see
+	// ServiceRestart). The event's Reason names the service and
+	// describes its panic.
+	MachineServiceQuarantined
+	// MachineServiceRestarted indicates that a quarantined service of
+	// the machine was restarted. The event's Reason names the service.
+	MachineServiceRestarted
+)
+
+var machineEventTypeStrings = [...]string{
+	MachineBooting:            "BOOTING",
+	MachineBinaryUploaded:     "BINARY_UPLOADED",
+	MachineExeced:             "EXECED",
+	MachineRunning:            "RUNNING",
+	MachineUnhealthy:          "UNHEALTHY",
+	MachineHealthy:            "HEALTHY",
+	MachineKeepaliveLost:      "KEEPALIVE_LOST",
+	MachineStopped:            "STOPPED",
+	MachineDraining:           "DRAINING",
+	MachineReplaced:           "REPLACED",
+	MachineUpgraded:           "UPGRADED",
+	MachineMemoryThreshold:    "MEMORY_THRESHOLD",
+	MachineRebooted:           "REBOOTED",
+	MachineServiceQuarantined: "SERVICE_QUARANTINED",
+	MachineServiceRestarted:   "SERVICE_RESTARTED",
+}
+
+// String returns a string representation of the event type.
+func (t MachineEventType) String() string {
+	if t < 0 || int(t) >= len(machineEventTypeStrings) {
+		return "UNKNOWN"
+	}
+	return machineEventTypeStrings[t]
+}
+
+// A MachineEvent is a machine lifecycle event.
+type MachineEvent struct {
+	// Machine is the machine to which the event pertains.
+	Machine *Machine
+	// Type is the type of the event.
+	Type MachineEventType
+	// Time is the time at which the event occurred.
+	Time time.Time
+	// Err is the error associated with the event, if any: for
+	// MachineStopped events, it is the cause of the stop; for
+	// MachineKeepaliveLost events, it is the keepalive error.
+	Err error
+	// Reason describes why the machine is unhealthy, for
+	// MachineUnhealthy events, the crossed threshold, for
+	// MachineMemoryThreshold events, and the service, for
+	// MachineServiceQuarantined and MachineServiceRestarted events.
+	Reason string
+	// Replacement is the machine that replaces the event's machine,
+	// for MachineReplaced events.
+	Replacement *Machine
+}
+
+// Events returns a channel of lifecycle events of b's machines:
+// events are delivered as the machines boot, are uploaded and
+// execute the driver's binary, start running, change health, lose
+// keepalives, stop, and are replaced. This lets drivers and monitoring react to
+// machine lifecycles without waiting on every machine. Events for a
+// machine are delivered in order; they are buffered as needed so
+// that slow receivers do not miss events or hold up b. Only events
+// that occur after the call to Events are delivered. The returned
+// channel is closed once the provided context is done.
+func (b *B) Events(ctx context.Context) <-chan MachineEvent {
+	sub := &eventSubscriber{
+		signal: make(chan struct{}, 1),
+		c:      make(chan MachineEvent),
+	}
+	b.subsMu.Lock()
+	if b.eventSubs == nil {
+		b.eventSubs = make(map[*eventSubscriber]bool)
+	}
+	b.eventSubs[sub] = true
+	b.subsMu.Unlock()
+	go func() {
+		sub.Run(ctx)
+		b.subsMu.Lock()
+		delete(b.eventSubs, sub)
+		b.subsMu.Unlock()
+	}()
+	return sub.c
+}
+
+// Emit delivers the provided event to b's event subscribers.
+func (b *B) emit(event MachineEvent) {
+	if event.Type == MachineRunning && event.Machine.Owned() {
+		b.boots.observe(event.Time.Sub(event.Machine.StartTime()))
+	}
+	b.subsMu.Lock()
+	defer b.subsMu.Unlock()
+	for sub := range b.eventSubs {
+		sub.Add(event)
+	}
+}
+
+// An eventSubscriber buffers the events delivered to a subscription.
+type eventSubscriber struct {
+	mu      sync.Mutex
+	pending []MachineEvent
+	signal  chan struct{}
+	c       chan MachineEvent
+}
+
+// Add enqueues an event.
+func (s *eventSubscriber) Add(event MachineEvent) {
+	s.mu.Lock()
+	s.pending = append(s.pending, event)
+	s.mu.Unlock()
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers the subscriber's events until the context is done.
+func (s *eventSubscriber) Run(ctx context.Context) {
+	defer close(s.c)
+	for {
+		s.mu.Lock()
+		pending := s.pending
+		s.pending = nil
+		s.mu.Unlock()
+		for _, event := range pending {
+			select {
+			case s.c <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case <-s.signal:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
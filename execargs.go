@@ -0,0 +1,89 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/grailbio/base/log"
+)
+
+const (
+	// ArgsFileEnv is the environment variable that names the file to
+	// which the arguments of an executed binary were spilled.
+	argsFileEnv = "BIGMACHINE_ARGS_FILE"
+
+	// MaxExecArgSize is the maximum size of a single argument or
+	// environment variable passed to exec (MAX_ARG_STRLEN on Linux).
+	maxExecArgSize = 128 << 10
+	// MaxExecArgsSize is the maximum combined size of the arguments and
+	// environment passed to exec. It is a conservative bound on the
+	// operating system's limit (ARG_MAX), which on Linux is a quarter of
+	// the stack size limit.
+	maxExecArgsSize = 1 << 20
+)
+
+func init() {
+	if err := restoreSpilledArgs(); err != nil {
+		log.Fatalf("bigmachine: %v", err)
+	}
+}
+
+// ExecArgs returns the argument vector with which a binary with the
+// provided arguments and environment is executed: when the arguments
+// would exceed the operating system's limits on exec, failing it with
+// E2BIG, they are spilled to a temporary file, and the binary is
+// executed with only its name; the file is named by the returned
+// environment, and the arguments are restored from it when the binary
+// starts (see restoreSpilledArgs).
+func execArgs(args, environ []string) ([]string, []string, error) {
+	size := 0
+	spill := false
+	for _, s := range append(append([]string{}, args...), environ...) {
+		// Each string is passed with its terminating NUL and a pointer.
+		size += len(s) + 1 + 8
+		if len(s) >= maxExecArgSize {
+			spill = true
+		}
+	}
+	if !spill && size <= maxExecArgsSize {
+		return args, environ, nil
+	}
+	f, err := ioutil.TempFile("", "bigmachine-args-")
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = f.WriteString(strings.Join(args, "\x00"))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, nil, fmt.Errorf("spilling arguments: %v", err)
+	}
+	log.Printf("arguments (%d bytes) exceed exec limits; spilled to %s", size, f.Name())
+	return args[:1], append(environ, argsFileEnv+"="+f.Name()), nil
+}
+
+// RestoreSpilledArgs restores the process's arguments (os.Args) from
+// the file to which they were spilled by execArgs, if any. It runs
+// when the package is initialized, so that the arguments are restored
+// before they are parsed by the program. The file is then removed.
+func restoreSpilledArgs() error {
+	path := os.Getenv(argsFileEnv)
+	if path == "" {
+		return nil
+	}
+	os.Unsetenv(argsFileEnv)
+	p, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("restoring spilled arguments: %v", err)
+	}
+	os.Args = strings.Split(string(p), "\x00")
+	return os.Remove(path)
+}
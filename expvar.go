@@ -39,11 +39,11 @@ func (v machineVars) String() string {
 		g.Go(func() error {
 			var mvars Expvars
 			if err := m.Call(ctx, "Supervisor.Expvars", struct{}{}, &mvars); err != nil {
-				log.Error.Printf("failed to retrieve variables for %s: %v", m.Addr, err)
+				log.Error.Printf("failed to retrieve variables for %s: %v", m.Name(), err)
 				return nil
 			}
 			mu.Lock()
-			vars[m.Addr] = mvars
+			vars[m.Name()] = mvars
 			mu.Unlock()
 			return nil
 		})
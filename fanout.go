@@ -0,0 +1,246 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/fatbin"
+	"github.com/grailbio/base/log"
+)
+
+// BinaryFanout is an option that distributes the driver's binary to
+// the B's machines peer-to-peer: a starting machine fetches the binary
+// from a machine that already runs it, and each such machine, like the
+// driver, serves the binary to at most width machines at a time. Since
+// the number of machines that serve the binary grows with each round
+// of transfers, a large cluster boots after O(log N) rounds instead of
+// N uploads, and the driver's egress is bounded by width uploads.
+// Peers that are closer to the starting machine (see Location) are
+// preferred; if a transfer from a peer fails, the machine falls back
+// to uploading the binary from the driver.
+func BinaryFanout(width int) Option {
+	return func(b *B) {
+		if width > 0 {
+			b.fanout = newBinaryFanout(width)
+		}
+	}
+}
+
+// A fanoutSource is a source of binaries: a machine that runs a
+// binary, or the driver, if machine is nil.
+type fanoutSource struct {
+	machine *Machine
+	// active is the number of transfers from the source in progress.
+	active int
+}
+
+// A binaryFanout schedules the transfers of binaries to machines
+// (see BinaryFanout).
+type binaryFanout struct {
+	width int
+
+	mu sync.Mutex
+	// driver is the driver's source, which serves all binaries.
+	driver *fanoutSource
+	// sources are the machines that serve each binary, keyed by
+	// digest.
+	sources map[digest.Digest][]*fanoutSource
+	// changed is closed (and replaced) when a source becomes
+	// available.
+	changed chan struct{}
+}
+
+func newBinaryFanout(width int) *binaryFanout {
+	return &binaryFanout{
+		width:   width,
+		driver:  new(fanoutSource),
+		sources: make(map[digest.Digest][]*fanoutSource),
+		changed: make(chan struct{}),
+	}
+}
+
+// Acquire acquires a source of the binary with the provided digest
+// for machine m, waiting for a source to become available if
+// necessary. If peers is false, only the driver is acquired. The
+// source must be released when the transfer is done.
+func (f *binaryFanout) Acquire(ctx context.Context, d digest.Digest, m *Machine, peers bool) (*fanoutSource, error) {
+	for {
+		f.mu.Lock()
+		src := f.pick(d, m, peers)
+		if src != nil {
+			src.active++
+			f.mu.Unlock()
+			return src, nil
+		}
+		changed := f.changed
+		f.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, errors.E("waiting for a binary source", ctx.Err())
+		}
+	}
+}
+
+// Pick returns the preferred available source of the binary with the
+// provided digest for machine m, or nil if none is available. Peers
+// are preferred over the driver, and closer peers, then less busy
+// ones, over others. Pick drops sources whose machines have stopped.
+// It must be called with f.mu held.
+func (f *binaryFanout) pick(d digest.Digest, m *Machine, peers bool) *fanoutSource {
+	var (
+		best     *fanoutSource
+		bestRank int
+		live     = f.sources[d][:0]
+	)
+	for _, src := range f.sources[d] {
+		if src.machine.State() >= Stopped {
+			continue
+		}
+		live = append(live, src)
+		if !peers || src.active >= f.width {
+			continue
+		}
+		rank := fanoutRank(src.machine, m)
+		if best == nil || rank < bestRank || rank == bestRank && src.active < best.active {
+			best, bestRank = src, rank
+		}
+	}
+	f.sources[d] = live
+	if best == nil && f.driver.active < f.width {
+		best = f.driver
+	}
+	return best
+}
+
+// FanoutRank ranks the transfers of binaries from machine src to
+// machine dst by the scope of the traffic between them; lower ranks
+// are preferred.
+func fanoutRank(src, dst *Machine) int {
+	if !src.located || !dst.located {
+		return 2
+	}
+	switch trafficScopeBetween(src.location, dst.location) {
+	case TrafficSameZone:
+		return 0
+	case TrafficCrossZone:
+		return 1
+	case TrafficCrossRegion:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// Release releases a source acquired by Acquire.
+func (f *binaryFanout) Release(src *fanoutSource) {
+	f.mu.Lock()
+	src.active--
+	f.broadcast()
+	f.mu.Unlock()
+}
+
+// Add adds machine m, which runs the binary with the provided digest,
+// as a source of that binary.
+func (f *binaryFanout) Add(d digest.Digest, m *Machine) {
+	f.mu.Lock()
+	f.sources[d] = append(f.sources[d], &fanoutSource{machine: m})
+	f.broadcast()
+	f.mu.Unlock()
+}
+
+// Broadcast wakes the waiters of Acquire. It must be called with
+// f.mu held.
+func (f *binaryFanout) broadcast() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// A peerBinaryRequest is the argument of Supervisor.FetchPeerBinary.
+type peerBinaryRequest struct {
+	// Addr is the address of the peer from which the binary is
+	// fetched.
+	Addr string
+	// Digest and Size are the binary's digest (see DigestPolicy) and
+	// size.
+	Digest digest.Digest
+	Size   int64
+}
+
+// GetCachedBinary replies with the binary with the provided digest,
+// if the supervisor has one: either the binary that the supervisor
+// itself runs, or one in the binary cache (see binaryCacheDir). It
+// lets the supervisor's peers fetch the binary from it (see
+// Supervisor.FetchPeerBinary).
+func (s *Supervisor) GetCachedBinary(ctx context.Context, d digest.Digest, reply *io.ReadCloser) error {
+	path, err := findBinary(d)
+	if err != nil {
+		return err
+	}
+	if path == "" {
+		return errors.E(errors.NotExist, fmt.Sprintf("Supervisor.GetCachedBinary: no binary %s", d.Short()))
+	}
+	f, err := os.Open(path)
+	*reply = f
+	return err
+}
+
+// FetchPeerBinary fetches the binary that is run by Supervisor.Exec
+// from the peer supervisor at the requested address (see
+// Supervisor.GetCachedBinary), and verifies that it has the expected
+// size and digest.
+func (s *Supervisor) FetchPeerBinary(ctx context.Context, req peerBinaryRequest, _ *struct{}) error {
+	if s.b == nil || s.b.client == nil {
+		return errors.E(errors.NotSupported, "Supervisor.FetchPeerBinary: no client")
+	}
+	var rc io.ReadCloser
+	if err := s.b.client.Call(ctx, req.Addr, "Supervisor.GetCachedBinary", req.Digest, &rc); err != nil {
+		return err
+	}
+	defer rc.Close()
+	return s.installBinary("Supervisor.FetchPeerBinary", rc, req.Digest, req.Size)
+}
+
+// DistributeBinary installs the provided binary image on the machine
+// from a source acquired from the machine's binary fanout: a peer that
+// runs the binary, or the driver, which uploads it.
+func (m *Machine) distributeBinary(ctx context.Context, bin *fatbin.Reader, info fatbin.Info) error {
+	d, err := cachedImageDigest(bin, info.Goos, info.Goarch)
+	if err != nil {
+		log.Error.Printf("%s: digest binary: %v", m.Name(), err)
+		return m.uploadBinary(ctx, bin, info)
+	}
+	const floor = 100 << 10 // bps
+	timeout := time.Duration((info.Size+floor-1)/floor)*time.Second + 10*time.Second
+	peers := true
+	for {
+		src, err := m.fanout.Acquire(ctx, d, m, peers)
+		if err != nil {
+			return err
+		}
+		if src.machine == nil {
+			err = m.uploadBinary(ctx, bin, info)
+			m.fanout.Release(src)
+			return err
+		}
+		req := peerBinaryRequest{Addr: src.machine.Addr, Digest: d, Size: info.Size}
+		err = m.timeoutCall(ctx, timeout, "Supervisor.FetchPeerBinary", req, nil)
+		m.fanout.Release(src)
+		if err == nil {
+			log.Printf("%s: fetched binary from %s", m.Name(), src.machine.Name())
+			return nil
+		}
+		log.Error.Printf("%s: fetch binary from %s: %v; uploading binary", m.Name(), src.machine.Name(), err)
+		peers = false
+	}
+}
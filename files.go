@@ -0,0 +1,197 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"bytes"
+	"context"
+	encbinary "encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/grailbio/base/errors"
+)
+
+const (
+	// MaxCopySize is the maximum size of a file copied to or from a
+	// machine (see Machine.CopyTo and Machine.CopyFrom).
+	maxCopySize = 4 << 30
+	// MaxCopyPath is the maximum length of the path of a copied file.
+	maxCopyPath = 4 << 10
+)
+
+// FileRoot returns the directory within which files are copied to and
+// from the machine running the current process (see Machine.CopyTo
+// and Machine.CopyFrom). Services use it to locate files shipped by
+// the driver.
+func FileRoot() string {
+	return filepath.Join(os.TempDir(), "bigmachine-files")
+}
+
+// CopyTo copies the contents of the provided reader to the file at
+// the provided path on the machine, replacing any existing file. The
+// path is relative to the machine's file root (see FileRoot), outside
+// of which files may not be written; intermediate directories are
+// created as needed. The file is replaced atomically once its
+// contents are written. Files may not exceed 4 GiB. CopyTo lets
+// drivers ship configuration files and models to machines without
+// standing up their own service for it.
+func (m *Machine) CopyTo(ctx context.Context, path string, r io.Reader) error {
+	if len(path) > maxCopyPath {
+		return errors.E(errors.Invalid, fmt.Sprintf("path of %d bytes is too long", len(path)))
+	}
+	// The path precedes the file's contents in the streamed argument.
+	var header bytes.Buffer
+	if err := encbinary.Write(&header, encbinary.BigEndian, uint16(len(path))); err != nil {
+		return err
+	}
+	header.WriteString(path)
+	return m.Call(ctx, "Supervisor.Put", io.MultiReader(&header, r), nil)
+}
+
+// CopyFrom returns the contents of the file at the provided path on
+// the machine, relative to its file root (see CopyTo). The caller
+// must close the returned reader.
+func (m *Machine) CopyFrom(ctx context.Context, path string) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	if err := m.Call(ctx, "Supervisor.Get", path, &rc); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+// Put writes a file within the machine's file root. The argument is
+// the file's path, relative to the root, preceded by its length as a
+// big-endian uint16, followed by the file's contents (see
+// Machine.CopyTo).
+func (s *Supervisor) Put(ctx context.Context, arg io.Reader, _ *struct{}) error {
+	var n uint16
+	if err := encbinary.Read(arg, encbinary.BigEndian, &n); err != nil {
+		return errors.E(errors.Invalid, "Supervisor.Put: reading path", err)
+	}
+	p := make([]byte, n)
+	if _, err := io.ReadFull(arg, p); err != nil {
+		return errors.E(errors.Invalid, "Supervisor.Put: reading path", err)
+	}
+	path, err := sandboxPath(string(p))
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	w := &limitWriter{w: f, n: maxCopySize}
+	_, err = io.Copy(w, arg)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if w.exceeded {
+		return errors.E(errors.Invalid, fmt.Sprintf("Supervisor.Put %s: file exceeds the limit of %d bytes", p, int64(maxCopySize)))
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Get replies with the contents of a file within the machine's file
+// root (see Machine.CopyFrom).
+func (s *Supervisor) Get(ctx context.Context, path string, reply *io.ReadCloser) error {
+	name, err := sandboxPath(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return errors.E(errors.NotExist, fmt.Sprintf("Supervisor.Get %s: file does not exist", path))
+	} else if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if info.IsDir() {
+		f.Close()
+		return errors.E(errors.Invalid, fmt.Sprintf("Supervisor.Get %s: file is a directory", path))
+	}
+	if info.Size() > maxCopySize {
+		f.Close()
+		return errors.E(errors.Invalid, fmt.Sprintf("Supervisor.Get %s: file exceeds the limit of %d bytes", path, int64(maxCopySize)))
+	}
+	*reply = f
+	return nil
+}
+
+// SandboxPath returns the local path of the file with the provided
+// path relative to the file root (see FileRoot). It fails with an
+// error of kind errors.Invalid if the path is absolute or escapes the
+// root, including through symbolic links.
+func sandboxPath(path string) (string, error) {
+	clean := filepath.Clean(path)
+	if path == "" || filepath.IsAbs(path) || !withinRoot(clean) {
+		return "", errors.E(errors.Invalid, fmt.Sprintf("path %q is not within the machine's file root", path))
+	}
+	name := filepath.Join(FileRoot(), clean)
+	// Symbolic links within the root may point outside of it, so we
+	// also check the path with the links in its longest existing
+	// prefix resolved. If the root does not exist, neither do links
+	// within it.
+	root, err := filepath.EvalSymlinks(FileRoot())
+	if os.IsNotExist(err) {
+		return name, nil
+	} else if err != nil {
+		return "", err
+	}
+	prefix := name
+	for {
+		resolved, err := filepath.EvalSymlinks(prefix)
+		if err == nil {
+			rel, err := filepath.Rel(root, resolved)
+			if err != nil || rel != "." && !withinRoot(rel) {
+				return "", errors.E(errors.Invalid, fmt.Sprintf("path %q is not within the machine's file root", path))
+			}
+			return name, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		prefix = filepath.Dir(prefix)
+	}
+}
+
+// WithinRoot tells whether the provided clean, relative path names a
+// file strictly within the directory to which it is relative.
+func withinRoot(rel string) bool {
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// A limitWriter writes to w, failing writes that would exceed n
+// bytes in total.
+type limitWriter struct {
+	w        io.Writer
+	n        int64
+	exceeded bool
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		l.exceeded = true
+		return 0, io.ErrShortWrite
+	}
+	n, err := l.w.Write(p)
+	l.n -= int64(n)
+	return n, err
+}
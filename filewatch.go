@@ -0,0 +1,212 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/grailbio/bigmachine/rpc"
+)
+
+// FileWatchPeriod is the interval at which watched files are polled
+// for changes.
+const fileWatchPeriod = time.Second
+
+// A FileEventType is the type of a change to a watched file.
+type FileEventType int
+
+const (
+	// FileCreated indicates that the file was created.
+	FileCreated FileEventType = iota
+	// FileModified indicates that the file's size or modification time
+	// changed.
+	FileModified
+	// FileRemoved indicates that the file was removed.
+	FileRemoved
+)
+
+var fileEventTypeStrings = [...]string{
+	FileCreated:  "CREATED",
+	FileModified: "MODIFIED",
+	FileRemoved:  "REMOVED",
+}
+
+// String returns a string representation of the event type.
+func (t FileEventType) String() string {
+	if t < 0 || int(t) >= len(fileEventTypeStrings) {
+		return "UNKNOWN"
+	}
+	return fileEventTypeStrings[t]
+}
+
+// A FileEvent describes a change to a file watched on a machine (see
+// Machine.WatchFiles).
+type FileEvent struct {
+	// Path is the path of the file on the machine.
+	Path string
+	// Type is the type of the change.
+	Type FileEventType
+	// Size and ModTime are the file's size and modification time after
+	// the change. They are zero for FileRemoved events.
+	Size    int64
+	ModTime time.Time
+	// Dir tells whether the file is a directory.
+	Dir bool
+}
+
+// A watchRequest is a request to watch files on a machine.
+type watchRequest struct {
+	// Path is the path of the file or directory to watch.
+	Path string
+	// Recursive watches the directory's subdirectories, too.
+	Recursive bool
+}
+
+// WatchFiles watches the file or directory at the provided path on
+// the machine, and returns a FileWatch on which changes to the file,
+// or to the directory's entries, are delivered. If recursive is true,
+// changes within the directory's subdirectories are delivered, too.
+// Only changes that occur after WatchFiles returns are delivered.
+// Files are polled for changes every second, so that rapid successive
+// changes may be coalesced. Watches let drivers integrate workers that
+// communicate by writing output files, rather than by RPC.
+func (m *Machine) WatchFiles(ctx context.Context, path string, recursive bool) (*FileWatch, error) {
+	var rc io.ReadCloser
+	if err := m.Call(ctx, "Supervisor.WatchFiles", watchRequest{path, recursive}, &rc); err != nil {
+		return nil, err
+	}
+	return &FileWatch{rc: rc, dec: gob.NewDecoder(rc)}, nil
+}
+
+// A FileWatch delivers changes to files watched on a machine.
+type FileWatch struct {
+	rc  io.ReadCloser
+	dec *gob.Decoder
+}
+
+// Next returns the next change to the watched files, blocking until
+// one occurs. Next returns io.EOF if the watch has ended.
+func (w *FileWatch) Next() (FileEvent, error) {
+	var event FileEvent
+	err := w.dec.Decode(&event)
+	return event, err
+}
+
+// Close ends the watch.
+func (w *FileWatch) Close() error {
+	return w.rc.Close()
+}
+
+// WatchFiles watches the requested files, replying with a stream of
+// gob-encoded FileEvents that describe changes to them. The watch
+// lasts until the stream is closed.
+func (s *Supervisor) WatchFiles(ctx context.Context, req watchRequest, reply *io.ReadCloser) error {
+	files, err := statFiles(req.Path, req.Recursive)
+	if err != nil {
+		return err
+	}
+	r, w := io.Pipe()
+	go func() {
+		tick := time.NewTicker(fileWatchPeriod)
+		defer tick.Stop()
+		enc := gob.NewEncoder(w)
+		for {
+			select {
+			case <-tick.C:
+			case <-ctx.Done():
+				w.CloseWithError(ctx.Err())
+				return
+			}
+			next, err := statFiles(req.Path, req.Recursive)
+			if err != nil {
+				w.CloseWithError(err)
+				return
+			}
+			for _, event := range diffFiles(files, next) {
+				if err := enc.Encode(event); err != nil {
+					w.CloseWithError(err)
+					return
+				}
+			}
+			files = next
+		}
+	}()
+	*reply = rpc.Flush(r)
+	return nil
+}
+
+// StatFiles returns the file info of the file at the provided path,
+// and, if it is a directory, of its entries (recursively, if
+// recursive is true), keyed by path. A path that does not exist has
+// no files.
+func statFiles(path string, recursive bool) (map[string]os.FileInfo, error) {
+	files := make(map[string]os.FileInfo)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return files, nil
+	} else if err != nil {
+		return nil, err
+	}
+	files[path] = info
+	if !info.IsDir() {
+		return files, nil
+	}
+	if !recursive {
+		infos, err := ioutil.ReadDir(path)
+		if os.IsNotExist(err) {
+			return files, nil
+		} else if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			files[filepath.Join(path, info.Name())] = info
+		}
+		return files, nil
+	}
+	err = filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// The file was removed during the walk.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		files[path] = info
+		return nil
+	})
+	return files, err
+}
+
+// DiffFiles returns the events that describe the changes from the
+// files prev to the files next, ordered by path.
+func diffFiles(prev, next map[string]os.FileInfo) []FileEvent {
+	var events []FileEvent
+	for path, info := range next {
+		event := FileEvent{Path: path, Size: info.Size(), ModTime: info.ModTime(), Dir: info.IsDir()}
+		if old, ok := prev[path]; !ok {
+			event.Type = FileCreated
+		} else if old.Size() != info.Size() || !old.ModTime().Equal(info.ModTime()) {
+			event.Type = FileModified
+		} else {
+			continue
+		}
+		events = append(events, event)
+	}
+	for path, info := range prev {
+		if _, ok := next[path]; !ok {
+			events = append(events, FileEvent{Path: path, Type: FileRemoved, Dir: info.IsDir()})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Path < events[j].Path
+	})
+	return events
+}
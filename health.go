@@ -0,0 +1,119 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+)
+
+const (
+	// HealthCheckPeriod is the interval at which health checks are run.
+	healthCheckPeriod = 30 * time.Second
+	// HealthCheckTimeout is the amount of time after which a health
+	// check that has not returned is considered to have failed.
+	healthCheckTimeout = 10 * time.Second
+)
+
+// A HealthChecker is a service that checks its own health. Services
+// that implement HealthChecker are checked periodically by their
+// machine's supervisor; a machine is reported unhealthy (see
+// Machine.Healthy) while any of its checks fail, even if its
+// supervisor still responds to keepalives. Checks that do not return
+// within 10 seconds, for example because the service is deadlocked,
+// are considered to have failed.
+type HealthChecker interface {
+	// Healthy returns an error describing why the service is unhealthy,
+	// or nil if it is healthy.
+	Healthy(ctx context.Context) error
+}
+
+// CheckHealthLoop runs health checks periodically until the provided
+// context is done.
+func (s *Supervisor) checkHealthLoop(ctx context.Context) {
+	tick := time.NewTicker(healthCheckPeriod)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+		s.checkHealth(ctx)
+		s.checkDisk(ctx)
+	}
+}
+
+// CheckHealth runs the health checks of the supervisor's services
+// and records their outcome, to be reported in keepalive replies.
+func (s *Supervisor) checkHealth(ctx context.Context) {
+	checks := make(map[string]HealthChecker)
+	s.servicesMu.Lock()
+	for name, iface := range s.services {
+		if checker, ok := iface.(HealthChecker); ok {
+			checks[name] = checker
+		}
+	}
+	s.servicesMu.Unlock()
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var problems []string
+	for _, name := range names {
+		if err := runHealthCheck(ctx, checks[name].Healthy); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	var err error
+	if len(problems) > 0 {
+		err = errors.E(errors.Unavailable, strings.Join(problems, "; "))
+	}
+	s.healthMu.Lock()
+	if err != nil && s.healthErr == nil {
+		log.Error.Printf("health check failed; marking machine unhealthy: %v", err)
+	} else if err == nil && s.healthErr != nil {
+		log.Printf("health checks pass; marking machine healthy")
+	}
+	s.healthErr = err
+	s.healthMu.Unlock()
+}
+
+// HealthError returns the error of the most recent failed health
+// checks, or nil if they passed.
+func (s *Supervisor) healthError() error {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	return s.healthErr
+}
+
+// RunHealthCheck runs the provided health check (or readiness probe),
+// failing it if it does not return within healthCheckTimeout.
+func runHealthCheck(ctx context.Context, check func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		defer func() {
+			if e := recover(); e != nil {
+				errc <- fmt.Errorf("panic: %v", e)
+			}
+		}()
+		errc <- check(ctx)
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("health check did not complete within %s", healthCheckTimeout)
+	}
+}
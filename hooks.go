@@ -0,0 +1,82 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+
+	"github.com/grailbio/base/log"
+)
+
+// Hooks are callbacks that are invoked as machines change state, for
+// example to clean up after, re-dispatch the work of, or alert on
+// machines, without a goroutine per machine blocked on Machine.Wait.
+// Hooks may be registered for individual machines, as a machine
+// parameter, or for all of a B's machines, with the MachineHooks
+// option. Hooks are invoked from a single goroutine per B, in the
+// order in which the machines' lifecycle events occurred (see
+// B.Events); hooks that block delay subsequent hooks, and should hand
+// off long-running work. Hooks that panic are logged.
+type Hooks struct {
+	// OnRunning is called when a machine starts running.
+	OnRunning func(m *Machine)
+	// OnUnhealthy is called when a machine's supervisor reports the
+	// machine to be unhealthy, with the reason that it is unhealthy.
+	OnUnhealthy func(m *Machine, reason string)
+	// OnStopped is called when a machine stops, with the cause of
+	// the stop.
+	OnStopped func(m *Machine, err error)
+}
+
+func (h Hooks) applyParam(m *Machine) {
+	m.hooks = append(m.hooks, h)
+}
+
+// MachineHooks is an option that registers hooks that are invoked for
+// each of the B's machines (see Hooks). Multiple hooks may be
+// registered.
+func MachineHooks(hooks Hooks) Option {
+	return func(b *B) {
+		b.hooks = append(b.hooks, hooks)
+	}
+}
+
+// StartHooks starts b's hook dispatcher, if it is not already
+// running. It must be called before the machines whose hooks are to be
+// invoked are started.
+func (b *B) startHooks() {
+	b.hooksOnce.Do(func() {
+		go b.runHooks(b.Events(context.Background()))
+	})
+}
+
+// RunHooks invokes the hooks registered for the provided events.
+func (b *B) runHooks(events <-chan MachineEvent) {
+	for event := range events {
+		m := event.Machine
+		for _, hooks := range [][]Hooks{b.hooks, m.hooks} {
+			for _, h := range hooks {
+				switch {
+				case event.Type == MachineRunning && h.OnRunning != nil:
+					invokeHook(m, "OnRunning", func() { h.OnRunning(m) })
+				case event.Type == MachineUnhealthy && h.OnUnhealthy != nil:
+					invokeHook(m, "OnUnhealthy", func() { h.OnUnhealthy(m, event.Reason) })
+				case event.Type == MachineStopped && h.OnStopped != nil:
+					invokeHook(m, "OnStopped", func() { h.OnStopped(m, event.Err) })
+				}
+			}
+		}
+	}
+}
+
+// InvokeHook invokes the named hook of the machine m, logging panics.
+func invokeHook(m *Machine, name string, hook func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Error.Printf("%s: %s hook panicked: %v", m.Name(), name, err)
+		}
+	}()
+	hook()
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grailbio/base/errors"
+)
+
+// An initAfterer is a service that depends on other services of its
+// machine: it implements the method
+//
+//	InitAfter() []string
+//
+// which returns the names of the services that must be registered and
+// initialized (see Services) before it is. Services are otherwise
+// registered in an unspecified order.
+type initAfterer interface {
+	InitAfter() []string
+}
+
+// InitAfter returns the names of the services on which the provided
+// service depends (see initAfterer).
+func initAfter(iface interface{}) []string {
+	if after, ok := iface.(initAfterer); ok {
+		return after.InitAfter()
+	}
+	return nil
+}
+
+// ServiceOrder returns the names of the provided services in the
+// order in which they must be registered: each service follows the
+// services it depends on (see initAfterer). Services that are not
+// ordered by dependencies are ordered by name. ServiceOrder returns an
+// error of kind errors.Invalid if a service depends on a service that
+// is not provided, or if the dependencies form a cycle.
+func serviceOrder(services map[string]interface{}) ([]string, error) {
+	var (
+		names      = make([]string, 0, len(services))
+		dependents = make(map[string][]string)
+		pending    = make(map[string]int)
+	)
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, dep := range initAfter(services[name]) {
+			if _, ok := services[dep]; !ok {
+				return nil, errors.E(errors.Invalid,
+					fmt.Sprintf("service %s depends on service %s, which is not provided", name, dep))
+			}
+			dependents[dep] = append(dependents[dep], name)
+			pending[name]++
+		}
+	}
+	var (
+		order = make([]string, 0, len(names))
+		ready []string
+	)
+	for _, name := range names {
+		if pending[name] == 0 {
+			ready = append(ready, name)
+		}
+	}
+	for len(ready) > 0 {
+		name := ready[0]
+		ready = ready[1:]
+		order = append(order, name)
+		var next []string
+		for _, dependent := range dependents[name] {
+			if pending[dependent]--; pending[dependent] == 0 {
+				next = append(next, dependent)
+			}
+		}
+		ready = append(ready, next...)
+		sort.Strings(ready)
+	}
+	if len(order) < len(names) {
+		var cycle []string
+		for _, name := range names {
+			if pending[name] > 0 {
+				cycle = append(cycle, name)
+			}
+		}
+		return nil, errors.E(errors.Invalid,
+			fmt.Sprintf("services %s have cyclic dependencies", strings.Join(cycle, ", ")))
+	}
+	return order, nil
+}
+
+// RegisterServices registers the machine's services with its
+// supervisor, which initializes them, in dependency order (see
+// serviceOrder).
+func (m *Machine) registerServices(ctx context.Context) error {
+	order, err := serviceOrder(m.services)
+	if err != nil {
+		return err
+	}
+	for _, name := range order {
+		if err := m.retryCall(ctx, 5*time.Minute, 25*time.Second, "Supervisor.Register", service{name, m.services[name]}, nil); err != nil {
+			return errors.E(err, fmt.Sprintf("Supervisor.Register %s", name))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grailbio/base/errors"
+)
+
+// An InFlightCall describes a call that is in flight to a machine, as
+// recorded in the machine's call journal (see Machine.InFlightCalls).
+type InFlightCall struct {
+	// ServiceMethod is the called method.
+	ServiceMethod string
+	// Start is the time at which the call was issued.
+	Start time.Time
+}
+
+// A callEntry is the entry of a call in its machine's journal.
+type callEntry struct {
+	InFlightCall
+	// cancel cancels the call.
+	cancel func()
+	// lost is set, when the machine is lost while the call is in
+	// flight, to the error with which the call fails.
+	lost *MachineLostError
+}
+
+// MachineLostError is the cause of the errors with which calls fail
+// when their machine is lost, that is, when it stops while they are in
+// flight: the calls are failed as soon as the machine stops, instead
+// of when they time out. Calls that fail this way did not necessarily
+// fail to execute; they may be redispatched to another machine (see
+// CallRedispatch) if their methods may be invoked more than once. The
+// errors are of kind errors.Unavailable and severity errors.Fatal; use
+// IsMachineLost to recognize them.
+type MachineLostError struct {
+	// Addr is the address of the lost machine.
+	Addr string
+	// ServiceMethod is the method of the lost call, and Start the time
+	// at which it was issued.
+	ServiceMethod string
+	Start         time.Time
+	// Err is the machine's error, if any (see Machine.Err).
+	Err error
+}
+
+// Error implements error.
+func (e *MachineLostError) Error() string {
+	msg := fmt.Sprintf("machine %s stopped with call %s in flight", e.Addr, e.ServiceMethod)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// IsMachineLost tells whether the provided error is the error of a
+// call whose machine was lost while the call was in flight (see
+// MachineLostError).
+func IsMachineLost(err error) bool {
+	for {
+		switch e := err.(type) {
+		case *MachineLostError:
+			return true
+		case *errors.Error:
+			err = e.Err
+		default:
+			return false
+		}
+	}
+}
+
+// InFlightCalls returns the calls that are in flight to the machine
+// through Machine.Call, ordered by the time at which they were issued.
+func (m *Machine) InFlightCalls() []InFlightCall {
+	m.mu.Lock()
+	calls := make([]InFlightCall, 0, len(m.journal))
+	for e := range m.journal {
+		calls = append(calls, e.InFlightCall)
+	}
+	m.mu.Unlock()
+	sort.Slice(calls, func(i, j int) bool { return calls[i].Start.Before(calls[j].Start) })
+	return calls
+}
+
+// JournalCall records a call of the provided method in the machine's
+// journal. It returns the context with which the call should be made,
+// which is canceled if the machine stops, and a function that removes
+// the call from the journal once it is done, returning the error of
+// the call if the machine was lost while it was in flight. The done
+// function is passed the call's reply: the context is canceled once
+// a streamed reply (*io.ReadCloser) is closed, so that it may continue
+// to be read once the call is done, and otherwise by done itself.
+func (m *Machine) journalCall(ctx context.Context, serviceMethod string) (context.Context, func(reply interface{}) *MachineLostError) {
+	ctx, cancel := context.WithCancel(ctx)
+	e := &callEntry{
+		InFlightCall: InFlightCall{ServiceMethod: serviceMethod, Start: time.Now()},
+		cancel:       cancel,
+	}
+	m.mu.Lock()
+	if State(m.state) >= Stopped {
+		m.mu.Unlock()
+		cancel()
+		return ctx, func(interface{}) *MachineLostError { return nil }
+	}
+	m.journal[e] = struct{}{}
+	m.mu.Unlock()
+	return ctx, func(reply interface{}) *MachineLostError {
+		m.mu.Lock()
+		delete(m.journal, e)
+		lost := e.lost
+		m.mu.Unlock()
+		if rc, ok := reply.(*io.ReadCloser); ok && *rc != nil {
+			*rc = &cancelingReadCloser{ReadCloser: *rc, cancel: cancel}
+		} else {
+			cancel()
+		}
+		return lost
+	}
+}
+
+// A cancelingReadCloser is a streamed reply that cancels the context
+// of its call once it is closed.
+type cancelingReadCloser struct {
+	io.ReadCloser
+	cancel func()
+}
+
+// Close implements io.Closer.
+func (r *cancelingReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.cancel()
+	return err
+}
+
+// LoseCalls fails the calls in the machine's journal with errors of
+// type MachineLostError. It is called with m.mu held, when the machine
+// stops.
+func (m *Machine) loseCalls() {
+	for e := range m.journal {
+		e.lost = &MachineLostError{
+			Addr:          m.Addr,
+			ServiceMethod: e.ServiceMethod,
+			Start:         e.Start,
+			Err:           m.err,
+		}
+		e.cancel()
+	}
+	m.journal = make(map[*callEntry]struct{})
+}
+
+// A Redispatcher chooses the machine to which a call of the provided
+// method, which was in flight to the lost machine, is redispatched
+// (see CallRedispatch).
+type Redispatcher func(ctx context.Context, lost *Machine, serviceMethod string) (*Machine, error)
+
+// CallRedispatch redispatches the call, at most n times, when it fails
+// because its machine is lost (see MachineLostError): the call is
+// issued again to the machine chosen by the provided redispatcher.
+// Since a lost call may have executed, redispatched methods should be
+// safe to invoke more than once. If the redispatcher fails, the call
+// fails with the machine's loss. Calls whose arguments are streamed
+// (io.Reader) are not redispatched.
+func CallRedispatch(n int, redispatch Redispatcher) CallOpt {
+	return func(o *callOpts) {
+		o.redispatches, o.redispatch = n, redispatch
+	}
+}
+
+// RedispatchLeastLoaded returns a redispatcher that chooses, among b's
+// other machines that are starting or running, are not draining, and
+// were started with the service of the lost call, the running machine
+// with the fewest calls in flight, or, if none is running, a starting
+// machine, such as the lost machine's replacement (see AutoReplace).
+func (b *B) RedispatchLeastLoaded() Redispatcher {
+	return func(ctx context.Context, lost *Machine, serviceMethod string) (*Machine, error) {
+		service := strings.SplitN(serviceMethod, ".", 2)[0]
+		_, user := lost.services[service]
+		var candidates []*Machine
+		for _, m := range b.Machines() {
+			if m == lost || m.Draining() {
+				continue
+			}
+			if state := m.State(); state != Starting && state != Running {
+				continue
+			}
+			if _, ok := m.services[service]; user && !ok {
+				continue
+			}
+			candidates = append(candidates, m)
+		}
+		if len(candidates) == 0 {
+			return nil, errors.E(errors.Unavailable, fmt.Sprintf("no machine to which to redispatch %s", serviceMethod))
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			ri, rj := candidates[i].State() == Running, candidates[j].State() == Running
+			if ri != rj {
+				return ri
+			}
+			return candidates[i].InFlight() < candidates[j].InFlight()
+		})
+		return candidates[0], nil
+	}
+}
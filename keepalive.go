@@ -0,0 +1,54 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import "time"
+
+// Keepalive is a machine parameter that configures the keepalive
+// that the driver maintains to a machine, overriding the defaults of
+// the machine's system (see System.KeepaliveConfig) and of its B (see
+// DefaultKeepalive). Zero-valued fields are not overridden.
+//
+// Workloads with long GC pauses, or that saturate their machines'
+// networks, may need to tolerate slow keepalives; latency-sensitive
+// drivers may instead want to fail unresponsive machines quickly.
+type Keepalive struct {
+	// Period is the interval at which keepalives are maintained.
+	Period time.Duration
+	// Timeout is the amount of time after which a machine whose
+	// keepalives fail is considered dead.
+	Timeout time.Duration
+	// RpcTimeout is the timeout of each individual keepalive call.
+	RpcTimeout time.Duration
+}
+
+func (k Keepalive) applyParam(m *Machine) {
+	m.keepalive = m.keepalive.override(k)
+}
+
+// DefaultKeepalive is an option that sets the default keepalive
+// configuration of the machines started by the B, overriding that of
+// the B's system. Zero-valued fields are not overridden. The
+// configuration may be overridden per machine by Keepalive
+// parameters.
+func DefaultKeepalive(k Keepalive) Option {
+	return func(b *B) {
+		b.keepalive = b.keepalive.override(k)
+	}
+}
+
+// Override returns k with the nonzero fields of other.
+func (k Keepalive) override(other Keepalive) Keepalive {
+	if other.Period != 0 {
+		k.Period = other.Period
+	}
+	if other.Timeout != 0 {
+		k.Timeout = other.Timeout
+	}
+	if other.RpcTimeout != 0 {
+		k.RpcTimeout = other.RpcTimeout
+	}
+	return k
+}
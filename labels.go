@@ -0,0 +1,91 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/grailbio/base/errors"
+)
+
+// Labels is a machine parameter that labels machines with a set of
+// key-value pairs, for example "role=reducer" or "zone=us-west-2a".
+// Machines can then be selected by their labels (see Query.Labels),
+// so that drivers that manage machines of mixed roles need not
+// maintain their own bookkeeping alongside B.Machines. Labels are
+// fixed when a machine is started; multiple Labels parameters are
+// merged, with later labels taking precedence.
+type Labels map[string]string
+
+func (l Labels) applyParam(m *Machine) {
+	if m.labels == nil {
+		m.labels = make(Labels)
+	}
+	for k, v := range l {
+		m.labels[k] = v
+	}
+}
+
+// Match tells whether the labels l include each of the labels in
+// selector.
+func (l Labels) Match(selector Labels) bool {
+	for k, v := range selector {
+		if w, ok := l[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the labels in selector syntax (see ParseLabels),
+// ordered by key.
+func (l Labels) String() string {
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	elems := make([]string, len(keys))
+	for i, k := range keys {
+		elems[i] = k + "=" + l[k]
+	}
+	return strings.Join(elems, ",")
+}
+
+// ParseLabels parses a comma-separated list of key=value pairs, such
+// as "role=reducer,zone=us-west-2a", into a set of labels. The empty
+// string is parsed into an empty set.
+func ParseLabels(selector string) (Labels, error) {
+	labels := make(Labels)
+	if selector == "" {
+		return labels, nil
+	}
+	for _, elem := range strings.Split(selector, ",") {
+		parts := strings.SplitN(elem, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.E(errors.Invalid, fmt.Sprintf("invalid label %q in selector %q", elem, selector))
+		}
+		labels[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return labels, nil
+}
+
+// Labels returns the machine's labels (see bigmachine.Labels). The
+// returned labels are owned by the caller.
+func (m *Machine) Labels() Labels {
+	labels := make(Labels, len(m.labels))
+	for k, v := range m.labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// Label returns the value of the machine's label with the provided
+// key, or the empty string if the machine has no such label.
+func (m *Machine) Label(key string) string {
+	return m.labels[key]
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/grailbio/base/log"
+)
+
+// reapDrainTimeout is the amount of time given to machines that are
+// reaped to drain before they are stopped.
+const reapDrainTimeout = 5 * time.Minute
+
+// Lifetime is a machine parameter that limits the lifetime of
+// machines, to defend against cost leaks from drivers that are left
+// running: a machine that has been idle for IdleTimeout, or that has
+// been running for MaxLifetime, is drained and stopped (see
+// Machine.Drain). Machines that do not drain within 5 minutes are
+// stopped regardless. Reaped machines are not replaced (see
+// AutoReplace).
+type Lifetime struct {
+	// IdleTimeout is the amount of time after which a machine that
+	// has had no calls (other than keepalives) is reaped. Zero means
+	// no limit.
+	IdleTimeout time.Duration
+	// MaxLifetime is the amount of time after which a running machine
+	// is reaped, regardless of its activity. Zero means no limit.
+	MaxLifetime time.Duration
+	// ReapDegraded reaps machines that are degraded (see
+	// Machine.Degraded) as soon as they have no calls in flight,
+	// without waiting for the idle timeout.
+	ReapDegraded bool
+}
+
+func (l Lifetime) applyParam(m *Machine) {
+	m.lifetime = &l
+}
+
+// Idle returns the amount of time for which the machine has had no
+// calls in flight, or zero if calls are in flight.
+func (m *Machine) Idle() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.inflight > 0 {
+		return 0
+	}
+	last := m.lastCall
+	if last.IsZero() {
+		last = m.startTime
+	}
+	return time.Since(last)
+}
+
+// Reap drains and stops the machine once it exceeds its idle timeout
+// or maximum lifetime. It returns when the machine is stopped.
+func (m *Machine) reap() {
+	l := m.lifetime
+	period := l.IdleTimeout
+	if period <= 0 || l.MaxLifetime > 0 && l.MaxLifetime < period {
+		period = l.MaxLifetime
+	}
+	if period <= 0 && l.ReapDegraded {
+		// Check degraded machines every 10 seconds.
+		period = 100 * time.Second
+	}
+	if period <= 0 {
+		return
+	}
+	stopped := m.Wait(Stopped)
+	if state, _ := m.WaitFor(context.Background(), Running, Stopped); state == Stopped {
+		return
+	}
+	running := time.Now()
+	ticker := time.NewTicker(period / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stopped:
+			return
+		}
+		var reason string
+		if l.MaxLifetime > 0 && time.Since(running) >= l.MaxLifetime {
+			reason = "reached its maximum lifetime of " + l.MaxLifetime.String()
+		} else if idle := m.Idle(); l.IdleTimeout > 0 && idle >= l.IdleTimeout {
+			reason = "idle for " + idle.Round(time.Second).String()
+		} else if l.ReapDegraded && idle > 0 && m.Degraded() {
+			reason = fmt.Sprintf("degraded (score %.2f)", m.Score())
+		} else {
+			continue
+		}
+		log.Printf("%s: reaping machine: %s", m.Name(), reason)
+		ctx, cancel := context.WithTimeout(context.Background(), reapDrainTimeout)
+		err := m.Drain(ctx)
+		cancel()
+		if err != nil {
+			log.Error.Printf("%s: drain: %v; stopping machine", m.Name(), err)
+			m.Cancel()
+		}
+		return
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+)
+
+// ListenersEnv is the environment variable through which listening
+// sockets are passed to exec'd binaries. It contains a
+// comma-separated list of entries of the form network/addr=fd.
+const listenersEnv = "BIGMACHINE_LISTENERS"
+
+var listeners struct {
+	mu sync.Mutex
+	// Files contains the file descriptors of the listeners created by
+	// Listen, keyed by network/addr; they are passed on exec.
+	files map[string]*os.File
+	// Inherited contains the listeners passed to this process that
+	// have not yet been claimed by Listen.
+	inherited map[string]*os.File
+}
+
+func init() {
+	listeners.files = make(map[string]*os.File)
+	listeners.inherited = parseListeners(os.Getenv(listenersEnv))
+}
+
+// Listen announces on the provided network address, as net.Listen.
+// Listeners created by Listen on a machine survive the exec of a new
+// binary by the machine's supervisor (see Supervisor.Exec): the
+// listening socket is passed to the new binary, and a call to Listen
+// with the same network and address in the new binary returns a
+// listener on the inherited socket. Since the socket remains open,
+// connections that arrive while the new binary starts are queued
+// instead of refused, so that machines that serve application
+// traffic may swap binaries without downtime.
+//
+// Listen fails if the process already listens on the provided
+// network and address through Listen. Inheritance is supported only
+// on Linux and macOS.
+func Listen(network, addr string) (net.Listener, error) {
+	key := network + "/" + addr
+	listeners.mu.Lock()
+	defer listeners.mu.Unlock()
+	if listeners.files[key] != nil {
+		return nil, errors.E(errors.Exists, fmt.Sprintf("already listening on %s", key))
+	}
+	if f := listeners.inherited[key]; f != nil {
+		delete(listeners.inherited, key)
+		l, err := net.FileListener(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		log.Printf("listening on inherited socket %s", key)
+		listeners.files[key] = f
+		return &inheritableListener{l, key}, nil
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	filer, ok := l.(interface{ File() (*os.File, error) })
+	if !ok {
+		return l, nil
+	}
+	f, err := filer.File()
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	listeners.files[key] = f
+	return &inheritableListener{l, key}, nil
+}
+
+// An inheritableListener is a listener created by Listen. Closing it
+// ensures that its socket is no longer passed on exec.
+type inheritableListener struct {
+	net.Listener
+	key string
+}
+
+// Close implements net.Listener.
+func (l *inheritableListener) Close() error {
+	listeners.mu.Lock()
+	if f := listeners.files[l.key]; f != nil {
+		f.Close()
+		delete(listeners.files, l.key)
+	}
+	listeners.mu.Unlock()
+	return l.Listener.Close()
+}
+
+// InheritListeners prepares the listeners created by Listen to be
+// inherited by an exec'd binary, and returns the provided
+// environment amended to communicate them to it. Listeners passed to
+// this process are never passed on through the environment: those
+// that have not been claimed by Listen are closed on exec.
+func inheritListeners(environ []string) ([]string, error) {
+	var amended []string
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, listenersEnv+"=") {
+			amended = append(amended, kv)
+		}
+	}
+	listeners.mu.Lock()
+	defer listeners.mu.Unlock()
+	if len(listeners.files) == 0 {
+		return amended, nil
+	}
+	entries := make([]string, 0, len(listeners.files))
+	for key, f := range listeners.files {
+		if err := clearCloseOnExec(f.Fd()); err != nil {
+			return nil, errors.E("inherit listener", key, err)
+		}
+		entries = append(entries, fmt.Sprintf("%s=%d", key, f.Fd()))
+	}
+	sort.Strings(entries)
+	return append(amended, listenersEnv+"="+strings.Join(entries, ",")), nil
+}
+
+// ParseListeners parses the listeners passed through the provided
+// environment variable value. The returned files are marked
+// close-on-exec, so that unclaimed listeners are not passed on.
+func parseListeners(env string) map[string]*os.File {
+	files := make(map[string]*os.File)
+	if env == "" {
+		return files
+	}
+	for _, entry := range strings.Split(env, ",") {
+		i := strings.LastIndex(entry, "=")
+		if i < 0 {
+			log.Error.Printf("%s: bad entry %q", listenersEnv, entry)
+			continue
+		}
+		key := entry[:i]
+		fd, err := strconv.Atoi(entry[i+1:])
+		if err != nil {
+			log.Error.Printf("%s: bad entry %q: %v", listenersEnv, entry, err)
+			continue
+		}
+		setCloseOnExec(uintptr(fd))
+		files[key] = os.NewFile(uintptr(fd), key)
+	}
+	return files
+}
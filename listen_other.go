@@ -0,0 +1,16 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package bigmachine
+
+import "github.com/grailbio/base/errors"
+
+func clearCloseOnExec(fd uintptr) error {
+	return errors.E(errors.NotSupported, "listener inheritance is not supported on this platform")
+}
+
+func setCloseOnExec(fd uintptr) {}
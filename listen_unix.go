@@ -0,0 +1,21 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+//go:build linux || darwin
+// +build linux darwin
+
+package bigmachine
+
+import "syscall"
+
+func clearCloseOnExec(fd uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_SETFD, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func setCloseOnExec(fd uintptr) {
+	syscall.CloseOnExec(int(fd))
+}
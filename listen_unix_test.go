@@ -0,0 +1,78 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+//go:build linux || darwin
+// +build linux darwin
+
+package bigmachine
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestListenInherit(t *testing.T) {
+	const key = "tcp/127.0.0.1:0"
+	l, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, err = Listen("tcp", "127.0.0.1:0"); err == nil {
+		t.Error("expected error")
+	}
+	environ, err := inheritListeners([]string{"A=B", listenersEnv + "=stale"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(environ), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := environ[0], "A=B"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !strings.HasPrefix(environ[1], listenersEnv+"="+key+"=") {
+		t.Errorf("bad environment %s", environ[1])
+	}
+
+	// Simulate an exec'd process: the listener is passed through a
+	// (duplicate) file descriptor, and claimed by Listen.
+	listeners.mu.Lock()
+	fd, err := syscall.Dup(int(listeners.files[key].Fd()))
+	if err != nil {
+		listeners.mu.Unlock()
+		t.Fatal(err)
+	}
+	saved := listeners.files
+	listeners.files = make(map[string]*os.File)
+	listeners.inherited = parseListeners(fmt.Sprintf("%s=%d", key, fd))
+	listeners.mu.Unlock()
+	defer func() {
+		listeners.mu.Lock()
+		listeners.files = saved
+		listeners.mu.Unlock()
+	}()
+	inherited, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inherited.Close()
+	if got, want := inherited.Addr().String(), l.Addr().String(); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	accepted, err := inherited.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+}
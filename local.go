@@ -10,7 +10,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"os"
 	"os/exec"
@@ -25,6 +24,7 @@ import (
 	"github.com/grailbio/bigmachine/internal/authority"
 	bigioutil "github.com/grailbio/bigmachine/internal/ioutil"
 	"github.com/grailbio/bigmachine/internal/tee"
+	"github.com/grailbio/bigmachine/rpc"
 	"golang.org/x/net/http2"
 )
 
@@ -44,21 +44,52 @@ func init() {
 const maxConcurrentStreams = 20000
 
 // Local is a System that insantiates machines by
-// creating new processes on the local machine.
+// creating new processes on the local machine. Each machine is a
+// separate process that runs its own supervisor, and is booted
+// through the same code paths as machines on other systems: the
+// driver uploads its binary to the machine's supervisor (see
+// Supervisor.Setbinary), which then execs it (see Supervisor.Exec).
+// Thus, problems in the boot and exec path may be reproduced
+// locally.
 var Local System = new(localSystem)
 
 // LocalSystem implements a System that instantiates machines
-// by creating processes on the local machine.
+// by creating processes on the local machine. Machines serve
+// on unix-domain sockets in a temporary directory that is shared
+// by the driver and its machines.
 type localSystem struct {
 	Gobable           struct{} // to make the struct gob-encodable
 	authorityFilename string
 	authority         *authority.T
+	network           rpc.UnixNetwork
+	// ownNetwork is true if the network's directory was created (and
+	// should be removed) by this process.
+	ownNetwork bool
 
 	mu     sync.Mutex
 	muxers map[*Machine]*tee.Writer
+	exits  map[*Machine]*localExit
+	next   int
+}
+
+// A localExit records the exit status of a machine's process, once
+// done is closed.
+type localExit struct {
+	done   chan struct{}
+	status ExitStatus
 }
 
 func (s *localSystem) Init(_ *B) error {
+	if dir := os.Getenv("BIGMACHINE_SOCKETDIR"); dir != "" {
+		s.network.Dir = dir
+	} else {
+		dir, err := ioutil.TempDir("", "bigmachine")
+		if err != nil {
+			return err
+		}
+		s.network.Dir = dir
+		s.ownNetwork = true
+	}
 	f, err := ioutil.TempFile("", "")
 	if err != nil {
 		return err
@@ -70,6 +101,7 @@ func (s *localSystem) Init(_ *B) error {
 	}
 	s.authority, err = authority.New(s.authorityFilename)
 	s.muxers = make(map[*Machine]*tee.Writer)
+	s.exits = make(map[*Machine]*localExit)
 	return err
 }
 
@@ -80,11 +112,11 @@ func (*localSystem) Name() string {
 func (s *localSystem) Start(ctx context.Context, count int) ([]*Machine, error) {
 	machines := make([]*Machine, count)
 	for i := range machines {
-		port, err := getFreeTCPPort()
-		if err != nil {
-			return nil, err
-		}
-		prefix := fmt.Sprintf("localhost:%d: ", port)
+		s.mu.Lock()
+		host := s.network.Host(fmt.Sprintf("m%d", s.next))
+		s.next++
+		s.mu.Unlock()
+		prefix := host + ": "
 		cmd := exec.Command(os.Args[0], os.Args[1:]...)
 		cmd.Env = os.Environ()
 		cmd.Env = append(cmd.Env, "BIGMACHINE_MODE=machine")
@@ -92,25 +124,32 @@ func (s *localSystem) Start(ctx context.Context, count int) ([]*Machine, error)
 		muxer := new(tee.Writer)
 		cmd.Stdout = iofmt.PrefixWriter(muxer, prefix)
 		cmd.Stderr = iofmt.PrefixWriter(muxer, prefix)
-		cmd.Env = append(cmd.Env, fmt.Sprintf("BIGMACHINE_ADDR=localhost:%d", port))
+		cmd.Env = append(cmd.Env, fmt.Sprintf("BIGMACHINE_ADDR=%s", host))
 		cmd.Env = append(cmd.Env, fmt.Sprintf("BIGMACHINE_AUTHORITY=%s", s.authorityFilename))
+		cmd.Env = append(cmd.Env, fmt.Sprintf("BIGMACHINE_SOCKETDIR=%s", s.network.Dir))
 
 		m := new(Machine)
-		m.Addr = fmt.Sprintf("https://localhost:%d/", port)
+		m.Addr = fmt.Sprintf("https://%s/", host)
+		exit := &localExit{done: make(chan struct{})}
 		s.mu.Lock()
 		s.muxers[m] = muxer
+		s.exits[m] = exit
 		s.mu.Unlock()
 		m.Maxprocs = 1
-		err = cmd.Start()
-		if err != nil {
+		if err := cmd.Start(); err != nil {
 			return nil, err
 		}
 		go func() {
 			if err := cmd.Wait(); err != nil {
-				log.Printf("machine %s terminated with error: %v", m.Addr, err)
+				log.Printf("machine %s terminated with error: %v", m.Name(), err)
 			} else {
-				log.Printf("machine %s terminated", m.Addr)
+				log.Printf("machine %s terminated", m.Name())
+			}
+			exit.status = ExitStatus{
+				Code:        cmd.ProcessState.ExitCode(),
+				Description: cmd.ProcessState.String(),
 			}
+			close(exit.done)
 		}()
 		machines[i] = m
 	}
@@ -165,7 +204,14 @@ func (s *localSystem) ListenAndServe(addr string, handler http.Handler) error {
 	if err != nil {
 		return fmt.Errorf("error configuring server: %v", err)
 	}
-	return server.ListenAndServeTLS("", "")
+	if _, ok := s.network.Path(addr); !ok {
+		return server.ListenAndServeTLS("", "")
+	}
+	l, err := s.network.Listen(addr)
+	if err != nil {
+		return err
+	}
+	return server.ServeTLS(l, "", "")
 }
 
 func (s *localSystem) HTTPClient() *http.Client {
@@ -174,8 +220,8 @@ func (s *localSystem) HTTPClient() *http.Client {
 		// TODO: propagate error, or return error client
 		log.Fatalf("error build TLS configuration: %v", err)
 	}
-	transport := &http.Transport{TLSClientConfig: config}
-	if err = http2.ConfigureTransport(transport); err != nil {
+	transport, err := rpc.NewTransport(rpc.TransportOptions{}, config, s.network.DialContext)
+	if err != nil {
 		// TODO: propagate error, or return error client
 		log.Fatalf("error configuring transport: %v", err)
 	}
@@ -186,7 +232,13 @@ func (*localSystem) Exit(code int) {
 	os.Exit(code)
 }
 
-func (*localSystem) Shutdown() {}
+func (s *localSystem) Shutdown() {
+	if s.ownNetwork {
+		if err := os.RemoveAll(s.network.Dir); err != nil {
+			log.Error.Printf("removing socket directory %s: %v", s.network.Dir, err)
+		}
+	}
+}
 
 func (*localSystem) Maxprocs() int {
 	return 1
@@ -216,6 +268,23 @@ func (s *localSystem) Tail(ctx context.Context, m *Machine) (io.Reader, error) {
 	return r, nil
 }
 
+// MachineExit waits for the process of machine m to exit, and returns
+// its exit status.
+func (s *localSystem) MachineExit(ctx context.Context, m *Machine) (ExitStatus, error) {
+	s.mu.Lock()
+	exit := s.exits[m]
+	s.mu.Unlock()
+	if exit == nil {
+		return ExitStatus{}, errors.New("machine not under management")
+	}
+	select {
+	case <-exit.done:
+		return exit.status, nil
+	case <-ctx.Done():
+		return ExitStatus{}, ctx.Err()
+	}
+}
+
 func (s *localSystem) Read(ctx context.Context, m *Machine, filename string) (io.Reader, error) {
 	f, err := os.Open(filename)
 	if err != nil {
@@ -223,17 +292,3 @@ func (s *localSystem) Read(ctx context.Context, m *Machine, filename string) (io
 	}
 	return bigioutil.NewClosingReader(f), nil
 }
-
-func getFreeTCPPort() (int, error) {
-	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
-	if err != nil {
-		return 0, err
-	}
-	l, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		return 0, err
-	}
-	port := l.Addr().(*net.TCPAddr).Port
-	l.Close()
-	return port, nil
-}
@@ -0,0 +1,87 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+)
+
+// A setLogLevelRequest is the argument of Supervisor.SetLogLevel.
+type setLogLevelRequest struct {
+	// Level is the log level to set.
+	Level log.Level
+	// Duration is the amount of time after which the previous level is
+	// restored; the level is kept if it is zero.
+	Duration time.Duration
+}
+
+// CurrentLogLevel returns the process's log level.
+func currentLogLevel() log.Level {
+	for _, level := range []log.Level{log.Debug, log.Info, log.Error} {
+		if log.At(level) {
+			return level
+		}
+	}
+	return log.Off
+}
+
+// SetLogLevel sets the log level of the process (see
+// github.com/grailbio/base/log), and replies with the previous level.
+// If the request has a duration, the previous level is restored once
+// it elapses, unless the level is set again before then.
+func (s *Supervisor) SetLogLevel(ctx context.Context, req setLogLevelRequest, prev *log.Level) error {
+	if req.Level < log.Off || req.Level > log.Debug {
+		return errors.E(errors.Invalid, fmt.Sprintf("Supervisor.SetLogLevel: invalid log level %d", req.Level))
+	}
+	s.logLevelMu.Lock()
+	defer s.logLevelMu.Unlock()
+	if s.logLevelTimer != nil {
+		s.logLevelTimer.Stop()
+		s.logLevelTimer = nil
+	}
+	*prev = currentLogLevel()
+	log.SetLevel(req.Level)
+	if *prev != req.Level {
+		log.Printf("log level set to %s (was %s)", req.Level, *prev)
+	}
+	if req.Duration > 0 {
+		var (
+			restore = *prev
+			timer   *time.Timer
+		)
+		timer = time.AfterFunc(req.Duration, func() {
+			s.logLevelMu.Lock()
+			defer s.logLevelMu.Unlock()
+			if s.logLevelTimer != timer {
+				return
+			}
+			s.logLevelTimer = nil
+			log.SetLevel(restore)
+			log.Printf("log level restored to %s", restore)
+		})
+		s.logLevelTimer = timer
+	}
+	return nil
+}
+
+// SetLogLevel sets the log level of the machine's process at runtime
+// (see github.com/grailbio/base/log), so that, for example, debug
+// logging may be enabled on a single misbehaving machine. It returns
+// the previous level. If d is positive, the previous level is restored
+// after d elapses, so that verbose logging is not left enabled. The
+// level applies to the machine's current process: it is not retained
+// if the machine is rebooted. Unlike the levels of structured log
+// records (see LogLevel), which are selected by drivers, the log level
+// determines which messages the machine logs at all.
+func (m *Machine) SetLogLevel(ctx context.Context, level log.Level, d time.Duration) (log.Level, error) {
+	var prev log.Level
+	err := m.Call(ctx, "Supervisor.SetLogLevel", setLogLevelRequest{Level: level, Duration: d}, &prev)
+	return prev, err
+}
@@ -0,0 +1,440 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/errors"
+)
+
+const (
+	// DefaultLogFileSize is the default size beyond which a machine's
+	// log output file is rotated.
+	defaultLogFileSize = 16 << 20
+	// DefaultLogTotalSize is the default maximum total size of a
+	// machine's retained log output.
+	defaultLogTotalSize = 128 << 20
+	// DefaultLogMaxAge is the default age beyond which a machine's log
+	// output is removed.
+	defaultLogMaxAge = 7 * 24 * time.Hour
+)
+
+// OutputDir is the directory in which the process retains its log
+// output (see LogRotation). Since the directory is named by the
+// process ID, which is preserved by Supervisor.Exec, output is
+// retained across execs. Its parent directory may be set by the
+// environment variable BIGMACHINE_OUTPUTDIR.
+var outputDir = func() string {
+	dir := os.Getenv("BIGMACHINE_OUTPUTDIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, fmt.Sprintf("bigmachine-output-%d", os.Getpid()))
+}()
+
+// LogRotation is a machine parameter that configures how the machine
+// retains its log output on disk, so that drivers may fetch the
+// output that was logged before they started tailing it, for example
+// after they reconnect (see Machine.TailRange). Output is written to
+// files that are rotated once they exceed a size or age limit; the
+// oldest files are removed once the total size of the output exceeds
+// its limit, or once they exceed the age limit, so that verbose
+// machines do not fill their disks. Zero-valued fields take their
+// defaults.
+type LogRotation struct {
+	// MaxFileSize is the size beyond which an output file is rotated.
+	// It defaults to 16 MiB.
+	MaxFileSize int64
+	// MaxTotalSize is the maximum total size of the output retained in
+	// rotated files, beyond which the oldest files are removed when the
+	// output is rotated. It defaults to 128 MiB.
+	MaxTotalSize int64
+	// MaxAge is the age beyond which an output file is rotated, and
+	// the age beyond which output is removed. It defaults to 7 days.
+	MaxAge time.Duration
+}
+
+func (r LogRotation) applyParam(m *Machine) {
+	m.logRotation = &r
+}
+
+// WithDefaults returns r with its zero-valued fields set to their
+// defaults.
+func (r LogRotation) withDefaults() LogRotation {
+	if r.MaxFileSize <= 0 {
+		r.MaxFileSize = defaultLogFileSize
+	}
+	if r.MaxTotalSize <= 0 {
+		r.MaxTotalSize = defaultLogTotalSize
+	}
+	if r.MaxAge <= 0 {
+		r.MaxAge = defaultLogMaxAge
+	}
+	return r
+}
+
+// An outputSegment is a file of retained log output.
+type outputSegment struct {
+	path string
+	// off is the offset of the segment's first byte in the output, and
+	// size the number of bytes in the segment.
+	off, size int64
+	// created and modified are the times at which the segment was
+	// created and last written.
+	created, modified time.Time
+}
+
+// An outputLog retains the log output of the process in a directory
+// of rotated segment files (see LogRotation). Segment files are named
+// by the offset in the output of their first byte, so that offsets
+// remain valid as segments are removed, and across execs.
+type outputLog struct {
+	dir string
+
+	mu       sync.Mutex
+	rotation LogRotation
+	// segments are the retained segments, in order; the last is
+	// written.
+	segments []*outputSegment
+	file     *os.File
+	// err is the error that disabled the log, if any.
+	err error
+	// written is closed (and replaced) when output is written.
+	written chan struct{}
+}
+
+// OpenOutputLog opens the output log in the provided directory,
+// continuing the output retained there, if any, in a new segment.
+func openOutputLog(dir string) (*outputLog, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	l := &outputLog{
+		dir:      dir,
+		rotation: LogRotation{}.withDefaults(),
+		written:  make(chan struct{}),
+	}
+	for _, info := range infos {
+		off, err := strconv.ParseInt(info.Name(), 10, 64)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		l.segments = append(l.segments, &outputSegment{
+			path:     filepath.Join(dir, info.Name()),
+			off:      off,
+			size:     info.Size(),
+			created:  info.ModTime(),
+			modified: info.ModTime(),
+		})
+	}
+	sort.Slice(l.segments, func(i, j int) bool {
+		return l.segments[i].off < l.segments[j].off
+	})
+	if err := l.rotate(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// End returns the offset of the end of the output. It must be called
+// with l.mu held.
+func (l *outputLog) end() int64 {
+	if len(l.segments) == 0 {
+		return 0
+	}
+	last := l.segments[len(l.segments)-1]
+	return last.off + last.size
+}
+
+// Rotate begins a new segment, and removes the segments that exceed
+// the log's limits. It must be called with l.mu held.
+func (l *outputLog) rotate() error {
+	if l.file != nil {
+		if err := l.file.Close(); err != nil {
+			return err
+		}
+		l.file = nil
+	}
+	off := l.end()
+	// Segments are named by zero-padded offsets, so that they sort by
+	// name.
+	path := filepath.Join(l.dir, fmt.Sprintf("%020d", off))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if n := len(l.segments); n == 0 || l.segments[n-1].path != path {
+		l.segments = append(l.segments, &outputSegment{path: path, off: off, created: now, modified: now})
+	}
+	l.file = f
+	l.prune()
+	return nil
+}
+
+// Prune removes the oldest segments, other than the one that is
+// written, while the log exceeds its size limit, or while they exceed
+// its age limit. It must be called with l.mu held.
+func (l *outputLog) prune() {
+	var total int64
+	for _, seg := range l.segments {
+		total += seg.size
+	}
+	cutoff := time.Now().Add(-l.rotation.MaxAge)
+	for len(l.segments) > 1 {
+		seg := l.segments[0]
+		if total <= l.rotation.MaxTotalSize && !seg.modified.Before(cutoff) {
+			break
+		}
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "bigmachine: remove log output %s: %v\n", seg.path, err)
+		}
+		total -= seg.size
+		l.segments = l.segments[1:]
+	}
+}
+
+// Write appends p to the log, rotating it as needed. Since the log
+// is written by the process's logger, failures are reported to
+// standard error, and disable the log; Write always returns len(p),
+// nil.
+func (l *outputLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return len(p), nil
+	}
+	seg := l.segments[len(l.segments)-1]
+	if seg.size > 0 && (seg.size >= l.rotation.MaxFileSize || time.Since(seg.created) >= l.rotation.MaxAge) {
+		if err := l.rotate(); err != nil {
+			l.fail(err)
+			return len(p), nil
+		}
+		seg = l.segments[len(l.segments)-1]
+	}
+	n, err := l.file.Write(p)
+	seg.size += int64(n)
+	seg.modified = time.Now()
+	if err != nil {
+		l.fail(err)
+	}
+	if n > 0 {
+		close(l.written)
+		l.written = make(chan struct{})
+	}
+	return len(p), nil
+}
+
+// WrittenAfter returns a channel that is closed once the output
+// extends beyond the provided offset.
+func (l *outputLog) writtenAfter(off int64) <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.end() > off {
+		c := make(chan struct{})
+		close(c)
+		return c
+	}
+	return l.written
+}
+
+// Fail disables the log because of the provided error. It must be
+// called with l.mu held.
+func (l *outputLog) fail(err error) {
+	l.err = err
+	fmt.Fprintf(os.Stderr, "bigmachine: log output is no longer retained: %v\n", err)
+}
+
+// Configure applies the provided rotation configuration, removing
+// segments as needed.
+func (l *outputLog) Configure(r LogRotation) {
+	l.mu.Lock()
+	l.rotation = r.withDefaults()
+	l.prune()
+	l.mu.Unlock()
+}
+
+// Open returns a reader of the retained output that begins at the
+// provided offset, or, if the offset is negative, at that offset from
+// the end of the output, and that reads at most limit bytes, or to the
+// current end of the output if limit is not positive. Offsets that
+// precede the retained output are advanced to its beginning; Open
+// returns the offset at which the reader begins.
+func (l *outputLog) Open(off, limit int64) (io.ReadCloser, int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	start, end := l.segments[0].off, l.end()
+	if off < 0 {
+		off += end
+	}
+	if off < start {
+		off = start
+	}
+	if off > end {
+		off = end
+	}
+	stop := end
+	if limit > 0 && off+limit < end {
+		stop = off + limit
+	}
+	var r outputReader
+	for _, seg := range l.segments {
+		if seg.off+seg.size <= off || seg.off >= stop {
+			continue
+		}
+		// Segments that are removed remain readable once opened.
+		f, err := os.Open(seg.path)
+		if err != nil {
+			r.Close()
+			return nil, 0, err
+		}
+		lo, hi := off-seg.off, stop-seg.off
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > seg.size {
+			hi = seg.size
+		}
+		r.files = append(r.files, f)
+		r.readers = append(r.readers, io.NewSectionReader(f, lo, hi-lo))
+	}
+	r.Reader = io.MultiReader(r.readers...)
+	return &r, off, nil
+}
+
+// An outputReader reads a range of retained output from its segment
+// files.
+type outputReader struct {
+	io.Reader
+	readers []io.Reader
+	files   []*os.File
+}
+
+// Close closes the reader's segment files.
+func (r *outputReader) Close() error {
+	var err error
+	for _, f := range r.files {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// SetLogRotation applies the provided configuration to the rotation
+// of the process's retained log output. It has no effect if the
+// output is not retained.
+func (s *Supervisor) SetLogRotation(ctx context.Context, r LogRotation, _ *struct{}) error {
+	if s.history != nil {
+		s.history.Configure(r)
+	}
+	return nil
+}
+
+// A tailRangeRequest is the argument of Supervisor.TailRange.
+type tailRangeRequest struct {
+	// Offset and Limit determine the range of output that is read (see
+	// Machine.TailRange).
+	Offset, Limit int64
+	// Compressors are the names of the compressors supported by the
+	// caller, in order of preference.
+	Compressors []string
+}
+
+// TailRange replies with a range of the process's retained log output
+// (see LogRotation). The reply begins with a line that contains the
+// offset at which the range begins, followed by a stream compressed
+// as in Supervisor.Tail. The reply ends at the end of the range.
+func (s *Supervisor) TailRange(ctx context.Context, req tailRangeRequest, reply *io.ReadCloser) error {
+	if s.history == nil {
+		return errors.E(errors.NotSupported, "Supervisor.TailRange: log output is not retained")
+	}
+	output, off, err := s.history.Open(req.Offset, req.Limit)
+	if err != nil {
+		return err
+	}
+	var (
+		c    = negotiateCompressor(req.Compressors)
+		name string
+	)
+	if c != nil {
+		name = c.Name()
+	}
+	r, w := io.Pipe()
+	go func() {
+		defer output.Close()
+		if _, err := fmt.Fprintf(w, "%d\n%s\n", off, name); err != nil {
+			w.CloseWithError(err)
+			return
+		}
+		var cw CompressWriter = nopFlusher{w}
+		if c != nil {
+			if cw, err = c.NewWriter(w); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+		}
+		if _, err := io.Copy(cw, output); err != nil {
+			w.CloseWithError(err)
+			return
+		}
+		w.CloseWithError(cw.Close())
+	}()
+	*reply = r
+	return nil
+}
+
+// TailRange returns a reader of a range of the log output that the
+// machine has retained (see LogRotation), so that drivers may fetch
+// the machine's recent output, and not only the output that is logged
+// while they tail it (see Machine.Tail). The range begins at the
+// provided offset in the machine's output, or, if the offset is
+// negative, at that offset from the end of the output; it comprises
+// at most limit bytes, or the rest of the output if limit is not
+// positive. Offsets that precede the retained output are advanced to
+// its beginning. TailRange also returns the offset at which the range
+// begins, so that drivers that reconnect may resume reading where they
+// left off.
+func (m *Machine) TailRange(ctx context.Context, offset, limit int64) (io.ReadCloser, int64, error) {
+	var rc io.ReadCloser
+	req := tailRangeRequest{Offset: offset, Limit: limit, Compressors: compressorNames()}
+	if err := m.Call(ctx, "Supervisor.TailRange", req, &rc); err != nil {
+		return nil, 0, err
+	}
+	br := bufio.NewReader(rc)
+	line, err := br.ReadString('\n')
+	if err == nil {
+		offset, err = strconv.ParseInt(strings.TrimSuffix(line, "\n"), 10, 64)
+	}
+	if err != nil {
+		rc.Close()
+		return nil, 0, errors.E(fmt.Sprintf("%s: tail range", m.Name()), err)
+	}
+	r, err := newTailReader(struct {
+		io.Reader
+		io.Closer
+	}{br, rc})
+	if err != nil {
+		rc.Close()
+		return nil, 0, errors.E(fmt.Sprintf("%s: tail range", m.Name()), err)
+	}
+	return r, offset, nil
+}
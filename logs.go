@@ -0,0 +1,389 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/bigmachine/rpc"
+)
+
+const (
+	// LogBufferSize is the number of structured log records retained
+	// by a process for its log streams; streams that fall further
+	// behind drop records.
+	logBufferSize = 4096
+	// LogBatchSize is the maximum number of records in each batch
+	// shipped by Supervisor.Logs, and logBatchDelay the time for which
+	// a batch is accumulated.
+	logBatchSize  = 256
+	logBatchDelay = 100 * time.Millisecond
+)
+
+// A LogLevel is the severity of a structured log record.
+type LogLevel int
+
+const (
+	// LogDebug is the level of debugging records.
+	LogDebug LogLevel = iota
+	// LogInfo is the level of informational records.
+	LogInfo
+	// LogWarning is the level of records of potential problems.
+	LogWarning
+	// LogError is the level of records of errors.
+	LogError
+)
+
+var logLevelStrings = [...]string{
+	LogDebug:   "DEBUG",
+	LogInfo:    "INFO",
+	LogWarning: "WARNING",
+	LogError:   "ERROR",
+}
+
+// String returns a string representation of the level.
+func (l LogLevel) String() string {
+	if l < 0 || int(l) >= len(logLevelStrings) {
+		return "UNKNOWN"
+	}
+	return logLevelStrings[l]
+}
+
+// A LogRecord is a structured log record, logged by a machine's
+// process through a Logger.
+type LogRecord struct {
+	// Machine is the name of the machine that logged the record. It is
+	// set by the driver.
+	Machine string
+	// Time is the time at which the record was logged.
+	Time time.Time
+	// Level is the record's severity.
+	Level LogLevel
+	// Source is the name of the logger that logged the record.
+	Source string
+	// Message is the record's message.
+	Message string
+	// Fields are the record's fields (see Logger.With).
+	Fields map[string]string
+}
+
+// String returns a one-line representation of the record.
+func (r LogRecord) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s", r.Time.Format(time.RFC3339Nano), r.Machine, r.Level)
+	if r.Source != "" {
+		fmt.Fprintf(&b, " %s:", r.Source)
+	}
+	fmt.Fprintf(&b, " %s", r.Message)
+	keys := make([]string, 0, len(r.Fields))
+	for k := range r.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%q", k, r.Fields[k])
+	}
+	return b.String()
+}
+
+// A LogFilter selects structured log records (see B.Logs).
+type LogFilter struct {
+	// Level is the minimum level of the selected records.
+	Level LogLevel
+	// Machines are the names of the machines whose records are
+	// selected. All machines' records are selected if it is empty.
+	Machines []string
+	// Source is the name of the logger whose records are selected. All
+	// loggers' records are selected if it is empty.
+	Source string
+	// Contains is a string that the messages of the selected records
+	// contain.
+	Contains string
+}
+
+// Match tells whether the filter selects the provided record.
+func (f LogFilter) Match(r LogRecord) bool {
+	if r.Level < f.Level {
+		return false
+	}
+	if f.Source != "" && r.Source != f.Source {
+		return false
+	}
+	if f.Contains != "" && !strings.Contains(r.Message, f.Contains) {
+		return false
+	}
+	return f.matchMachine(r.Machine)
+}
+
+// MatchMachine tells whether the filter selects the records of the
+// named machine.
+func (f LogFilter) matchMachine(name string) bool {
+	if len(f.Machines) == 0 {
+		return true
+	}
+	for _, m := range f.Machines {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+// A Logger logs structured records, which drivers receive through
+// B.Logs, in addition to writing them to the process's log output.
+// Loggers may be used concurrently.
+type Logger struct {
+	source string
+	fields map[string]string
+}
+
+// NewLogger returns a logger whose records have the provided source,
+// for example the name of the service that logs them.
+func NewLogger(source string) *Logger {
+	return &Logger{source: source}
+}
+
+// With returns a logger that adds a field with the provided key and
+// value to the records of l.
+func (l *Logger) With(key, value string) *Logger {
+	fields := make(map[string]string, len(l.fields)+1)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	fields[key] = value
+	return &Logger{source: l.source, fields: fields}
+}
+
+// Debugf logs a record at LogDebug level, formatted as with
+// fmt.Sprintf.
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(LogDebug, fmt.Sprintf(format, args...))
+}
+
+// Infof logs a record at LogInfo level.
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(LogInfo, fmt.Sprintf(format, args...))
+}
+
+// Warningf logs a record at LogWarning level.
+func (l *Logger) Warningf(format string, args ...interface{}) {
+	l.log(LogWarning, fmt.Sprintf(format, args...))
+}
+
+// Errorf logs a record at LogError level.
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(LogError, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) log(level LogLevel, message string) {
+	r := LogRecord{
+		Time:    time.Now(),
+		Level:   level,
+		Source:  l.source,
+		Message: message,
+		Fields:  l.fields,
+	}
+	logRecords.Add(r)
+	switch level {
+	case LogDebug:
+		log.Debug.Print(r.String())
+	case LogError:
+		log.Error.Print(r.String())
+	default:
+		log.Print(r.String())
+	}
+}
+
+// LogRecords are the structured log records of the current process.
+var logRecords = newLogBuffer(logBufferSize)
+
+// A logBuffer retains the most recent structured log records of a
+// process, by sequence number, for its log streams.
+type logBuffer struct {
+	mu   sync.Mutex
+	ring []LogRecord
+	// next is the sequence number of the next record.
+	next uint64
+	// added is closed (and replaced) when a record is added.
+	added chan struct{}
+}
+
+func newLogBuffer(n int) *logBuffer {
+	return &logBuffer{ring: make([]LogRecord, n), added: make(chan struct{})}
+}
+
+// Add adds a record to the buffer, replacing its oldest record if it
+// is full.
+func (b *logBuffer) Add(r LogRecord) {
+	b.mu.Lock()
+	b.ring[b.next%uint64(len(b.ring))] = r
+	b.next++
+	close(b.added)
+	b.added = make(chan struct{})
+	b.mu.Unlock()
+}
+
+// Read returns up to max of the retained records with sequence numbers
+// no less than seq, the sequence number that follows them, and a
+// channel that is closed when another record is added.
+func (b *logBuffer) Read(seq uint64, max int) (records []LogRecord, next uint64, added <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n := uint64(len(b.ring)); b.next > n && seq < b.next-n {
+		seq = b.next - n
+	}
+	for ; seq < b.next && len(records) < max; seq++ {
+		records = append(records, b.ring[seq%uint64(len(b.ring))])
+	}
+	return records, seq, b.added
+}
+
+// Next returns the sequence number of the next record.
+func (b *logBuffer) Next() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.next
+}
+
+// Logs replies with a stream of gob-encoded batches of the structured
+// log records that the process logs from the time of the call, and
+// that the provided filter selects. Records are shipped in batches,
+// so that verbose processes do not incur a call per record. The stream
+// lasts until it is closed.
+func (s *Supervisor) Logs(ctx context.Context, filter LogFilter, reply *io.ReadCloser) error {
+	// Records are filtered by machine by the driver.
+	filter.Machines = nil
+	seq := logRecords.Next()
+	r, w := io.Pipe()
+	go func() {
+		enc := gob.NewEncoder(w)
+		for {
+			records, next, added := logRecords.Read(seq, logBatchSize)
+			seq = next
+			var batch []LogRecord
+			for _, r := range records {
+				if filter.Match(r) {
+					batch = append(batch, r)
+				}
+			}
+			if len(batch) > 0 {
+				if err := enc.Encode(batch); err != nil {
+					w.CloseWithError(err)
+					return
+				}
+			}
+			if len(records) == logBatchSize {
+				continue
+			}
+			select {
+			case <-added:
+			case <-ctx.Done():
+				w.CloseWithError(ctx.Err())
+				return
+			}
+			// Accumulate records for a batch.
+			select {
+			case <-time.After(logBatchDelay):
+			case <-ctx.Done():
+				w.CloseWithError(ctx.Err())
+				return
+			}
+		}
+	}()
+	*reply = rpc.Flush(r)
+	return nil
+}
+
+// Logs returns a channel of the structured log records, selected by
+// the provided filter, that b's machines log (see Logger) from the
+// time of the call. Records of the machines that start running later
+// are included. Records are annotated with the names of the machines
+// that logged them. Records logged while a machine's log stream is
+// reestablished, for example while the machine reboots, may be lost.
+// The channel is closed once the provided context is done.
+func (b *B) Logs(ctx context.Context, filter LogFilter) <-chan LogRecord {
+	c := make(chan LogRecord, logBatchSize)
+	// Subscribe to events first, so that no running machine is missed.
+	events := b.Events(ctx)
+	go func() {
+		var (
+			wg       sync.WaitGroup
+			followed = make(map[*Machine]bool)
+		)
+		follow := func(m *Machine) {
+			if followed[m] || !filter.matchMachine(m.Name()) {
+				return
+			}
+			followed[m] = true
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				m.followLogs(ctx, filter, c)
+			}()
+		}
+		for _, m := range b.Machines() {
+			if m.State() == Running {
+				follow(m)
+			}
+		}
+		for event := range events {
+			if event.Type == MachineRunning {
+				follow(event.Machine)
+			}
+		}
+		wg.Wait()
+		close(c)
+	}()
+	return c
+}
+
+// FollowLogs delivers the machine's structured log records selected by
+// the provided filter to c, reestablishing its log stream as needed,
+// until the context is done or the machine stops.
+func (m *Machine) followLogs(ctx context.Context, filter LogFilter, c chan<- LogRecord) {
+	for ctx.Err() == nil && m.State() == Running {
+		var rc io.ReadCloser
+		err := m.Call(ctx, "Supervisor.Logs", filter, &rc)
+		if err == nil {
+			err = m.deliverLogs(ctx, rc, c)
+			rc.Close()
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Debug.Printf("%s: logs: %v", m.Name(), err)
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// DeliverLogs decodes batches of log records from r and delivers them
+// to c until the stream ends or the context is done.
+func (m *Machine) deliverLogs(ctx context.Context, r io.Reader, c chan<- LogRecord) error {
+	dec := gob.NewDecoder(r)
+	for {
+		var batch []LogRecord
+		if err := dec.Decode(&batch); err != nil {
+			return err
+		}
+		for _, r := range batch {
+			r.Machine = m.Name()
+			select {
+			case c <- r:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"io"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+)
+
+// A logShipper is a System that can ship the log output of its
+// machines to durable storage outside of the machines, for example a
+// cloud logging service, so that the output survives the machines'
+// termination. Machines call ShipLogs once, when they start, with a
+// reader of their output that blocks until more output is written;
+// ShipLogs returns once the reader fails or the context is done. It
+// returns an error of kind errors.NotSupported if the system is not
+// configured to ship logs.
+type logShipper interface {
+	ShipLogs(ctx context.Context, output io.Reader) error
+}
+
+// ShipOutput ships the process's log output, as retained in the
+// provided log, from its current end, through the provided shipper.
+func shipOutput(ctx context.Context, shipper logShipper, history *outputLog) {
+	history.mu.Lock()
+	off := history.end()
+	history.mu.Unlock()
+	err := shipper.ShipLogs(ctx, &outputFollower{ctx: ctx, log: history, off: off})
+	if err != nil && !errors.Is(errors.NotSupported, err) && ctx.Err() == nil {
+		log.Error.Printf("log shipping stopped: %v", err)
+	}
+}
+
+// An outputFollower reads the output retained by an outputLog from an
+// offset, waiting for more output at its end, until its context is
+// done. Output that is removed from the log before it is read is
+// skipped.
+type outputFollower struct {
+	ctx context.Context
+	log *outputLog
+	off int64
+	r   io.ReadCloser
+}
+
+// Read reads the next output, waiting for it to be written as needed.
+func (f *outputFollower) Read(p []byte) (int, error) {
+	for {
+		if f.r == nil {
+			r, off, err := f.log.Open(f.off, 0)
+			if err != nil {
+				return 0, err
+			}
+			f.r, f.off = r, off
+		}
+		n, err := f.r.Read(p)
+		f.off += int64(n)
+		if err == io.EOF {
+			f.r.Close()
+			f.r, err = nil, nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+		if f.r != nil {
+			continue
+		}
+		select {
+		case <-f.log.writtenAfter(f.off):
+		case <-f.ctx.Done():
+			return 0, f.ctx.Err()
+		}
+	}
+}
+
+// Close closes the follower's current reader, if any.
+func (f *outputFollower) Close() error {
+	if f.r == nil {
+		return nil
+	}
+	err := f.r.Close()
+	f.r = nil
+	return err
+}
@@ -0,0 +1,169 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	golog "log"
+	"os"
+	"strings"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/bigmachine/internal/tee"
+	"github.com/grailbio/bigmachine/rpc"
+)
+
+// CaptureOutput captures the process's log output, so that it may be
+// tailed by drivers (see Machine.Tail), in addition to being written
+// to standard error. The output is also retained on disk, if possible
+// (see LogRotation).
+func captureOutput() (*tee.Writer, *outputLog) {
+	output := new(tee.Writer)
+	history, err := openOutputLog(outputDir)
+	if err != nil {
+		golog.SetOutput(io.MultiWriter(os.Stderr, output))
+		log.Error.Printf("log output is not retained: %v", err)
+		return output, nil
+	}
+	golog.SetOutput(io.MultiWriter(os.Stderr, output, history))
+	return output, history
+}
+
+// A tailRequest is the argument of Supervisor.Tail.
+type tailRequest struct {
+	// Compressors are the names of the compressors supported by the
+	// caller, in order of preference.
+	Compressors []string
+}
+
+// Tail returns a reader that follows the log output of the machine's
+// process from the time of the call, until the reader is closed or
+// the context is canceled. The stream is served by the machine's
+// supervisor over the machine's RPC channel, and is compressed with
+// the most preferred compressor that is registered by both the driver
+// and the machine (see RegisterCompressor), so that verbose machines
+// do not incur excessive data transfer. Output may be dropped if the
+// reader does not keep up with the machine's log volume.
+func (m *Machine) Tail(ctx context.Context) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	if err := m.Call(ctx, "Supervisor.Tail", tailRequest{compressorNames()}, &rc); err != nil {
+		return nil, err
+	}
+	r, err := newTailReader(rc)
+	if err != nil {
+		rc.Close()
+		return nil, errors.E(fmt.Sprintf("%s: tail", m.Name()), err)
+	}
+	return r, nil
+}
+
+// NewTailReader returns a reader of the log stream replied by
+// Supervisor.Tail. The stream is preceded by a line with the name of
+// the compressor with which the rest of the stream is compressed, or
+// an empty line if the stream is uncompressed.
+func newTailReader(rc io.ReadCloser) (io.ReadCloser, error) {
+	br := bufio.NewReader(rc)
+	name, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	name = strings.TrimSuffix(name, "\n")
+	if name == "" {
+		return struct {
+			io.Reader
+			io.Closer
+		}{br, rc}, nil
+	}
+	c := lookupCompressor(name)
+	if c == nil {
+		return nil, errors.E(errors.NotSupported, fmt.Sprintf("unknown compressor %s", name))
+	}
+	r, err := c.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+	return tailReader{r, rc}, nil
+}
+
+// A tailReader is a reader of a compressed log stream.
+type tailReader struct {
+	io.ReadCloser
+	stream io.Closer
+}
+
+// Close closes the reader and its underlying stream.
+func (r tailReader) Close() error {
+	err := r.ReadCloser.Close()
+	if serr := r.stream.Close(); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// Tail replies with a stream of the process's log output, compressed
+// with the first of the requested compressors that is registered (see
+// Machine.Tail). The stream ends when the call is canceled.
+func (s *Supervisor) Tail(ctx context.Context, req tailRequest, reply *io.ReadCloser) error {
+	if s.output == nil {
+		return errors.E(errors.NotSupported, "Supervisor.Tail: log output is not captured")
+	}
+	var (
+		c    = negotiateCompressor(req.Compressors)
+		name string
+	)
+	if c != nil {
+		name = c.Name()
+	}
+	r, w := io.Pipe()
+	go func() {
+		if _, err := io.WriteString(w, name+"\n"); err != nil {
+			w.CloseWithError(err)
+			return
+		}
+		var cw CompressWriter = nopFlusher{w}
+		if c != nil {
+			var err error
+			if cw, err = c.NewWriter(w); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+			// Flush the compressor's header, if any, so that the
+			// driver's reader may be opened before there is output.
+			if err := cw.Flush(); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+		}
+		cancel := s.output.Tee(flushWriter{cw})
+		<-ctx.Done()
+		cancel()
+		cw.Close()
+		w.CloseWithError(ctx.Err())
+	}()
+	*reply = rpc.Flush(r)
+	return nil
+}
+
+// A flushWriter flushes its CompressWriter after every write, so that
+// log output is streamed promptly.
+type flushWriter struct{ w CompressWriter }
+
+// Write implements io.Writer.
+func (w flushWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err == nil {
+		err = w.w.Flush()
+	}
+	return n, err
+}
+
+// A nopFlusher is a CompressWriter that does not compress.
+type nopFlusher struct{ io.WriteCloser }
+
+func (nopFlusher) Flush() error { return nil }
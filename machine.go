@@ -11,15 +11,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/url"
 	"os"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/grailbio/base/digest"
 	"github.com/grailbio/base/errors"
 	"github.com/grailbio/base/fatbin"
 	"github.com/grailbio/base/iofmt"
@@ -87,16 +90,6 @@ type stateWaiter struct {
 	state State
 }
 
-type canceler interface {
-	Cancel()
-}
-
-type cancelFunc struct{ cancel func() }
-
-func (f *cancelFunc) Cancel() {
-	f.cancel()
-}
-
 // A MemInfo describes system and Go runtime memory usage.
 type MemInfo struct {
 	System  mem.VirtualMemoryStat
@@ -106,6 +99,9 @@ type MemInfo struct {
 // A DiskInfo describes system disk usage.
 type DiskInfo struct {
 	Usage disk.UsageStat
+	// Volumes describes the usage of the volumes monitored for disk
+	// pressure (see DiskWatchdog).
+	Volumes []disk.UsageStat
 }
 
 // A LoadInfo describes system load.
@@ -130,6 +126,9 @@ type Machine struct {
 	// Maxprocs is the number of processors available on the machine.
 	Maxprocs int
 
+	// Name is the machine's human-readable name (see Name).
+	name string
+
 	// NoExec should be set to true if the machine should not exec a
 	// new binary. This is meant for testing purposes.
 	NoExec bool
@@ -141,27 +140,188 @@ type Machine struct {
 	// process.
 	environ []string
 
+	// Tmpfs is the set of tmpfs file systems to be mounted on a new
+	// machine before its binary is executed.
+	tmpfs []Tmpfs
+
+	// Swap is the swap configuration of a new machine, if any.
+	swap *Swap
+	// ResourceLimits are the cgroup limits of a new machine's
+	// process, if any.
+	resourceLimits *ResourceLimits
+
+	// Spec is the shape of a new machine, if it overrides the
+	// System's configuration.
+	spec *MachineSpec
+
+	// CallLimit limits the number of concurrent calls to the machine,
+	// if not nil. CallMu guards callsActive, the number of calls that
+	// hold a call slot, and callWaiters, the calls that wait for one,
+	// in order of admission.
+	callLimit   *CallLimit
+	callMu      sync.Mutex
+	callsActive int
+	callWaiters []*callWaiter
+
+	// Replace configures the replacement of the machine, if it stops
+	// unexpectedly (see AutoReplace); generation is the number of
+	// times that the machine's predecessors were replaced.
+	replace    *AutoReplace
+	generation int
+	// canceled is set to 1 when the machine is canceled by Cancel.
+	canceled int32
+
+	// Labels are the machine's labels (see bigmachine.Labels).
+	labels Labels
+	// Hooks are the machine's state-transition hooks (see
+	// bigmachine.Hooks).
+	hooks []Hooks
+	// Lifetime limits the lifetime of the machine, if not nil (see
+	// bigmachine.Lifetime).
+	lifetime *Lifetime
+	// stopGrace is the amount of time for which calls in flight are
+	// awaited before the machine is stopped (see StopGrace).
+	stopGrace time.Duration
+	// Pricing is the price of the machine, as reported by its system,
+	// if priced is true (see B.CostReport).
+	pricing Pricing
+	priced  bool
+	// Location is the machine's location, as reported by its system,
+	// if located is true; trafficScope is the scope of the traffic
+	// between the driver and the machine (see Machine.TrafficScope).
+	location     Location
+	located      bool
+	trafficScope TrafficScope
+
+	// memoryWatchdog is the memory watchdog installed on the machine,
+	// if any (see MemoryWatchdog). memTrips are the memory thresholds
+	// that the machine currently crosses.
+	memoryWatchdog *MemoryWatchdog
+	memTrips       []MemoryTrip
+	// serviceRestart configures the restarts of the machine's
+	// services, if not nil, and serviceStatuses are their statuses
+	// (see ServiceRestart).
+	serviceRestart  *ServiceRestart
+	serviceStatuses []ServiceStatus
+	// diskWatchdog configures the machine's disk-pressure monitoring,
+	// if not nil (see DiskWatchdog).
+	diskWatchdog *DiskWatchdog
+	// logRotation configures the rotation of the machine's retained
+	// log output, if not nil (see LogRotation).
+	logRotation *LogRotation
+	// blobCache configures the machine's blob store, if not nil (see
+	// BlobCache).
+	blobCache *BlobCache
+	// readiness configures how the driver waits for the machine's
+	// services to become ready (see ReadinessProber).
+	readiness Readiness
+	// credentials configures the tokens vended to the machine, if not
+	// nil (see Credentials).
+	credentials *Credentials
+
+	// Cluster is the name of the persistent cluster to which the
+	// machine belongs, if any, and lease is the keepalive lease of its
+	// members (see Cluster). Reattached is true if the machine was
+	// started by another driver (see B.Reattach).
+	cluster    string
+	lease      time.Duration
+	reattached bool
+
 	owner bool
 
+	// Registrar is used to register the machine in an external
+	// service registry, if not nil.
+	registrar Registrar
+
 	client *rpc.Client
 	cancel func()
 
 	// event logs an event. See System.Event.
 	event func(typ string, fieldPairs ...interface{})
-
-	mu        sync.Mutex
-	state     int64
-	err       error
-	waiters   []stateWaiter
-	cancelers map[canceler]struct{}
+	// changed is called when the machine's state or health changes.
+	changed func(m *Machine)
+	// panicked is called when a panic is detected in the machine's
+	// log output.
+	panicked func(m *Machine, message, stack string)
+	// stager stages the binaries executed by the machine, if its
+	// system supports it (see binaryStager).
+	stager binaryStager
+	// fanout distributes binaries to the machine from its peers, if
+	// not nil (see BinaryFanout); binaryDigest is the digest of the
+	// binary that the machine runs, which it serves to its peers.
+	fanout       *binaryFanout
+	binaryDigest digest.Digest
+	// maxBinarySize is the maximum size of the binaries executed by
+	// the machine, if positive (see MaxBinarySize).
+	maxBinarySize int64
+	// rebooter reboots the machine's instance, if its system supports
+	// it (see Machine.Reboot).
+	rebooter machineRebooter
+	// recent retains the machine's recent log output, for its crash
+	// report, which is set if its process crashed (see
+	// Machine.CrashReport). crashReport is protected by mu.
+	recent      outputRecorder
+	crashReport *CrashReport
+	// lifecycle is called with the machine's lifecycle events.
+	lifecycle func(event MachineEvent)
+	// aborted returns the error with which the machine's B was
+	// aborted, if any.
+	aborted func() error
+	// budget is the error budget against which the machine's failures
+	// and calls are counted, if any.
+	budget *errorBudget
+	// retries limits the machine's retries, if not nil.
+	retries *retryLimiter
+
+	// startTime is the time at which the machine was started.
+	startTime time.Time
+	// unhealthy is set to 1 while the machine's supervisor reports
+	// that the machine is unhealthy.
+	unhealthy int32
+	// unhealthyReason describes why the machine is unhealthy. It is
+	// protected by mu.
+	unhealthyReason string
+
+	mu       sync.Mutex
+	state    int64
+	err      error
+	stopTime time.Time
+	waiters  []stateWaiter
+	// journal records the calls in flight through Call, which are
+	// canceled when the machine stops (see InFlightCalls).
+	journal map[*callEntry]struct{}
+
+	// Draining is set when the machine is draining (see Drain);
+	// inflight is the number of calls in flight. Once the machine is
+	// draining, drained is closed when inflight reaches 0. LastCall is
+	// the time at which a call last began or ended.
+	draining bool
+	inflight int
+	drained  chan struct{}
+	lastCall time.Time
+
+	// Rebooted is closed when the machine's current reboot ends; it is
+	// nil if the machine is not rebooting (see Reboot).
+	rebooted chan struct{}
 
 	nextKeepalive       time.Time
 	numKeepalive        int
 	keepaliveReplyTimes [numKeepaliveReplyTimes]time.Duration
 
+	// score is the machine's smoothed health score, valid if scored is
+	// true; degraded tells whether the machine is degraded (see Score).
+	// errorRate is the smoothed error rate of calls to the machine.
+	score     float64
+	scored    bool
+	degraded  bool
+	errorRate float64
+
 	// KeepalivePeriod, keepaliveTimeout, and keepaliveRpcTimeout configures
 	// keepalive behavior.
 	keepalivePeriod, keepaliveTimeout, keepaliveRpcTimeout time.Duration
+	// Keepalive contains the keepalive configuration provided by
+	// Keepalive parameters; it overrides the B's configuration.
+	keepalive Keepalive
 
 	// used to wait for the output from the worker to be completed.
 	tailDone chan struct{}
@@ -173,6 +333,18 @@ func (m *Machine) Owned() bool {
 	return m.owner
 }
 
+// ServiceNames returns the sorted names of the services that are
+// instantiated on the machine. It is defined only for owned
+// machines.
+func (m *Machine) ServiceNames() []string {
+	names := make([]string, 0, len(m.services))
+	for name := range m.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // KeepaliveReplyTimes returns a buffer up to the last
 // numKeepaliveReplyTimes keepalive reply latencies,
 // most recent first.
@@ -199,6 +371,19 @@ func (m *Machine) NextKeepalive() time.Time {
 	return t
 }
 
+// Name returns the machine's name. Machines started by B.Start are
+// named deterministically after the B (see bigmachine.Name) or the
+// binary, and their order of creation, for example "myjob-0042".
+// Names are used in place of addresses in logs, metrics, cloud tags,
+// and diagnostic output. Machines obtained by Dial are named by
+// their address.
+func (m *Machine) Name() string {
+	if m.name == "" {
+		return m.Addr
+	}
+	return m.name
+}
+
 // Hostname returns the hostname portion of the machine's address.
 func (m *Machine) Hostname() string {
 	u, err := url.Parse(m.Addr)
@@ -217,6 +402,38 @@ func (m *Machine) State() State {
 	return State(atomic.LoadInt64(&m.state))
 }
 
+// StartTime returns the time at which the machine was started (or,
+// for machines obtained through Dial, first dialed).
+func (m *Machine) StartTime() time.Time {
+	return m.startTime
+}
+
+// StopTime returns the time at which the machine stopped, or the zero
+// time if it has not stopped.
+func (m *Machine) StopTime() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stopTime
+}
+
+// Healthy tells whether the machine is healthy. Machines are healthy
+// unless their supervisor reported otherwise in its most recent
+// keepalive reply: for example, because the machine is running out
+// of memory, or because the health check of one of its services
+// failed (see HealthChecker).
+func (m *Machine) Healthy() bool {
+	return atomic.LoadInt32(&m.unhealthy) == 0
+}
+
+// UnhealthyReason describes why the machine is unhealthy, as reported
+// by its supervisor. It returns an empty string if the machine is
+// healthy.
+func (m *Machine) UnhealthyReason() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.unhealthyReason
+}
+
 // Wait returns a channel that is closed once the machine reaches the
 // provided state or greater.
 func (m *Machine) Wait(state State) <-chan struct{} {
@@ -231,6 +448,49 @@ func (m *Machine) Wait(state State) <-chan struct{} {
 	return c
 }
 
+// WaitFor waits for the machine to reach one of the provided states,
+// or a later one, since machines may skip states (for example, a
+// machine that fails to start proceeds from Starting to Stopped). It
+// returns the latest of the provided states that the machine has
+// reached and, if the machine has stopped, the error that caused it
+// to stop, if any (see Machine.Err). If the context is done first,
+// WaitFor returns the machine's current state and the context's
+// error. For example,
+//
+//	state, err := m.WaitFor(ctx, Running, Stopped)
+//
+// returns Running once the machine is running, or Stopped and the
+// machine's error if it fails to start.
+func (m *Machine) WaitFor(ctx context.Context, states ...State) (State, error) {
+	if len(states) == 0 {
+		return m.State(), errors.E(errors.Invalid, "Machine.WaitFor: no states provided")
+	}
+	min := states[0]
+	for _, state := range states[1:] {
+		if state < min {
+			min = state
+		}
+	}
+	select {
+	case <-m.Wait(min):
+	case <-ctx.Done():
+		// The machine may have reached the state concurrently.
+		if m.State() < min {
+			return m.State(), ctx.Err()
+		}
+	}
+	current, fired := m.State(), min
+	for _, state := range states {
+		if state <= current && state > fired {
+			fired = state
+		}
+	}
+	if current == Stopped {
+		return fired, m.Err()
+	}
+	return fired, nil
+}
+
 // MemInfo returns the machine's memory usage information.
 // Go runtime memory stats are read if readMemStats is true.
 func (m *Machine) MemInfo(ctx context.Context, readMemStats bool) (info MemInfo, err error) {
@@ -250,10 +510,33 @@ func (m *Machine) LoadInfo(ctx context.Context) (info LoadInfo, err error) {
 	return
 }
 
+// Services describes the services registered on the machine,
+// including the supervisor, together with their methods and their
+// argument and reply types.
+func (m *Machine) Services(ctx context.Context) (services []rpc.ServiceInfo, err error) {
+	err = m.Call(ctx, "Supervisor.Services", struct{}{}, &services)
+	return
+}
+
 // Cancel cancels all pending operations on machine m. The machine
-// is stopped with an error of context.Canceled.
+// is stopped with an error of context.Canceled. If the machine has a
+// stop grace period (see StopGrace), it is first given the period for
+// its calls in flight to complete; Cancel does not wait for them, and
+// a repeated Cancel stops the machine immediately.
 func (m *Machine) Cancel() {
-	m.cancel()
+	if atomic.SwapInt32(&m.canceled, 1) != 0 || m.stopGrace <= 0 {
+		m.cancel()
+		return
+	}
+	go func() {
+		m.awaitCalls()
+		m.cancel()
+	}()
+}
+
+// Canceled tells whether the machine was stopped by Cancel.
+func (m *Machine) Canceled() bool {
+	return atomic.LoadInt32(&m.canceled) != 0
 }
 
 // Err returns a machine's error. Err is only well-defined when the machine
@@ -269,14 +552,37 @@ func (m *Machine) start(b *B) {
 	if m.client == nil {
 		m.client = b.client
 	}
+	if m.registrar == nil && b != nil {
+		m.registrar = b.registrar
+	}
 	if m.keepalivePeriod == 0 {
-		m.keepalivePeriod, m.keepaliveTimeout, m.keepaliveRpcTimeout = b.System().KeepaliveConfig()
+		var k Keepalive
+		k.Period, k.Timeout, k.RpcTimeout = b.System().KeepaliveConfig()
+		k = k.override(b.keepalive).override(m.keepalive)
+		m.keepalivePeriod, m.keepaliveTimeout, m.keepaliveRpcTimeout = k.Period, k.Timeout, k.RpcTimeout
 	}
+	m.startTime = time.Now()
 	m.event = func(_ string, _ ...interface{}) {}
+	m.changed = func(*Machine) {}
+	m.panicked = func(*Machine, string, string) {}
+	m.lifecycle = func(MachineEvent) {}
+	m.aborted = func() error { return nil }
 	if b != nil {
-		m.event = b.system.Event
+		m.lifecycle = b.emit
+		m.event = sampleEvents(b.system.Event, b.telemetry.EventSampleRate)
+		m.changed = b.notify
+		m.panicked = b.recordPanic
+		m.aborted = b.Err
+		m.retries = b.retries
+		m.rebooter, _ = b.system.(machineRebooter)
+		m.stager, _ = b.system.(binaryStager)
+		m.fanout = b.fanout
+		m.maxBinarySize = b.maxBinarySize
+		if m.owner {
+			m.budget = b.budget
+		}
 	}
-	m.cancelers = make(map[canceler]struct{})
+	m.journal = make(map[*callEntry]struct{})
 	ctx := context.Background()
 	ctx, m.cancel = context.WithCancel(ctx)
 	go func() {
@@ -295,11 +601,13 @@ func (m *Machine) setError(err error) {
 	m.err = err
 	m.mu.Unlock()
 	m.setState(Stopped)
+	m.budget.MachineFailed(m, err)
 	m.event("bigmachine:machineError",
 		"addr", m.Addr,
+		"name", m.Name(),
 		"error", err.Error(),
 	)
-	log.Error.Printf("%s: %v", m.Addr, err)
+	log.Error.Printf("%s: %v", m.Name(), err)
 }
 
 func (m *Machine) errorf(format string, args ...interface{}) {
@@ -318,18 +626,66 @@ func (m *Machine) setState(s State) {
 			m.waiters = append(m.waiters, w)
 		}
 	}
-	atomic.StoreInt64(&m.state, int64(s))
+	prev := State(atomic.SwapInt64(&m.state, int64(s)))
+	if s >= Stopped && m.stopTime.IsZero() {
+		m.stopTime = time.Now()
+	}
 	if s >= Stopped {
-		for c := range m.cancelers {
-			c.Cancel()
-		}
-		m.cancelers = make(map[canceler]struct{})
-		m.event("bigmachine:machineStop", "addr", m.Addr)
+		m.loseCalls()
+		m.event("bigmachine:machineStop", "addr", m.Addr, "name", m.Name())
 	}
 	m.mu.Unlock()
 	for _, c := range triggered {
 		close(c)
 	}
+	m.changed(m)
+	if prev == s {
+		return
+	}
+	switch s {
+	case Starting:
+		m.emit(MachineBooting, nil, "")
+	case Running:
+		m.emit(MachineRunning, nil, "")
+	case Stopped:
+		if m.client != nil {
+			m.client.Forget(m.Addr)
+		}
+		m.emit(MachineStopped, m.Err(), "")
+	}
+}
+
+// emit emits a lifecycle event of the provided type for the machine.
+func (m *Machine) emit(typ MachineEventType, err error, reason string) {
+	m.lifecycle(MachineEvent{
+		Machine: m,
+		Type:    typ,
+		Time:    time.Now(),
+		Err:     err,
+		Reason:  reason,
+	})
+}
+
+// setHealthy records the machine's health as reported by its
+// supervisor, together with the reason that the machine is unhealthy.
+func (m *Machine) setHealthy(healthy bool, reason string) {
+	var unhealthy int32
+	if !healthy {
+		unhealthy = 1
+	} else {
+		reason = ""
+	}
+	m.mu.Lock()
+	m.unhealthyReason = reason
+	m.mu.Unlock()
+	if atomic.SwapInt32(&m.unhealthy, unhealthy) != unhealthy {
+		m.changed(m)
+		if healthy {
+			m.emit(MachineHealthy, nil, "")
+		} else {
+			m.emit(MachineUnhealthy, nil, reason)
+		}
+	}
 }
 
 func (m *Machine) loop(ctx context.Context, system System) {
@@ -338,6 +694,7 @@ func (m *Machine) loop(ctx context.Context, system System) {
 	if m.owner {
 		m.event("bigmachine:machineAlive",
 			"addr", m.Addr,
+			"name", m.Name(),
 			"duration", time.Since(start).Nanoseconds()/1e6,
 		)
 		if system != nil {
@@ -345,7 +702,7 @@ func (m *Machine) loop(ctx context.Context, system System) {
 				var err error
 				defer func() {
 					if err != nil && err != context.Canceled {
-						log.Error.Printf("%s: tail: %s", m.Addr, err)
+						log.Error.Printf("%s: tail: %s", m.Name(), err)
 					}
 					close(m.tailDone)
 				}()
@@ -353,14 +710,27 @@ func (m *Machine) loop(ctx context.Context, system System) {
 				if err != nil {
 					return
 				}
-				w := iofmt.PrefixWriter(os.Stderr, m.Addr+": ")
-				// Scan the log output for the sync marker or an error.
+				w := iofmt.PrefixWriter(os.Stderr, m.Name()+": ")
+				// Scan the log output for the sync marker or an error,
+				// and for panics, which are aggregated by the B.
+				var panics panicScanner
+				defer func() {
+					if message, stack, ok := panics.Flush(); ok {
+						m.recent.Panic(message, stack)
+						m.panicked(m, message, stack)
+					}
+				}()
 				sc := bufio.NewScanner(r)
 				for sc.Scan() {
 					line := sc.Bytes()
 					if bytes.HasSuffix(line, logSyncMarker) {
 						break
 					}
+					m.recent.Line(string(line))
+					if message, stack, ok := panics.Line(string(line)); ok {
+						m.recent.Panic(message, stack)
+						m.panicked(m, message, stack)
+					}
 					if _, err = w.Write(append(line, '\n')); err != nil {
 						return
 					}
@@ -391,6 +761,7 @@ func (m *Machine) loop(ctx context.Context, system System) {
 				m.setError(err)
 				return
 			}
+			m.emit(MachineExeced, nil, "")
 		}
 	}
 
@@ -399,6 +770,13 @@ func (m *Machine) loop(ctx context.Context, system System) {
 		return
 	}
 
+	if m.reattached {
+		if err := m.checkReattached(ctx); err != nil {
+			m.setError(err)
+			return
+		}
+	}
+
 	if !m.owner {
 		// If we're not the owner, we maintain machine state
 		// (up or down) by maintaining a periodic ping.
@@ -422,12 +800,48 @@ func (m *Machine) loop(ctx context.Context, system System) {
 	//	(3) maintain a keepalive
 	//	(4) take emergency pre-OOM heap profiles if the keepalive reply
 	//	  indicates that we're close to machine death
-	for name, iface := range m.services {
-		if err := m.retryCall(ctx, 5*time.Minute, 25*time.Second, "Supervisor.Register", service{name, iface}, nil); err != nil {
-			m.setError(errors.E(err, fmt.Sprintf("Supervisor.Register %s", name)))
+	if !m.reattached {
+		// Reattached machines' services were registered by their original
+		// owner.
+		if err := m.registerServices(ctx); err != nil {
+			m.setError(err)
+			return
+		}
+	}
+	if m.diskWatchdog != nil {
+		if err := m.retryCall(ctx, time.Minute, 10*time.Second, "Supervisor.SetDiskWatchdog", *m.diskWatchdog, nil); err != nil {
+			m.setError(errors.E(err, "Supervisor.SetDiskWatchdog"))
+			return
+		}
+	}
+	if m.logRotation != nil {
+		if err := m.retryCall(ctx, time.Minute, 10*time.Second, "Supervisor.SetLogRotation", *m.logRotation, nil); err != nil {
+			m.setError(errors.E(err, "Supervisor.SetLogRotation"))
+			return
+		}
+	}
+	if m.serviceRestart != nil {
+		if err := m.retryCall(ctx, time.Minute, 10*time.Second, "Supervisor.SetServiceRestart", *m.serviceRestart, nil); err != nil {
+			m.setError(errors.E(err, "Supervisor.SetServiceRestart"))
+			return
+		}
+	}
+	if m.memoryWatchdog != nil {
+		if err := m.retryCall(ctx, time.Minute, 10*time.Second, "Supervisor.SetMemoryWatchdog", *m.memoryWatchdog, nil); err != nil {
+			m.setError(errors.E(err, "Supervisor.SetMemoryWatchdog"))
+			return
+		}
+	}
+	if m.blobCache != nil {
+		if err := m.retryCall(ctx, time.Minute, 10*time.Second, "Blobs.Configure", *m.blobCache, nil); err != nil {
+			m.setError(errors.E(err, "Blobs.Configure"))
 			return
 		}
 	}
+	if err := m.waitReady(ctx); err != nil {
+		m.setError(err)
+		return
+	}
 
 	if system != nil {
 		// Note that this means that OOMs are detected only by the owner
@@ -441,19 +855,48 @@ func (m *Machine) loop(ctx context.Context, system System) {
 
 	// Switch to running state now that all of the services are registered.
 	m.setState(Running)
+	if m.fanout != nil && !m.binaryDigest.IsZero() {
+		m.fanout.Add(m.binaryDigest, m)
+	}
 
-	const keepalive = 5 * time.Minute
+	var reg *registration
+	if m.registrar != nil {
+		reg = newRegistration(m.registrar, m)
+		defer reg.Stop()
+	}
+
+	keepalive := defaultKeepaliveLease
+	if m.lease > 0 {
+		keepalive = m.lease
+	}
 	for {
 		callStart := time.Now()
 		var reply keepaliveReply
 		err := m.retryCall(ctx, m.keepaliveTimeout, m.keepaliveRpcTimeout, "Supervisor.Keepalive", keepalive, &reply)
+		if done := m.rebooting(); err != nil && done != nil {
+			// The machine is expected to be unreachable while it reboots.
+			select {
+			case <-done:
+				continue
+			case <-ctx.Done():
+			}
+		}
 		if err != nil {
-			m.errorf("keepalive failed after %s (timeout=%s, rpc timeout=%s): %v",
+			m.emit(MachineKeepaliveLost, err, "")
+			msg := fmt.Sprintf("keepalive failed after %s (timeout=%s, rpc timeout=%s): %v",
 				time.Since(callStart), m.keepaliveTimeout, m.keepaliveRpcTimeout, err)
+			if ctx.Err() == nil {
+				if report := m.reportCrash(ctx, system); report != nil {
+					m.setError(errors.E(msg, report))
+					return
+				}
+			}
+			m.setError(errors.New(msg))
 			return
 		}
 		m.event("bigmachine:machineAlive",
 			"addr", m.Addr,
+			"name", m.Name(),
 			"duration", time.Since(start).Nanoseconds()/1e6,
 		)
 		m.mu.Lock()
@@ -461,6 +904,11 @@ func (m *Machine) loop(ctx context.Context, system System) {
 		m.numKeepalive++
 		m.nextKeepalive = time.Now().Add(reply.Next)
 		m.mu.Unlock()
+		m.setMemoryTrips(reply.MemoryTrips)
+		m.setServiceStatuses(reply.Services)
+		m.setHealthy(reply.Healthy, reply.Reason)
+		m.updateScore(m.sampleScore())
+		reg.Update(reply.Healthy)
 		next := reply.Next
 		if next > m.keepalivePeriod {
 			next = m.keepalivePeriod
@@ -471,19 +919,19 @@ func (m *Machine) loop(ctx context.Context, system System) {
 		//
 		// TODO(marius): rate limit, collect, or rotate these?
 		if !reply.Healthy {
-			log.Printf("%s: supervisor indicated machine was unhealthy, taking heap profile and expvar dump", m.Addr)
+			log.Printf("%s: supervisor indicated machine was unhealthy (%s), taking heap profile and expvar dump", m.Name(), reply.Reason)
 			suffix := "." + m.Hostname() + "-" + time.Now().Format("20060102T150405")
 			path := "heap" + suffix
 			if err = m.saveProfile(ctx, "heap", path); err != nil {
-				log.Error.Printf("%s: heap profile failed: %v", m.Addr, err)
+				log.Error.Printf("%s: heap profile failed: %v", m.Name(), err)
 			} else {
-				log.Printf("%s: heap profile saved to %s", m.Addr, path)
+				log.Printf("%s: heap profile saved to %s", m.Name(), path)
 			}
 			path = "vars" + suffix
 			if err = m.saveExpvars(ctx, path); err != nil {
-				log.Error.Printf("%s: failed to retrieve expvars: %v", m.Addr, err)
+				log.Error.Printf("%s: failed to retrieve expvars: %v", m.Name(), err)
 			} else {
-				log.Printf("%s: expvars saved to %s", m.Addr, path)
+				log.Printf("%s: expvars saved to %s", m.Name(), path)
 			}
 		}
 
@@ -502,26 +950,26 @@ func (m *Machine) loop(ctx context.Context, system System) {
 func (m *Machine) tryMonitorOOMs(ctx context.Context, system System) {
 	var pid int
 	if err := m.retryCall(ctx, 5*time.Minute, 25*time.Second, "Supervisor.Getpid", struct{}{}, &pid); err != nil {
-		log.Error.Printf("%s: could not get pid: %v: cannot monitor for OOMs", m.Addr, err)
+		log.Error.Printf("%s: could not get pid: %v: cannot monitor for OOMs", m.Name(), err)
 		return
 	}
 	r, err := system.Read(ctx, m, "/dev/kmsg")
 	if err != nil {
-		log.Error.Printf("%s: could not read kernel message buffer: %v: cannot monitor for OOMs", m.Addr, err)
+		log.Error.Printf("%s: could not read kernel message buffer: %v: cannot monitor for OOMs", m.Name(), err)
 		return
 	}
 	look := fmt.Sprintf("Out of memory: Kill process %d", pid)
 	scan := bufio.NewScanner(r)
 	for scan.Scan() {
 		if log.At(log.Debug) {
-			log.Debug.Printf("%s kmsg: %s", m.Addr, scan.Text())
+			log.Debug.Printf("%s kmsg: %s", m.Name(), scan.Text())
 		}
 		if strings.Contains(scan.Text(), look) {
 			m.setError(errors.E(errors.OOM, "bigmachine process killed by the kernel"))
 		}
 	}
 	if err := scan.Err(); err != nil && err != context.Canceled {
-		log.Error.Printf("%s: could not tail kernel message buffer: %v: cannot monitor for OOMs", m.Addr, err)
+		log.Error.Printf("%s: could not tail kernel message buffer: %v: cannot monitor for OOMs", m.Name(), err)
 	}
 }
 
@@ -529,28 +977,6 @@ func (m *Machine) ping(ctx context.Context) error {
 	return m.retryCall(ctx, 9*time.Minute, 3*time.Minute, "Supervisor.Ping", 0, nil)
 }
 
-// Context returns a new derived context that is canceled whenever
-// the machine has stopped. This can be used to tie context lifetimes
-// to machine lifetimes. The returned cancellation function should be
-// called when the context is discarded.
-func (m *Machine) context(ctx context.Context) (mctx context.Context, cancel func()) {
-	ctx, ctxcancel := context.WithCancel(ctx)
-	m.mu.Lock()
-	if State(m.state) >= Stopped {
-		m.mu.Unlock()
-		ctxcancel()
-		return ctx, func() {}
-	}
-	c := &cancelFunc{ctxcancel}
-	m.cancelers[c] = struct{}{}
-	m.mu.Unlock()
-	return ctx, func() {
-		m.mu.Lock()
-		delete(m.cancelers, c)
-		m.mu.Unlock()
-	}
-}
-
 // Exec prepares the remote machine for binary replacement, and then
 // calls Supervisor.Exec.
 func (m *Machine) exec(ctx context.Context) error {
@@ -558,7 +984,13 @@ func (m *Machine) exec(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	return m.execBinary(ctx, self)
+}
 
+// ExecBinary prepares the remote machine for binary replacement, and
+// then replaces the machine's binary with the image of the provided
+// binary for the machine's OS and architecture.
+func (m *Machine) execBinary(ctx context.Context, self *fatbin.Reader) error {
 	// We first get the target GOOS/GOARCH so that we can
 	// compute the total time to allow for uploads, assuming
 	// at a minimum 100 kB/s upload bandwidth.
@@ -567,7 +999,10 @@ func (m *Machine) exec(ctx context.Context) error {
 	// base this on measuring progress instead (e.g., by wrapping
 	// the reader).
 	const timeout = 10 * time.Second
-	var info Info
+	var (
+		info Info
+		err  error
+	)
 	if err = m.timeoutCall(ctx, timeout, "Supervisor.Info", struct{}{}, &info); err != nil {
 		return err
 	}
@@ -575,7 +1010,29 @@ func (m *Machine) exec(ctx context.Context) error {
 	if !ok {
 		return errors.E(errors.Fatal, "no image for ", info.Goos, "/", info.Goarch)
 	}
-	if err = m.timeoutCall(ctx, timeout, "Supervisor.Setenv", m.environ, nil); err != nil {
+	if err = checkBinarySize(m.maxBinarySize, binInfo); err != nil {
+		return err
+	}
+	for _, t := range m.tmpfs {
+		if err = m.timeoutCall(ctx, timeout, "Supervisor.MountTmpfs", t, nil); err != nil {
+			return err
+		}
+	}
+	if m.swap != nil {
+		if err = m.timeoutCall(ctx, timeout, "Supervisor.Swapon", *m.swap, nil); err != nil {
+			return err
+		}
+	}
+	if m.resourceLimits != nil {
+		if err = m.timeoutCall(ctx, timeout, "Supervisor.SetResourceLimits", *m.resourceLimits, nil); err != nil {
+			return err
+		}
+	}
+	environ := m.environ
+	if len(m.tmpfs) > 0 {
+		environ = append(append([]string{}, environ...), tmpfsEnviron(m.tmpfs))
+	}
+	if err = m.timeoutCall(ctx, timeout, "Supervisor.Setenv", environ, nil); err != nil {
 		return err
 	}
 	if err = m.timeoutCall(ctx, timeout, "Supervisor.Setargs", os.Args, nil); err != nil {
@@ -585,20 +1042,103 @@ func (m *Machine) exec(ctx context.Context) error {
 	uploadTimeout := time.Duration((binInfo.Size+floor-1)/floor) * time.Second
 	log.Debug.Printf("exec: upload timeout: %v", uploadTimeout)
 	if err = m.timeoutCall(ctx, timeout, "Supervisor.Keepalive", uploadTimeout, nil); err != nil {
-		log.Error.Printf("Keepalive %v: %v", m.Addr, err)
+		log.Error.Printf("Keepalive %v: %v", m.Name(), err)
 	}
 
-	rc, err := self.Open(info.Goos, info.Goarch)
-	if err != nil {
+	if m.useCachedBinary(ctx, self, info.Goos, info.Goarch) {
+		log.Printf("%s: using cached binary", m.Name())
+	} else if m.fetchStagedBinary(ctx, self, binInfo) {
+		log.Printf("%s: fetched staged binary", m.Name())
+	} else if m.fanout != nil {
+		if err := m.distributeBinary(ctx, self, binInfo); err != nil {
+			return err
+		}
+	} else if err := m.uploadBinary(ctx, self, binInfo); err != nil {
 		return err
 	}
-	defer rc.Close()
-	if err := m.call(ctx, "Supervisor.Setbinary", rc, nil); err != nil {
-		return err
+	if m.fanout != nil && m.binaryDigest.IsZero() {
+		// Once it runs the binary, the machine serves it to its peers.
+		m.binaryDigest, _ = cachedImageDigest(self, info.Goos, info.Goarch)
 	}
+	m.emit(MachineBinaryUploaded, nil, "")
 	return m.timeoutCall(ctx, timeout, "Supervisor.Exec", struct{}{}, nil)
 }
 
+// BinaryChunkSize is the size of the chunks in which binaries are
+// uploaded to machines.
+var binaryChunkSize = 8 << 20
+
+// UploadBinary uploads the binary described by binInfo to the
+// machine in checksummed chunks (see Supervisor.SetbinaryChunk).
+// Failed chunks are retried, and the upload is resumed from the
+// offset reported by the supervisor, so that a flaky connection does
+// not require restarting the upload from the beginning. If the
+// supervisor does not support chunked uploads, the binary is
+// streamed through Supervisor.Setbinary instead. Chunked uploads are
+// verified by the supervisor before they are committed, and corrupted
+// chunks are resent (see Machine.verifyUpload).
+func (m *Machine) uploadBinary(ctx context.Context, self *fatbin.Reader, binInfo fatbin.Info) error {
+	const floor = 100 << 10 // bps
+	chunkTimeout := time.Duration(binaryChunkSize/floor)*time.Second + 10*time.Second
+	var (
+		rc  io.ReadCloser
+		pos int64
+	)
+	defer func() {
+		if rc != nil {
+			rc.Close()
+		}
+	}()
+	// Seek positions rc at offset off, reopening the binary if needed.
+	seek := func(off int64) error {
+		if rc == nil || off < pos {
+			if rc != nil {
+				rc.Close()
+				rc = nil
+			}
+			r, err := self.Open(binInfo.Goos, binInfo.Goarch)
+			if err != nil {
+				return err
+			}
+			rc, pos = r, 0
+		}
+		n, err := io.CopyN(ioutil.Discard, rc, off-pos)
+		pos += n
+		return err
+	}
+	buf := make([]byte, binaryChunkSize)
+	for off := int64(0); off < binInfo.Size; {
+		if err := seek(off); err != nil {
+			return err
+		}
+		n, err := io.ReadFull(rc, buf)
+		pos += int64(n)
+		if err == io.EOF {
+			return errors.E(errors.Invalid, fmt.Sprintf("binary ended at %d bytes, expected %d", off, binInfo.Size))
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		chunk := rpc.NewChunk(off, buf[:n])
+		err = m.retryCall(ctx, 5*time.Minute, chunkTimeout, "Supervisor.SetbinaryChunk", chunk, &off)
+		if err != nil && off == 0 && errors.Is(errors.Invalid, err) {
+			// The supervisor does not support chunked uploads, for example
+			// because it is running an older bootstrap binary.
+			log.Printf("%s: chunked upload failed: %v; streaming binary", m.Name(), err)
+			if err = seek(0); err != nil {
+				return err
+			}
+			return m.call(ctx, "Supervisor.Setbinary", rc, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := m.verifyUpload(ctx, self, binInfo); err != nil {
+		return err
+	}
+	return m.retryCall(ctx, time.Minute, 10*time.Second, "Supervisor.Commitbinary", binInfo.Size, nil)
+}
+
 func (m *Machine) call(ctx context.Context, serviceMethod string, arg, reply interface{}) (err error) {
 	if log.At(log.Debug) {
 		var deadline string
@@ -616,6 +1156,13 @@ func (m *Machine) call(ctx context.Context, serviceMethod string, arg, reply int
 			}
 		}()
 	}
+	// If we know the service, tell the server which version of it we
+	// expect, so that mismatched binaries fail clearly.
+	if iface, ok := m.services[strings.SplitN(serviceMethod, ".", 2)[0]]; ok {
+		if version := rpc.VersionOf(iface); version != "" {
+			ctx = rpc.WithServiceVersion(ctx, version)
+		}
+	}
 	err = m.client.Call(ctx, m.Addr, serviceMethod, arg, reply)
 	return err
 }
@@ -637,23 +1184,26 @@ func (m *Machine) retryCall(ctx context.Context, overallTimeout, rpcTimeout time
 		cancel()
 		if err == nil {
 			if retries > 0 {
-				log.Printf("%s %s: succeeded after %d retries", m.Addr, serviceMethod, retries)
+				log.Printf("%s %s: succeeded after %d retries", m.Name(), serviceMethod, retries)
 			}
 			return nil
 		}
 		if errors.Match(errors.E(errors.Fatal), err) {
 			return errors.E("fatal error calling", serviceMethod, err)
 		}
-		log.Debug.Printf("%s %s: %v; retrying (%d)", m.Addr, serviceMethod, err, retries)
+		log.Debug.Printf("%s %s: %v; retrying (%d)", m.Name(), serviceMethod, err, retries)
 		// TODO(marius): this isn't quite right. Introduce an errors package
 		// similar to Reflow's here to categorize errors properly.
 		if _, ok := err.(net.Error); !ok {
-			log.Error.Printf("%s %s(%v): %v", m.Addr, serviceMethod, arg, err)
+			log.Error.Printf("%s %s(%v): %v", m.Name(), serviceMethod, arg, err)
 		}
 		if err := retry.Wait(retryCtx, retryPolicy, retries); err != nil {
 			// Change the severity from temporary -> fatal.
 			return errors.E(errors.Fatal, err)
 		}
+		if werr := m.retries.Wait(retryCtx); werr != nil {
+			return errors.E(errors.Fatal, errors.TooManyTries, serviceMethod+": retry budget exhausted", err)
+		}
 	}
 }
 
@@ -664,14 +1214,60 @@ func (m *Machine) retryCall(ctx context.Context, overallTimeout, rpcTimeout time
 // state, and fails fast when it is stopped.
 //
 // If a machine fails its keepalive, pending calls are canceled.
-func (m *Machine) Call(ctx context.Context, serviceMethod string, arg, reply interface{}) error {
+//
+// If the machine's B was aborted (see AbortOnErrors), Call fails with
+// the error with which it was aborted. If the machine is draining
+// (see Drain), Call fails with an error of kind errors.Unavailable.
+//
+// If the called service was provided to the machine (see Services)
+// and declares a version (see rpc.Versioned), Call fails with an
+// error of kind errors.Precondition if the machine serves a
+// different version of the service, as may happen when the machine
+// runs a different binary.
+//
+// The behavior of the call may be customized by call options (see
+// CallOpt).
+func (m *Machine) Call(ctx context.Context, serviceMethod string, arg, reply interface{}, opts ...CallOpt) error {
+	if len(opts) == 0 {
+		return m.runningCall(ctx, 0, serviceMethod, arg, reply)
+	}
+	return m.callWithOpts(ctx, serviceMethod, arg, reply, opts)
+}
+
+// runningCall implements Call without options: it waits for the
+// machine to be running and invokes the method. Calls that wait for
+// a call slot are admitted in the order of the provided priority (see
+// CallPriority).
+func (m *Machine) runningCall(ctx context.Context, priority int, serviceMethod string, arg, reply interface{}) (err error) {
+	if err := m.aborted(); err != nil {
+		return err
+	}
+	if err := m.acquireCall(ctx, priority); err != nil {
+		return err
+	}
+	defer m.releaseCall()
+	if err := m.beginCall(); err != nil {
+		return err
+	}
+	defer m.endCall()
+	defer func() {
+		if ctx.Err() == nil {
+			m.budget.CallDone(m, err)
+			m.recordCallError(err)
+		}
+	}()
 	for {
 		switch state := m.State(); state {
 		case Running:
-			ctxCall, cancel := m.context(ctx)
-			defer cancel()
+			ctxCall, done := m.journalCall(ctx, serviceMethod)
 			err := m.call(ctxCall, serviceMethod, arg, reply)
-			if err == nil || err != ctxCall.Err() || m.State() != Stopped {
+			// Done cancels ctxCall, so we first note whether the call
+			// was canceled by the machine's stop.
+			canceled := err != nil && err == ctxCall.Err()
+			if lost := done(reply); err != nil && lost != nil && ctx.Err() == nil {
+				return errors.E(errors.Fatal, errors.Unavailable, lost)
+			}
+			if !canceled || m.State() != Stopped {
 				return err
 			}
 			fallthrough
@@ -682,34 +1278,47 @@ func (m *Machine) Call(ctx context.Context, serviceMethod string, arg, reply int
 			}
 			return errors.E(errors.Fatal, errors.Unavailable, msg)
 		default:
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			case <-m.Wait(Running):
+			if _, err := m.WaitFor(ctx, Running); err != nil && err == ctx.Err() {
+				return err
 			}
 		}
 	}
 }
 
-// RetryCall invokes Call, and retries on a temporary error.
-func (m *Machine) RetryCall(ctx context.Context, serviceMethod string, arg, reply interface{}) error {
+// RetryCall invokes Call, and retries on a temporary error. Retries
+// are subject to the B's retry budget, if any (see LimitRetries).
+func (m *Machine) RetryCall(ctx context.Context, serviceMethod string, arg, reply interface{}, opts ...CallOpt) error {
 	for retries := 0; ; retries++ {
-		if err := m.Call(ctx, serviceMethod, arg, reply); err == nil || !errors.IsTemporary(err) {
+		err := m.Call(ctx, serviceMethod, arg, reply, opts...)
+		if err == nil || !errors.IsTemporary(err) {
 			return err
 		}
 		if err := retry.Wait(ctx, retryPolicy, retries); err != nil {
 			return errors.E(errors.Fatal, err)
 		}
+		if werr := m.retries.Wait(ctx); werr != nil {
+			return errors.E(errors.Fatal, errors.TooManyTries, serviceMethod+": retry budget exhausted", err)
+		}
 	}
 }
 
+// Duplex opens a full-duplex stream to the method named by
+// serviceMethod on this machine. The method must be of the form
+// described by the rpc.Duplex docs. Like Call, Duplex waits for the
+// machine to be running.
+func (m *Machine) Duplex(ctx context.Context, serviceMethod string) (*rpc.Duplex, error) {
+	return rpc.OpenDuplex(func(arg io.Reader, reply *io.ReadCloser) error {
+		return m.Call(ctx, serviceMethod, arg, reply)
+	})
+}
+
 // SaveProfile saves a profile to a local file. The name of the file is
 // returned.
 func (m *Machine) saveProfile(ctx context.Context, which, path string) error {
 	ctx, cancel := context.WithTimeout(ctx, time.Minute)
 	defer cancel()
 	var rc io.ReadCloser
-	err := m.Call(ctx, "Supervisor.Profile", profileRequest{which, 0, false}, &rc)
+	err := m.Call(ctx, "Supervisor.Profile", profileRequest{Name: which}, &rc)
 	if err != nil {
 		return err
 	}
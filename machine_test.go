@@ -5,23 +5,38 @@
 package bigmachine
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto"
+	encbinary "encoding/binary"
 	"encoding/gob"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"reflect"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/grailbio/base/digest"
 	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/fatbin"
+	grlog "github.com/grailbio/base/log"
+	"github.com/grailbio/bigmachine/internal/tee"
 	"github.com/grailbio/bigmachine/rpc"
+	"github.com/shirou/gopsutil/disk"
 )
 
-var fakeDigest = digester.FromString("fake binary")
+var fakeDigest = defaultDigestPolicy.Digester.FromString("fake binary")
 
 type fakeSupervisor struct {
 	Args          []string
@@ -30,6 +45,16 @@ type fakeSupervisor struct {
 	LastKeepalive time.Time
 	Hung          bool
 	Execd         bool
+	Drained       bool
+	// Digest is the binary digest reported by Info, if set.
+	Digest digest.Digest
+	Tmpfs  []Tmpfs
+	Swap   Swap
+	// FailChunks is the number of chunk uploads (past the first chunk)
+	// whose replies are replaced by errors, after the chunk is written.
+	FailChunks int
+
+	upload []byte
 }
 
 func (s *fakeSupervisor) Setenv(ctx context.Context, env []string, _ *struct{}) error {
@@ -37,6 +62,16 @@ func (s *fakeSupervisor) Setenv(ctx context.Context, env []string, _ *struct{})
 	return nil
 }
 
+func (s *fakeSupervisor) MountTmpfs(ctx context.Context, t Tmpfs, _ *struct{}) error {
+	s.Tmpfs = append(s.Tmpfs, t)
+	return nil
+}
+
+func (s *fakeSupervisor) Swapon(ctx context.Context, swap Swap, _ *struct{}) error {
+	s.Swap = swap
+	return nil
+}
+
 func (s *fakeSupervisor) Setargs(ctx context.Context, args []string, _ *struct{}) error {
 	s.Args = args
 	return nil
@@ -47,6 +82,32 @@ func (s *fakeSupervisor) Setbinary(ctx context.Context, binary io.Reader, _ *str
 	return err
 }
 
+func (s *fakeSupervisor) SetbinaryChunk(ctx context.Context, chunk rpc.Chunk, size *int64) error {
+	if err := chunk.Verify(); err != nil {
+		return err
+	}
+	if chunk.Offset == 0 {
+		s.upload = nil
+	}
+	if chunk.Offset <= int64(len(s.upload)) {
+		s.upload = append(s.upload[:chunk.Offset], chunk.Data...)
+	}
+	*size = int64(len(s.upload))
+	if chunk.Offset > 0 && s.FailChunks > 0 {
+		s.FailChunks--
+		return errors.E(errors.Net, errors.Temporary, "reply lost")
+	}
+	return nil
+}
+
+func (s *fakeSupervisor) Commitbinary(ctx context.Context, size int64, _ *struct{}) error {
+	if got, want := int64(len(s.upload)), size; got != want {
+		return errors.E(errors.Precondition, fmt.Sprintf("got %d bytes, want %d", got, want))
+	}
+	s.Image, s.upload = s.upload, nil
+	return nil
+}
+
 func (s *fakeSupervisor) GetBinary(ctx context.Context, _ struct{}, rc *io.ReadCloser) error {
 	if s.Image == nil {
 		return errors.E(errors.Invalid, "no binary set")
@@ -73,6 +134,14 @@ func (s *fakeSupervisor) Info(ctx context.Context, _ struct{}, info *Info) error
 	info.Goos = runtime.GOOS
 	info.Goarch = runtime.GOARCH
 	info.Digest = fakeDigest
+	if !s.Digest.IsZero() {
+		info.Digest = s.Digest
+	}
+	return nil
+}
+
+func (s *fakeSupervisor) Drain(ctx context.Context, _ struct{}, _ *struct{}) error {
+	s.Drained = true
 	return nil
 }
 
@@ -159,6 +228,469 @@ func TestMachineBootup(t *testing.T) {
 	}
 }
 
+// TestUploadBinaryResume verifies that binary uploads are resumed
+// when chunk uploads fail.
+func TestUploadBinaryResume(t *testing.T) {
+	save := binaryChunkSize
+	binaryChunkSize = 1 << 20
+	defer func() {
+		binaryChunkSize = save
+	}()
+	supervisor := &fakeSupervisor{FailChunks: 2}
+	srv := rpc.NewServer()
+	if err := srv.Register("Supervisor", supervisor); err != nil {
+		t.Fatal(err)
+	}
+	httpsrv := httptest.NewServer(srv)
+	defer httpsrv.Close()
+	client, err := rpc.NewClient(func() *http.Client { return httpsrv.Client() }, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Machine{Addr: httpsrv.URL, client: client}
+	self, err := fatbin.Self()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, ok := self.Stat(runtime.GOOS, runtime.GOARCH)
+	if !ok {
+		t.Fatal("no binary for current platform")
+	}
+	if info.Size <= 2*int64(binaryChunkSize) {
+		t.Skipf("binary too small (%d bytes) to test resumption", info.Size)
+	}
+	if err = m.uploadBinary(context.Background(), self, info); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := supervisor.FailChunks, 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	r, err := binary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	image, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(supervisor.Image, image) {
+		t.Error("image does not match")
+	}
+}
+
+// A corruptingSupervisor is a supervisor that corrupts the first
+// chunks that are uploaded to it, as would a faulty network that
+// evades the chunks' checksums.
+type corruptingSupervisor struct {
+	*Supervisor
+	corrupt int32
+}
+
+func (s *corruptingSupervisor) SetbinaryChunk(ctx context.Context, chunk rpc.Chunk, size *int64) error {
+	if chunk.Offset > 0 && atomic.AddInt32(&s.corrupt, -1) >= 0 {
+		data := append([]byte{}, chunk.Data...)
+		data[len(data)/2] ^= 0xff
+		chunk = rpc.NewChunk(chunk.Offset, data)
+	}
+	return s.Supervisor.SetbinaryChunk(ctx, chunk, size)
+}
+
+// TestUploadBinaryRepair verifies that uploaded binaries are verified
+// before they are committed, that corrupted chunks are resent, and
+// that binaries that are corrupted after they are verified are not
+// run.
+func TestUploadBinaryRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saveDir, saveSize := binaryCacheDir, binaryChunkSize
+	binaryCacheDir, binaryChunkSize = dir, 1<<20
+	defer func() {
+		binaryCacheDir, binaryChunkSize = saveDir, saveSize
+	}()
+	supervisor := &corruptingSupervisor{Supervisor: new(Supervisor), corrupt: 2}
+	srv := rpc.NewServer()
+	if err = srv.Register("Supervisor", supervisor); err != nil {
+		t.Fatal(err)
+	}
+	httpsrv := httptest.NewServer(srv)
+	defer httpsrv.Close()
+	client, err := rpc.NewClient(func() *http.Client { return httpsrv.Client() }, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Machine{Addr: httpsrv.URL, client: client}
+	self, err := fatbin.Self()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, ok := self.Stat(runtime.GOOS, runtime.GOARCH)
+	if !ok {
+		t.Fatal("no binary for current platform")
+	}
+	if info.Size <= 3*int64(binaryChunkSize) {
+		t.Skipf("binary too small (%d bytes) to test repairs", info.Size)
+	}
+	if err = m.uploadBinary(context.Background(), self, info); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&supervisor.corrupt); got >= 0 {
+		t.Errorf("%d chunks were not corrupted", got)
+	}
+	d, err := imageDigest(runtime.GOOS, runtime.GOARCH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	supervisor.mu.Lock()
+	path, execDigest := supervisor.binaryPath, supervisor.execDigest
+	supervisor.mu.Unlock()
+	if got, want := execDigest, d; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploaded, err := digestPolicy.digest(f, info.Size)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := uploaded, d; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Truncated binaries are not run.
+	if err = os.Truncate(path, info.Size/2); err != nil {
+		t.Fatal(err)
+	}
+	err = supervisor.Exec(context.Background(), struct{}{}, nil)
+	if !errors.Is(errors.Integrity, err) {
+		t.Errorf("got %v, want integrity error", err)
+	}
+}
+
+func TestBinaryCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	save := binaryCacheDir
+	binaryCacheDir = dir
+	defer func() {
+		binaryCacheDir = save
+	}()
+	ctx := context.Background()
+	image := []byte("#!/bin/sh\necho hello\n")
+	if err = new(Supervisor).Setbinary(ctx, bytes.NewReader(image), nil); err != nil {
+		t.Fatal(err)
+	}
+	d, err := digestPolicy.digest(bytes.NewReader(image), int64(len(image)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := new(Supervisor)
+	var found bool
+	if err = s.UseBinary(ctx, digest.Digester(crypto.SHA256).FromString("other"), &found); err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("found binary that was not uploaded")
+	}
+	if err = s.UseBinary(ctx, d, &found); err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("uploaded binary was not cached")
+	}
+	cached, err := ioutil.ReadFile(s.binaryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cached, image) {
+		t.Error("image does not match")
+	}
+	if err = s.UseBinary(ctx, LocalInfo().Digest, &found); err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Error("supervisor's own binary was not found")
+	}
+}
+
+func TestFetchBinary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	save := binaryCacheDir
+	binaryCacheDir = dir
+	defer func() {
+		binaryCacheDir = save
+	}()
+	image := []byte("#!/bin/sh\necho hello\n")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(image)
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	d, err := digestPolicy.digest(bytes.NewReader(image), int64(len(image)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := new(Supervisor)
+	err = s.FetchBinary(ctx, fetchBinaryRequest{URL: srv.URL, Digest: d, Size: int64(len(image)) + 1}, nil)
+	if !errors.Is(errors.Integrity, err) {
+		t.Errorf("expected integrity error, got %v", err)
+	}
+	other := digest.Digester(crypto.SHA256).FromString("other")
+	err = s.FetchBinary(ctx, fetchBinaryRequest{URL: srv.URL, Digest: other, Size: int64(len(image))}, nil)
+	if !errors.Is(errors.Integrity, err) {
+		t.Errorf("expected integrity error, got %v", err)
+	}
+	if s.binaryPath != "" {
+		t.Fatal("binary path set by failed fetch")
+	}
+	if err = s.FetchBinary(ctx, fetchBinaryRequest{URL: srv.URL, Digest: d, Size: int64(len(image))}, nil); err != nil {
+		t.Fatal(err)
+	}
+	fetched, err := ioutil.ReadFile(s.binaryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fetched, image) {
+		t.Error("image does not match")
+	}
+	// Fetched binaries are cached like uploaded ones.
+	var found bool
+	if err = new(Supervisor).UseBinary(ctx, d, &found); err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Error("fetched binary was not cached")
+	}
+}
+
+func TestBinaryFanout(t *testing.T) {
+	f := newBinaryFanout(1)
+	d := digest.Digester(crypto.SHA256).FromString("binary")
+	m := &Machine{Addr: "m", location: Location{"us-west-2", "us-west-2b"}, located: true}
+	ctx := context.Background()
+	driver, err := f.Acquire(ctx, d, m, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if driver.machine != nil {
+		t.Fatal("expected driver source")
+	}
+	// The driver serves a single transfer at a time.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	_, err = f.Acquire(timeoutCtx, d, m, true)
+	cancel()
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	var (
+		crossZone = &Machine{Addr: "a", location: Location{"us-west-2", "us-west-2a"}, located: true}
+		sameZone  = &Machine{Addr: "b", location: Location{"us-west-2", "us-west-2b"}, located: true}
+		stopped   = &Machine{Addr: "c", location: Location{"us-west-2", "us-west-2b"}, located: true}
+	)
+	atomic.StoreInt64(&stopped.state, int64(Stopped))
+	f.Add(d, crossZone)
+	f.Add(d, stopped)
+	f.Add(d, sameZone)
+	for _, want := range []*Machine{sameZone, crossZone} {
+		src, err := f.Acquire(ctx, d, m, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := src.machine; got != want {
+			t.Errorf("got %v, want %v", got.Addr, want.Addr)
+		}
+	}
+	if got, want := len(f.sources[d]), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	acquired := make(chan *fanoutSource)
+	go func() {
+		src, err := f.Acquire(ctx, d, m, false)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- src
+	}()
+	f.Release(driver)
+	if src := <-acquired; src != driver {
+		t.Error("expected driver source")
+	}
+}
+
+func TestFetchPeerBinary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	save := binaryCacheDir
+	binaryCacheDir = dir
+	defer func() {
+		binaryCacheDir = save
+	}()
+	ctx := context.Background()
+	image := []byte("#!/bin/sh\necho hello\n")
+	peer := new(Supervisor)
+	if err = peer.Setbinary(ctx, bytes.NewReader(image), nil); err != nil {
+		t.Fatal(err)
+	}
+	srv := rpc.NewServer()
+	if err = srv.Register("Supervisor", peer); err != nil {
+		t.Fatal(err)
+	}
+	httpsrv := httptest.NewServer(srv)
+	defer httpsrv.Close()
+	client, err := rpc.NewClient(func() *http.Client { return httpsrv.Client() }, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := digestPolicy.digest(bytes.NewReader(image), int64(len(image)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Supervisor{b: &B{client: client}}
+	other := digest.Digester(crypto.SHA256).FromString("other")
+	err = s.FetchPeerBinary(ctx, peerBinaryRequest{Addr: httpsrv.URL, Digest: other, Size: int64(len(image))}, nil)
+	if err == nil {
+		t.Error("expected error")
+	}
+	if err = s.FetchPeerBinary(ctx, peerBinaryRequest{Addr: httpsrv.URL, Digest: d, Size: int64(len(image))}, nil); err != nil {
+		t.Fatal(err)
+	}
+	fetched, err := ioutil.ReadFile(s.binaryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fetched, image) {
+		t.Error("image does not match")
+	}
+}
+
+func TestBlobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	save := blobDir
+	blobDir = dir
+	defer func() {
+		blobDir = save
+	}()
+	ctx := context.Background()
+	blobs := NewBlobs()
+	if err = blobs.Configure(ctx, BlobCache{MaxBytes: 10}, nil); err != nil {
+		t.Fatal(err)
+	}
+	put := func(content string) digest.Digest {
+		t.Helper()
+		var d digest.Digest
+		if err := blobs.Put(ctx, strings.NewReader(content), &d); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := d, blobDigester.FromString(content); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		return d
+	}
+	a := put("aaaa")
+	b := put("bbbb")
+	// Blobs are evicted in least recently used order.
+	past := time.Now().Add(-time.Hour)
+	if err = os.Chtimes(blobPath(b), past, past); err != nil {
+		t.Fatal(err)
+	}
+	c := put("cccc")
+	var info BlobInfo
+	if err = blobs.Stat(ctx, b, &info); !errors.Is(errors.NotExist, err) {
+		t.Errorf("expected not-exist error, got %v", err)
+	}
+	for _, d := range []digest.Digest{a, c} {
+		if err = blobs.Stat(ctx, d, &info); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := info.Size, int64(4); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	f, err := OpenBlob(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(content), "aaaa"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err = blobs.Put(ctx, strings.NewReader("too large a blob"), new(digest.Digest)); !errors.Is(errors.Unavailable, err) {
+		t.Errorf("expected resources-exhausted error, got %v", err)
+	}
+	// Blobs outlive the service.
+	if err = NewBlobs().Stat(ctx, c, &info); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLogBuffer(t *testing.T) {
+	b := newLogBuffer(4)
+	for i := 0; i < 6; i++ {
+		b.Add(LogRecord{Message: fmt.Sprint(i)})
+	}
+	// The two oldest records were replaced.
+	records, next, _ := b.Read(0, 3)
+	if got, want := len(records), 3; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := records[0].Message, "2"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	records, next, added := b.Read(next, 3)
+	if got, want := len(records), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := records[0].Message, "5"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	b.Add(LogRecord{Message: "6"})
+	select {
+	case <-added:
+	default:
+		t.Error("added channel not closed")
+	}
+	if records, _, _ = b.Read(next, 3); len(records) != 1 || records[0].Message != "6" {
+		t.Errorf("bad records %v", records)
+	}
+	filter := LogFilter{Level: LogWarning, Machines: []string{"a"}, Contains: "disk"}
+	for _, test := range []struct {
+		record LogRecord
+		match  bool
+	}{
+		{LogRecord{Machine: "a", Level: LogError, Message: "disk full"}, true},
+		{LogRecord{Machine: "b", Level: LogError, Message: "disk full"}, false},
+		{LogRecord{Machine: "a", Level: LogInfo, Message: "disk full"}, false},
+		{LogRecord{Machine: "a", Level: LogError, Message: "out of memory"}, false},
+	} {
+		if got, want := filter.Match(test.record), test.match; got != want {
+			t.Errorf("%v: got %v, want %v", test.record, got, want)
+		}
+	}
+}
+
 func TestMachineEnv(t *testing.T) {
 	m, supervisor, shutdown := newTestMachine(t, Environ{"test=yes"})
 	defer shutdown()
@@ -171,6 +703,32 @@ func TestMachineEnv(t *testing.T) {
 	}
 }
 
+func TestMachineTmpfs(t *testing.T) {
+	scratch := Tmpfs{Path: "/scratch", Size: 1 << 30}
+	m, supervisor, shutdown := newTestMachine(t, Environ{"test=yes"}, scratch)
+	defer shutdown()
+	<-m.Wait(Running)
+	if got, want := len(supervisor.Tmpfs), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := supervisor.Tmpfs[0], scratch; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := supervisor.Environ, []string{"test=yes", tmpfsEnv + "=/scratch"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMachineSwap(t *testing.T) {
+	swap := Swap{Size: 8 << 30, Swappiness: 1}
+	m, supervisor, shutdown := newTestMachine(t, swap)
+	defer shutdown()
+	<-m.Wait(Running)
+	if got, want := supervisor.Swap, swap; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
 func TestCallTimeout(t *testing.T) {
 	m, _, shutdown := newTestMachine(t)
 	defer shutdown()
@@ -208,45 +766,1131 @@ type serviceGobUnregistered struct{}
 func TestServiceGobUnregisteredFastFail(t *testing.T) {
 	m, _, shutdown := newTestMachine(t, Services{"GobUnregistered": serviceGobUnregistered{}})
 	defer shutdown()
-	select {
-	case <-m.Wait(Running):
-		if m.State() == Running {
-			t.Fatalf("machine is running with broken service")
-		}
-	case <-time.After(2 * time.Minute):
-		// If our test environment causes this to falsely fail, we almost
-		// surely have lots of other problems, as this should otherwise fail
-		// almost instantly.
+	// If our test environment causes this to falsely fail, we almost
+	// surely have lots of other problems, as this should otherwise fail
+	// almost instantly.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	switch state, err := m.WaitFor(ctx, Running, Stopped); {
+	case err != nil && err == ctx.Err():
 		t.Fatalf("took too long to fail")
+	case state == Running:
+		t.Fatalf("machine is running with broken service")
 	}
 }
 
-// serviceInitPanic is a service that panics in Init, indicating that the
-// service is fatally broken.
-type serviceInitPanic struct{}
+// serviceBadMethod is a service with a method whose argument cannot
+// be encoded by gob.
+type serviceBadMethod struct{}
 
-func (serviceInitPanic) Init(b *B) error {
-	panic("")
+func (serviceBadMethod) Chan(ctx context.Context, c chan int, _ *struct{}) error {
+	return nil
 }
 
 func init() {
-	gob.Register(serviceInitPanic{})
+	gob.Register(serviceBadMethod{})
 }
 
-// TestBadServiceFastFail verifies that we fail fast when a service panics in
+// TestCheckServices verifies that problems with services are detected
+// before any machines are started.
+func TestCheckServices(t *testing.T) {
+	if err := checkServices(map[string]interface{}{"InitPanic": serviceInitPanic{}}); err != nil {
+		t.Fatal(err)
+	}
+	err := checkServices(map[string]interface{}{
+		"GobUnregistered": serviceGobUnregistered{},
+		"BadMethod":       serviceBadMethod{},
+		"InitPanic":       serviceInitPanic{},
+	})
+	if !errors.Is(errors.Invalid, err) {
+		t.Fatalf("error %v is not invalid", err)
+	}
+	for _, want := range []string{"service GobUnregistered", "service BadMethod", "Chan: argument chan int"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "InitPanic") {
+		t.Errorf("error %q reports valid service", err)
+	}
+}
+
+// serviceInitPanic is a service that panics in Init, indicating that the
+// service is fatally broken.
+type serviceInitPanic struct{}
+
+func (serviceInitPanic) Init(b *B) error {
+	panic("")
+}
+
+func init() {
+	gob.Register(serviceInitPanic{})
+}
+
+// TestBadServiceFastFail verifies that we fail fast when a service panics in
 // its Init.
 func TestServiceInitPanicFastFail(t *testing.T) {
 	m, _, shutdown := newTestMachine(t, Services{"InitPanic": serviceInitPanic{}})
 	defer shutdown()
-	select {
-	case <-m.Wait(Running):
-		if m.State() == Running {
-			t.Fatalf("machine is running with broken service")
-		}
-	case <-time.After(2 * time.Minute):
-		// If our test environment causes this to falsely fail, we almost
-		// surely have lots of other problems, as this should otherwise fail
-		// almost instantly.
+	// If our test environment causes this to falsely fail, we almost
+	// surely have lots of other problems, as this should otherwise fail
+	// almost instantly.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	switch state, err := m.WaitFor(ctx, Running, Stopped); {
+	case err != nil && err == ctx.Err():
 		t.Fatalf("took too long to fail")
+	case state == Running:
+		t.Fatalf("machine is running with broken service")
+	}
+}
+
+type fakeRegistrar struct {
+	mu           sync.Mutex
+	registered   map[string]bool
+	deregistered chan struct{}
+}
+
+func (r *fakeRegistrar) Register(ctx context.Context, m *Machine) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.registered[m.Addr] = true
+	return nil
+}
+
+func (r *fakeRegistrar) Deregister(ctx context.Context, m *Machine) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.registered, m.Addr)
+	close(r.deregistered)
+	return nil
+}
+
+func (r *fakeRegistrar) Registered(addr string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.registered[addr]
+}
+
+// TestRegistrar verifies that running machines are registered, and
+// that they are deregistered when they stop.
+func TestRegistrar(t *testing.T) {
+	r := &fakeRegistrar{
+		registered:   make(map[string]bool),
+		deregistered: make(chan struct{}),
+	}
+	m, _, shutdown := newTestMachine(t, registrarParam{r})
+	<-m.Wait(Running)
+	for start := time.Now(); !r.Registered(m.Addr); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Minute {
+			t.Fatal("machine was not registered")
+		}
+	}
+	shutdown()
+	<-r.deregistered
+	if r.Registered(m.Addr) {
+		t.Error("machine was not deregistered")
+	}
+}
+
+// blockingRegistrar records the calls made to it, each of which then
+// blocks until the registrar is released.
+type blockingRegistrar struct {
+	release chan struct{}
+	calls   chan string
+}
+
+func (r *blockingRegistrar) Register(ctx context.Context, m *Machine) error {
+	r.calls <- "register"
+	<-r.release
+	return nil
+}
+
+func (r *blockingRegistrar) Deregister(ctx context.Context, m *Machine) error {
+	r.calls <- "deregister"
+	<-r.release
+	return nil
+}
+
+// TestRegistrationCoalesced verifies that registration updates do not
+// block on the registrar, and that updates made while a call is in
+// flight are coalesced.
+func TestRegistrationCoalesced(t *testing.T) {
+	r := &blockingRegistrar{
+		release: make(chan struct{}),
+		calls:   make(chan string, 10),
+	}
+	reg := newRegistration(r, &Machine{Addr: "test"})
+	reg.Update(true)
+	if got, want := <-r.calls, "register"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The registration is in flight; these updates leave the machine
+	// registered, so they incur no further calls.
+	reg.Update(false)
+	reg.Update(true)
+	reg.Update(false)
+	reg.Update(true)
+	close(r.release)
+	reg.Stop()
+	if got, want := <-r.calls, "deregister"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	select {
+	case call := <-r.calls:
+		t.Errorf("unexpected call %s", call)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+type registrarParam struct{ Registrar }
+
+func (p registrarParam) applyParam(m *Machine) {
+	m.registrar = p.Registrar
+}
+
+func TestCallMachines(t *testing.T) {
+	var machines []*Machine
+	for i := 0; i < 3; i++ {
+		m, _, shutdown := newTestMachine(t)
+		defer shutdown()
+		machines = append(machines, m)
+	}
+	ctx := context.Background()
+	var replies []int
+	if err := CallMachines(ctx, machines, "Supervisor.Ping", 123, &replies, Concurrency(2)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := replies, []int{123, 123, 123}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	machines[1].Cancel()
+	<-machines[1].Wait(Stopped)
+	err := CallMachines(ctx, machines, "Supervisor.Ping", 321, &replies)
+	callErr, ok := err.(*CallAllError)
+	if !ok {
+		t.Fatalf("error %v is not a *CallAllError", err)
+	}
+	if got, want := callErr.Failed(), 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !errors.Is(errors.Unavailable, callErr.Errs[1]) {
+		t.Errorf("error %v is not Unavailable", callErr.Errs[1])
+	}
+	if got, want := replies, []int{321, 0, 321}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCallMachinesSpill(t *testing.T) {
+	var machines []*Machine
+	for i := 0; i < 2; i++ {
+		m, _, shutdown := newTestMachine(t)
+		defer shutdown()
+		<-m.Wait(Running)
+		machines = append(machines, m)
+	}
+	ctx := context.Background()
+	var replies []io.ReadCloser
+	if err := CallMachines(ctx, machines, "Supervisor.GetBinary", struct{}{}, &replies, Spill()); err != nil {
+		t.Fatal(err)
+	}
+	self, err := fatbin.Self()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, ok := self.Stat(runtime.GOOS, runtime.GOARCH)
+	if !ok {
+		t.Fatal("no local binary")
+	}
+	for _, rc := range replies {
+		n, err := io.Copy(ioutil.Discard, rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := n, info.Size; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if err := rc.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	err = CallMachines(ctx, machines, "Supervisor.GetBinary", struct{}{}, &replies, Spill(), ReplyBudget(1<<10))
+	callErr, ok := err.(*CallAllError)
+	if !ok {
+		t.Fatalf("error %v is not a *CallAllError", err)
+	}
+	for _, err := range callErr.Errs {
+		if !errors.Is(errors.Precondition, err) {
+			t.Errorf("error %v is not a precondition error", err)
+		}
+	}
+	var infos []Info
+	err = CallMachines(ctx, machines, "Supervisor.Info", struct{}{}, &infos, ReplyBudget(16))
+	if callErr, ok := err.(*CallAllError); !ok || callErr.Failed() != 2 {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestDigestPolicy(t *testing.T) {
+	var (
+		a = []byte("the quick brown fox jumps over the lazy dog")
+		b = []byte("the quick BROWN fox jumps over the lazy dog")
+	)
+	sum := func(p DigestPolicy, data []byte) digest.Digest {
+		t.Helper()
+		d, err := p.digest(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	if got, want := sum(defaultDigestPolicy, a), defaultDigestPolicy.Digester.FromBytes(a); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if sum(defaultDigestPolicy, a) == sum(defaultDigestPolicy, b) {
+		t.Error("distinct binaries have the same digest")
+	}
+	policy := defaultDigestPolicy
+	policy.Exclude = func(r io.ReaderAt, size int64) ([]ByteRange, error) {
+		if got, want := size, int64(len(a)); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		return []ByteRange{{Off: 10, Len: 5}}, nil
+	}
+	if sum(policy, a) != sum(policy, b) {
+		t.Error("binaries that differ only in excluded ranges have different digests")
+	}
+	// Stripping build IDs is a no-op for non-ELF binaries.
+	policy = defaultDigestPolicy
+	policy.StripBuildID = true
+	if got, want := sum(policy, a), sum(defaultDigestPolicy, a); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestKeepaliveParams(t *testing.T) {
+	b := new(B)
+	DefaultKeepalive(Keepalive{Period: time.Second, Timeout: 10 * time.Second})(b)
+	m := new(Machine)
+	Keepalive{Timeout: time.Minute}.applyParam(m)
+	system := Keepalive{Period: time.Minute, Timeout: 2 * time.Minute, RpcTimeout: 10 * time.Second}
+	got := system.override(b.keepalive).override(m.keepalive)
+	want := Keepalive{Period: time.Second, Timeout: time.Minute, RpcTimeout: 10 * time.Second}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestPanicScanner(t *testing.T) {
+	const (
+		crash = `starting
+panic: boom
+
+goroutine 1 [running]:
+main.crash(0x1, 0x2)
+	/src/main.go:10 +0x39
+main.main()
+	/src/main.go:5 +0x20
+
+goroutine 6 [chan receive]:
+main.other()
+	/src/main.go:20 +0x1a
+exit status 2`
+		method = `2020/01/01 00:00:00 serving
+2020/01/01 00:00:01 panic in method call Svc.Crash
+goroutine 17 [running]:
+main.crash(0x3, 0x4)
+	/src/main.go:10 +0x41
+main.main()
+	/src/main.go:5 +0x20
+2020/01/01 00:00:02 still serving
+2020/01/01 00:00:03 done`
+	)
+	scan := func(output string) (messages, stacks []string) {
+		var s panicScanner
+		for _, line := range strings.Split(output, "\n") {
+			if message, stack, ok := s.Line(line); ok {
+				messages = append(messages, message)
+				stacks = append(stacks, stack)
+			}
+		}
+		if message, stack, ok := s.Flush(); ok {
+			messages = append(messages, message)
+			stacks = append(stacks, stack)
+		}
+		return
+	}
+	crashMessages, crashStacks := scan(crash)
+	if got, want := crashMessages, []string{"panic: boom"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := crashStacks[0], "goroutine 1 [running]:\nmain.crash(0x1, 0x2)\n\t/src/main.go:10 +0x39\nmain.main()\n\t/src/main.go:5 +0x20"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	methodMessages, methodStacks := scan(method)
+	if got, want := methodMessages, []string{"panic in method call Svc.Crash"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := panicSignature(methodStacks[0]), panicSignature(crashStacks[0]); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if panicSignature(methodStacks[0]) == panicSignature("goroutine 1 [running]:\nmain.main()\n\t/src/main.go:5 +0x20") {
+		t.Error("distinct stacks have the same signature")
+	}
+}
+
+// ExitSystem is a System that reports the exit status of all
+// machines.
+type exitSystem struct {
+	System
+	status ExitStatus
+}
+
+func (s exitSystem) MachineExit(context.Context, *Machine) (ExitStatus, error) {
+	return s.status, nil
+}
+
+func TestCrashReport(t *testing.T) {
+	m := &Machine{Addr: "https://m0/"}
+	for i := 0; i < maxCrashOutputLines; i++ {
+		m.recent.Line(fmt.Sprintf("line %d", i))
+	}
+	m.recent.Panic("panic in method call Svc.Crash", "goroutine 17 [running]:\nmain.crash()\n\t/src/main.go:10 +0x41")
+	ctx := context.Background()
+	if report := m.reportCrash(ctx, Local); report != nil {
+		t.Fatalf("unexpected crash report %v", report)
+	}
+	for _, line := range []string{"panic: boom", "", "goroutine 1 [running]:", "main.main()", "\t/src/main.go:5 +0x20"} {
+		m.recent.Line(line)
+	}
+	report := m.reportCrash(ctx, exitSystem{status: ExitStatus{Code: 2, Description: "exit status 2"}})
+	if report == nil {
+		t.Fatal("no crash report")
+	}
+	if got, want := report.Error(), "machine crashed (exit status 2): panic: boom"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := report.Stack, "goroutine 1 [running]:\nmain.main()\n\t/src/main.go:5 +0x20"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := len(report.Output), maxCrashOutputLines; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := report.Output[0], "line 5"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := report.Output[len(report.Output)-1], "\t/src/main.go:5 +0x20"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if m.CrashReport() != report {
+		t.Error("crash report was not retained")
+	}
+}
+
+type sickService struct{ err error }
+
+func (s *sickService) Healthy(ctx context.Context) error { return s.err }
+
+func (s *sickService) Ping(ctx context.Context, arg int, reply *int) error {
+	*reply = arg
+	return nil
+}
+
+func TestHealthCheck(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := StartSupervisor(ctx, nil, nil, rpc.NewServer())
+	sick := new(sickService)
+	if err := s.Register(ctx, service{"Sick", sick}, nil); err != nil {
+		t.Fatal(err)
+	}
+	keepalive := func() keepaliveReply {
+		t.Helper()
+		s.checkHealth(ctx)
+		var reply keepaliveReply
+		if err := s.Keepalive(ctx, time.Minute, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	if reply := keepalive(); !reply.Healthy {
+		t.Fatalf("unexpectedly unhealthy: %s", reply.Reason)
+	}
+	sick.err = errors.New("out of widgets")
+	reply := keepalive()
+	if reply.Healthy {
+		t.Fatal("unexpectedly healthy")
+	}
+	if got, want := reply.Reason, "Sick: out of widgets"; !strings.Contains(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	sick.err = nil
+	if reply := keepalive(); !reply.Healthy {
+		t.Fatalf("unexpectedly unhealthy: %s", reply.Reason)
+	}
+}
+
+func TestRetryLimiter(t *testing.T) {
+	var unlimited *retryLimiter
+	for i := 0; i < 10; i++ {
+		if err := unlimited.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := new(B)
+	LimitRetries(RetryBudget{Rate: 0.001, Burst: 2})(b)
+	for i := 0; i < 2; i++ {
+		if err := b.retries.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := b.retries.Wait(ctx); err == nil {
+		t.Error("expected retry to be throttled")
+	}
+}
+
+func TestCallPriority(t *testing.T) {
+	m := &Machine{callLimit: &CallLimit{Max: 1}}
+	ctx := context.Background()
+	if err := m.acquireCall(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	waiting := func() int {
+		m.callMu.Lock()
+		defer m.callMu.Unlock()
+		return len(m.callWaiters)
+	}
+	var (
+		admitted = make(chan int, 4)
+		canceled = make(chan error)
+	)
+	cancelCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		canceled <- m.acquireCall(cancelCtx, 3)
+	}()
+	for waiting() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	// Calls of equal priority are admitted in the order in which they
+	// were made.
+	for i, priority := range []int{0, 1, 2, 1} {
+		i, priority := i, priority
+		go func() {
+			if err := m.acquireCall(ctx, priority); err != nil {
+				t.Error(err)
+			}
+			admitted <- i
+		}()
+		for waiting() != i+2 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	cancel()
+	if err := <-canceled; err != context.Canceled {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	if got, want := waiting(), 4; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	var order []int
+	for range []int{0, 1, 2, 3} {
+		m.releaseCall()
+		order = append(order, <-admitted)
+	}
+	if got, want := order, []int{2, 1, 3, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	m.releaseCall()
+	if got, want := m.callsActive, 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestJournalCancel(t *testing.T) {
+	m := &Machine{journal: make(map[*callEntry]struct{})}
+	ctx, done := m.journalCall(context.Background(), "Test.Call")
+	if got, want := len(m.InFlightCalls()), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if lost := done(nil); lost != nil {
+		t.Fatal(lost)
+	}
+	if got, want := ctx.Err(), context.Canceled; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(m.InFlightCalls()), 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// The contexts of calls with streamed replies are canceled once
+	// the replies are closed.
+	ctx, done = m.journalCall(context.Background(), "Test.Stream")
+	rc := ioutil.NopCloser(strings.NewReader("reply"))
+	if lost := done(&rc); lost != nil {
+		t.Fatal(lost)
+	}
+	if err := ctx.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ctx.Err(), context.Canceled; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMachineUpgrade(t *testing.T) {
+	m, supervisor, shutdown := newTestMachine(t)
+	defer shutdown()
+	<-m.Wait(Running)
+	self, err := fatbin.Self()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := binaryImageDigest(self, runtime.GOOS, runtime.GOARCH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	supervisor.Execd = false
+	supervisor.Digest = want
+	ctx := context.Background()
+	if err := m.upgrade(ctx, self); err != nil {
+		t.Fatal(err)
+	}
+	if !supervisor.Drained {
+		t.Error("machine not drained")
+	}
+	if !supervisor.Execd {
+		t.Error("binary not execd")
+	}
+	if m.Draining() {
+		t.Error("machine still draining after upgrade")
+	}
+	supervisor.Digest = fakeDigest
+	if err := m.upgrade(ctx, self); err == nil || !errors.Is(errors.Precondition, err) {
+		t.Errorf("bad error %v", err)
+	}
+	if got, want := m.State(), Running; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMachineReboot(t *testing.T) {
+	m, supervisor, shutdown := newTestMachine(t)
+	defer shutdown()
+	<-m.Wait(Running)
+	supervisor.Execd = false
+	ctx := context.Background()
+	if err := m.Reboot(ctx, RebootOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if !supervisor.Drained {
+		t.Error("machine not drained")
+	}
+	if !supervisor.Execd {
+		t.Error("binary not execd")
+	}
+	if m.Draining() {
+		t.Error("machine still draining after reboot")
+	}
+	if m.rebooting() != nil {
+		t.Error("machine still rebooting after reboot")
+	}
+	if got, want := m.State(), Running; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := m.Reboot(ctx, RebootOptions{Hard: true}); err == nil || !errors.Is(errors.NotSupported, err) {
+		t.Errorf("bad error %v", err)
+	}
+}
+
+type dependentService []string
+
+func (s dependentService) InitAfter() []string { return s }
+
+func TestServiceOrder(t *testing.T) {
+	order, err := serviceOrder(map[string]interface{}{
+		"Cache":   dependentService{"Storage", "Config"},
+		"Config":  dependentService(nil),
+		"Storage": dependentService{"Config"},
+		"Worker":  dependentService{"Cache"},
+		"Aux":     dependentService(nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := order, []string{"Aux", "Config", "Storage", "Cache", "Worker"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	_, err = serviceOrder(map[string]interface{}{
+		"A": dependentService{"B"},
+		"B": dependentService{"C"},
+		"C": dependentService{"A"},
+		"D": dependentService(nil),
+	})
+	if err == nil || !errors.Is(errors.Invalid, err) || !strings.Contains(err.Error(), "A, B, C have cyclic") {
+		t.Errorf("bad error %v", err)
+	}
+	_, err = serviceOrder(map[string]interface{}{
+		"A": dependentService{"Missing"},
+	})
+	if err == nil || !errors.Is(errors.Invalid, err) {
+		t.Errorf("bad error %v", err)
+	}
+}
+
+type releaseService struct{ released int }
+
+func (s *releaseService) ReleaseMemory() { s.released++ }
+
+func TestMemoryWatchdog(t *testing.T) {
+	svc := new(releaseService)
+	s := &Supervisor{services: map[string]interface{}{"Svc": svc}}
+	w := MemoryWatchdog{
+		Thresholds: []MemoryThreshold{
+			{Name: "warning", Heap: 1 << 30, Actions: MemoryGC | MemoryRelease},
+			{Name: "critical", SystemPercent: 90, Actions: MemoryUnhealthy},
+		},
+	}
+	ctx := context.Background()
+	s.checkMemory(ctx, w, memoryUsage{SystemPercent: 50, Heap: 1 << 20})
+	if trips, unhealthy := s.memoryStatus(); len(trips) != 0 || unhealthy {
+		t.Fatalf("unexpected trips %v (unhealthy %v)", trips, unhealthy)
+	}
+	s.checkMemory(ctx, w, memoryUsage{SystemPercent: 50, Heap: 2 << 30})
+	trips, unhealthy := s.memoryStatus()
+	if got, want := len(trips), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := trips[0].String(), "warning: heap "; !strings.HasPrefix(got, want) {
+		t.Errorf("got %v, want prefix %v", got, want)
+	}
+	if unhealthy {
+		t.Error("machine unexpectedly unhealthy")
+	}
+	if got, want := svc.released, 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	first := trips[0].Time
+	s.checkMemory(ctx, w, memoryUsage{SystemPercent: 95, Heap: 2 << 30})
+	trips, unhealthy = s.memoryStatus()
+	if got, want := len(trips), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if !trips[0].Time.Equal(first) {
+		t.Errorf("trip time changed from %v to %v", first, trips[0].Time)
+	}
+	if !unhealthy {
+		t.Error("machine unexpectedly healthy")
+	}
+	if got, want := svc.released, 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := (MemoryGC | MemoryExit).String(), "gc|exit"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSampleEvents(t *testing.T) {
+	counts := make(map[string]int)
+	event := sampleEvents(func(typ string, _ ...interface{}) { counts[typ]++ }, 0.1)
+	for i := 0; i < 10000; i++ {
+		event("bigmachine:machineAlive")
+		event("bigmachine:machineStop")
+	}
+	if got, want := counts["bigmachine:machineStop"], 10000; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := counts["bigmachine:machineAlive"]; got < 500 || got > 1500 {
+		t.Errorf("sampled %d of 10000 events at rate 0.1", got)
+	}
+}
+
+type cleanupService struct {
+	used    map[string]float64
+	cleaned []string
+}
+
+func (s *cleanupService) CleanupDisk(ctx context.Context, path string) error {
+	s.cleaned = append(s.cleaned, path)
+	s.used[path] -= 10
+	return nil
+}
+
+func TestDiskWatchdog(t *testing.T) {
+	svc := &cleanupService{used: map[string]float64{"/": 50, os.TempDir(): 50, "/data": 99}}
+	save := diskUsage
+	diskUsage = func(path string) (*disk.UsageStat, error) {
+		return &disk.UsageStat{Path: path, UsedPercent: svc.used[path]}, nil
+	}
+	defer func() { diskUsage = save }()
+	s := &Supervisor{services: map[string]interface{}{"Svc": svc}}
+	ctx := context.Background()
+	s.checkDisk(ctx)
+	if err := s.diskError(); err != nil {
+		t.Fatal(err)
+	}
+	// The cleanup brings /data to 89%, below the threshold.
+	if err := s.SetDiskWatchdog(ctx, DiskWatchdog{Paths: []string{"/data"}, Threshold: 90}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.diskError(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := svc.cleaned, []string{"/data"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	svc.used["/data"] = 105
+	s.checkDisk(ctx)
+	if err := s.diskError(); err == nil || !errors.Is(errors.Unavailable, err) || !strings.Contains(err.Error(), "disk /data is 95.0% full") {
+		t.Errorf("bad error %v", err)
+	}
+	var info DiskInfo
+	if err := s.DiskInfo(ctx, struct{}{}, &info); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(info.Volumes), 3; os.TempDir() != "/" && got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestExecArgs(t *testing.T) {
+	environ := []string{"A=b"}
+	args, env, err := execArgs([]string{"prog", "-flag"}, environ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := args, []string{"prog", "-flag"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := env, environ; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	long := []string{"prog", "-input=" + strings.Repeat("x", maxExecArgSize), "-flag"}
+	args, env, err = execArgs(long, environ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := args, []string{"prog"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(env), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	save := os.Args
+	defer func() { os.Args = save }()
+	os.Setenv(argsFileEnv, strings.TrimPrefix(env[1], argsFileEnv+"="))
+	if err := restoreSpilledArgs(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := os.Args, long; !reflect.DeepEqual(got, want) {
+		t.Errorf("restored %d arguments, want %d", len(got), len(want))
+	}
+	if os.Getenv(argsFileEnv) != "" {
+		t.Errorf("%s is still set", argsFileEnv)
+	}
+}
+
+func TestMachineScore(t *testing.T) {
+	m := &Machine{Addr: "test", changed: func(*Machine) {}}
+	if got, want := m.Score(), 1.0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The score decays gradually, and the machine becomes degraded once
+	// it falls below 0.5.
+	m.updateScore(0)
+	if m.Degraded() {
+		t.Fatalf("machine degraded after a single bad sample (score %v)", m.Score())
+	}
+	for i := 0; i < 2; i++ {
+		m.updateScore(0)
+	}
+	if !m.Degraded() {
+		t.Fatalf("machine not degraded (score %v)", m.Score())
+	}
+	// Recovery requires a score of 0.7.
+	m.updateScore(1)
+	if score := m.Score(); score < degradedScore || score >= recoveredScore || !m.Degraded() {
+		t.Fatalf("score %v: degraded %v", score, m.Degraded())
+	}
+	for m.Score() < recoveredScore {
+		m.updateScore(1)
+	}
+	if m.Degraded() {
+		t.Fatalf("machine degraded (score %v)", m.Score())
+	}
+
+	for i := 0; i < 100; i++ {
+		m.recordCallError(errors.E("failed"))
+	}
+	if sample := m.sampleScore(); sample > 0.1 {
+		t.Errorf("sample %v despite call errors", sample)
+	}
+}
+
+func TestTunnel(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+	var header bytes.Buffer
+	if err := encbinary.Write(&header, encbinary.BigEndian, uint16(port)); err != nil {
+		t.Fatal(err)
+	}
+	pr, pw := io.Pipe()
+	var (
+		s     = new(Supervisor)
+		reply io.ReadCloser
+	)
+	if err := s.Tunnel(context.Background(), io.MultiReader(&header, pr), &reply); err != nil {
+		t.Fatal(err)
+	}
+	defer reply.Close()
+	for _, msg := range []string{"hello", "world"} {
+		if _, err := io.WriteString(pw, msg); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(reply, buf); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(buf), msg; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	pw.Close()
+	if rest, err := ioutil.ReadAll(reply); err != nil || len(rest) != 0 {
+		t.Errorf("got %q, %v, want EOF", rest, err)
+	}
+
+	header.Reset()
+	if err := encbinary.Write(&header, encbinary.BigEndian, uint16(0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Tunnel(context.Background(), &header, &reply); !errors.Is(errors.Unavailable, err) {
+		t.Errorf("got %v, want Unavailable", err)
+	}
+}
+
+func TestOutputLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := openOutputLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Configure(LogRotation{MaxFileSize: 10, MaxTotalSize: 40})
+	var written bytes.Buffer
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(io.MultiWriter(l, &written), "line %02d\n", i)
+	}
+	// Reopening the log, as after an exec, continues its output.
+	l, err = openOutputLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Configure(LogRotation{MaxFileSize: 10, MaxTotalSize: 40})
+	fmt.Fprintf(io.MultiWriter(l, &written), "line %02d\n", 20)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(infos), 3; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	output := written.Bytes()
+	for _, test := range []struct {
+		off, limit int64
+		start      int64
+		want       string
+	}{
+		{0, 0, 128, "line 16\nline 17\nline 18\nline 19\nline 20\n"},
+		{-16, 0, 152, "line 19\nline 20\n"},
+		{132, 8, 132, " 16\nline"},
+		{1000, 0, int64(len(output)), ""},
+	} {
+		r, start, err := l.Open(test.off, test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := start, test.start; got != want {
+			t.Errorf("%d, %d: got %v, want %v", test.off, test.limit, got, want)
+		}
+		if got, want := string(b), test.want; got != want {
+			t.Errorf("%d, %d: got %q, want %q", test.off, test.limit, got, want)
+		}
+		if got, want := string(b), string(output[start:start+int64(len(b))]); got != want {
+			t.Errorf("%d, %d: got %q, want %q", test.off, test.limit, got, want)
+		}
+	}
+
+	s := &Supervisor{history: l}
+	var rc io.ReadCloser
+	if err = s.TailRange(context.Background(), tailRangeRequest{Offset: -8, Compressors: []string{"gzip"}}, &rc); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(rc)
+	if line, _ := br.ReadString('\n'); line != "160\n" {
+		t.Errorf("got %q, want offset 160", line)
+	}
+	r, err := newTailReader(ioutil.NopCloser(br))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "line 20\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	rc.Close()
+}
+
+func TestOutputFollower(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := openOutputLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Configure(LogRotation{MaxFileSize: 10})
+	fmt.Fprintf(l, "skipped\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &outputFollower{ctx: ctx, log: l, off: int64(len("skipped\n"))}
+	go func() {
+		for i := 0; i < 10; i++ {
+			fmt.Fprintf(l, "line %02d\n", i)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	r := bufio.NewReader(f)
+	for i := 0; i < 10; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := line, fmt.Sprintf("line %02d\n", i); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	cancel()
+	if _, err := r.ReadString('\n'); err != context.Canceled {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	f.Close()
+}
+
+func TestTailCompression(t *testing.T) {
+	s := &Supervisor{output: new(tee.Writer)}
+	for _, compressors := range [][]string{nil, {"bogus", "gzip"}} {
+		ctx, cancel := context.WithCancel(context.Background())
+		var rc io.ReadCloser
+		if err := s.Tail(ctx, tailRequest{compressors}, &rc); err != nil {
+			t.Fatal(err)
+		}
+		r, err := newTailReader(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := r.(tailReader); ok != (compressors != nil) {
+			t.Errorf("%v: compressed %v", compressors, ok)
+		}
+		// The tee is asynchronous, so we write until the first line
+		// is read.
+		lines := make(chan string)
+		go func() {
+			line, _ := bufio.NewReader(r).ReadString('\n')
+			lines <- line
+		}()
+		var line string
+	loop:
+		for {
+			io.WriteString(s.output, "hello world\n")
+			select {
+			case line = <-lines:
+				break loop
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+		if got, want := line, "hello world\n"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		cancel()
+		r.Close()
+	}
+}
+
+func TestSetLogLevel(t *testing.T) {
+	var (
+		s    = new(Supervisor)
+		ctx  = context.Background()
+		prev grlog.Level
+	)
+	// The current level is observed through SetLogLevel, which is
+	// synchronized with the restoration of levels.
+	if err := s.SetLogLevel(ctx, setLogLevelRequest{Level: grlog.Debug}, &prev); err != nil {
+		t.Fatal(err)
+	}
+	orig := prev
+	defer s.SetLogLevel(ctx, setLogLevelRequest{Level: orig}, &prev)
+	if err := s.SetLogLevel(ctx, setLogLevelRequest{Level: grlog.Error, Duration: 20 * time.Millisecond}, &prev); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := prev, grlog.Debug; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := s.SetLogLevel(ctx, setLogLevelRequest{Level: grlog.Info, Duration: 20 * time.Millisecond}, &prev); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := prev, grlog.Debug; got != want {
+		t.Errorf("got %v, want %v (level not restored)", got, want)
+	}
+	// Setting the level again cancels the pending restoration.
+	if err := s.SetLogLevel(ctx, setLogLevelRequest{Level: grlog.Error}, &prev); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := s.SetLogLevel(ctx, setLogLevelRequest{Level: grlog.Error}, &prev); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := prev, grlog.Error; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := s.SetLogLevel(ctx, setLogLevelRequest{Level: grlog.Debug + 1}, &prev); !errors.Is(errors.Invalid, err) {
+		t.Errorf("got %v, want Invalid", err)
 	}
 }
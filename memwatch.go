@@ -0,0 +1,331 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grailbio/base/data"
+	"github.com/grailbio/base/log"
+	"github.com/shirou/gopsutil/mem"
+)
+
+// DefaultMemoryWatchdogPeriod is the default interval at which a
+// memory watchdog samples the machine's memory usage.
+const defaultMemoryWatchdogPeriod = 10 * time.Second
+
+// A MemoryAction is an action taken by a memory watchdog when the
+// machine's memory usage crosses a threshold (see MemoryWatchdog).
+// Actions may be combined.
+type MemoryAction int
+
+const (
+	// MemoryGC forces a garbage collection and returns as much memory
+	// as possible to the operating system.
+	MemoryGC MemoryAction = 1 << iota
+	// MemoryRelease calls the method
+	//
+	//	ReleaseMemory()
+	//
+	// of each of the machine's services that implements it, so that
+	// services may drop caches and other discardable state.
+	MemoryRelease
+	// MemoryUnhealthy marks the machine unhealthy for as long as its
+	// memory usage remains above the threshold (see Machine.Healthy).
+	MemoryUnhealthy
+	// MemoryExit terminates the machine.
+	MemoryExit
+)
+
+// String returns a string representation of the actions.
+func (a MemoryAction) String() string {
+	var actions []string
+	for _, action := range []struct {
+		action MemoryAction
+		name   string
+	}{
+		{MemoryGC, "gc"},
+		{MemoryRelease, "release"},
+		{MemoryUnhealthy, "unhealthy"},
+		{MemoryExit, "exit"},
+	} {
+		if a&action.action != 0 {
+			actions = append(actions, action.name)
+		}
+	}
+	if len(actions) == 0 {
+		return "none"
+	}
+	return strings.Join(actions, "|")
+}
+
+// A MemoryThreshold is a memory usage threshold of a memory watchdog.
+// A threshold is crossed when any of its (nonzero) limits is reached.
+type MemoryThreshold struct {
+	// Name names the threshold, for example "warning" or "critical".
+	Name string
+	// SystemPercent is the percentage of the system's memory in use.
+	SystemPercent float64
+	// RSS is the resident set size of the machine's process, in bytes.
+	// It is measured only on Linux.
+	RSS uint64
+	// Heap is the size of the Go heap of the machine's process, in
+	// bytes (runtime.MemStats.HeapAlloc).
+	Heap uint64
+	// Actions are the actions taken each time the watchdog finds the
+	// threshold crossed.
+	Actions MemoryAction
+}
+
+// MemoryWatchdog is a machine parameter that configures a memory
+// watchdog on the machine: the machine's supervisor periodically
+// samples the machine's memory usage and takes the actions of each
+// threshold that is crossed. The thresholds that a machine has crossed
+// are reported to the driver, which logs them, emits a
+// MachineMemoryThreshold event when a threshold is first crossed (see
+// B.Events), and reports them through Machine.MemoryTrips. The memory
+// watchdog supplements the supervisor's default health check, which
+// marks machines unhealthy when more than 95% of system memory is in
+// use.
+type MemoryWatchdog struct {
+	// Period is the interval at which memory usage is sampled. It
+	// defaults to 10 seconds.
+	Period time.Duration
+	// Thresholds are the watchdog's thresholds.
+	Thresholds []MemoryThreshold
+}
+
+func (w MemoryWatchdog) applyParam(m *Machine) {
+	m.memoryWatchdog = &w
+}
+
+// A MemoryTrip describes a memory threshold that a machine has
+// crossed.
+type MemoryTrip struct {
+	// Threshold is the name of the threshold.
+	Threshold string
+	// Reason describes the limit that was reached.
+	Reason string
+	// Time is the time at which the threshold was first crossed.
+	Time time.Time
+}
+
+// String returns a string representation of the trip.
+func (t MemoryTrip) String() string {
+	return fmt.Sprintf("%s: %s", t.Threshold, t.Reason)
+}
+
+// MemoryUsage is a sample of a process's memory usage.
+type memoryUsage struct {
+	SystemPercent float64
+	RSS, Heap     uint64
+}
+
+// Crossed returns a description of the limit of threshold t that the
+// provided usage reaches, or the empty string if t is not crossed.
+func (t MemoryThreshold) crossed(usage memoryUsage) string {
+	switch {
+	case t.SystemPercent > 0 && usage.SystemPercent >= t.SystemPercent:
+		return fmt.Sprintf("system memory %.1f%% >= %.1f%%", usage.SystemPercent, t.SystemPercent)
+	case t.RSS > 0 && usage.RSS >= t.RSS:
+		return fmt.Sprintf("rss %s >= %s", data.Size(usage.RSS), data.Size(t.RSS))
+	case t.Heap > 0 && usage.Heap >= t.Heap:
+		return fmt.Sprintf("heap %s >= %s", data.Size(usage.Heap), data.Size(t.Heap))
+	}
+	return ""
+}
+
+// ReadMemoryUsage samples the current process's memory usage.
+func readMemoryUsage() (memoryUsage, error) {
+	var usage memoryUsage
+	vm, err := mem.VirtualMemory()
+	if err != nil {
+		return usage, err
+	}
+	usage.SystemPercent = vm.UsedPercent
+	if usage.RSS, err = readRSS(); err != nil {
+		return usage, err
+	}
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	usage.Heap = stats.HeapAlloc
+	return usage, nil
+}
+
+// ReadRSS returns the resident set size of the current process, as
+// reported by /proc/self/statm. It returns 0 on systems without procfs.
+func readRSS() (uint64, error) {
+	statm, err := ioutil.ReadFile("/proc/self/statm")
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(statm))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("/proc/self/statm: unexpected contents %q", statm)
+	}
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("/proc/self/statm: %v", err)
+	}
+	return pages * uint64(os.Getpagesize()), nil
+}
+
+// SetMemoryWatchdog installs the provided memory watchdog, replacing
+// any previously installed one.
+func (s *Supervisor) SetMemoryWatchdog(ctx context.Context, w MemoryWatchdog, _ *struct{}) error {
+	s.memWatchMu.Lock()
+	defer s.memWatchMu.Unlock()
+	if s.memWatchCancel != nil {
+		s.memWatchCancel()
+	}
+	s.memTrips = nil
+	s.memWatchdog = &w
+	var watchCtx context.Context
+	watchCtx, s.memWatchCancel = context.WithCancel(context.Background())
+	go s.watchMemory(watchCtx, w)
+	return nil
+}
+
+// WatchMemory runs the memory watchdog w until the context is done.
+func (s *Supervisor) watchMemory(ctx context.Context, w MemoryWatchdog) {
+	period := w.Period
+	if period <= 0 {
+		period = defaultMemoryWatchdogPeriod
+	}
+	tick := time.NewTicker(period)
+	defer tick.Stop()
+	for {
+		usage, err := readMemoryUsage()
+		if err != nil {
+			log.Error.Printf("memory watchdog: %v", err)
+		} else {
+			s.checkMemory(ctx, w, usage)
+		}
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// CheckMemory checks the provided memory usage against the thresholds
+// of watchdog w, takes the actions of the thresholds that are crossed,
+// and records them as the supervisor's current memory trips.
+func (s *Supervisor) checkMemory(ctx context.Context, w MemoryWatchdog, usage memoryUsage) {
+	s.memWatchMu.Lock()
+	prev := make(map[string]MemoryTrip)
+	for _, trip := range s.memTrips {
+		prev[trip.Threshold] = trip
+	}
+	s.memWatchMu.Unlock()
+	var (
+		trips   []MemoryTrip
+		actions MemoryAction
+	)
+	for _, t := range w.Thresholds {
+		reason := t.crossed(usage)
+		if reason == "" {
+			continue
+		}
+		trip, ok := prev[t.Name]
+		if !ok {
+			trip.Time = time.Now()
+			log.Error.Printf("memory threshold %s crossed: %s; actions: %s", t.Name, reason, t.Actions)
+		}
+		trip.Threshold, trip.Reason = t.Name, reason
+		trips = append(trips, trip)
+		actions |= t.Actions
+	}
+	s.memWatchMu.Lock()
+	if ctx.Err() == nil {
+		s.memTrips = trips
+		s.memUnhealthy = actions&MemoryUnhealthy != 0
+	}
+	s.memWatchMu.Unlock()
+	if actions&MemoryGC != 0 {
+		debug.FreeOSMemory()
+	}
+	if actions&MemoryRelease != 0 {
+		s.releaseMemory()
+	}
+	if actions&MemoryExit != 0 {
+		log.Error.Printf("memory watchdog: %s; terminating", trips[len(trips)-1].Reason)
+		s.system.Exit(1)
+	}
+}
+
+// ReleaseMemory calls the method ReleaseMemory of each of the
+// supervisor's services that implements it.
+func (s *Supervisor) releaseMemory() {
+	type releaser interface {
+		ReleaseMemory()
+	}
+	s.servicesMu.Lock()
+	var names []string
+	for name := range s.services {
+		names = append(names, name)
+	}
+	services := make([]interface{}, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		services[i] = s.services[name]
+	}
+	s.servicesMu.Unlock()
+	for i, iface := range services {
+		if r, ok := iface.(releaser); ok {
+			log.Printf("memory watchdog: releasing memory of service %s", names[i])
+			r.ReleaseMemory()
+		}
+	}
+}
+
+// MemoryStatus returns the memory thresholds currently crossed by the
+// supervisor's process, and whether they render the process
+// unhealthy.
+func (s *Supervisor) memoryStatus() (trips []MemoryTrip, unhealthy bool) {
+	s.memWatchMu.Lock()
+	defer s.memWatchMu.Unlock()
+	return append([]MemoryTrip(nil), s.memTrips...), s.memUnhealthy
+}
+
+// MemoryTrips returns the memory thresholds that the machine currently
+// crosses, as reported by its memory watchdog (see MemoryWatchdog).
+func (m *Machine) MemoryTrips() []MemoryTrip {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]MemoryTrip(nil), m.memTrips...)
+}
+
+// SetMemoryTrips records the memory thresholds that the machine
+// currently crosses, as reported by its supervisor, and reports those
+// that are newly crossed.
+func (m *Machine) setMemoryTrips(trips []MemoryTrip) {
+	m.mu.Lock()
+	prev := make(map[string]bool)
+	for _, trip := range m.memTrips {
+		prev[trip.Threshold] = true
+	}
+	m.memTrips = trips
+	m.mu.Unlock()
+	for _, trip := range trips {
+		if prev[trip.Threshold] {
+			continue
+		}
+		log.Error.Printf("%s: memory threshold %s", m.Name(), trip)
+		m.emit(MachineMemoryThreshold, nil, trip.String())
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+// DefaultMessageLimits are the message limits of a B that is not
+// configured with LimitMessages.
+var defaultMessageLimits = MessageLimits{MaxArg: 1 << 30, MaxReply: 1 << 30}
+
+// MessageLimits limits the sizes of the encoded arguments and replies
+// of the calls made to a B's machines, so that a buggy service cannot
+// exhaust the memory of the driver (or of a machine) with an outsized
+// value. Calls that exceed the limits fail with errors of kind
+// errors.Precondition. Streamed arguments and replies (io.Reader,
+// io.ReadCloser) are not limited. A limit of 0 means no limit.
+type MessageLimits struct {
+	// MaxArg is the maximum size of arguments, enforced both by the
+	// driver and by the machines' servers.
+	MaxArg int64
+	// MaxReply is the maximum size of replies, enforced both by the
+	// driver and by the machines' servers.
+	MaxReply int64
+}
+
+// LimitMessages is an option that limits the sizes of the arguments
+// and replies of calls to the B's machines. By default, both are
+// limited to 1 GiB. The option must be provided to the B in both the
+// driver and the machines, as with other options.
+func LimitMessages(limits MessageLimits) Option {
+	return func(b *B) {
+		b.messageLimits = limits
+	}
+}
+
+// MessageLimits returns the B's message limits (see LimitMessages),
+// so that systems that serve machines' supervisors themselves may
+// enforce them.
+func (b *B) MessageLimits() MessageLimits {
+	return b.messageLimits
+}
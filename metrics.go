@@ -0,0 +1,218 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grailbio/bigmachine/rpc"
+	"golang.org/x/sync/errgroup"
+)
+
+// BootBuckets are the upper bounds, in seconds, of the buckets of the
+// histogram of machine boot durations.
+var bootBuckets = []float64{10, 30, 60, 120, 300, 600, 1200, 1800}
+
+// A bootHistogram is a histogram of the durations for which machines
+// boot: the time from their start until they are running.
+type bootHistogram struct {
+	mu sync.Mutex
+	// counts are the numbers of boots in each of bootBuckets; count is
+	// the total number of boots, and sum their total duration in
+	// seconds.
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+// Observe records a boot of the provided duration.
+func (h *bootHistogram) observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.counts == nil {
+		h.counts = make([]int64, len(bootBuckets))
+	}
+	secs := d.Seconds()
+	for i, le := range bootBuckets {
+		if secs <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += secs
+}
+
+// MetricsHandler implements an HTTP handler that exports the B's
+// metrics in the Prometheus text exposition format, so that existing
+// dashboards and alerts may monitor bigmachine jobs: the number of
+// machines in each state; the keepalive latency, memory, disk, load,
+// and traffic of each machine; the statistics of the calls made and
+// served by the driver, by method; and a histogram of machine boot
+// durations. The usage of running machines is retrieved from them as
+// the metrics are scraped.
+type metricsHandler struct{ *B }
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	machines := h.Machines()
+	sort.Slice(machines, func(i, j int) bool {
+		return machines[i].Addr < machines[j].Addr
+	})
+	infos := make([]machineInfo, len(machines))
+	g, ctx := errgroup.WithContext(r.Context())
+	for i, m := range machines {
+		if state := m.State(); state != Running {
+			infos[i].err = fmt.Errorf("machine state %s", state)
+			continue
+		}
+		i, m := i, m
+		g.Go(func() error {
+			infos[i] = allInfo(ctx, m)
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	mw := metricsWriter{w: bw}
+
+	states := make(map[State]int)
+	for _, m := range machines {
+		states[m.State()]++
+	}
+	mw.family("bigmachine_machines", "gauge", "Number of machines, by state.")
+	for _, state := range []State{Unstarted, Starting, Running, Stopped} {
+		mw.sample("bigmachine_machines", float64(states[state]), "state", state.String())
+	}
+
+	mw.family("bigmachine_machine_keepalive_latency_seconds", "gauge", "Latency of the machine's most recent keepalive.")
+	for _, m := range machines {
+		if times := m.KeepaliveReplyTimes(); len(times) > 0 {
+			mw.sample("bigmachine_machine_keepalive_latency_seconds", times[0].Seconds(), "machine", m.Name())
+		}
+	}
+	for _, metric := range []struct {
+		name, typ, help string
+		value           func(info machineInfo) float64
+	}{
+		{"bigmachine_machine_memory_total_bytes", "gauge", "Total memory of the machine.",
+			func(info machineInfo) float64 { return float64(info.MemInfo.System.Total) }},
+		{"bigmachine_machine_memory_used_bytes", "gauge", "Memory used on the machine.",
+			func(info machineInfo) float64 { return float64(info.MemInfo.System.Used) }},
+		{"bigmachine_machine_runtime_memory_bytes", "gauge", "Memory obtained from the system by the machine's Go runtime.",
+			func(info machineInfo) float64 { return float64(info.MemInfo.Runtime.Sys) }},
+		{"bigmachine_machine_disk_total_bytes", "gauge", "Total size of the machine's disk.",
+			func(info machineInfo) float64 { return float64(info.DiskInfo.Usage.Total) }},
+		{"bigmachine_machine_disk_used_bytes", "gauge", "Disk space used on the machine.",
+			func(info machineInfo) float64 { return float64(info.DiskInfo.Usage.Used) }},
+		{"bigmachine_machine_load1", "gauge", "The machine's 1-minute load average.",
+			func(info machineInfo) float64 { return info.LoadInfo.Averages.Load1 }},
+		{"bigmachine_machine_load5", "gauge", "The machine's 5-minute load average.",
+			func(info machineInfo) float64 { return info.LoadInfo.Averages.Load5 }},
+		{"bigmachine_machine_load15", "gauge", "The machine's 15-minute load average.",
+			func(info machineInfo) float64 { return info.LoadInfo.Averages.Load15 }},
+	} {
+		mw.family(metric.name, metric.typ, metric.help)
+		for i, m := range machines {
+			// Usage is reported only for the machines from which it was
+			// retrieved.
+			if infos[i].err != nil {
+				continue
+			}
+			mw.sample(metric.name, metric.value(infos[i]), "machine", m.Name())
+		}
+	}
+	mw.family("bigmachine_machine_sent_bytes_total", "counter", "Call data sent by the driver to the machine.")
+	for _, m := range machines {
+		mw.sample("bigmachine_machine_sent_bytes_total", float64(m.Traffic().Sent), "machine", m.Name())
+	}
+	mw.family("bigmachine_machine_received_bytes_total", "counter", "Call data received by the driver from the machine.")
+	for _, m := range machines {
+		mw.sample("bigmachine_machine_received_bytes_total", float64(m.Traffic().Received), "machine", m.Name())
+	}
+
+	stats := map[string][]rpc.MethodStats{
+		"client": rpc.ClientStats(),
+		"server": rpc.ServerStats(),
+	}
+	for _, metric := range []struct {
+		name, help string
+		value      func(rpc.MethodStats) float64
+	}{
+		{"bigmachine_rpc_calls_total", "Calls made (client) and served (server) by the process, by method.",
+			func(s rpc.MethodStats) float64 { return float64(s.Calls) }},
+		{"bigmachine_rpc_errors_total", "Failed calls, by side and method.",
+			func(s rpc.MethodStats) float64 { return float64(s.Errors) }},
+		{"bigmachine_rpc_duration_seconds_total", "Total duration of calls, by side and method.",
+			func(s rpc.MethodStats) float64 { return s.Time.Seconds() }},
+		{"bigmachine_rpc_request_bytes_total", "Total size of the requests of calls, by side and method.",
+			func(s rpc.MethodStats) float64 { return float64(s.RequestBytes) }},
+		{"bigmachine_rpc_reply_bytes_total", "Total size of the replies to calls, by side and method.",
+			func(s rpc.MethodStats) float64 { return float64(s.ReplyBytes) }},
+	} {
+		mw.family(metric.name, "counter", metric.help)
+		for _, side := range []string{"client", "server"} {
+			for _, s := range stats[side] {
+				mw.sample(metric.name, metric.value(s), "side", side, "method", s.Method)
+			}
+		}
+	}
+
+	h.boots.mu.Lock()
+	counts := append([]int64(nil), h.boots.counts...)
+	count, sum := h.boots.count, h.boots.sum
+	h.boots.mu.Unlock()
+	mw.family("bigmachine_machine_boot_duration_seconds", "histogram", "Time from the start of machines until they are running.")
+	for i, le := range bootBuckets {
+		var n int64
+		if i < len(counts) {
+			n = counts[i]
+		}
+		mw.sample("bigmachine_machine_boot_duration_seconds_bucket", float64(n), "le", strconv.FormatFloat(le, 'g', -1, 64))
+	}
+	mw.sample("bigmachine_machine_boot_duration_seconds_bucket", float64(count), "le", "+Inf")
+	mw.sample("bigmachine_machine_boot_duration_seconds_sum", sum)
+	mw.sample("bigmachine_machine_boot_duration_seconds_count", float64(count))
+}
+
+// A metricsWriter writes metrics in the Prometheus text exposition
+// format.
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+// Family writes the header of the named metric family.
+func (m metricsWriter) family(name, typ, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// Sample writes a sample of the named metric with the provided value
+// and label pairs.
+func (m metricsWriter) sample(name string, value float64, labelPairs ...string) {
+	m.w.WriteString(name)
+	for i := 0; i+1 < len(labelPairs); i += 2 {
+		if i == 0 {
+			m.w.WriteByte('{')
+		} else {
+			m.w.WriteByte(',')
+		}
+		fmt.Fprintf(m.w, "%s=\"%s\"", labelPairs[i], labelEscaper.Replace(labelPairs[i+1]))
+	}
+	if len(labelPairs) > 1 {
+		m.w.WriteByte('}')
+	}
+	fmt.Fprintf(m.w, " %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// LabelEscaper escapes the values of labels.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
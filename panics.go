@@ -0,0 +1,227 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/grailbio/base/log"
+)
+
+// MaxPanicStackLines is the maximum number of stack trace lines
+// captured for a panic.
+const maxPanicStackLines = 200
+
+// A Panic describes a panic that occurred on one or more of the
+// machines managed by a B. Panics are identified by their stack
+// signatures: panics with the same call stacks (ignoring goroutine
+// IDs, argument values, and program counter offsets) are considered
+// to be the same panic, regardless of the machine on which they
+// occurred.
+type Panic struct {
+	// Signature identifies the panic's stack.
+	Signature string
+	// Message is the panic's message (from the first occurrence).
+	Message string
+	// Stack is the stack trace of the panicking goroutine (from the
+	// first occurrence).
+	Stack string
+	// Machines are the names of the machines on which the panic
+	// occurred, in order of occurrence.
+	Machines []string
+	// First and Last are the times of the panic's first and last
+	// occurrences.
+	First, Last time.Time
+}
+
+// Panics returns the panics that occurred on b's machines, ordered
+// by the number of machines on which they occurred (most first).
+// Panics are detected in the log output of the machines that b
+// owns: they include both panics that crashed machines and panics
+// in service methods, which are recovered by the RPC server (see
+// package rpc).
+func (b *B) Panics() []Panic {
+	b.panicsMu.Lock()
+	panics := make([]Panic, 0, len(b.panics))
+	for _, p := range b.panics {
+		c := *p
+		c.Machines = append([]string(nil), p.Machines...)
+		panics = append(panics, c)
+	}
+	b.panicsMu.Unlock()
+	sort.Slice(panics, func(i, j int) bool {
+		if ni, nj := len(panics[i].Machines), len(panics[j].Machines); ni != nj {
+			return ni > nj
+		}
+		return panics[i].First.Before(panics[j].First)
+	})
+	return panics
+}
+
+// RecordPanic records a panic with the provided message and stack
+// that occurred on machine m.
+func (b *B) recordPanic(m *Machine, message, stack string) {
+	sig := panicSignature(stack)
+	now := time.Now()
+	b.panicsMu.Lock()
+	if b.panics == nil {
+		b.panics = make(map[string]*Panic)
+	}
+	p := b.panics[sig]
+	if p == nil {
+		p = &Panic{Signature: sig, Message: message, Stack: stack, First: now}
+		b.panics[sig] = p
+	}
+	p.Machines = append(p.Machines, m.Name())
+	p.Last = now
+	n := len(p.Machines)
+	b.panicsMu.Unlock()
+	if n == 1 {
+		log.Error.Printf("%s: panic %s: %s", m.Name(), sig, message)
+	} else {
+		log.Error.Printf("%s: panic %s: %s (this panic has occurred on %d machines)", m.Name(), sig, message, n)
+	}
+	b.system.Event("bigmachine:panic",
+		"signature", sig,
+		"message", message,
+		"name", m.Name(),
+		"addr", m.Addr,
+		"machines", n,
+	)
+}
+
+// PanicSignature returns the signature of the provided stack trace:
+// a hash of its frames' functions and source locations.
+func panicSignature(stack string) string {
+	h := fnv.New64a()
+	for _, line := range strings.Split(stack, "\n") {
+		switch {
+		case strings.HasPrefix(line, "goroutine "):
+			// Skip goroutine IDs and states.
+			continue
+		case strings.HasPrefix(line, "\t"):
+			// File and line; strip the PC offset.
+			if i := strings.LastIndex(line, " +0x"); i >= 0 {
+				line = line[:i]
+			}
+		default:
+			// Function; strip its arguments.
+			if i := strings.LastIndex(line, "("); i > 0 {
+				line = line[:i]
+			}
+		}
+		fmt.Fprintln(h, strings.TrimSpace(line))
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// A panicScanner detects panics in a machine's log output, which is
+// provided one line at a time. A panic is detected by its message,
+// which is followed by the stack trace of the panicking goroutine.
+// Two forms are recognized: those of runtime panics (and fatal
+// errors) that crash the process, and those of panics in service
+// methods, which are logged by the RPC server.
+type panicScanner struct {
+	// Message is the message of the panic being scanned, if any.
+	message string
+	// Stack contains the lines of the stack trace scanned so far.
+	stack []string
+	// InStack is true once the stack trace's goroutine header has
+	// been scanned.
+	inStack bool
+	// Pending is a function line that has not yet been confirmed as
+	// part of the stack trace by a following file and line.
+	pending string
+}
+
+// Line scans the next line of output. It returns the message and
+// stack trace of a panic whose trace ends with the line.
+func (s *panicScanner) Line(line string) (message, stack string, ok bool) {
+	switch {
+	case s.message == "":
+	case !s.inStack:
+		if strings.HasPrefix(line, "goroutine ") {
+			s.inStack = true
+			s.stack = append(s.stack, line)
+			return "", "", false
+		}
+		if line == "" || strings.HasPrefix(line, "\t") {
+			// Runtime panics are followed by a blank line, and
+			// possibly by the messages of repanics.
+			return "", "", false
+		}
+		s.reset()
+	case strings.HasPrefix(line, "\t") && s.pending != "":
+		s.stack = append(s.stack, s.pending, line)
+		s.pending = ""
+		if len(s.stack) < maxPanicStackLines {
+			return "", "", false
+		}
+		return s.Flush()
+	case line != "" && !strings.HasPrefix(line, "\t") && s.pending == "":
+		s.pending = line
+		return "", "", false
+	default:
+		// The stack trace has ended.
+		message, stack, ok = s.Flush()
+		// The line may begin another panic.
+		s.start(line)
+		return
+	}
+	s.start(line)
+	return "", "", false
+}
+
+// Flush returns the panic being scanned, if its stack trace is
+// complete, and resets the scanner. It should be called once the
+// output has been scanned.
+func (s *panicScanner) Flush() (message, stack string, ok bool) {
+	if s.inStack && len(s.stack) > 1 {
+		message, stack, ok = s.message, strings.Join(s.stack, "\n"), true
+	}
+	s.reset()
+	return
+}
+
+func (s *panicScanner) start(line string) {
+	if i := strings.Index(line, "panic in method call "); i >= 0 {
+		s.message = line[i:]
+	} else if strings.HasPrefix(line, "panic: ") || strings.HasPrefix(line, "fatal error: ") {
+		s.message = line
+	}
+}
+
+func (s *panicScanner) reset() {
+	*s = panicScanner{}
+}
+
+// PanicsHandler implements an HTTP handler that lists the panics that
+// occurred on a B's machines (see B.Panics).
+type panicsHandler struct{ *B }
+
+func (h *panicsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	panics := h.Panics()
+	if len(panics) == 0 {
+		fmt.Fprintln(w, "no panics")
+		return
+	}
+	for _, p := range panics {
+		var tw tabwriter.Writer
+		tw.Init(w, 4, 4, 1, ' ', 0)
+		fmt.Fprintf(&tw, "panic %s: %s\n", p.Signature, p.Message)
+		fmt.Fprintf(&tw, "\tmachines:\t%d (%s)\n", len(p.Machines), strings.Join(p.Machines, ", "))
+		fmt.Fprintf(&tw, "\tfirst:\t%s\n", p.First.Format(time.RFC3339))
+		fmt.Fprintf(&tw, "\tlast:\t%s\n", p.Last.Format(time.RFC3339))
+		tw.Flush()
+		fmt.Fprintf(w, "%s\n\n", p.Stack)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigmachine/rpc"
+)
+
+// CheckParams checks the machine parameters provided to B.Start:
+// machines must be provided at least one service, and the services
+// must pass checkServices, and their dependencies must be satisfiable
+// (see serviceOrder). CheckParams returns a machine to which the
+// parameters have been applied.
+func checkParams(params []Param) (*Machine, error) {
+	probe := new(Machine)
+	for _, p := range params {
+		p.applyParam(probe)
+	}
+	if len(probe.services) == 0 {
+		return nil, errors.E(errors.Invalid, "no services provided")
+	}
+	if err := checkServices(probe.services); err != nil {
+		return nil, err
+	}
+	if _, err := serviceOrder(probe.services); err != nil {
+		return nil, err
+	}
+	return probe, nil
+}
+
+// CheckServices checks that the provided services can be transmitted
+// to machines, and that their methods' arguments and replies can be
+// encoded, before any machines are started. Services are transmitted
+// to machines as interface values, and thus their types must be
+// registered with gob; problems are otherwise detected only once a
+// machine has booted. The returned error lists every problem found.
+func checkServices(services map[string]interface{}) error {
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var problems []string
+	for _, name := range names {
+		iface := services[name]
+		if err := gob.NewEncoder(ioutil.Discard).Encode(service{name, iface}); err != nil {
+			problems = append(problems, fmt.Sprintf("service %s (%T): %v", name, iface, err))
+			continue
+		}
+		if err := rpc.CheckService(iface); err != nil {
+			problems = append(problems, fmt.Sprintf("service %s: %v", name, err))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.E(errors.Invalid, fmt.Sprintf("invalid services (are their types registered with gob?): %s", strings.Join(problems, "; ")))
+}
@@ -5,17 +5,21 @@
 package bigmachine
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"net/http"
+	"runtime"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/pprof/profile"
 	"github.com/grailbio/base/diagnostic/dump"
+	"github.com/grailbio/base/errors"
 	"github.com/grailbio/base/log"
 	"github.com/grailbio/bigmachine/internal/filebuf"
 	"golang.org/x/sync/errgroup"
@@ -57,11 +61,11 @@ func (h *profileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func getProfile(ctx context.Context, m *Machine, which string, sec, debug int, gc bool) (rc io.ReadCloser, err error) {
+func getProfile(ctx context.Context, m *Machine, which string, sec, debug int, gc bool, sample time.Duration) (rc io.ReadCloser, err error) {
 	if which == "profile" {
 		err = m.Call(ctx, "Supervisor.CPUProfile", time.Duration(sec)*time.Second, &rc)
 	} else {
-		err = m.Call(ctx, "Supervisor.Profile", profileRequest{which, debug, gc}, &rc)
+		err = m.Call(ctx, "Supervisor.Profile", profileRequest{Name: which, Debug: debug, GC: gc, Sample: sample}, &rc)
 	}
 	return
 }
@@ -92,6 +96,13 @@ type profiler struct {
 	// gc determines whether we request a garbage collection before taking the
 	// profile. This is only relevant when which == "heap".
 	gc bool
+	// sample is the duration for which block or mutex events are
+	// sampled before the profile is taken. It is only relevant when
+	// which == "block" or which == "mutex".
+	sample time.Duration
+	// query selects the machines whose profiles are aggregated when
+	// addr == "". Only running machines are profiled.
+	query Query
 }
 
 // errNoProfiles is a marker type for the error that is returned by
@@ -123,7 +134,7 @@ func (p profiler) Marshal(ctx context.Context, w io.Writer) (err error) {
 			return fmt.Errorf("failed to dial machine: %v", err)
 		}
 		var rc io.ReadCloser
-		if rc, err = getProfile(ctx, m, p.which, p.sec, p.debug, p.gc); err != nil {
+		if rc, err = getProfile(ctx, m, p.which, p.sec, p.debug, p.gc, p.sample); err != nil {
 			return fmt.Errorf("failed to collect %s profile: %v", p.which, err)
 		}
 		defer func() {
@@ -142,7 +153,7 @@ func (p profiler) Marshal(ctx context.Context, w io.Writer) (err error) {
 	var (
 		mu       sync.Mutex
 		profiles = make(map[*Machine]io.ReadCloser)
-		machines = p.b.Machines()
+		machines = p.b.Query(p.query)
 	)
 	for _, m := range machines {
 		if m.State() != Running {
@@ -150,14 +161,14 @@ func (p profiler) Marshal(ctx context.Context, w io.Writer) (err error) {
 		}
 		m := m
 		g.Go(func() (err error) {
-			rc, err := getProfile(ctx, m, p.which, p.sec, p.debug, p.gc)
+			rc, err := getProfile(ctx, m, p.which, p.sec, p.debug, p.gc, p.sample)
 			if err != nil {
-				log.Error.Printf("failed to collect profile %s from %s: %v", p.which, m.Addr, err)
+				log.Error.Printf("failed to collect profile %s from %s: %v", p.which, m.Name(), err)
 				return nil
 			}
 			prof, err := filebuf.New(rc)
 			if err != nil {
-				log.Error.Printf("failed to read profile from %s: %v", m.Addr, err)
+				log.Error.Printf("failed to read profile from %s: %v", m.Name(), err)
 				return nil
 			}
 			mu.Lock()
@@ -237,3 +248,144 @@ func makeProfileDumpFunc(b *B, which string, debug int) dump.Func {
 		return p.Marshal(ctx, w)
 	}
 }
+
+const (
+	// BlockProfileRate is the rate at which blocking events are sampled
+	// for on-demand block profiles: on average, one event per 10µs
+	// spent blocked (see runtime.SetBlockProfileRate).
+	blockProfileRate = 10000
+	// MutexProfileFraction is the fraction of mutex contention events
+	// that are sampled for on-demand mutex profiles (see
+	// runtime.SetMutexProfileFraction).
+	mutexProfileFraction = 10
+)
+
+// SampleMu serializes the sampling of contention events.
+var sampleMu sync.Mutex
+
+// SampleContention samples the events of the named contention profile
+// ("block" or "mutex") for the provided duration. Block sampling is
+// disabled afterwards; the mutex profile fraction is restored.
+func sampleContention(ctx context.Context, which string, d time.Duration) error {
+	sampleMu.Lock()
+	defer sampleMu.Unlock()
+	switch which {
+	case "block":
+		runtime.SetBlockProfileRate(blockProfileRate)
+		defer runtime.SetBlockProfileRate(0)
+	case "mutex":
+		prev := runtime.SetMutexProfileFraction(mutexProfileFraction)
+		defer runtime.SetMutexProfileFraction(prev)
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ProfileOptions configure the collection of profiles by B.Profile.
+type ProfileOptions struct {
+	// Duration is the duration of CPU profiles; it defaults to 30
+	// seconds. For block and mutex profiles, which are not sampled by
+	// default, Duration is the amount of time for which events are
+	// sampled before the profiles are taken; if zero, the profiles
+	// contain only events that were previously sampled, if any.
+	Duration time.Duration
+	// GC requests a garbage collection before heap profiles are
+	// taken, so that they reflect live data.
+	GC bool
+	// Debug selects the text format of the profiles, as in
+	// runtime/pprof; text profiles are concatenated instead of merged.
+	Debug int
+	// Query selects the machines to profile; the zero Query selects
+	// all of the B's machines. Only running machines are profiled.
+	Query Query
+}
+
+// Profile collects the named profile ("profile" for a CPU profile,
+// or the name of a runtime/pprof profile such as "heap", "goroutine",
+// "block", or "mutex") from the selected machines, and writes to w a
+// single pprof profile that merges them. The merged profile
+// describes the activity of the selected machines as a whole. Machines
+// from which the profile cannot be collected are skipped; Profile
+// fails with an error of kind errors.NotExist if no profiles are
+// collected. The merged profile is also served at
+// /debug/bigmachine/profile (see HandleDebug).
+func (b *B) Profile(ctx context.Context, which string, opts ProfileOptions, w io.Writer) error {
+	p := profiler{
+		b:      b,
+		which:  which,
+		sec:    int(opts.Duration / time.Second),
+		debug:  opts.Debug,
+		gc:     opts.GC,
+		sample: opts.Duration,
+		query:  opts.Query,
+	}
+	if which == "profile" && p.sec == 0 {
+		p.sec = 30
+	}
+	err := p.Marshal(ctx, w)
+	if _, ok := err.(errNoProfiles); ok {
+		err = errors.E(errors.NotExist, err)
+	}
+	return err
+}
+
+// ProfileQueryHandler implements an HTTP handler that serves merged
+// profiles of selected machines (see B.Profile). The handler takes
+// the following parameters:
+//
+//	which     the name of the profile (default "profile", the CPU profile)
+//	seconds   the profile's duration (see ProfileOptions.Duration)
+//	gc        if nonzero, garbage collect before heap profiles
+//	debug     the text format of the profiles, if nonzero
+//	machines  a comma-separated list of the addresses of the machines to profile
+//	labels    labels of the machines to profile, such as "role=worker"
+type profileQueryHandler struct{ *B }
+
+func (h *profileQueryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		which    = r.FormValue("which")
+		sec, _   = strconv.Atoi(r.FormValue("seconds"))
+		debug, _ = strconv.Atoi(r.FormValue("debug"))
+		gc, _    = strconv.Atoi(r.FormValue("gc"))
+		opts     = ProfileOptions{Duration: time.Duration(sec) * time.Second, GC: gc > 0, Debug: debug}
+	)
+	if which == "" {
+		which = "profile"
+	}
+	if labels := r.FormValue("labels"); labels != "" {
+		var err error
+		if opts.Query.Labels, err = ParseLabels(labels); err != nil {
+			profileErrorf(w, http.StatusBadRequest, "invalid labels %q: %v", labels, err)
+			return
+		}
+	}
+	if machines := r.FormValue("machines"); machines != "" {
+		addrs := make(map[string]bool)
+		for _, addr := range strings.Split(machines, ",") {
+			addrs[addr] = true
+		}
+		opts.Query.Func = func(m *Machine) bool { return addrs[m.Addr] }
+	}
+	p := profiler{which: which, debug: debug}
+	w.Header().Set("Content-Type", p.ContentType())
+	if debug == 0 {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", which+".pb.gz"))
+	}
+	// The profile is buffered so that errors may be reported with an
+	// appropriate status.
+	var buf bytes.Buffer
+	if err := h.Profile(r.Context(), which, opts, &buf); err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(errors.NotExist, err) {
+			code = http.StatusNotFound
+		}
+		w.Header().Del("Content-Disposition")
+		profileErrorf(w, code, "%v", err)
+		return
+	}
+	io.Copy(w, &buf)
+}
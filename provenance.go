@@ -0,0 +1,167 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/base/log"
+)
+
+// scrubbedEnvironPatterns are the (upper case) substrings of the names
+// of environment variables whose values are scrubbed from provenance
+// records.
+var scrubbedEnvironPatterns = []string{"SECRET", "TOKEN", "PASSWORD", "PASSWD", "CREDENTIAL", "KEY", "AUTH"}
+
+// Provenance is a record of how a B's computation was run, for
+// reproducibility audits: the driver's binary, arguments, and
+// environment; the machines on which it ran; and the digests of its
+// inputs, as recorded by RecordInput. Values of environment variables
+// whose names suggest that they hold secrets (for example,
+// AWS_SECRET_ACCESS_KEY) are scrubbed. Provenance records are
+// exported as JSON.
+type Provenance struct {
+	// Binary is the digest of the driver's binary (see Info.Digest).
+	Binary string
+	// Goos and Goarch are the driver's OS and architecture.
+	Goos, Goarch string
+	// Args are the driver's command line arguments.
+	Args []string
+	// Environ is the driver's (scrubbed) environment.
+	Environ []string
+	// Start is the time at which the driver started.
+	Start time.Time
+	// Machines describes the machines that were started by the B,
+	// ordered by start time.
+	Machines []MachineProvenance
+	// Inputs are the digests of the inputs recorded by RecordInput,
+	// keyed by name.
+	Inputs map[string]string
+}
+
+// MachineProvenance describes a machine in a provenance record.
+type MachineProvenance struct {
+	// Name and Addr are the machine's name and address.
+	Name, Addr string
+	// InstanceType is the machine's instance type, if known.
+	InstanceType string `json:",omitempty"`
+	// Spec is the machine's spec, if it was started with one (see
+	// MachineSpec).
+	Spec *MachineSpec `json:",omitempty"`
+	// Maxprocs is the number of processors of the machine.
+	Maxprocs int
+	// Labels are the machine's labels (see bigmachine.Labels).
+	Labels Labels `json:",omitempty"`
+	// Environ is the (scrubbed) environment provided to the machine
+	// with Environ parameters.
+	Environ []string `json:",omitempty"`
+	// Start and Stop are the times at which the machine was started
+	// and stopped; Stop is the zero time if the machine is running.
+	Start, Stop time.Time
+}
+
+// RecordInput records the digest of an input of the B's computation,
+// such as a reference genome or a configuration file, under the
+// provided name, so that it is included in the B's provenance record.
+// Recording an input again under the same name replaces its digest.
+func (b *B) RecordInput(name string, d digest.Digest) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.inputs == nil {
+		b.inputs = make(map[string]string)
+	}
+	b.inputs[name] = d.String()
+}
+
+// Provenance returns the provenance record of b's computation so far.
+// It is also served as JSON at /debug/bigmachine/provenance (see
+// HandleDebug).
+func (b *B) Provenance() Provenance {
+	info := LocalInfo()
+	p := Provenance{
+		Binary:  info.Digest.String(),
+		Goos:    info.Goos,
+		Goarch:  info.Goarch,
+		Args:    append([]string{}, os.Args...),
+		Environ: scrubEnviron(os.Environ()),
+		Start:   startTime,
+		Inputs:  make(map[string]string),
+	}
+	b.mu.Lock()
+	for name, d := range b.inputs {
+		p.Inputs[name] = d
+	}
+	b.mu.Unlock()
+	for _, m := range b.Machines() {
+		if !m.Owned() {
+			continue
+		}
+		mp := MachineProvenance{
+			Name:         m.Name(),
+			Addr:         m.Addr,
+			InstanceType: m.pricing.InstanceType,
+			Spec:         m.spec,
+			Maxprocs:     m.Maxprocs,
+			Labels:       m.Labels(),
+			Environ:      scrubEnviron(m.environ),
+			Start:        m.StartTime(),
+			Stop:         m.StopTime(),
+		}
+		if mp.InstanceType == "" && m.spec != nil {
+			mp.InstanceType = m.spec.InstanceType
+		}
+		p.Machines = append(p.Machines, mp)
+	}
+	sort.Slice(p.Machines, func(i, j int) bool {
+		return p.Machines[i].Start.Before(p.Machines[j].Start)
+	})
+	return p
+}
+
+// WriteJSON writes the provenance record as indented JSON to w.
+func (p Provenance) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
+
+// ScrubEnviron returns a copy of the provided environment in which the
+// values of variables whose names suggest that they hold secrets are
+// replaced.
+func scrubEnviron(environ []string) []string {
+	if len(environ) == 0 {
+		return nil
+	}
+	scrubbed := make([]string, len(environ))
+	for i, kv := range environ {
+		scrubbed[i] = kv
+		name := strings.ToUpper(strings.SplitN(kv, "=", 2)[0])
+		for _, pattern := range scrubbedEnvironPatterns {
+			if strings.Contains(name, pattern) {
+				scrubbed[i] = name + "=<scrubbed>"
+				break
+			}
+		}
+	}
+	return scrubbed
+}
+
+// ProvenanceHandler implements an HTTP handler that serves a B's
+// provenance record as JSON (see B.Provenance).
+type provenanceHandler struct{ *B }
+
+func (h *provenanceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := h.Provenance().WriteJSON(w); err != nil {
+		log.Error.Printf("provenance: %v", err)
+	}
+}
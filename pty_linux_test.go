@@ -0,0 +1,57 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package bigmachine
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestShell(t *testing.T) {
+	if _, err := os.Stat("/dev/ptmx"); err != nil {
+		t.Skip("no pseudo-terminals: ", err)
+	}
+	save := os.Getenv("SHELL")
+	os.Setenv("SHELL", "/bin/sh")
+	defer os.Setenv("SHELL", save)
+	var (
+		s     = new(Supervisor)
+		reply io.ReadCloser
+	)
+	if err := s.Shell(context.Background(), strings.NewReader("echo hello-$((1+2))\nexit\n"), &reply); err != nil {
+		t.Fatal(err)
+	}
+	defer reply.Close()
+	out, err := ioutil.ReadAll(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The terminal echoes the input, so we check for the expanded
+	// expression.
+	if !strings.Contains(string(out), "hello-3") {
+		t.Errorf("got %q, want output containing hello-3", out)
+	}
+
+	// The shell exits at the end of its input, even if the input ends
+	// with a partial line.
+	if err := s.Shell(context.Background(), strings.NewReader("echo partial-$((2+3))"), &reply); err != nil {
+		t.Fatal(err)
+	}
+	defer reply.Close()
+	out, err = ioutil.ReadAll(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "partial-5") {
+		t.Errorf("got %q, want output containing partial-5", out)
+	}
+}
@@ -0,0 +1,19 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package bigmachine
+
+import (
+	"io"
+	"os/exec"
+
+	"github.com/grailbio/base/errors"
+)
+
+func startPTY(cmd *exec.Cmd) (io.ReadWriteCloser, error) {
+	return nil, errors.E(errors.NotSupported, "pseudo-terminals are supported only on linux")
+}
@@ -0,0 +1,193 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Query selects machines managed by a B (see B.Query). The zero
+// Query selects all machines; each nonzero field further restricts
+// the selection.
+type Query struct {
+	// States selects machines in any of the provided states.
+	States []State
+	// Healthy selects machines that are healthy; Unhealthy selects
+	// machines that have been reported unhealthy by their supervisor.
+	// See Machine.Healthy.
+	Healthy, Unhealthy bool
+	// MinAge and MaxAge select machines that were started at least
+	// MinAge and at most MaxAge ago.
+	MinAge, MaxAge time.Duration
+	// Labels selects machines that have each of the provided labels
+	// (see bigmachine.Labels).
+	Labels Labels
+	// MinScore selects machines whose score is at least MinScore;
+	// NotDegraded selects machines that are not degraded. See
+	// Machine.Score.
+	MinScore    float64
+	NotDegraded bool
+	// Func selects machines for which it returns true.
+	Func func(m *Machine) bool
+}
+
+// Match tells whether the machine m is selected by the query.
+func (q Query) Match(m *Machine) bool {
+	if len(q.States) > 0 {
+		var ok bool
+		state := m.State()
+		for _, s := range q.States {
+			if s == state {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if q.Healthy && !m.Healthy() || q.Unhealthy && m.Healthy() {
+		return false
+	}
+	age := time.Since(m.StartTime())
+	if q.MinAge > 0 && age < q.MinAge || q.MaxAge > 0 && age > q.MaxAge {
+		return false
+	}
+	if !m.labels.Match(q.Labels) {
+		return false
+	}
+	if q.MinScore > 0 && m.Score() < q.MinScore || q.NotDegraded && m.Degraded() {
+		return false
+	}
+	if q.Func != nil && !q.Func(m) {
+		return false
+	}
+	return true
+}
+
+// Query returns a snapshot of the machines managed by b that are
+// selected by the provided query, ordered by address. The returned
+// slice is owned by the caller; it is not affected by subsequent
+// changes to b's machines.
+func (b *B) Query(q Query) []*Machine {
+	var machines []*Machine
+	for _, m := range b.Machines() {
+		if q.Match(m) {
+			machines = append(machines, m)
+		}
+	}
+	sort.Slice(machines, func(i, j int) bool {
+		return machines[i].Addr < machines[j].Addr
+	})
+	return machines
+}
+
+// A MachineUpdate reports the state of a machine managed by a B.
+// Updates are delivered to subscribers (see B.Subscribe) when
+// machines are added to the B, change state, change health, or start
+// draining.
+type MachineUpdate struct {
+	// Machine is the machine whose state is reported.
+	Machine *Machine
+	// State is the machine's state at the time of the update.
+	State State
+	// Healthy tells whether the machine was healthy at the time of
+	// the update.
+	Healthy bool
+	// Draining tells whether the machine was draining at the time of
+	// the update (see Machine.Drain).
+	Draining bool
+}
+
+// Subscribe subscribes to updates of b's machines. An update for each
+// of b's current machines is delivered first, followed by updates as
+// machines are added, change state, or change health. Updates for a
+// machine are delivered in order; they are buffered as needed so
+// that slow subscribers do not miss updates or hold up b. The
+// returned channel is closed once the provided context is done.
+func (b *B) Subscribe(ctx context.Context) <-chan MachineUpdate {
+	sub := &subscriber{
+		signal: make(chan struct{}, 1),
+		c:      make(chan MachineUpdate),
+	}
+	b.subsMu.Lock()
+	if b.subs == nil {
+		b.subs = make(map[*subscriber]bool)
+	}
+	b.subs[sub] = true
+	b.subsMu.Unlock()
+	for _, m := range b.Machines() {
+		sub.Update(m)
+	}
+	go func() {
+		sub.Run(ctx)
+		b.subsMu.Lock()
+		delete(b.subs, sub)
+		b.subsMu.Unlock()
+	}()
+	return sub.c
+}
+
+// Notify delivers an update for the machine m to b's subscribers.
+func (b *B) notify(m *Machine) {
+	b.subsMu.Lock()
+	defer b.subsMu.Unlock()
+	for sub := range b.subs {
+		sub.Update(m)
+	}
+}
+
+// A subscriber buffers the updates delivered to a subscription.
+type subscriber struct {
+	mu      sync.Mutex
+	pending []MachineUpdate
+	signal  chan struct{}
+	c       chan MachineUpdate
+}
+
+// Update enqueues an update that reflects the current state of the
+// machine m. The update is computed while holding the subscriber's
+// lock so that updates are enqueued in the order in which they
+// occurred.
+func (s *subscriber) Update(m *Machine) {
+	s.mu.Lock()
+	s.pending = append(s.pending, MachineUpdate{
+		Machine:  m,
+		State:    m.State(),
+		Healthy:  m.Healthy(),
+		Draining: m.Draining(),
+	})
+	s.mu.Unlock()
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers the subscriber's updates until the context is done.
+func (s *subscriber) Run(ctx context.Context) {
+	defer close(s.c)
+	for {
+		s.mu.Lock()
+		pending := s.pending
+		s.pending = nil
+		s.mu.Unlock()
+		for _, update := range pending {
+			select {
+			case s.c <- update:
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case <-s.signal:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+)
+
+// A Quorum is a policy for starting machines with tolerance for
+// partial failure (see B.StartQuorum).
+type Quorum struct {
+	// Fraction is the fraction of the requested machines that must be
+	// running for StartQuorum to return, for example 0.9. Zero or one
+	// requires all of the machines to be running.
+	Fraction float64
+	// Timeout is the amount of time within which the quorum must be
+	// running. Zero means no timeout.
+	Timeout time.Duration
+	// Retries is the number of replacements that may be started, in
+	// total, for machines that stop before they are running.
+	Retries int
+}
+
+// Size returns the number of machines, out of n, that form a quorum.
+func (q Quorum) size(n int) int {
+	if q.Fraction <= 0 || q.Fraction >= 1 {
+		return n
+	}
+	return int(math.Ceil(q.Fraction * float64(n)))
+}
+
+// StartQuorum starts n machines with the provided parameters, like
+// Start, and waits until a quorum of them is running, as defined by
+// the provided policy. Thus, for example, a large Start may proceed
+// once 90% of its machines are running, instead of waiting for the
+// slowest machines or failing because of a few that do not boot.
+// Machines that stop before they are running are replaced, within the
+// policy's retry limit.
+//
+// StartQuorum returns the running machines, and the stragglers: the
+// machines that are still being started, which are delivered as they
+// become running. StartQuorum fails with an error of kind
+// errors.Unavailable if the quorum is not running within the policy's
+// timeout, or if it can no longer be formed; the machines that it
+// started are then canceled.
+func (b *B) StartQuorum(ctx context.Context, n int, quorum Quorum, params ...Param) ([]*Machine, *Stragglers, error) {
+	if quorum.Fraction < 0 || quorum.Fraction > 1 || quorum.Retries < 0 {
+		return nil, nil, errors.E(errors.Invalid, fmt.Sprintf("invalid quorum %+v", quorum))
+	}
+	machines, err := b.Start(ctx, n, params...)
+	if err != nil {
+		return nil, nil, err
+	}
+	s := &Stragglers{
+		b:       b,
+		params:  params,
+		retries: quorum.Retries,
+		c:       make(chan *Machine, n),
+		changed: make(chan struct{}, 1),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.mu.Lock()
+	for _, m := range machines {
+		s.track(m)
+	}
+	// Systems may start fewer machines than requested; the remainder
+	// is replaced as though the machines had failed.
+	for i := len(machines); i < n; i++ {
+		s.replace(nil)
+	}
+	s.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if quorum.Timeout > 0 {
+		timer := time.NewTimer(quorum.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	need := quorum.size(n)
+	for {
+		s.mu.Lock()
+		if len(s.ready) >= need {
+			ready := s.ready
+			s.ready = nil
+			s.returned = true
+			s.maybeClose()
+			s.mu.Unlock()
+			return ready, s, nil
+		}
+		var (
+			running = len(s.ready)
+			failed  = len(s.pending) == 0 && s.replacing == 0
+		)
+		s.mu.Unlock()
+		if failed {
+			return nil, nil, s.abort(errors.E(errors.Unavailable,
+				fmt.Sprintf("start quorum: only %d of %d required machines are running; no more are starting", running, need)))
+		}
+		select {
+		case <-s.changed:
+		case <-timeout:
+			return nil, nil, s.abort(errors.E(errors.Unavailable,
+				fmt.Sprintf("start quorum: only %d of %d required machines are running after %s", running, need, quorum.Timeout)))
+		case <-ctx.Done():
+			return nil, nil, s.abort(ctx.Err())
+		}
+	}
+}
+
+// Stragglers are the machines that were still being started when
+// StartQuorum returned.
+type Stragglers struct {
+	b      *B
+	params []Param
+	ctx    context.Context
+	cancel func()
+	// c delivers the stragglers as they become running; changed is
+	// signaled when the machines' states change.
+	c       chan *Machine
+	changed chan struct{}
+
+	mu sync.Mutex
+	// pending are the machines that are being started; ready are the
+	// machines that are running but not yet returned or delivered.
+	pending map[*Machine]bool
+	ready   []*Machine
+	// retries is the number of replacements that may still be
+	// started; replacing is the number that are being started.
+	retries   int
+	replacing int
+	// returned is set once StartQuorum has returned.
+	returned bool
+	closed   bool
+}
+
+// C returns a channel on which the stragglers are delivered as they
+// become running. The channel is closed once no more machines are
+// being started.
+func (s *Stragglers) C() <-chan *Machine {
+	return s.c
+}
+
+// Pending returns the number of machines that are still being
+// started, including replacements.
+func (s *Stragglers) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending) + s.replacing
+}
+
+// Cancel cancels the machines that are still being started, and stops
+// replacing failed machines. Machines that were delivered are not
+// affected.
+func (s *Stragglers) Cancel() {
+	s.cancel()
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.maybeClose()
+	s.mu.Unlock()
+	for m := range pending {
+		m.Cancel()
+	}
+}
+
+// Abort cancels all of the machines that were started, and returns
+// the provided error.
+func (s *Stragglers) abort(err error) error {
+	s.Cancel()
+	s.mu.Lock()
+	ready := s.ready
+	s.ready = nil
+	s.mu.Unlock()
+	for _, m := range ready {
+		m.Cancel()
+	}
+	return err
+}
+
+// Track waits for the machine m to become running or to stop. It must
+// be called with s.mu held.
+func (s *Stragglers) track(m *Machine) {
+	if s.pending == nil {
+		s.pending = make(map[*Machine]bool)
+	}
+	s.pending[m] = true
+	go func() {
+		state, err := m.WaitFor(s.ctx, Running, Stopped)
+		if err != nil && err == s.ctx.Err() {
+			return
+		}
+		running := state == Running
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if !s.pending[m] {
+			return
+		}
+		delete(s.pending, m)
+		switch {
+		case running && s.returned:
+			s.c <- m
+		case running:
+			s.ready = append(s.ready, m)
+		default:
+			log.Error.Printf("%s: failed to start: %v", m.Name(), m.Err())
+			s.replace(m)
+		}
+		s.maybeClose()
+		s.notify()
+	}()
+}
+
+// Replace starts a replacement for the machine m, which failed to
+// start, if retries remain. It must be called with s.mu held.
+func (s *Stragglers) replace(m *Machine) {
+	if s.retries == 0 || s.ctx.Err() != nil {
+		return
+	}
+	s.retries--
+	s.replacing++
+	go func() {
+		machines, err := s.b.Start(s.ctx, 1, s.params...)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.replacing--
+		switch {
+		case err != nil:
+			log.Error.Printf("failed to start replacement machine: %v", err)
+			s.replace(nil)
+		case s.ctx.Err() != nil:
+			machines[0].Cancel()
+		default:
+			s.track(machines[0])
+		}
+		s.maybeClose()
+		s.notify()
+	}()
+}
+
+// MaybeClose closes the stragglers' channel once StartQuorum has
+// returned and no more machines are being started. It must be called
+// with s.mu held.
+func (s *Stragglers) maybeClose() {
+	if s.returned && !s.closed && len(s.pending) == 0 && s.replacing == 0 {
+		s.closed = true
+		close(s.c)
+	}
+}
+
+// Notify signals that the state of the stragglers changed.
+func (s *Stragglers) notify() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
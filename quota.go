@@ -0,0 +1,126 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+)
+
+// A MachineQuota limits the number of machines that a B runs at once.
+type MachineQuota struct {
+	// Max is the maximum number of machines started by the B (see
+	// B.Start) that may be starting or running at once.
+	Max int
+	// Wait makes B.Start block until enough machines stop to admit the
+	// requested machines, or until its context is done, instead of
+	// failing with a QuotaError.
+	Wait bool
+}
+
+// MaxMachines is an option that limits the machines started by the B
+// to the provided quota. Quota is reserved as B.Start is called,
+// before the system starts the machines, so that machines that are
+// still booting are counted; it is released as machines stop.
+// Machines that are attached or reattached (see B.Attach and
+// B.Reattach) are not counted, since they were started outside of
+// the B. The quota guards against accidentally launching far more
+// machines than intended, for example past a cloud provider's quota,
+// which may cause all requests to be throttled.
+func MaxMachines(quota MachineQuota) Option {
+	return func(b *B) {
+		b.quota = &machineQuota{MachineQuota: quota, freed: make(chan struct{})}
+	}
+}
+
+// A QuotaError is the error returned by B.Start when starting the
+// requested machines would exceed the B's machine quota (see
+// MaxMachines). It is wrapped in an error of kind
+// errors.Unavailable.
+type QuotaError struct {
+	// Requested is the number of machines requested.
+	Requested int
+	// InUse is the number of machines counted against the quota.
+	InUse int
+	// Max is the quota's maximum number of machines.
+	Max int
+}
+
+// Error implements error.
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("machine quota exceeded: requested %d machines with %d of %d in use", e.Requested, e.InUse, e.Max)
+}
+
+// QuotaUsage returns the number of machines counted against b's
+// machine quota and the quota's maximum. Max is zero if b has no
+// quota.
+func (b *B) QuotaUsage() (inUse, max int) {
+	return b.quota.Usage()
+}
+
+// A machineQuota enforces a MachineQuota. Its methods may be called
+// on a nil machineQuota, in which case machines are not limited.
+type machineQuota struct {
+	MachineQuota
+
+	mu    sync.Mutex
+	inUse int
+	// freed is closed (and replaced) when quota is released.
+	freed chan struct{}
+}
+
+// Acquire reserves quota for n machines. If quota is not available,
+// Acquire waits for it if the quota is configured to wait, and fails
+// with a QuotaError otherwise.
+func (q *machineQuota) Acquire(ctx context.Context, n int) error {
+	if q == nil {
+		return nil
+	}
+	for {
+		q.mu.Lock()
+		if q.inUse+n <= q.Max {
+			q.inUse += n
+			q.mu.Unlock()
+			return nil
+		}
+		err := &QuotaError{Requested: n, InUse: q.inUse, Max: q.Max}
+		freed := q.freed
+		q.mu.Unlock()
+		if !q.Wait || n > q.Max {
+			return errors.E(errors.Unavailable, err)
+		}
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return errors.E(ctx.Err(), err.Error())
+		}
+	}
+}
+
+// Release releases quota reserved for n machines.
+func (q *machineQuota) Release(n int) {
+	if q == nil || n == 0 {
+		return
+	}
+	q.mu.Lock()
+	q.inUse -= n
+	close(q.freed)
+	q.freed = make(chan struct{})
+	q.mu.Unlock()
+}
+
+// Usage returns the number of machines counted against the quota and
+// its maximum.
+func (q *machineQuota) Usage() (inUse, max int) {
+	if q == nil {
+		return 0, 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.inUse, q.Max
+}
@@ -0,0 +1,126 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+)
+
+const (
+	// DefaultReadinessTimeout is the default amount of time for which
+	// a machine's services may be unready before the machine fails.
+	defaultReadinessTimeout = 30 * time.Minute
+	// DefaultReadinessPeriod is the default interval at which the
+	// readiness of a machine's services is probed.
+	defaultReadinessPeriod = 5 * time.Second
+)
+
+// A ReadinessProber is a service that must become ready before its
+// machine is considered running. After a machine's services are
+// registered and initialized, the driver probes those that implement
+// ReadinessProber until all of them are ready, and only then does the
+// machine transition to Running, so that drivers do not route work to
+// machines whose services are still loading, for example, large
+// models or indexes. Probes are also run after a machine is rebooted
+// (see Machine.Reboot). Probes that do not return within 10 seconds
+// are considered to have failed.
+type ReadinessProber interface {
+	// Ready returns an error describing why the service is not yet
+	// ready, or nil if it is ready.
+	Ready(ctx context.Context) error
+}
+
+// Readiness is a machine parameter that configures how the driver
+// waits for the machine's services to become ready (see
+// ReadinessProber). Zero-valued fields take their defaults.
+type Readiness struct {
+	// Timeout is the amount of time after which a machine whose
+	// services are not ready fails. It defaults to 30 minutes.
+	Timeout time.Duration
+	// Period is the interval at which readiness is probed. It defaults
+	// to 5 seconds.
+	Period time.Duration
+}
+
+func (r Readiness) applyParam(m *Machine) {
+	m.readiness = r
+}
+
+// Ready replies once the probes of the supervisor's services that
+// implement ReadinessProber all pass. It fails with an error of kind
+// errors.Unavailable that describes the services that are not ready
+// otherwise.
+func (s *Supervisor) Ready(ctx context.Context, _ struct{}, _ *struct{}) error {
+	probers := make(map[string]ReadinessProber)
+	s.servicesMu.Lock()
+	for name, iface := range s.services {
+		if prober, ok := iface.(ReadinessProber); ok {
+			probers[name] = prober
+		}
+	}
+	s.servicesMu.Unlock()
+	names := make([]string, 0, len(probers))
+	for name := range probers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var problems []string
+	for _, name := range names {
+		if err := runHealthCheck(ctx, probers[name].Ready); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.E(errors.Unavailable, "not ready: "+strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// WaitReady waits for the machine's services to become ready (see
+// ReadinessProber), probing them periodically. It fails if they are
+// not ready within the machine's readiness timeout.
+func (m *Machine) waitReady(ctx context.Context) error {
+	timeout, period := m.readiness.Timeout, m.readiness.Period
+	if timeout <= 0 {
+		timeout = defaultReadinessTimeout
+	}
+	if period <= 0 {
+		period = defaultReadinessPeriod
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	for probes := 0; ; probes++ {
+		err := m.timeoutCall(ctx, healthCheckTimeout+10*time.Second, "Supervisor.Ready", struct{}{}, nil)
+		if err == nil {
+			if probes > 0 {
+				log.Printf("%s: services ready after %s", m.Name(), time.Since(start))
+			}
+			return nil
+		}
+		if errors.Is(errors.Invalid, err) {
+			// The supervisor does not support readiness probes, for
+			// example because it is running an older binary.
+			return nil
+		}
+		if probes == 0 {
+			log.Printf("%s: waiting for services to become ready: %v", m.Name(), err)
+		} else {
+			log.Debug.Printf("%s: waiting for services to become ready: %v", m.Name(), err)
+		}
+		select {
+		case <-time.After(period):
+		case <-ctx.Done():
+			return errors.E(errors.Unavailable, fmt.Sprintf("services not ready after %s", time.Since(start)), err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/grailbio/base/errors"
+)
+
+// DefaultKeepaliveLease is the amount of time for which machines stay
+// alive without keepalives from their driver, unless they belong to a
+// persistent cluster.
+const defaultKeepaliveLease = 5 * time.Minute
+
+// A machineDiscoverer is a System that can discover the running
+// machines of a persistent cluster (see Cluster), for example by
+// looking up cloud instance tags. The returned machines need only
+// have their addresses set.
+type machineDiscoverer interface {
+	DiscoverMachines(ctx context.Context, cluster string) ([]*Machine, error)
+}
+
+// Cluster is an option that makes the B's machines members of the
+// named persistent cluster: they outlive the driver for the provided
+// lease if the driver dies without shutting them down, so that a new
+// driver may reattach to them (see B.Reattach) instead of booting a
+// new cluster. The lease replaces the default lease of 5 minutes;
+// it should be long enough for the driver to be restarted. Machines
+// are labeled with the cluster's name (see Machine.Cluster), by which
+// Systems discover them.
+func Cluster(name string, lease time.Duration) Option {
+	return func(b *B) {
+		b.cluster = name
+		b.lease = lease
+	}
+}
+
+// Cluster returns the name of the persistent cluster of which b's
+// machines are members, if any (see bigmachine.Cluster).
+func (b *B) Cluster() string {
+	return b.cluster
+}
+
+// Cluster returns the name of the persistent cluster to which the
+// machine belongs, if any (see bigmachine.Cluster).
+func (m *Machine) Cluster() string {
+	return m.cluster
+}
+
+// Reattach discovers the running machines of b's persistent cluster
+// (see Cluster) and resumes ownership of them: b maintains keepalives
+// to the machines and tails their output, as if it had started them.
+// The provided parameters should be those with which the machines
+// were started; the services they name are not instantiated again,
+// since the machines already serve them. Machines that run a binary
+// other than the driver's are stopped with an error of kind
+// errors.Precondition. Machines that b already manages are not
+// returned. The System must support discovery; Reattach fails with an
+// error of kind errors.NotSupported otherwise.
+func (b *B) Reattach(ctx context.Context, params ...Param) ([]*Machine, error) {
+	if b.cluster == "" {
+		return nil, errors.E(errors.Invalid, "reattach: the B is not part of a persistent cluster")
+	}
+	discoverer, ok := b.system.(machineDiscoverer)
+	if !ok {
+		return nil, errors.E(errors.NotSupported, fmt.Sprintf("system %s does not support machine discovery", b.system.Name()))
+	}
+	discovered, err := discoverer.DiscoverMachines(ctx, b.cluster)
+	if err != nil {
+		return nil, errors.E(fmt.Sprintf("reattach %s", b.cluster), err)
+	}
+	for _, m := range discovered {
+		m.reattached = true
+		m.NoExec = true
+	}
+	return b.manage(discovered, params, 0, "reattaching to"), nil
+}
+
+// CheckReattached checks that a reattached machine runs the driver's
+// binary image for the machine's OS and architecture.
+func (m *Machine) checkReattached(ctx context.Context) error {
+	var info Info
+	if err := m.retryCall(ctx, time.Minute, 10*time.Second, "Supervisor.Info", struct{}{}, &info); err != nil {
+		return err
+	}
+	want, err := imageDigest(info.Goos, info.Goarch)
+	if err != nil {
+		return errors.E(fmt.Sprintf("reattach: image %s/%s", info.Goos, info.Goarch), err)
+	}
+	if info.Digest != want {
+		return errors.E(errors.Precondition,
+			fmt.Sprintf("reattached machine runs binary %s; driver runs %s", info.Digest.Short(), want.Short()))
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/fatbin"
+	"github.com/grailbio/base/log"
+)
+
+// DefaultRebootTimeout is the default amount of time allowed for a
+// machine to reboot.
+const defaultRebootTimeout = 10 * time.Minute
+
+// RebootOptions configures a machine reboot (see Machine.Reboot).
+type RebootOptions struct {
+	// Hard reboots the machine's underlying instance, instead of
+	// executing the driver's binary again in a new process. The
+	// machine's System must support rebooting.
+	Hard bool
+	// Timeout is the amount of time allowed for the machine to reboot
+	// and run its services again. It defaults to 10 minutes.
+	Timeout time.Duration
+}
+
+// Reboot restarts the machine m, for example to recover from wedged
+// GPUs or device drivers, without replacing it: the machine keeps its
+// name, address, lease, and handle, so that the driver may continue
+// to use it once Reboot returns. The machine is first drained of
+// calls in flight (accepting no new calls meanwhile, as with
+// Machine.Drain); then the driver's binary is executed again (a soft
+// reboot), or the machine's instance is rebooted and the driver's
+// binary is executed once its supervisor is back (a hard reboot).
+// Finally, the machine's services are registered again, and the
+// machine accepts calls again. Keepalive failures during the reboot
+// do not stop the machine, but the machine is stopped if Reboot fails
+// after its process was restarted, since its services are then lost.
+//
+// Only machines owned by the driver may be rebooted; soft reboots
+// additionally require machines whose binaries are executed by
+// bigmachine (see Machine.NoExec). Reboot fails with an error of kind
+// errors.Precondition otherwise, and with an error of kind
+// errors.NotSupported if a hard reboot is requested of a System that
+// cannot reboot machines.
+func (m *Machine) Reboot(ctx context.Context, opts RebootOptions) error {
+	if !m.owner {
+		return errors.E(errors.Precondition, fmt.Sprintf("reboot: machine %s is not owned", m.Addr))
+	}
+	if m.State() != Running {
+		return errors.E(errors.Precondition, fmt.Sprintf("reboot: machine %s is not running", m.Addr))
+	}
+	if m.NoExec && !opts.Hard {
+		return errors.E(errors.Precondition, fmt.Sprintf("reboot: machine %s does not exec binaries", m.Addr))
+	}
+	if opts.Hard && m.rebooter == nil {
+		return errors.E(errors.NotSupported, fmt.Sprintf("reboot: system does not support rebooting machine %s", m.Addr))
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultRebootTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	log.Printf("%s: rebooting (hard: %t)", m.Name(), opts.Hard)
+	drained := m.beginDrain()
+	defer m.endDrain()
+	if err := m.call(ctx, "Supervisor.Drain", struct{}{}, nil); err != nil {
+		return errors.E("reboot: drain", err)
+	}
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return errors.E("reboot: waiting for calls in flight", ctx.Err())
+	}
+	m.beginReboot()
+	defer m.endReboot()
+	if err := m.reboot(ctx, opts.Hard); err != nil {
+		err = errors.E(fmt.Sprintf("reboot %s", m.Name()), err)
+		m.setError(err)
+		return err
+	}
+	m.emit(MachineRebooted, nil, "")
+	log.Printf("%s: rebooted", m.Name())
+	return nil
+}
+
+// Reboot restarts the machine's process, or reboots its instance if
+// hard is true, registers the machine's services again, and waits for
+// them to become ready.
+func (m *Machine) reboot(ctx context.Context, hard bool) error {
+	if hard {
+		if err := m.rebooter.RebootMachine(ctx, m); err != nil {
+			return err
+		}
+		// Wait for the machine to go down, so that we do not mistake the
+		// process that is shutting down for the rebooted supervisor.
+		for {
+			if err := m.timeoutCall(ctx, 5*time.Second, "Supervisor.Ping", 0, nil); err != nil {
+				if ctx.Err() != nil {
+					return errors.E("waiting for machine to go down", ctx.Err())
+				}
+				break
+			}
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return errors.E("waiting for machine to go down", ctx.Err())
+			}
+		}
+		if err := m.ping(ctx); err != nil {
+			return err
+		}
+	}
+	if !m.NoExec {
+		self, err := fatbin.Self()
+		if err != nil {
+			return err
+		}
+		// As at startup, we expect the exec call to fail, since the
+		// process is replaced before it can reply.
+		if err := m.execBinary(ctx, self); err != nil && !errors.Is(errors.Net, err) {
+			return err
+		}
+		if err := m.ping(ctx); err != nil {
+			return err
+		}
+	}
+	if err := m.registerServices(ctx); err != nil {
+		return err
+	}
+	if m.diskWatchdog != nil {
+		if err := m.call(ctx, "Supervisor.SetDiskWatchdog", *m.diskWatchdog, nil); err != nil {
+			return errors.E(err, "Supervisor.SetDiskWatchdog")
+		}
+	}
+	if m.logRotation != nil {
+		if err := m.call(ctx, "Supervisor.SetLogRotation", *m.logRotation, nil); err != nil {
+			return errors.E(err, "Supervisor.SetLogRotation")
+		}
+	}
+	if m.serviceRestart != nil {
+		if err := m.call(ctx, "Supervisor.SetServiceRestart", *m.serviceRestart, nil); err != nil {
+			return errors.E(err, "Supervisor.SetServiceRestart")
+		}
+	}
+	if m.memoryWatchdog != nil {
+		if err := m.call(ctx, "Supervisor.SetMemoryWatchdog", *m.memoryWatchdog, nil); err != nil {
+			return errors.E(err, "Supervisor.SetMemoryWatchdog")
+		}
+	}
+	if m.blobCache != nil {
+		if err := m.call(ctx, "Blobs.Configure", *m.blobCache, nil); err != nil {
+			return errors.E(err, "Blobs.Configure")
+		}
+	}
+	return m.waitReady(ctx)
+}
+
+// BeginReboot marks the machine as rebooting, so that keepalive
+// failures do not stop it.
+func (m *Machine) beginReboot() {
+	m.mu.Lock()
+	m.rebooted = make(chan struct{})
+	m.mu.Unlock()
+}
+
+// EndReboot marks the end of a reboot begun by beginReboot.
+func (m *Machine) endReboot() {
+	m.mu.Lock()
+	close(m.rebooted)
+	m.rebooted = nil
+	m.mu.Unlock()
+}
+
+// Rebooting returns a channel that is closed when the machine's
+// current reboot ends, or nil if the machine is not rebooting.
+func (m *Machine) rebooting() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.rebooted
+}
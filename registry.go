@@ -0,0 +1,145 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/log"
+)
+
+// registryTimeout is the timeout used for calls to a Registrar.
+const registryTimeout = 30 * time.Second
+
+// A Registrar registers machines in an external service registry
+// (for example, Consul, etcd, or DNS SRV records), so that clients
+// that are not part of the bigmachine session can discover machines
+// and call the application services they host.
+//
+// Machines are registered once they are running and all of their
+// services have been instantiated; they are deregistered when they
+// are reported unhealthy by their supervisor, and re-registered if
+// they become healthy again. Machines are always deregistered when
+// they stop. Registrar errors are logged, but do not otherwise
+// affect the machine. Registrars are called asynchronously, one call
+// at a time for each machine.
+//
+// Registrars are called only for machines owned by the B (i.e.,
+// those created by B.Start).
+type Registrar interface {
+	// Register registers the machine m. Register may be called more
+	// than once for the same machine.
+	Register(ctx context.Context, m *Machine) error
+	// Deregister removes the machine m from the registry.
+	Deregister(ctx context.Context, m *Machine) error
+}
+
+// Registry is an option that registers the machines started by the
+// B with the provided registrar.
+func Registry(r Registrar) Option {
+	return func(b *B) {
+		b.registrar = r
+	}
+}
+
+// A registration maintains a machine's registration with a
+// registrar. Registrar calls are made by the registration's own
+// goroutine, so that a slow registrar does not hold up the machine's
+// keepalives; updates made while a call is in flight are coalesced,
+// so that only the latest health is applied.
+type registration struct {
+	registrar Registrar
+	machine   *Machine
+	// Updatec is signaled when the registration is updated.
+	updatec chan struct{}
+
+	mu      sync.Mutex
+	healthy bool
+	stopped bool
+}
+
+// NewRegistration returns a registration of machine m with the
+// provided registrar. The machine is not registered until it is
+// reported healthy by Update.
+func newRegistration(registrar Registrar, m *Machine) *registration {
+	r := &registration{
+		registrar: registrar,
+		machine:   m,
+		updatec:   make(chan struct{}, 1),
+	}
+	go r.loop()
+	return r
+}
+
+// Update asynchronously registers or deregisters the machine
+// according to its health. A nil registration is a no-op.
+func (r *registration) Update(healthy bool) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	if !r.stopped {
+		r.healthy = healthy
+	}
+	r.mu.Unlock()
+	r.signal()
+}
+
+// Stop asynchronously deregisters the machine, and ends the
+// registration: further updates are ignored. A nil registration is
+// a no-op.
+func (r *registration) Stop() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.healthy = false
+	r.stopped = true
+	r.mu.Unlock()
+	r.signal()
+}
+
+func (r *registration) signal() {
+	select {
+	case r.updatec <- struct{}{}:
+	default:
+	}
+}
+
+func (r *registration) loop() {
+	var registered bool
+	for range r.updatec {
+		r.mu.Lock()
+		healthy, stopped := r.healthy, r.stopped
+		r.mu.Unlock()
+		if healthy != registered {
+			registered = r.apply(healthy)
+		}
+		if stopped {
+			return
+		}
+	}
+}
+
+// Apply registers or deregisters the machine, and returns whether
+// it is registered afterwards.
+func (r *registration) apply(healthy bool) (registered bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+	defer cancel()
+	if healthy {
+		if err := r.registrar.Register(ctx, r.machine); err != nil {
+			log.Error.Printf("%s: registration failed: %v", r.machine.Name(), err)
+			return false
+		}
+		return true
+	}
+	if err := r.registrar.Deregister(ctx, r.machine); err != nil {
+		log.Error.Printf("%s: deregistration failed: %v", r.machine.Name(), err)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+
+	"github.com/grailbio/base/log"
+)
+
+// AutoReplace is a machine parameter that causes machines that stop
+// unexpectedly to be replaced: when such a machine stops, the B starts
+// a replacement with the same parameters, including services, and
+// reports the replacement through a MachineReplaced event (see
+// B.Events). Long-running computations can thus rebind their work to
+// the replacement instead of restarting the driver. Machines that are
+// stopped deliberately (by Machine.Cancel, Machine.Drain, or
+// B.Shutdown) or after the B is aborted are not replaced.
+// Replacements are subject to the B's retry budget, if any (see
+// LimitRetries).
+type AutoReplace struct {
+	// Max is the number of times that a machine and its successive
+	// replacements may be replaced. Zero means no limit.
+	Max int
+}
+
+func (r AutoReplace) applyParam(m *Machine) {
+	m.replace = &r
+}
+
+// Replace waits for the owned machine m, which was started with the
+// provided parameters, to stop; if it stops unexpectedly, Replace
+// starts a replacement.
+func (b *B) replace(m *Machine, params []Param) {
+	<-m.Wait(Stopped)
+	if m.replace.Max > 0 && m.generation >= m.replace.Max {
+		log.Error.Printf("%s: not replacing stopped machine: replaced %d times", m.Name(), m.generation)
+		return
+	}
+	if m.Canceled() || m.Draining() || b.Err() != nil {
+		return
+	}
+	b.mu.Lock()
+	shutdown := b.shutdown
+	b.mu.Unlock()
+	if shutdown {
+		return
+	}
+	ctx := context.Background()
+	if err := b.retries.Wait(ctx); err != nil {
+		log.Error.Printf("%s: not replacing stopped machine: %v", m.Name(), err)
+		return
+	}
+	machines, err := b.start(ctx, 1, params, m.generation+1)
+	if err != nil {
+		log.Error.Printf("%s: failed to start replacement: %v", m.Name(), err)
+		return
+	}
+	replacement := machines[0]
+	log.Printf("%s: replaced stopped machine (error: %v) with %s", m.Name(), m.Err(), replacement.Name())
+	m.lifecycle(MachineEvent{
+		Machine:     m,
+		Type:        MachineReplaced,
+		Time:        replacement.StartTime(),
+		Err:         m.Err(),
+		Replacement: replacement,
+	})
+}
@@ -0,0 +1,211 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/retry"
+)
+
+const (
+	// DefaultServiceRestartWindow is the default window within which
+	// panics are counted (see ServiceRestart).
+	defaultServiceRestartWindow = time.Minute
+	// ServiceRestartAttempts is the number of times that the
+	// reinitialization of a quarantined service is attempted.
+	serviceRestartAttempts = 5
+)
+
+// ServiceRestartPolicy is the retry policy of the reinitialization of
+// quarantined services.
+var serviceRestartPolicy = retry.Backoff(time.Second, 30*time.Second, 2)
+
+// ServiceRestart is a machine parameter that isolates the panics of
+// the machine's services: a service whose methods panic Panics times
+// within Window is quarantined, so that calls to it fail with errors
+// of kind errors.Unavailable, and it is reinitialized by calling its
+// Init method again (see Services), while the machine's other
+// services keep serving. Calls to the service that are in flight when
+// it is quarantined are not waited for. A service that fails to
+// reinitialize remains quarantined. Quarantines and restarts are
+// reported to the driver with the machine's keepalives, as
+// MachineServiceQuarantined and MachineServiceRestarted events (see
+// B.Events). The Supervisor service is never quarantined.
+type ServiceRestart struct {
+	// Panics is the number of panics after which a service is
+	// quarantined and restarted. Services are never restarted if it is
+	// zero.
+	Panics int
+	// Window is the duration within which panics are counted. It
+	// defaults to 1 minute.
+	Window time.Duration
+}
+
+func (r ServiceRestart) applyParam(m *Machine) {
+	m.serviceRestart = &r
+}
+
+// A ServiceStatus describes the panics of a machine's service (see
+// ServiceRestart).
+type ServiceStatus struct {
+	// Name is the name of the service.
+	Name string
+	// Quarantined indicates whether the service is quarantined.
+	Quarantined bool
+	// Reason describes the service's most recent panic, or the failure
+	// to restart it.
+	Reason string
+	// Restarts is the number of times that the service was restarted.
+	Restarts int
+}
+
+// SetServiceRestart applies the provided configuration to the
+// restarts of the supervisor's services.
+func (s *Supervisor) SetServiceRestart(ctx context.Context, r ServiceRestart, _ *struct{}) error {
+	if r.Window <= 0 {
+		r.Window = defaultServiceRestartWindow
+	}
+	s.restartMu.Lock()
+	s.serviceRestart = r
+	s.restartMu.Unlock()
+	return nil
+}
+
+// HandlePanic records a panic in a method of the named service, and
+// quarantines and restarts the service if it has panicked too often
+// (see ServiceRestart).
+func (s *Supervisor) handlePanic(service, method string, e interface{}) {
+	if service == "Supervisor" {
+		return
+	}
+	s.restartMu.Lock()
+	r := s.serviceRestart
+	if r.Panics <= 0 {
+		s.restartMu.Unlock()
+		return
+	}
+	if s.panics == nil {
+		s.panics = make(map[string][]time.Time)
+		s.serviceStatus = make(map[string]*ServiceStatus)
+	}
+	now := time.Now()
+	times := append(s.panics[service], now)
+	for len(times) > 0 && now.Sub(times[0]) > r.Window {
+		times = times[1:]
+	}
+	s.panics[service] = times
+	status := s.serviceStatus[service]
+	if status == nil {
+		status = &ServiceStatus{Name: service}
+		s.serviceStatus[service] = status
+	}
+	status.Reason = fmt.Sprintf("panic in %s.%s: %v", service, method, e)
+	if len(times) < r.Panics || status.Quarantined {
+		s.restartMu.Unlock()
+		return
+	}
+	status.Quarantined = true
+	reason := status.Reason
+	delete(s.panics, service)
+	s.restartMu.Unlock()
+	log.Error.Printf("service %s panicked %d times within %s; quarantining and restarting it", service, len(times), r.Window)
+	s.server.Suspend(service, reason)
+	go s.restartService(service)
+}
+
+// RestartService reinitializes the named quarantined service, and
+// resumes it once it is reinitialized.
+func (s *Supervisor) restartService(name string) {
+	s.servicesMu.Lock()
+	iface := s.services[name]
+	s.servicesMu.Unlock()
+	var err error
+	for attempt := 0; attempt < serviceRestartAttempts; attempt++ {
+		if attempt > 0 {
+			_ = retry.Wait(context.Background(), serviceRestartPolicy, attempt-1)
+		}
+		if err = s.reinitService(iface); err == nil {
+			break
+		}
+		log.Error.Printf("service %s: restart: %v", name, err)
+	}
+	s.restartMu.Lock()
+	status := s.serviceStatus[name]
+	if err != nil {
+		status.Reason = fmt.Sprintf("restart failed: %v", err)
+		s.restartMu.Unlock()
+		log.Error.Printf("service %s remains quarantined: %v", name, err)
+		return
+	}
+	status.Quarantined = false
+	status.Restarts++
+	s.restartMu.Unlock()
+	s.server.Resume(name)
+	log.Printf("service %s restarted", name)
+}
+
+// ReinitService calls the Init method of the provided service, if it
+// has one, recovering its panics.
+func (s *Supervisor) reinitService(iface interface{}) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("panic in Init: %v", e)
+		}
+	}()
+	return maybeInit(iface, s.b)
+}
+
+// ServiceStatuses returns the statuses of the supervisor's services
+// that have panicked, ordered by name.
+func (s *Supervisor) serviceStatuses() []ServiceStatus {
+	s.restartMu.Lock()
+	defer s.restartMu.Unlock()
+	statuses := make([]ServiceStatus, 0, len(s.serviceStatus))
+	for _, status := range s.serviceStatus {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+// ServiceStatuses returns the statuses of the machine's services that
+// have panicked, as of the machine's most recent keepalive (see
+// ServiceRestart).
+func (m *Machine) ServiceStatuses() []ServiceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]ServiceStatus(nil), m.serviceStatuses...)
+}
+
+// SetServiceStatuses records the statuses of the machine's services,
+// as reported by its supervisor, and emits events for the services
+// that were quarantined or restarted since they were last reported.
+func (m *Machine) setServiceStatuses(statuses []ServiceStatus) {
+	m.mu.Lock()
+	prev := make(map[string]ServiceStatus)
+	for _, status := range m.serviceStatuses {
+		prev[status.Name] = status
+	}
+	m.serviceStatuses = statuses
+	m.mu.Unlock()
+	for _, status := range statuses {
+		last := prev[status.Name]
+		if status.Quarantined && (!last.Quarantined || status.Restarts > last.Restarts) {
+			log.Error.Printf("%s: service %s quarantined: %s", m.Name(), status.Name, status.Reason)
+			m.emit(MachineServiceQuarantined, nil, fmt.Sprintf("%s: %s", status.Name, status.Reason))
+		}
+		if status.Restarts > last.Restarts {
+			log.Printf("%s: service %s restarted", m.Name(), status.Name)
+			m.emit(MachineServiceRestarted, nil, status.Name)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/log"
+	"golang.org/x/time/rate"
+)
+
+// RetryThrottleLogPeriod is the minimum interval between log messages
+// that report that retries are being throttled.
+const retryThrottleLogPeriod = time.Minute
+
+// A RetryBudget limits the rate of retries across all of a B's
+// machines. Retries draw from a shared token bucket that holds up to
+// Burst tokens and is refilled at Rate tokens per second. When the
+// bucket is empty, retries wait for tokens to become available,
+// failing if their deadlines would expire first. Thus, when failures
+// are correlated (for example, during an outage of a service that
+// all machines depend on), retries back off collectively and their
+// failures are surfaced, instead of hundreds of machines retrying in
+// a storm.
+type RetryBudget struct {
+	// Rate is the sustained number of retries per second.
+	Rate float64
+	// Burst is the number of retries that may be made in a burst.
+	Burst int
+}
+
+// LimitRetries is an option that limits the retries of the B's
+// machines to the provided budget. The budget applies both to the
+// calls that a B makes to maintain its machines (for example,
+// keepalives) and to calls made through Machine.RetryCall.
+func LimitRetries(budget RetryBudget) Option {
+	return func(b *B) {
+		b.retries = &retryLimiter{limiter: rate.NewLimiter(rate.Limit(budget.Rate), budget.Burst)}
+	}
+}
+
+// A retryLimiter enforces a RetryBudget. Its methods may be called on
+// a nil retryLimiter, in which case retries are not limited.
+type retryLimiter struct {
+	limiter *rate.Limiter
+
+	mu       sync.Mutex
+	lastWarn time.Time
+}
+
+// Wait waits until a retry is permitted by the budget. It returns an
+// error if the context is done, or if its deadline would expire
+// before a retry is permitted.
+func (l *retryLimiter) Wait(ctx context.Context) error {
+	if l == nil || l.limiter.Allow() {
+		return nil
+	}
+	l.mu.Lock()
+	if time.Since(l.lastWarn) > retryThrottleLogPeriod {
+		log.Error.Printf("retry budget exhausted; throttling retries")
+		l.lastWarn = time.Now()
+	}
+	l.mu.Unlock()
+	return l.limiter.Wait(ctx)
+}
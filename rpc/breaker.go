@@ -0,0 +1,119 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/errors"
+)
+
+// DefaultBreakerCooldown is the default amount of time an open
+// circuit breaker waits before it admits a probe call.
+const defaultBreakerCooldown = 5 * time.Second
+
+type breakerState int
+
+const (
+	// BreakerClosed admits all calls.
+	breakerClosed breakerState = iota
+	// BreakerOpen fails all calls fast.
+	breakerOpen
+	// BreakerHalfOpen admits a single probe call; all other calls
+	// fail fast until the outcome of the probe is known.
+	breakerHalfOpen
+)
+
+// A breaker is a circuit breaker for calls to a single address. It
+// counts consecutive failures (network errors and timeouts); once
+// the count reaches the configured threshold, the breaker opens,
+// and calls fail fast without contacting the server. After a
+// cooldown period, a single probe call is admitted: if it succeeds,
+// the breaker closes again; otherwise it reopens for another
+// cooldown period. A probe that does not complete within a cooldown
+// period is presumed to have failed, and another probe is admitted,
+// so that a hung probe does not keep the breaker open indefinitely.
+type breaker struct {
+	addr      string
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	// ProbedAt is the time at which the current probe was admitted.
+	probedAt time.Time
+}
+
+// Allow returns nil if a call may proceed. If the breaker is open (or
+// a probe is already in flight), Allow returns an error of kind
+// errors.Net so that callers treat the fast failure as they would an
+// unreachable machine.
+func (b *breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) >= b.cooldown {
+			b.state = breakerHalfOpen
+			b.probedAt = time.Now()
+			return nil
+		}
+	case breakerHalfOpen:
+		if time.Since(b.probedAt) >= b.cooldown {
+			b.probedAt = time.Now()
+			return nil
+		}
+	default:
+		return nil
+	}
+	return errors.E(errors.Net, errors.Temporary,
+		fmt.Sprintf("%s: circuit breaker open after %d consecutive failures", b.addr, b.failures))
+}
+
+// Done records the outcome of a call admitted by Allow, made with
+// the provided context.
+func (b *breaker) Done(ctx context.Context, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil && ctx.Err() == context.Canceled {
+		// The call was abandoned by its caller, so we learned nothing.
+		// The cancellation may surface as any error, so we consult the
+		// context instead. If the call was the probe, the next call
+		// becomes the probe.
+		if b.state == breakerHalfOpen {
+			b.state = breakerOpen
+		}
+		return
+	}
+	if !isBreakerFailure(ctx, err) {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// IsBreakerFailure tells whether err should count against a
+// machine's circuit breaker. Only failures that indicate that the
+// machine itself may be unhealthy are counted; application errors
+// are successful calls as far as the breaker is concerned.
+func isBreakerFailure(ctx context.Context, err error) bool {
+	if err == nil {
+		return false
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return true
+	}
+	return errors.Is(errors.Net, err)
+}
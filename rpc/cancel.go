@@ -0,0 +1,97 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/log"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+const (
+	// BigmachineCallIDHeader is the HTTP header used to transmit the
+	// unique ID of a call, by which the call may be canceled.
+	bigmachineCallIDHeader = "x-bigmachine-call-id"
+	// BigmachineCancelHeader is the HTTP header used to request the
+	// cancellation of the call with the provided ID.
+	bigmachineCancelHeader = "x-bigmachine-cancel"
+)
+
+// CancelTimeout is the timeout for delivering cancellation requests.
+const cancelTimeout = 10 * time.Second
+
+// NewCallID returns a new, random call ID.
+func newCallID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// ActiveCalls maintains the cancellation functions of the calls in
+// flight, keyed by their IDs.
+type activeCalls struct {
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+}
+
+// Add registers the cancellation function of the call with the
+// provided ID.
+func (c *activeCalls) add(id string, cancel context.CancelFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancels == nil {
+		c.cancels = make(map[string]context.CancelFunc)
+	}
+	c.cancels[id] = cancel
+}
+
+// Remove unregisters the call with the provided ID.
+func (c *activeCalls) remove(id string) {
+	c.mu.Lock()
+	delete(c.cancels, id)
+	c.mu.Unlock()
+}
+
+// Cancel cancels the call with the provided ID, and returns whether
+// such a call was in flight.
+func (c *activeCalls) cancel(id string) bool {
+	c.mu.Lock()
+	cancel := c.cancels[id]
+	c.mu.Unlock()
+	if cancel == nil {
+		return false
+	}
+	cancel()
+	return true
+}
+
+// SendCancel asks the server at the provided URL to cancel the call
+// with the provided ID. Cancellation is best-effort: errors are
+// logged, and the call's context is eventually canceled regardless
+// once its connection is severed or its deadline expires.
+func sendCancel(client *http.Client, url, id string) {
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		log.Error.Printf("cancel %s %s: %v", url, id, err)
+		return
+	}
+	req.Header.Set(bigmachineCancelHeader, id)
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+	resp, err := ctxhttp.Do(ctx, client, req)
+	if err != nil {
+		log.Debug.Printf("cancel %s %s: %v", url, id, err)
+		return
+	}
+	resp.Body.Close()
+}
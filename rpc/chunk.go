@@ -0,0 +1,61 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"hash/crc32"
+
+	"github.com/grailbio/base/errors"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// A Chunk is a checksummed piece of a larger byte stream. Chunks
+// are used to transfer large streams in multiple calls, so that a
+// transfer that is interrupted can be resumed from the offset of the
+// last chunk that was successfully received, rather than from the
+// beginning of the stream. Each chunk carries a CRC-32C checksum of
+// its data so that receivers can detect corruption.
+type Chunk struct {
+	// Offset is the offset of the chunk's data in the stream.
+	Offset int64
+	// Data is the chunk's data. An empty chunk indicates the end of
+	// the stream.
+	Data []byte
+	// Checksum is the CRC-32C (Castagnoli) checksum of Data.
+	Checksum uint32
+}
+
+// NewChunk returns a new chunk with the provided offset and data,
+// computing its checksum.
+func NewChunk(offset int64, data []byte) Chunk {
+	return Chunk{
+		Offset:   offset,
+		Data:     data,
+		Checksum: crc32.Checksum(data, castagnoli),
+	}
+}
+
+// Verify returns an error of kind errors.Integrity if the chunk's
+// data do not match its checksum. Integrity errors are temporary:
+// the chunk should be transferred again.
+func (c Chunk) Verify() error {
+	if sum := crc32.Checksum(c.Data, castagnoli); sum != c.Checksum {
+		return errors.E(errors.Integrity, errors.Temporary,
+			fmt.Sprintf("chunk at offset %d: checksum mismatch: got %08x, want %08x", c.Offset, sum, c.Checksum))
+	}
+	return nil
+}
+
+// End returns the offset of the end of the chunk's data.
+func (c Chunk) End() int64 {
+	return c.Offset + int64(len(c.Data))
+}
+
+// String returns a summary of the chunk, omitting its data.
+func (c Chunk) String() string {
+	return fmt.Sprintf("chunk{offset:%d len:%d checksum:%08x}", c.Offset, len(c.Data), c.Checksum)
+}
@@ -6,14 +6,17 @@ package rpc
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/gob"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/grailbio/base/errors"
@@ -61,23 +64,78 @@ type Client struct {
 	factory func() *http.Client
 	prefix  string
 
+	// BreakerThreshold and breakerCooldown configure the per-address
+	// circuit breakers. Breakers are disabled if breakerThreshold is 0.
+	breakerThreshold int
+	breakerCooldown  time.Duration
+
+	// MaxArg and maxReply are the maximum sizes of gob-encoded
+	// arguments and replies; they are unlimited if 0.
+	maxArg, maxReply int64
+
 	// Loggers contains a rate limiting logger per client;
 	// use getLogger to retrieve it.
 	loggers sync.Map // map[string]*rateLimitingOutputter
 
-	mu      sync.Mutex
-	clients map[string]*clientState
+	// Traffic counts the bytes exchanged with each address; use
+	// getTraffic to retrieve an address's counter.
+	traffic sync.Map // map[string]*trafficCounter
+
+	mu       sync.Mutex
+	clients  map[string]*clientState
+	breakers map[string]*breaker
+}
+
+// A ClientOption is an option that can be provided when creating a
+// new Client.
+type ClientOption func(c *Client)
+
+// Breaker enables the client's per-address circuit breakers, which
+// are disabled by default. After threshold consecutive network
+// failures or timeouts to an address, calls to that address fail
+// fast with an error of kind errors.Net. Once cooldown has elapsed
+// (5 seconds if cooldown is 0), a single call is admitted to probe
+// for recovery; if it succeeds, calls are admitted again. If the
+// probe does not complete within another cooldown, another call is
+// admitted as the probe. A threshold of 0 disables circuit breaking.
+func Breaker(threshold int, cooldown time.Duration) ClientOption {
+	return func(c *Client) {
+		if cooldown <= 0 {
+			cooldown = defaultBreakerCooldown
+		}
+		c.breakerThreshold = threshold
+		c.breakerCooldown = cooldown
+	}
+}
+
+// ClientLimits limits the sizes of gob-encoded arguments and replies
+// of calls made by the client. Calls with arguments larger than
+// maxArg bytes fail without contacting the server; calls whose
+// replies would be larger than maxReply bytes fail instead of
+// reading the reply. Both errors are of kind errors.Precondition.
+// A limit of 0 means no limit. The reply limit may be lowered for
+// individual calls by WithMaxReply.
+func ClientLimits(maxArg, maxReply int64) ClientOption {
+	return func(c *Client) {
+		c.maxArg = maxArg
+		c.maxReply = maxReply
+	}
 }
 
 // NewClient creates a new RPC client.  clientFactory is called to create a new
 // http.Client object. It may be called repeatedly and concurrently. prefix is
 // prepended to the service method when constructing an URL.
-func NewClient(clientFactory func() *http.Client, prefix string) (*Client, error) {
-	return &Client{
-		factory: clientFactory,
-		prefix:  prefix,
-		clients: make(map[string]*clientState),
-	}, nil
+func NewClient(clientFactory func() *http.Client, prefix string, opts ...ClientOption) (*Client, error) {
+	c := &Client{
+		factory:  clientFactory,
+		prefix:   prefix,
+		clients:  make(map[string]*clientState),
+		breakers: make(map[string]*breaker),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
 }
 
 func (c *Client) getClient(addr string) *clientState {
@@ -108,6 +166,36 @@ func (c *Client) updateClientState(h *clientState, err error, serviceMethod stri
 	}
 }
 
+// getBreaker returns the circuit breaker for addr, or nil if circuit
+// breaking is disabled.
+func (c *Client) getBreaker(addr string) *breaker {
+	if c.breakerThreshold <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.breakers[addr]
+	if b == nil {
+		b = &breaker{
+			addr:      addr,
+			threshold: c.breakerThreshold,
+			cooldown:  c.breakerCooldown,
+		}
+		c.breakers[addr] = b
+	}
+	return b
+}
+
+// Forget discards the client's circuit breaker for addr, once the
+// address is no longer called, for example because the machine
+// that served it has stopped. A later call to addr starts with a
+// closed breaker.
+func (c *Client) Forget(addr string) {
+	c.mu.Lock()
+	delete(c.breakers, addr)
+	c.mu.Unlock()
+}
+
 func (c *Client) getLogger(addr string) *rateLimitingOutputter {
 	v, ok := c.loggers.Load(addr)
 	if ok {
@@ -126,12 +214,13 @@ func (c *Client) getLogger(addr string) *rateLimitingOutputter {
 //
 // If the argument is an io.Reader, it is streamed directly to the
 // server method. In this case, Call does not return until the data
-// are fully streamed. If the reply is an *io.ReadCloser, the reply
-// is streamed directly from the server method. In this case, Call
-// returns once the stream is available, and the client is
-// responsible for fully reading the data and closing the reader. If
-// an error occurs while the response is streamed, the returned
-// io.ReadCloser errors on read.
+// are fully streamed, unless the reply is also streamed and the
+// server replies before consuming the argument (see Duplex). If the
+// reply is an *io.ReadCloser, the reply is streamed directly from the
+// server method. In this case, Call returns once the stream is
+// available, and the client is responsible for fully reading the
+// data and closing the reader. If an error occurs while the response
+// is streamed, the returned io.ReadCloser errors on read.
 //
 // If the argument is a (func () io.Reader), it is called to get a reader
 // streamed directly to the server method as above. This is mostly useful when
@@ -139,6 +228,30 @@ func (c *Client) getLogger(addr string) *rateLimitingOutputter {
 // call, as opposed to continuing from whatever unknown state remains from
 // previously attempted calls.
 //
+// If ctx has a deadline, it is transmitted to the server, which
+// cancels the method's context once the deadline (plus a small
+// allowance for clock skew) has passed.
+//
+// Arguments and replies that exceed the client's limits (see
+// ClientLimits), or the server's, fail with errors of kind
+// errors.Precondition.
+//
+// If ctx is canceled (or its deadline expires) before the server
+// replies, the client asks the server to cancel the method's context
+// so that the method does not continue on behalf of a caller that
+// has gone away.
+//
+// If ctx carries an idempotency key (see WithIdempotencyKey), the
+// server invokes the method at most once for the key.
+//
+// If ctx carries a service version (see WithServiceVersion), calls
+// to a service with a different version fail with an error of kind
+// errors.Precondition.
+//
+// If circuit breaking is enabled (see Breaker), calls to an address
+// that has failed repeatedly fail fast with an error of kind
+// errors.Net until a probe call succeeds.
+//
 // Remote errors are decoded into *errors.Error and returned.
 // (Non-*errors.Error errors are converted by the server.) The RPC
 // client does not pass on errors of kind errors.Net; these are
@@ -147,6 +260,7 @@ func (c *Client) getLogger(addr string) *rateLimitingOutputter {
 // they are never from the application.
 func (c *Client) Call(ctx context.Context, addr, serviceMethod string, arg, reply interface{}) (err error) {
 	done := clientstats.Start(addr, serviceMethod)
+	traffic := c.getTraffic(addr)
 	var (
 		requestBytes = -1
 		replyBytes   = -1
@@ -154,6 +268,14 @@ func (c *Client) Call(ctx context.Context, addr, serviceMethod string, arg, repl
 	defer func() {
 		done(int64(requestBytes), int64(replyBytes), err)
 	}()
+	if b := c.getBreaker(addr); b != nil {
+		if err = b.Allow(); err != nil {
+			return err
+		}
+		defer func() {
+			b.Done(ctx, err)
+		}()
+	}
 	url := strings.TrimRight(addr, "/") + c.prefix + serviceMethod
 	if log.At(log.Debug) {
 		call := fmt.Sprint("call ", addr, " ", serviceMethod, " ", truncatef(arg))
@@ -169,17 +291,19 @@ func (c *Client) Call(ctx context.Context, addr, serviceMethod string, arg, repl
 	var (
 		body        io.Reader
 		contentType string
+		codec       = codecFromContext(ctx)
+		compress    = compressionFromContext(ctx)
 	)
 	switch arg := arg.(type) {
 	case func() io.Reader:
-		body = arg()
+		body = countReader(arg(), &traffic.sent)
 		contentType = "application/octet-stream"
 	case io.Reader:
-		body = arg
+		body = countReader(arg, &traffic.sent)
 		contentType = "application/octet-stream"
 	default:
 		b := new(bytes.Buffer)
-		enc := gob.NewEncoder(b)
+		enc := codec.newEncoder(b)
 		if err = enc.Encode(arg); err != nil {
 			// Because we are writing into a Buffer, any error we see is a
 			// failure to encode, which will not succeed on retry without
@@ -187,25 +311,75 @@ func (c *Client) Call(ctx context.Context, addr, serviceMethod string, arg, repl
 			return errors.E(errors.Fatal, errors.Invalid, err)
 		}
 		requestBytes = b.Len()
+		if c.maxArg > 0 && int64(requestBytes) > c.maxArg {
+			return errors.E(errors.Precondition, fmt.Sprintf("call %s %s: argument of %d bytes exceeds limit of %d bytes", addr, serviceMethod, requestBytes, c.maxArg))
+		}
 		if requestBytes > largeRpcPayload {
 			log.Outputf(largeArgLogger, log.Info, "call %s %s: large argument: %d bytes", addr, serviceMethod, requestBytes)
 		}
+		if compress {
+			compressed := new(bytes.Buffer)
+			gz := gzip.NewWriter(compressed)
+			if _, err = gz.Write(b.Bytes()); err == nil {
+				err = gz.Close()
+			}
+			if err != nil {
+				return errors.E(errors.Fatal, errors.Invalid, err)
+			}
+			b = compressed
+		}
+		atomic.AddInt64(&traffic.sent, int64(b.Len()))
 		body = b
-		contentType = gobContentType
+		contentType = codec.contentType()
 	}
 
 	h := c.getClient(addr)
 	defer func() {
 		c.updateClientState(h, err, serviceMethod)
 	}()
-	resp, err := ctxhttp.Post(ctx, h.Client(), url, contentType, body)
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return errors.E(errors.Fatal, errors.Invalid, err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", codec.contentType())
+	if compress {
+		req.Header.Set(bigmachineCompressionHeader, gzipCompression)
+	}
+	callID := newCallID()
+	req.Header.Set(bigmachineCallIDHeader, callID)
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set(bigmachineDeadlineHeader, strconv.FormatInt(deadline.UnixNano(), 10))
+	}
+	if key := idempotencyKeyFromContext(ctx); key != "" {
+		req.Header.Set(bigmachineIdempotencyKeyHeader, key)
+	}
+	if version := serviceVersionFromContext(ctx); version != "" {
+		req.Header.Set(bigmachineServiceVersionHeader, version)
+	}
+	if credential := outgoingCredential(ctx); credential != "" {
+		req.Header.Set(bigmachineCredentialHeader, credential)
+	}
+	maxReply := c.maxReply
+	if max := maxReplyFromContext(ctx); max > 0 && (maxReply == 0 || max < maxReply) {
+		maxReply = max
+	}
+	if maxReply > 0 {
+		req.Header.Set(bigmachineMaxReplyHeader, strconv.FormatInt(maxReply, 10))
+	}
+	resp, err := ctxhttp.Do(ctx, h.Client(), req)
 	switch err {
 	case nil:
 	case context.DeadlineExceeded, context.Canceled:
+		// Tell the server to cancel the call explicitly: it may not
+		// otherwise notice that we have gone away until the
+		// connection times out.
+		go sendCancel(h.Client(), url, callID)
 		return err
 	default:
 		return errors.E(errors.Net, errors.Temporary, err)
 	}
+	resp.Body = countingReadCloser{countingReader{resp.Body, &traffic.received}, resp.Body}
 	if InjectFailures {
 		resp.Body = &rpcFaultInjector{label: fmt.Sprintf("%s(%s)", serviceMethod, addr), in: resp.Body}
 	}
@@ -224,6 +398,15 @@ func (c *Client) Call(ctx context.Context, addr, serviceMethod string, arg, repl
 		case resp.StatusCode == methodErrorCode:
 			dec := gob.NewDecoder(resp.Body)
 			return decodeError(serviceMethod, dec)
+		case resp.StatusCode == http.StatusRequestEntityTooLarge:
+			body, err := ioutil.ReadAll(resp.Body)
+			return errors.E(errors.Precondition, fmt.Sprintf("%s: %s, %v", url, string(body), err))
+		case resp.StatusCode == http.StatusServiceUnavailable:
+			body, err := ioutil.ReadAll(resp.Body)
+			return errors.E(errors.Unavailable, fmt.Sprintf("%s: %s, %v", url, string(body), err))
+		case resp.StatusCode == http.StatusPreconditionFailed:
+			body, err := ioutil.ReadAll(resp.Body)
+			return errors.E(errors.Precondition, fmt.Sprintf("%s: %s, %v", url, string(body), err))
 		case 400 <= resp.StatusCode && resp.StatusCode < 500:
 			body, err := ioutil.ReadAll(resp.Body)
 			return errors.E(errors.Fatal, errors.Invalid, fmt.Sprintf("%s: client error %s, %v, %v", url, resp.Status, string(body), err))
@@ -233,14 +416,33 @@ func (c *Client) Call(ctx context.Context, addr, serviceMethod string, arg, repl
 		}
 	default:
 		defer resp.Body.Close()
-		sizeReader := &sizeTrackingReader{Reader: resp.Body}
-		dec := gob.NewDecoder(sizeReader)
+		var replyBody io.Reader = resp.Body
+		if resp.StatusCode == 200 && resp.Header.Get(bigmachineCompressionHeader) == gzipCompression {
+			replyBody = &decompressReader{r: resp.Body}
+		}
+		// The limit applies to the decompressed reply, so that small
+		// compressed replies cannot expand without bound.
+		limitReader := &maxSizeReader{Reader: replyBody, max: maxReply}
+		sizeReader := &sizeTrackingReader{Reader: limitReader}
 		switch {
 		case resp.StatusCode == methodErrorCode:
-			return decodeError(serviceMethod, dec)
+			// Errors are always gob-encoded.
+			return decodeError(serviceMethod, gob.NewDecoder(sizeReader))
+		case resp.StatusCode == http.StatusRequestEntityTooLarge:
+			body, err := ioutil.ReadAll(resp.Body)
+			return errors.E(errors.Precondition, fmt.Sprintf("%s: %s, %v", url, string(body), err))
+		case resp.StatusCode == http.StatusServiceUnavailable:
+			body, err := ioutil.ReadAll(resp.Body)
+			return errors.E(errors.Unavailable, fmt.Sprintf("%s: %s, %v", url, string(body), err))
+		case resp.StatusCode == http.StatusPreconditionFailed:
+			body, err := ioutil.ReadAll(resp.Body)
+			return errors.E(errors.Precondition, fmt.Sprintf("%s: %s, %v", url, string(body), err))
 		case resp.StatusCode == 200:
+			dec := codecOf(resp.Header.Get("Content-Type")).newDecoder(sizeReader)
 			err := dec.Decode(reply)
-			if err != nil {
+			if limitReader.Exceeded() {
+				err = errors.E(errors.Precondition, fmt.Sprintf("call %s %s: reply exceeds limit of %d bytes", addr, serviceMethod, maxReply))
+			} else if err != nil {
 				err = errors.E(errors.Invalid, errors.Temporary, "error while decoding reply for "+serviceMethod, err)
 			}
 			replyBytes = sizeReader.Len()
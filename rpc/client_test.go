@@ -8,7 +8,10 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/grailbio/base/errors"
 )
@@ -61,6 +64,180 @@ func TestEncodeError(t *testing.T) {
 	}
 }
 
+// countingTransport counts the round trips it performs. If fail is set,
+// round trips fail without contacting the server.
+type countingTransport struct {
+	http.RoundTripper
+	n    int32
+	fail int32
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&t.n, 1)
+	if atomic.LoadInt32(&t.fail) != 0 {
+		return nil, errors.New("connection refused")
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// TestCircuitBreaker verifies that calls to an address fail fast after
+// repeated failures and that the breaker closes after a successful probe.
+func TestCircuitBreaker(t *testing.T) {
+	srv := NewServer()
+	if err := srv.Register("Test", new(TestService)); err != nil {
+		t.Fatal(err)
+	}
+	httpsrv := httptest.NewServer(srv)
+	defer httpsrv.Close()
+	transport := &countingTransport{RoundTripper: httpsrv.Client().Transport, fail: 1}
+	const cooldown = 100 * time.Millisecond
+	client, err := NewClient(func() *http.Client { return &http.Client{Transport: transport} }, testPrefix, Breaker(2, cooldown))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		err = client.Call(ctx, httpsrv.URL, "Test.Echo", "hello", nil)
+		if err == nil || !errors.Is(errors.Net, err) {
+			t.Fatalf("call %d: bad error %v", i, err)
+		}
+	}
+	if got, want := atomic.LoadInt32(&transport.n), int32(2); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !strings.Contains(err.Error(), "circuit breaker open") {
+		t.Errorf("bad error %v", err)
+	}
+	time.Sleep(cooldown)
+	atomic.StoreInt32(&transport.fail, 0)
+	var reply string
+	if err = client.Call(ctx, httpsrv.URL, "Test.Echo", "hello", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Call(ctx, httpsrv.URL, "Test.Echo", "hello", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := atomic.LoadInt32(&transport.n), int32(4); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// TestBreakerDisabled verifies that circuit breaking is disabled unless
+// it is configured, and that Forget discards an address's breaker.
+func TestBreakerDisabled(t *testing.T) {
+	srv := NewServer()
+	if err := srv.Register("Test", new(TestService)); err != nil {
+		t.Fatal(err)
+	}
+	httpsrv := httptest.NewServer(srv)
+	defer httpsrv.Close()
+	transport := &countingTransport{RoundTripper: httpsrv.Client().Transport, fail: 1}
+	client, err := NewClient(func() *http.Client { return &http.Client{Transport: transport} }, testPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		if err = client.Call(ctx, httpsrv.URL, "Test.Echo", "hello", nil); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+	if got, want := atomic.LoadInt32(&transport.n), int32(10); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	client, err = NewClient(func() *http.Client { return &http.Client{Transport: transport} }, testPrefix, Breaker(1, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = client.Call(ctx, httpsrv.URL, "Test.Echo", "hello", nil); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+	if got, want := atomic.LoadInt32(&transport.n), int32(11); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	client.Forget(httpsrv.URL)
+	client.mu.Lock()
+	n := len(client.breakers)
+	client.mu.Unlock()
+	if got, want := n, 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	atomic.StoreInt32(&transport.fail, 0)
+	if err = client.Call(ctx, httpsrv.URL, "Test.Echo", "hello", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestBreakerCanceled verifies that calls abandoned by their callers do
+// not count against the breaker, even when the cancellation surfaces
+// as a network error.
+func TestBreakerCanceled(t *testing.T) {
+	b := &breaker{threshold: 2, cooldown: time.Hour}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	netErr := errors.E(errors.Net, "net/http: request canceled")
+	for i := 0; i < 3; i++ {
+		if err := b.Allow(); err != nil {
+			t.Fatal(err)
+		}
+		b.Done(canceled, netErr)
+	}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := b.Allow(); err != nil {
+			t.Fatal(err)
+		}
+		b.Done(ctx, netErr)
+	}
+	if err := b.Allow(); err == nil {
+		t.Fatal("expected breaker to be open")
+	}
+	// Admit a probe, and abandon it: the next call becomes the probe.
+	b.openedAt = time.Now().Add(-time.Hour)
+	if err := b.Allow(); err != nil {
+		t.Fatal(err)
+	}
+	b.Done(canceled, netErr)
+	if err := b.Allow(); err != nil {
+		t.Fatal(err)
+	}
+	b.Done(ctx, nil)
+	if err := b.Allow(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestBreakerProbeTimeout verifies that a probe that does not
+// complete within the cooldown does not keep the breaker open.
+func TestBreakerProbeTimeout(t *testing.T) {
+	const cooldown = 50 * time.Millisecond
+	b := &breaker{threshold: 1, cooldown: cooldown}
+	ctx := context.Background()
+	if err := b.Allow(); err != nil {
+		t.Fatal(err)
+	}
+	b.Done(ctx, errors.E(errors.Net, "connection refused"))
+	time.Sleep(cooldown)
+	// Admit a probe that never completes.
+	if err := b.Allow(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Allow(); err == nil {
+		t.Fatal("expected breaker to be half-open")
+	}
+	time.Sleep(cooldown)
+	if err := b.Allow(); err != nil {
+		t.Fatal(err)
+	}
+	b.Done(ctx, nil)
+	if err := b.Allow(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // newTestClient returns the address of a server running the TestService and a
 // client for calling that server.
 func newTestClient(t *testing.T) (string, *Client) {
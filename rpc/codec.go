@@ -0,0 +1,140 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+)
+
+const (
+	jsonContentType = "application/json"
+
+	// BigmachineCompressionHeader names the compression of the encoded
+	// argument of a call; it also asks the server to compress the
+	// encoded reply, and is set on replies that are compressed.
+	bigmachineCompressionHeader = "x-bigmachine-compression"
+	gzipCompression             = "gzip"
+)
+
+// A Codec is an encoding of the arguments and replies of calls.
+// Streamed arguments and replies (io.Reader, io.ReadCloser) are not
+// encoded, and errors are always gob-encoded.
+type Codec int
+
+const (
+	// Gob encodes values with encoding/gob. It is the default codec.
+	Gob Codec = iota
+	// JSON encodes values with encoding/json. It is useful for
+	// values that are also exchanged with other systems; values that
+	// encoding/json cannot round-trip, such as interfaces, are not
+	// supported.
+	JSON
+)
+
+// String returns the name of the codec.
+func (c Codec) String() string {
+	switch c {
+	case Gob:
+		return "gob"
+	case JSON:
+		return "json"
+	default:
+		return "unknown"
+	}
+}
+
+// ContentType returns the content type of values encoded by the
+// codec.
+func (c Codec) contentType() string {
+	if c == JSON {
+		return jsonContentType
+	}
+	return gobContentType
+}
+
+// CodecOf returns the codec of the provided content type.
+func codecOf(contentType string) Codec {
+	if contentType == jsonContentType {
+		return JSON
+	}
+	return Gob
+}
+
+// An encoder encodes values written with a Codec.
+type encoder interface {
+	Encode(v interface{}) error
+}
+
+// A decoder decodes values written with a Codec.
+type decoder interface {
+	Decode(v interface{}) error
+}
+
+func (c Codec) newEncoder(w io.Writer) encoder {
+	if c == JSON {
+		return json.NewEncoder(w)
+	}
+	return gob.NewEncoder(w)
+}
+
+func (c Codec) newDecoder(r io.Reader) decoder {
+	if c == JSON {
+		return json.NewDecoder(r)
+	}
+	return gob.NewDecoder(r)
+}
+
+type codecKey struct{}
+
+// WithCodec returns a context that encodes the arguments and replies
+// of calls made with it with the provided codec.
+func WithCodec(ctx context.Context, codec Codec) context.Context {
+	return context.WithValue(ctx, codecKey{}, codec)
+}
+
+func codecFromContext(ctx context.Context) Codec {
+	codec, _ := ctx.Value(codecKey{}).(Codec)
+	return codec
+}
+
+type compressionKey struct{}
+
+// WithCompression returns a context that gzip-compresses the encoded
+// arguments and replies of calls made with it, trading CPU for
+// bandwidth on large values. Limits on the sizes of arguments and
+// replies (see ClientLimits, ServerLimits) apply to their sizes before
+// compression: values that decompress to more than the limit fail
+// with an error of kind errors.Precondition.
+func WithCompression(ctx context.Context) context.Context {
+	return context.WithValue(ctx, compressionKey{}, true)
+}
+
+func compressionFromContext(ctx context.Context) bool {
+	compress, _ := ctx.Value(compressionKey{}).(bool)
+	return compress
+}
+
+// DecompressReader wraps r to decompress gzip-compressed data.
+type decompressReader struct {
+	r  io.Reader
+	gz *gzip.Reader
+}
+
+// Read implements io.Reader. The gzip header is read lazily, so that
+// errors reading it are returned from Read.
+func (d *decompressReader) Read(p []byte) (int, error) {
+	if d.gz == nil {
+		gz, err := gzip.NewReader(d.r)
+		if err != nil {
+			return 0, err
+		}
+		d.gz = gz
+	}
+	return d.gz.Read(p)
+}
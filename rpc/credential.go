@@ -0,0 +1,58 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import "context"
+
+// BigmachineCredentialHeader is the HTTP header used to transmit a
+// call's credential.
+const bigmachineCredentialHeader = "x-bigmachine-credential"
+
+type credentialKey struct{}
+
+// A credential is the value of a context's credential. Received
+// credentials were transmitted with the call that the context
+// belongs to; they are not transmitted with calls made with the
+// context.
+type credential struct {
+	value    string
+	received bool
+}
+
+// WithCredential returns a context that carries the provided
+// credential, for example a token vended by a driver. Calls made with
+// the returned context transmit the credential to the server, which
+// makes it available to the called method through Credential.
+//
+// The credentials that methods receive are not forwarded with the
+// calls that they make in turn: a method that means to forward its
+// credential must do so explicitly, with
+// WithCredential(ctx, Credential(ctx)).
+func WithCredential(ctx context.Context, value string) context.Context {
+	return context.WithValue(ctx, credentialKey{}, credential{value: value})
+}
+
+// Credential returns the credential transmitted with the call whose
+// context is provided (see WithCredential), or "" if there is none.
+func Credential(ctx context.Context) string {
+	c, _ := ctx.Value(credentialKey{}).(credential)
+	return c.value
+}
+
+// WithReceivedCredential returns a context that carries the
+// credential transmitted with a call received by a server.
+func withReceivedCredential(ctx context.Context, value string) context.Context {
+	return context.WithValue(ctx, credentialKey{}, credential{value: value, received: true})
+}
+
+// OutgoingCredential returns the credential to transmit with calls
+// made with the provided context, or "" if there is none.
+func outgoingCredential(ctx context.Context) string {
+	c, _ := ctx.Value(credentialKey{}).(credential)
+	if c.received {
+		return ""
+	}
+	return c.value
+}
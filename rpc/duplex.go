@@ -0,0 +1,79 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"io"
+)
+
+// A Duplex is a full-duplex byte stream to a remote method: data
+// written to the Duplex are streamed to the method's io.Reader
+// argument, while the method's io.ReadCloser reply is read from the
+// Duplex. Duplex streams allow for interactive sessions, such as
+// remote shells or debugging channels.
+//
+// Methods that serve duplex streams have the form
+//
+//	Func(ctx context.Context, arg io.Reader, reply *io.ReadCloser) error
+//
+// and must wrap their reply with Flush, so that the reply is
+// delivered to the caller as soon as it is written. The method's
+// context remains valid for the lifetime of the stream.
+//
+// Duplex streams require that the client and server communicate over
+// HTTP/2: HTTP/1.x servers do not permit reading a request while its
+// reply is being written.
+type Duplex struct {
+	w *io.PipeWriter
+	r io.ReadCloser
+}
+
+// OpenDuplex opens a duplex stream by invoking call with the stream's
+// argument and reply. Call should invoke a method of the form
+// described in the Duplex docs; it should return once the reply is
+// available.
+func OpenDuplex(call func(arg io.Reader, reply *io.ReadCloser) error) (*Duplex, error) {
+	pr, pw := io.Pipe()
+	var rc io.ReadCloser
+	if err := call(pr, &rc); err != nil {
+		pw.CloseWithError(err)
+		return nil, err
+	}
+	return &Duplex{pw, rc}, nil
+}
+
+// Duplex opens a duplex stream to the method named by serviceMethod
+// on the server at the provided address. The stream is aborted if
+// the provided context is canceled.
+func (c *Client) Duplex(ctx context.Context, addr, serviceMethod string) (*Duplex, error) {
+	return OpenDuplex(func(arg io.Reader, reply *io.ReadCloser) error {
+		return c.Call(ctx, addr, serviceMethod, arg, reply)
+	})
+}
+
+// Read reads from the method's reply stream.
+func (d *Duplex) Read(p []byte) (n int, err error) {
+	return d.r.Read(p)
+}
+
+// Write writes to the method's argument stream. Write blocks until
+// the data are consumed by the transport.
+func (d *Duplex) Write(p []byte) (n int, err error) {
+	return d.w.Write(p)
+}
+
+// CloseWrite closes the method's argument stream: the method reads
+// io.EOF once it has consumed all of the data written. The reply
+// stream may still be read after CloseWrite.
+func (d *Duplex) CloseWrite() error {
+	return d.w.Close()
+}
+
+// Close closes both directions of the stream.
+func (d *Duplex) Close() error {
+	d.w.Close()
+	return d.r.Close()
+}
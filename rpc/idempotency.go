@@ -0,0 +1,151 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// BigmachineIdempotencyKeyHeader is the HTTP header used to transmit
+// a call's idempotency key.
+const bigmachineIdempotencyKeyHeader = "x-bigmachine-idempotency-key"
+
+// DefaultIdempotencyWindow is the default amount of time for which
+// servers retain the outcomes of calls with idempotency keys.
+const defaultIdempotencyWindow = 10 * time.Minute
+
+type idempotencyKey struct{}
+
+// WithIdempotencyKey returns a context that carries the provided
+// idempotency key. Calls made with the returned context transmit the
+// key to the server, which invokes the called method at most once
+// per key: repeated calls with the same key (for example, retries
+// after a network failure) wait for the first invocation to
+// complete, and then return its outcome instead of invoking the
+// method again. Keys should be unique (see NewIdempotencyKey); they
+// are scoped to the called method.
+//
+// Servers retain outcomes for a limited time (see
+// IdempotencyWindow). Outcomes of methods whose replies are
+// streamed (io.ReadCloser) cannot be replayed: repeated calls to
+// such methods fail with an error of kind errors.Precondition.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey{}, key)
+}
+
+// NewIdempotencyKey returns a new, random idempotency key.
+func NewIdempotencyKey() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+func idempotencyKeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKey{}).(string)
+	return key
+}
+
+// IdempotencyWindow sets the amount of time for which the server
+// retains the outcomes of calls with idempotency keys (see
+// WithIdempotencyKey), measured from their completion. The default
+// is 10 minutes.
+func IdempotencyWindow(window time.Duration) ServerOption {
+	return func(s *Server) {
+		s.idempotent.window = window
+	}
+}
+
+// An idempotentCall is the (possibly pending) outcome of a call
+// with an idempotency key.
+type idempotentCall struct {
+	key   string
+	done  chan struct{}
+	reply interface{}
+	err   error
+	// Abandoned is set if the call failed because its context was
+	// done; its outcome is then not recorded.
+	abandoned bool
+
+	expires time.Time
+}
+
+// IdempotentCalls records the outcomes of calls with idempotency
+// keys.
+type idempotentCalls struct {
+	window time.Duration
+
+	mu    sync.Mutex
+	calls map[string]*idempotentCall
+	// Completed contains the completed calls, in order of completion
+	// (and thus expiry).
+	completed []*idempotentCall
+}
+
+// Do invokes fn at most once for the provided key. If fn has already
+// been invoked for key, do waits for it to complete and returns its
+// outcome, with replayed set to true. Invocations that fail because
+// their context is done (for example, because the caller canceled
+// the call, or its deadline expired) are not recorded, so that the
+// call may be retried; calls waiting for such invocations invoke fn
+// themselves.
+func (c *idempotentCalls) do(ctx context.Context, key string, fn func() (interface{}, error)) (reply interface{}, err error, replayed bool) {
+	c.mu.Lock()
+	for {
+		c.expire(time.Now())
+		if c.calls == nil {
+			c.calls = make(map[string]*idempotentCall)
+		}
+		call := c.calls[key]
+		if call == nil {
+			break
+		}
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+			if !call.abandoned {
+				return call.reply, call.err, true
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err(), false
+		}
+		c.mu.Lock()
+	}
+	call := &idempotentCall{key: key, done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		if call.abandoned {
+			delete(c.calls, key)
+		} else {
+			call.expires = time.Now().Add(c.window)
+			c.completed = append(c.completed, call)
+		}
+		c.mu.Unlock()
+		close(call.done)
+	}()
+	call.reply, call.err = fn()
+	call.abandoned = call.err != nil && ctx.Err() != nil
+	return call.reply, call.err, false
+}
+
+// Expire removes the calls that have expired by the provided time.
+// It must be called with c.mu held.
+func (c *idempotentCalls) expire(now time.Time) {
+	var n int
+	for n < len(c.completed) && !now.Before(c.completed[n].expires) {
+		delete(c.calls, c.completed[n].key)
+		c.completed[n] = nil
+		n++
+	}
+	c.completed = c.completed[n:]
+}
@@ -0,0 +1,138 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/grailbio/base/errors"
+)
+
+type maxReplyKey struct{}
+
+// WithMaxReply returns a context that limits the size of gob-encoded
+// replies to calls made with it to max bytes. Calls whose replies
+// would exceed the limit fail with an error of kind
+// errors.Precondition. WithMaxReply can only lower the limit set by
+// the client (see ClientLimits).
+func WithMaxReply(ctx context.Context, max int64) context.Context {
+	return context.WithValue(ctx, maxReplyKey{}, max)
+}
+
+func maxReplyFromContext(ctx context.Context) int64 {
+	max, _ := ctx.Value(maxReplyKey{}).(int64)
+	return max
+}
+
+// MaxSizeReader is a reader that fails once more than max bytes
+// have been read from the underlying reader. A max of 0 means no
+// limit.
+type maxSizeReader struct {
+	io.Reader
+	max      int64
+	n        int64
+	exceeded bool
+}
+
+// Read implements io.Reader.
+func (r *maxSizeReader) Read(p []byte) (n int, err error) {
+	if r.max <= 0 {
+		return r.Reader.Read(p)
+	}
+	if r.exceeded {
+		return 0, errors.E(errors.Precondition, fmt.Sprintf("exceeded limit of %d bytes", r.max))
+	}
+	// Read one byte past the limit so that we can tell whether it was
+	// exceeded.
+	if left := r.max - r.n + 1; int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err = r.Reader.Read(p)
+	r.n += int64(n)
+	if r.n > r.max {
+		r.exceeded = true
+		n -= int(r.n - r.max)
+		r.n = r.max
+		err = errors.E(errors.Precondition, fmt.Sprintf("exceeded limit of %d bytes", r.max))
+	}
+	return
+}
+
+// Exceeded tells whether the reader's limit was exceeded.
+func (r *maxSizeReader) Exceeded() bool { return r.exceeded }
+
+// MaxSizeWriter is a writer that refuses writes that would make more
+// than max bytes be written to the underlying writer. A max of 0
+// means no limit.
+type maxSizeWriter struct {
+	io.Writer
+	max int64
+	n   int64
+}
+
+// Write implements io.Writer.
+func (w *maxSizeWriter) Write(p []byte) (int, error) {
+	if w.max > 0 && w.n+int64(len(p)) > w.max {
+		return 0, errors.E(errors.Precondition, fmt.Sprintf("reply of at least %d bytes exceeds limit of %d bytes", w.n+int64(len(p)), w.max))
+	}
+	n, err := w.Writer.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// ReplyWriter buffers a reply until it exceeds a threshold size,
+// after which it is streamed directly to the underlying writer.
+// ReplyWriter refuses writes that would make the reply exceed max
+// bytes (if max > 0). Since gob encoders write each value in a
+// single write, oversized values are generally rejected before any
+// part of them is written to the underlying writer.
+type replyWriter struct {
+	w         io.Writer
+	threshold int64
+	max       int64
+
+	buf       bytes.Buffer
+	n         int64
+	streaming bool
+}
+
+// Write implements io.Writer.
+func (r *replyWriter) Write(p []byte) (n int, err error) {
+	if r.max > 0 && r.n+int64(len(p)) > r.max {
+		return 0, errors.E(errors.Precondition, fmt.Sprintf("reply of at least %d bytes exceeds limit of %d bytes", r.n+int64(len(p)), r.max))
+	}
+	r.n += int64(len(p))
+	if !r.streaming {
+		if int64(r.buf.Len()+len(p)) <= r.threshold {
+			return r.buf.Write(p)
+		}
+		r.streaming = true
+		if err = r.Flush(); err != nil {
+			return 0, err
+		}
+		r.buf = bytes.Buffer{}
+	}
+	return r.w.Write(p)
+}
+
+// Flush writes any buffered data to the underlying writer.
+func (r *replyWriter) Flush() error {
+	if r.buf.Len() == 0 {
+		return nil
+	}
+	_, err := r.w.Write(r.buf.Bytes())
+	r.buf.Reset()
+	return err
+}
+
+// Len returns the number of bytes written to the reply.
+func (r *replyWriter) Len() int64 { return r.n }
+
+// Streaming tells whether any part of the reply has been written to
+// the underlying writer.
+func (r *replyWriter) Streaming() bool { return r.streaming }
@@ -0,0 +1,208 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+)
+
+// A MemoryNetwork is an in-memory network of HTTP handlers. Unlike
+// PipeNetwork, it does not use connections or the HTTP protocol at
+// all: MemoryNetwork is an http.RoundTripper that dispatches each
+// request directly to the handler of the host that it addresses,
+// streaming request and reply bodies through in-memory pipes. It is
+// intended for tests that run many servers in a single process.
+//
+// Clients use the network by setting their http.Client's Transport
+// to the network.
+type MemoryNetwork struct {
+	mu       sync.Mutex
+	next     int
+	handlers map[string]http.Handler
+}
+
+// NewMemoryNetwork returns a new, empty memory network.
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{handlers: make(map[string]http.Handler)}
+}
+
+// Handle adds the provided handler to the network and returns a
+// unique host name that addresses it, which may be used in URLs.
+func (n *MemoryNetwork) Handle(handler http.Handler) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	host := fmt.Sprintf("memory-%d", n.next)
+	n.next++
+	n.handlers[host] = handler
+	return host
+}
+
+// Remove removes the handler with the provided host name from the
+// network. Subsequent requests to the host fail; requests in flight
+// are unaffected.
+func (n *MemoryNetwork) Remove(host string) {
+	n.mu.Lock()
+	delete(n.handlers, host)
+	n.mu.Unlock()
+}
+
+// RoundTrip implements http.RoundTripper. It returns once the
+// handler has written the reply's header; the reply's body is
+// streamed as the handler writes it. The handler's request context
+// is canceled when the request's context is done, when the reply's
+// body is closed, or when the handler returns.
+func (n *MemoryNetwork) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	n.mu.Lock()
+	handler := n.handlers[host]
+	n.mu.Unlock()
+	if handler == nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, &net.OpError{Op: "dial", Net: "memory", Err: errors.New("connection refused")}
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	sreq := req.WithContext(ctx)
+	sreq.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		sreq.Header[k] = append([]string(nil), v...)
+	}
+	sreq.RequestURI = req.URL.RequestURI()
+	sreq.RemoteAddr = "memory"
+	if sreq.Body == nil {
+		sreq.Body = http.NoBody
+	}
+	pr, pw := io.Pipe()
+	w := &memoryResponseWriter{
+		header: make(http.Header),
+		resp: &http.Response{
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			ContentLength: -1,
+			Body:          &memoryBody{pr, cancel},
+			Request:       req,
+		},
+		body:  pw,
+		ready: make(chan struct{}),
+	}
+	done := make(chan struct{})
+	go func() {
+		defer cancel()
+		defer close(done)
+		var err error
+		defer func() {
+			if e := recover(); e != nil {
+				err = fmt.Errorf("panic in handler: %v", e)
+			}
+			w.finish(err)
+		}()
+		handler.ServeHTTP(w, sreq)
+	}()
+	go func() {
+		select {
+		case <-req.Context().Done():
+			pr.CloseWithError(req.Context().Err())
+		case <-done:
+		}
+	}()
+	select {
+	case <-w.ready:
+		return w.resp, nil
+	case <-req.Context().Done():
+		cancel()
+		return nil, req.Context().Err()
+	}
+}
+
+// A memoryResponseWriter is the http.ResponseWriter used to serve
+// requests in a MemoryNetwork. It writes reply bodies to a pipe whose
+// other end is the body of the reply returned to the client.
+type memoryResponseWriter struct {
+	header http.Header
+	resp   *http.Response
+	body   *io.PipeWriter
+
+	once  sync.Once
+	ready chan struct{}
+}
+
+// Header implements http.ResponseWriter.
+func (w *memoryResponseWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader implements http.ResponseWriter. The reply's header is
+// a snapshot of the writer's header at the time of the call; declared
+// trailers are set once the handler returns.
+func (w *memoryResponseWriter) WriteHeader(code int) {
+	w.once.Do(func() {
+		w.resp.StatusCode = code
+		w.resp.Status = fmt.Sprintf("%d %s", code, http.StatusText(code))
+		w.resp.Header = make(http.Header, len(w.header))
+		for k, v := range w.header {
+			w.resp.Header[k] = append([]string(nil), v...)
+		}
+		for _, v := range w.header["Trailer"] {
+			for _, k := range strings.Split(v, ",") {
+				if k = strings.TrimSpace(k); k != "" {
+					if w.resp.Trailer == nil {
+						w.resp.Trailer = make(http.Header)
+					}
+					w.resp.Trailer[http.CanonicalHeaderKey(k)] = nil
+				}
+			}
+		}
+		close(w.ready)
+	})
+}
+
+// Write implements http.ResponseWriter.
+func (w *memoryResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+// Flush implements http.Flusher. Since writes are unbuffered, Flush
+// only needs to make sure that the header has been written.
+func (w *memoryResponseWriter) Flush() {
+	w.WriteHeader(http.StatusOK)
+}
+
+// Finish completes the reply once the handler has returned: it sets
+// the reply's trailers and closes its body with the provided error.
+func (w *memoryResponseWriter) finish(err error) {
+	w.WriteHeader(http.StatusOK)
+	for k := range w.resp.Trailer {
+		w.resp.Trailer[k] = w.header[k]
+	}
+	w.body.CloseWithError(err)
+}
+
+// A memoryBody is the body of a reply in a MemoryNetwork. Closing the
+// body cancels the handler's request context, as a client would by
+// resetting its stream.
+type memoryBody struct {
+	*io.PipeReader
+	cancel func()
+}
+
+// Close implements io.Closer.
+func (b *memoryBody) Close() error {
+	b.cancel()
+	return b.PipeReader.Close()
+}
@@ -11,10 +11,8 @@
 // exceptions:
 //	- if argType is io.Reader, a direct byte stream is provided
 //	- if replyType is io.ReadCloser, a direct byte stream is provided
-// In the future, the package will also support custom codecs, so
-// that, for example, if the argument or reply is generated by a
-// protocol buffer, then protocol buffer encoding is used
-// automatically.
+// Callers may choose another codec (see WithCodec) and compress
+// encoded values (see WithCompression) on a per-call basis.
 //
 // Every value is registered with a name. This name is used by the
 // client to specify the object on which to dispatch methods.
@@ -36,7 +34,46 @@
 //
 // On successful invocation, HTTP code 200 is returned. When a method
 // invocation returns an error, HTTP code 590 is returned. In this
-// case, the error message is gob-encoded as the reply body.
+// case, the error message is gob-encoded as the reply body. Servers
+// that are shutting down (see Server.Shutdown) refuse calls with HTTP
+// code 503.
+//
+// Servers and clients may limit the size of gob-encoded arguments
+// and replies (see ServerLimits and ClientLimits); calls that exceed
+// a limit fail with an error of kind errors.Precondition. A client's
+// reply limit is transmitted in the x-bigmachine-max-reply header so
+// that the server refuses to produce oversized replies in the first
+// place. Byte streams (io.Reader arguments and io.ReadCloser
+// replies) are not subject to these limits. Large replies are
+// written directly to the connection instead of being buffered in
+// full by the server.
+//
+// Methods with an io.Reader argument and an io.ReadCloser reply that
+// is wrapped by Flush may serve full-duplex streams over HTTP/2; see
+// Duplex.
+//
+// Services may declare versions (see Versioned). Callers transmit
+// the version that they expect in the x-bigmachine-service-version
+// header; calls that expect a different version are refused with
+// HTTP code 412, which clients report as errors of kind
+// errors.Precondition.
+//
+// Calls may carry idempotency keys (see WithIdempotencyKey), which
+// are transmitted in the x-bigmachine-idempotency-key header. The
+// server invokes a method at most once per key, and replays the
+// outcome of the first invocation to repeated calls.
+//
+// If the caller's context has a deadline, the client propagates it in
+// the x-bigmachine-deadline header, and the server derives the
+// method's context from it, so that methods do not continue to run
+// on behalf of callers that have already given up.
+//
+// Each call also carries a unique ID in the x-bigmachine-call-id
+// header. When a caller's context is canceled before the call
+// completes, the client sends a request with the call's ID in the
+// x-bigmachine-cancel header, and the server cancels the method's
+// context. Thus methods are canceled promptly even when the caller's
+// connection is not observably severed.
 //
 // At the moment, a new gob encoder is created for each call. This is
 // inefficient for small requests and replies. Future work includes
@@ -44,7 +81,7 @@
 package rpc
 
 import (
-	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/gob"
 	"fmt"
@@ -53,8 +90,10 @@ import (
 	"path"
 	"reflect"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/grailbio/base/backgroundcontext"
 	"github.com/grailbio/base/errors"
@@ -70,6 +109,26 @@ const methodErrorCode = 590
 // indicate streaming errors.
 const bigmachineErrorTrailer = "x-bigmachine-error"
 
+// BigmachineDeadlineHeader is the HTTP header used to propagate the
+// caller's deadline, in nanoseconds since the Unix epoch.
+const bigmachineDeadlineHeader = "x-bigmachine-deadline"
+
+// BigmachineMaxReplyHeader is the HTTP header used to transmit the
+// client's maximum reply size, in bytes.
+const bigmachineMaxReplyHeader = "x-bigmachine-max-reply"
+
+// ReplyStreamThreshold is the size above which encoded replies are
+// written to the client as they are encoded, instead of being
+// buffered in full. Streamed replies are not otherwise framed: if
+// encoding fails once streaming has begun, the client fails to decode
+// the reply.
+const replyStreamThreshold = 4 << 20
+
+// DeadlineSkew is the amount of clock skew tolerated between clients
+// and servers when enforcing propagated deadlines: the method's
+// context is canceled this long after the caller's deadline.
+const deadlineSkew = time.Second
+
 var (
 	typeOfContext    = reflect.TypeOf((*context.Context)(nil)).Elem()
 	typeOfReader     = reflect.TypeOf((*io.Reader)(nil)).Elem()
@@ -88,6 +147,7 @@ type service struct {
 	name    string
 	recv    reflect.Value
 	typ     reflect.Type
+	version string
 	methods map[string]*method
 }
 
@@ -140,15 +200,64 @@ func (s *service) Init() error {
 // Its dispatch rules are described in the package docs. Server
 // implements http.Handler and can be served by any HTTP server.
 type Server struct {
+	// MaxRequest and maxReply are the maximum sizes of gob-encoded
+	// requests and replies; they are unlimited if 0.
+	maxRequest, maxReply int64
+	// StreamThreshold is the reply size above which replies are
+	// streamed instead of buffered.
+	streamThreshold int64
+	// Idempotent records the outcomes of calls with idempotency keys.
+	idempotent idempotentCalls
+	// Active contains the calls in flight that may be canceled by
+	// their callers.
+	active activeCalls
+
 	mu       sync.RWMutex
 	services map[string]*service
+	// Suspended contains the reasons for which suspended services are
+	// suspended, keyed by service name (see Suspend).
+	suspended map[string]string
+	// PanicHandler is called when a method panics (see HandlePanics).
+	panicHandler func(service, method string, e interface{})
+	// Undrained contains the methods, named "Service.Method", whose
+	// calls Shutdown does not wait for (see Undrained).
+	undrained map[string]bool
+
+	// Calls is the number of calls in flight. Once the server is
+	// shutting down, idle is closed when calls reaches 0.
+	callsMu  sync.Mutex
+	calls    int
+	shutdown bool
+	idle     chan struct{}
+}
+
+// A ServerOption is an option that can be provided when creating a
+// new Server.
+type ServerOption func(s *Server)
+
+// ServerLimits limits the sizes of gob-encoded requests and replies
+// handled by the server. Requests larger than maxRequest bytes are
+// rejected without invoking the method; replies larger than maxReply
+// bytes are replaced by an error. Both errors are of kind
+// errors.Precondition. A limit of 0 means no limit.
+func ServerLimits(maxRequest, maxReply int64) ServerOption {
+	return func(s *Server) {
+		s.maxRequest = maxRequest
+		s.maxReply = maxReply
+	}
 }
 
 // NewServer returns a new, initialized, Server.
-func NewServer() *Server {
-	return &Server{
-		services: make(map[string]*service),
+func NewServer(opts ...ServerOption) *Server {
+	s := &Server{
+		streamThreshold: replyStreamThreshold,
+		idempotent:      idempotentCalls{window: defaultIdempotencyWindow},
+		services:        make(map[string]*service),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
 
 // Register registers the provided interface under the given name.
@@ -167,9 +276,10 @@ func (s *Server) Register(serviceName string, iface interface{}) error {
 		return nil
 	}
 	svc := &service{
-		recv: reflect.ValueOf(iface),
-		typ:  reflect.TypeOf(iface),
-		name: serviceName,
+		recv:    reflect.ValueOf(iface),
+		typ:     reflect.TypeOf(iface),
+		name:    serviceName,
+		version: VersionOf(iface),
 	}
 	if err := svc.Init(); err != nil {
 		return err
@@ -178,6 +288,50 @@ func (s *Server) Register(serviceName string, iface interface{}) error {
 	return nil
 }
 
+// Suspend suspends the named service: until it is resumed by Resume,
+// calls to the service fail with an error of kind errors.Unavailable
+// that describes the provided reason, without invoking its methods.
+// Calls in flight are not affected.
+func (s *Server) Suspend(serviceName, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.suspended == nil {
+		s.suspended = make(map[string]string)
+	}
+	s.suspended[serviceName] = reason
+}
+
+// Resume resumes the named service, which was suspended by Suspend.
+func (s *Server) Resume(serviceName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.suspended, serviceName)
+}
+
+// HandlePanics sets the function that is called, with the service and
+// method names, and the recovered value, when a method panics. Panics
+// are recovered by the server, and fail their calls, regardless.
+func (s *Server) HandlePanics(handler func(service, method string, e interface{})) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.panicHandler = handler
+}
+
+// Undrained marks the provided methods, named "Service.Method", as
+// long-lived: Shutdown refuses new calls to them, but does not wait
+// for calls in flight to complete. It is useful for methods whose
+// replies stream until they are canceled, such as log tails.
+func (s *Server) Undrained(serviceMethods ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.undrained == nil {
+		s.undrained = make(map[string]bool)
+	}
+	for _, serviceMethod := range serviceMethods {
+		s.undrained[serviceMethod] = true
+	}
+}
+
 // ServeHTTP interprets an HTTP request and, if it represents a valid
 // rpc call, dispatches it onto the appropriate registered method.
 //
@@ -187,7 +341,43 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "method not allowed", 405)
 		return
 	}
-	ctx := backgroundcontext.Wrap(r.Context())
+	if id := r.Header.Get(bigmachineCancelHeader); id != "" {
+		if !s.active.cancel(id) {
+			log.Debug.Printf("rpc: cancel %s: no such call", id)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	ctx, cancel := context.WithCancel(backgroundcontext.Wrap(r.Context()))
+	defer cancel()
+	if id := r.Header.Get(bigmachineCallIDHeader); id != "" {
+		s.active.add(id, cancel)
+		defer s.active.remove(id)
+	}
+	if v := r.Header.Get(bigmachineDeadlineHeader); v != "" {
+		nanos, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad deadline %q: %v", v, err), 400)
+			return
+		}
+		var cancelDeadline func()
+		ctx, cancelDeadline = context.WithDeadline(ctx, time.Unix(0, nanos).Add(deadlineSkew))
+		defer cancelDeadline()
+	}
+	if credential := r.Header.Get(bigmachineCredentialHeader); credential != "" {
+		ctx = withReceivedCredential(ctx, credential)
+	}
+	maxReply := s.maxReply
+	if v := r.Header.Get(bigmachineMaxReplyHeader); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad maximum reply size %q: %v", v, err), 400)
+			return
+		}
+		if maxReply == 0 || n < maxReply {
+			maxReply = n
+		}
+	}
 	parts := strings.SplitN(path.Base(r.URL.Path), ".", 2)
 	if len(parts) != 2 {
 		http.Error(w, "bad url", 400)
@@ -196,11 +386,28 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	service, method := parts[0], parts[1]
 	s.mu.RLock()
 	svc := s.services[service]
+	reason, suspended := s.suspended[service]
+	drain := !s.undrained[service+"."+method]
 	s.mu.RUnlock()
+	if !s.begin(drain) {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if drain {
+		defer s.end()
+	}
 	if svc == nil {
 		http.Error(w, "no such service", 404)
 		return
 	}
+	if suspended {
+		http.Error(w, fmt.Sprintf("service %s is suspended: %s", service, reason), http.StatusServiceUnavailable)
+		return
+	}
+	if want := r.Header.Get(bigmachineServiceVersionHeader); want != "" && svc.version != "" && want != svc.version {
+		http.Error(w, fmt.Sprintf("service %s has version %s; caller expects version %s", service, svc.version, want), http.StatusPreconditionFailed)
+		return
+	}
 	m := svc.methods[method]
 	if m == nil {
 		http.Error(w, "no such method", 404)
@@ -227,10 +434,29 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		} else {
 			argv = reflect.New(m.arg)
 		}
-		sizeReader := &sizeTrackingReader{Reader: r.Body}
-		dec := gob.NewDecoder(sizeReader)
+		compressed := r.Header.Get(bigmachineCompressionHeader) == gzipCompression
+		if s.maxRequest > 0 && !compressed && r.ContentLength > s.maxRequest {
+			err = errors.E(errors.Precondition, fmt.Sprintf("request of %d bytes exceeds limit of %d bytes", r.ContentLength, s.maxRequest))
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		var body io.Reader = r.Body
+		if compressed {
+			body = &decompressReader{r: r.Body}
+		}
+		// The limit applies to the decompressed request, so that small
+		// compressed requests cannot expand without bound.
+		limitReader := &maxSizeReader{Reader: body, max: s.maxRequest}
+		sizeReader := &sizeTrackingReader{Reader: limitReader}
+		dec := codecOf(r.Header.Get("Content-Type")).newDecoder(sizeReader)
+		err = dec.Decode(argv.Interface())
 		requestBytes = sizeReader.Len()
-		if err = dec.Decode(argv.Interface()); err != nil {
+		if limitReader.Exceeded() {
+			err = errors.E(errors.Precondition, fmt.Sprintf("request exceeds limit of %d bytes", s.maxRequest))
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
 			http.Error(w, fmt.Sprintf("error decoding request: %v", err), 400)
 			return
 		}
@@ -253,11 +479,17 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			replyv.Elem().Set(reflect.MakeSlice(m.reply.Elem(), 0, 0))
 		}
 	}
-	err = func() (err error) {
+	invoke := func() (err error) {
 		defer func() {
 			if e := recover(); e != nil {
 				log.Error.Printf("panic in method call %s.%s\n%s", service, method, string(debug.Stack()))
 				err = errors.E(errors.Fatal, fmt.Errorf("panic: %v", e))
+				s.mu.RLock()
+				handler := s.panicHandler
+				s.mu.RUnlock()
+				if handler != nil {
+					handler(service, method, e)
+				}
 			}
 		}()
 		rvs := m.method.Func.Call([]reflect.Value{svc.recv, reflect.ValueOf(ctx), argv, replyv})
@@ -265,9 +497,28 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			err = e.(error)
 		}
 		return
-	}()
-	code := 200
+	}
 	replyIface := replyv.Interface()
+	if key := r.Header.Get(bigmachineIdempotencyKeyHeader); key == "" {
+		err = invoke()
+	} else {
+		var (
+			reply    interface{}
+			replayed bool
+		)
+		reply, err, replayed = s.idempotent.do(ctx, service+"."+method+"/"+key, func() (interface{}, error) {
+			return replyIface, invoke()
+		})
+		switch {
+		case !replayed:
+		case m.reply.Elem() == typeOfReadCloser && err == nil:
+			err = errors.E(errors.Precondition, fmt.Sprintf("%s.%s: call with idempotency key %s has already been made; its streamed reply cannot be replayed", service, method, key))
+		default:
+			log.Debug.Printf("%s.%s: replaying reply for idempotency key %s", service, method, key)
+			replyIface = reply
+		}
+	}
+	code := 200
 	if err != nil {
 		code = methodErrorCode
 		replyIface = errors.Recover(err)
@@ -282,6 +533,10 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		var wr io.Writer = w
 		if _, needFlush := readcloser.(*flushOpt); needFlush {
 			if wf, ok := wr.(writeFlusher); ok {
+				// Flush the header so that the client receives the reply
+				// before the method writes to it; this is required for
+				// full-duplex streams (see Duplex).
+				wf.Flush()
 				wr = &flusher{wf}
 			} else {
 				log.Printf("%s.%s: asked to flush, but HTTP connection does not support flushing", service, method)
@@ -291,25 +546,63 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if _, err = io.Copy(wr, readcloser); err != nil {
 			log.Error.Printf("rpc: error writing reply: %v", err)
 			errStr = err.Error()
+			// The caller has likely gone away; cancel the method's
+			// context so that producers of the stream do not block.
+			cancel()
 		}
 		// This is required because of a bug in net/http2 that causes the
 		// connection to hang when pre-declared trailers are not set.
 		w.Header().Set(bigmachineErrorTrailer, errStr)
 		return
 	}
-	w.Header().Set("Content-Type", gobContentType)
+	codec := codecOf(r.Header.Get("Accept"))
+	compress := r.Header.Get(bigmachineCompressionHeader) == gzipCompression
+	if code != 200 {
+		// Errors are always gob-encoded, and are not compressed.
+		codec, compress = Gob, false
+	}
+	w.Header().Set("Content-Type", codec.contentType())
+	if compress {
+		w.Header().Set(bigmachineCompressionHeader, gzipCompression)
+	}
 	if code != 200 {
 		// Only write error codes here so that, if the call is a success
 		// but encoding fails, we have a chance to propagate the error
 		// properly.
 		w.WriteHeader(code)
 	}
-	b := new(bytes.Buffer)
-	enc := gob.NewEncoder(b)
+	rw := &replyWriter{w: w, threshold: s.streamThreshold, max: maxReply}
+	var (
+		ew io.Writer = rw
+		gz *gzip.Writer
+	)
+	if compress {
+		// The limit applies to the reply before it is compressed, as it
+		// does on the client.
+		rw.max = 0
+		gz = gzip.NewWriter(rw)
+		ew = &maxSizeWriter{Writer: gz, max: maxReply}
+	}
+	enc := codec.newEncoder(ew)
 	err = enc.Encode(replyIface)
-	replyBytes = b.Len()
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
 	if err == nil {
-		_, err = w.Write(b.Bytes())
+		err = rw.Flush()
+	}
+	replyBytes = int(rw.Len())
+	if err != nil && code == 200 && !rw.Streaming() && errors.Is(errors.Precondition, err) {
+		// Nothing has been written yet, so we can still replace the
+		// reply with the error.
+		log.Error.Printf("rpc: %s.%s: %v", service, method, err)
+		w.Header().Set("Content-Type", gobContentType)
+		w.Header().Del(bigmachineCompressionHeader)
+		w.WriteHeader(methodErrorCode)
+		if err := gob.NewEncoder(w).Encode(errors.Recover(err)); err != nil {
+			log.Error.Printf("rpc: error writing reply: %v", err)
+		}
+		return
 	}
 	if err != nil {
 		log.Error.Printf("rpc: error writing reply: %v", err)
@@ -319,6 +612,60 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Shutdown gracefully shuts down the server: calls received after
+// Shutdown is called are refused with HTTP code 503, which clients
+// report as errors of kind errors.Unavailable; Shutdown then waits
+// for calls in flight to complete, including the streaming of their
+// replies, except for calls to methods marked by Undrained. If the provided context is done before then, Shutdown
+// returns the context's error.
+//
+// Shutdown does not close the HTTP server through which the server
+// is served, or its connections: once Shutdown returns, the process
+// may exit without severing calls mid-reply.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.callsMu.Lock()
+	if !s.shutdown {
+		s.shutdown = true
+		s.idle = make(chan struct{})
+		if s.calls == 0 {
+			close(s.idle)
+		}
+	}
+	idle := s.idle
+	s.callsMu.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Begin admits a new call to the server, registering it to be
+// drained by Shutdown if drain is true. It returns false if the
+// server is shutting down.
+func (s *Server) begin(drain bool) bool {
+	s.callsMu.Lock()
+	defer s.callsMu.Unlock()
+	if s.shutdown {
+		return false
+	}
+	if drain {
+		s.calls++
+	}
+	return true
+}
+
+// End unregisters a call that was registered by begin.
+func (s *Server) end() {
+	s.callsMu.Lock()
+	defer s.callsMu.Unlock()
+	s.calls--
+	if s.shutdown && s.calls == 0 {
+		close(s.idle)
+	}
+}
+
 // Flush wraps the provided ReadCloser to instruct the rpc server to
 // flush after every write. This is useful when the reply stream
 // should be interactive -- no guarantees are otherwise provided
@@ -5,20 +5,28 @@
 package rpc
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto"
 	"crypto/rand"
+	"encoding/gob"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/grailbio/base/digest"
 	"github.com/grailbio/base/errors"
+	"golang.org/x/net/http2"
 )
 
 const testPrefix = "/"
@@ -40,6 +48,28 @@ func (s *TestService) ErrorError(ctx context.Context, err *errors.Error, reply *
 	return err
 }
 
+func (s *TestService) Deadline(ctx context.Context, _ struct{}, reply *time.Time) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return errors.E(errors.Invalid, "no deadline")
+	}
+	*reply = deadline
+	return nil
+}
+
+func (s *TestService) Sleep(ctx context.Context, d time.Duration, _ *struct{}) error {
+	time.Sleep(d)
+	return nil
+}
+
+func (s *TestService) Bytes(ctx context.Context, n int, reply *[]byte) error {
+	*reply = make([]byte, n)
+	for i := range *reply {
+		(*reply)[i] = byte(i)
+	}
+	return nil
+}
+
 func TestServer(t *testing.T) {
 	srv := NewServer()
 	if err := srv.Register("Test", new(TestService)); err != nil {
@@ -91,6 +121,349 @@ func TestServer(t *testing.T) {
 	}
 }
 
+// TestDeadline verifies that the caller's deadline is propagated to the
+// server method's context.
+func TestDeadline(t *testing.T) {
+	url, client := newTestClient(t)
+	ctx := context.Background()
+	if err := client.Call(ctx, url, "Test.Deadline", struct{}{}, nil); err == nil {
+		t.Error("expected error")
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	want, _ := ctx.Deadline()
+	var got time.Time
+	if err := client.Call(ctx, url, "Test.Deadline", struct{}{}, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Before(want) || got.After(want.Add(deadlineSkew)) {
+		t.Errorf("got %v, want %v (+%v)", got, want, deadlineSkew)
+	}
+}
+
+type counterService struct {
+	n int64
+	// Hangs is the number of calls to Hang that hang until they are
+	// canceled.
+	hangs int64
+}
+
+func (s *counterService) Incr(ctx context.Context, _ struct{}, reply *int64) error {
+	*reply = atomic.AddInt64(&s.n, 1)
+	return nil
+}
+
+func (s *counterService) Hang(ctx context.Context, _ struct{}, reply *int64) error {
+	n := atomic.AddInt64(&s.n, 1)
+	if atomic.AddInt64(&s.hangs, -1) >= 0 {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	*reply = n
+	return nil
+}
+
+func (s *counterService) Stream(ctx context.Context, _ struct{}, reply *io.ReadCloser) error {
+	*reply = ioutil.NopCloser(strings.NewReader("stream"))
+	return nil
+}
+
+func TestIdempotency(t *testing.T) {
+	srv := NewServer(IdempotencyWindow(time.Hour))
+	counter := new(counterService)
+	if err := srv.Register("Counter", counter); err != nil {
+		t.Fatal(err)
+	}
+	httpsrv := httptest.NewServer(srv)
+	defer httpsrv.Close()
+	client, err := NewClient(func() *http.Client { return httpsrv.Client() }, testPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := WithIdempotencyKey(context.Background(), NewIdempotencyKey())
+	for i := 0; i < 3; i++ {
+		var n int64
+		if err = client.Call(ctx, httpsrv.URL, "Counter.Incr", struct{}{}, &n); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := n, int64(1); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	var n int64
+	if err = client.Call(context.Background(), httpsrv.URL, "Counter.Incr", struct{}{}, &n); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n, int64(2); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Streamed replies cannot be replayed.
+	var rc io.ReadCloser
+	if err = client.Call(ctx, httpsrv.URL, "Counter.Stream", struct{}{}, &rc); err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+	err = client.Call(ctx, httpsrv.URL, "Counter.Stream", struct{}{}, &rc)
+	if !errors.Is(errors.Remote, err) || !errors.Is(errors.Precondition, errors.Recover(err).Err) {
+		t.Errorf("error %v is not a remote precondition error", err)
+	}
+
+	// Outcomes expire after the idempotency window.
+	srv.idempotent.mu.Lock()
+	srv.idempotent.expire(time.Now().Add(time.Hour))
+	srv.idempotent.mu.Unlock()
+	if err = client.Call(ctx, httpsrv.URL, "Counter.Incr", struct{}{}, &n); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n, int64(3); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// TestIdempotencyCanceled verifies that the outcomes of canceled calls
+// are not recorded, so that the calls may be retried.
+func TestIdempotencyCanceled(t *testing.T) {
+	srv := NewServer(IdempotencyWindow(time.Hour))
+	counter := &counterService{hangs: 1}
+	if err := srv.Register("Counter", counter); err != nil {
+		t.Fatal(err)
+	}
+	httpsrv := httptest.NewServer(srv)
+	defer httpsrv.Close()
+	client, err := NewClient(func() *http.Client { return httpsrv.Client() }, testPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := WithIdempotencyKey(context.Background(), NewIdempotencyKey())
+	attemptCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	err = client.Call(attemptCtx, httpsrv.URL, "Counter.Hang", struct{}{}, nil)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	// The retry invokes the method again, instead of replaying the
+	// first attempt's cancellation.
+	var n int64
+	if err = client.Call(ctx, httpsrv.URL, "Counter.Hang", struct{}{}, &n); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n, int64(2); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The successful outcome is replayed.
+	if err = client.Call(ctx, httpsrv.URL, "Counter.Hang", struct{}{}, &n); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n, int64(2); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	srv := NewServer()
+	if err := srv.Register("Test", new(TestService)); err != nil {
+		t.Fatal(err)
+	}
+	httpsrv := httptest.NewServer(srv)
+	defer httpsrv.Close()
+	client, err := NewClient(func() *http.Client { return httpsrv.Client() }, testPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	const d = 500 * time.Millisecond
+	errc := make(chan error)
+	go func() {
+		errc <- client.Call(ctx, httpsrv.URL, "Test.Sleep", d, nil)
+	}()
+	for {
+		srv.callsMu.Lock()
+		calls := srv.calls
+		srv.callsMu.Unlock()
+		if calls > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	shortCtx, cancel := context.WithTimeout(ctx, time.Millisecond)
+	if got, want := srv.Shutdown(shortCtx), context.DeadlineExceeded; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	cancel()
+	if err := client.Call(ctx, httpsrv.URL, "Test.Echo", "hello", nil); !errors.Is(errors.Unavailable, err) {
+		t.Errorf("error %v is not unavailable", err)
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdownUndrained(t *testing.T) {
+	srv := NewServer()
+	counter := &counterService{hangs: 1}
+	if err := srv.Register("Counter", counter); err != nil {
+		t.Fatal(err)
+	}
+	srv.Undrained("Counter.Hang")
+	httpsrv := httptest.NewServer(srv)
+	defer httpsrv.Close()
+	client, err := NewClient(func() *http.Client { return httpsrv.Client() }, testPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	hangCtx, cancelHang := context.WithCancel(ctx)
+	errc := make(chan error)
+	go func() {
+		errc <- client.Call(hangCtx, httpsrv.URL, "Counter.Hang", struct{}{}, nil)
+	}()
+	for atomic.LoadInt64(&counter.n) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The hanging call does not hold up the shutdown.
+	shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := client.Call(ctx, httpsrv.URL, "Counter.Hang", struct{}{}, nil); !errors.Is(errors.Unavailable, err) {
+		t.Errorf("error %v is not unavailable", err)
+	}
+	cancelHang()
+	if got, want := <-errc, context.Canceled; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// credentialService replies with the credentials of the calls it
+// receives, and of the calls it makes in turn.
+type credentialService struct {
+	client *Client
+	addr   string
+}
+
+func (s *credentialService) Get(ctx context.Context, _ struct{}, reply *string) error {
+	*reply = Credential(ctx)
+	return nil
+}
+
+func (s *credentialService) Forward(ctx context.Context, forward bool, reply *[2]string) error {
+	reply[0] = Credential(ctx)
+	if forward {
+		ctx = WithCredential(ctx, Credential(ctx))
+	}
+	return s.client.Call(ctx, s.addr, "Credential.Get", struct{}{}, &reply[1])
+}
+
+// TestCredential verifies that credentials are transmitted with
+// calls, and that methods forward the credentials they receive only
+// if they do so explicitly.
+func TestCredential(t *testing.T) {
+	srv := NewServer()
+	svc := new(credentialService)
+	if err := srv.Register("Credential", svc); err != nil {
+		t.Fatal(err)
+	}
+	httpsrv := httptest.NewServer(srv)
+	defer httpsrv.Close()
+	client, err := NewClient(func() *http.Client { return httpsrv.Client() }, testPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.client, svc.addr = client, httpsrv.URL
+	ctx := WithCredential(context.Background(), "secret")
+	for _, c := range []struct {
+		forward bool
+		want    [2]string
+	}{
+		{false, [2]string{"secret", ""}},
+		{true, [2]string{"secret", "secret"}},
+	} {
+		var reply [2]string
+		if err := client.Call(ctx, httpsrv.URL, "Credential.Forward", c.forward, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := reply, c.want; got != want {
+			t.Errorf("forward %v: got %v, want %v", c.forward, got, want)
+		}
+	}
+}
+
+func TestServices(t *testing.T) {
+	srv := NewServer()
+	if err := srv.Register("Counter", new(counterService)); err != nil {
+		t.Fatal(err)
+	}
+	want := []ServiceInfo{{
+		Name: "Counter",
+		Type: "*rpc.counterService",
+		Methods: []MethodInfo{
+			{Name: "Hang", Arg: "struct {}", Reply: "int64"},
+			{Name: "Incr", Arg: "struct {}", Reply: "int64"},
+			{Name: "Stream", Arg: "struct {}", Reply: "io.ReadCloser"},
+		},
+	}}
+	if got := srv.Services(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	srv := NewServer(ServerLimits(1<<10, 1<<20))
+	srv.streamThreshold = 1 << 10
+	if err := srv.Register("Test", new(TestService)); err != nil {
+		t.Fatal(err)
+	}
+	httpsrv := httptest.NewServer(srv)
+	defer httpsrv.Close()
+	client, err := NewClient(func() *http.Client { return httpsrv.Client() }, testPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// Replies above the streaming threshold are streamed.
+	var reply []byte
+	if err = client.Call(ctx, httpsrv.URL, "Test.Bytes", 64<<10, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(reply), 64<<10; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range reply {
+		if got, want := reply[i], byte(i); got != want {
+			t.Fatalf("byte %d: got %v, want %v", i, got, want)
+		}
+	}
+
+	err = client.Call(ctx, httpsrv.URL, "Test.Bytes", 2<<20, &reply)
+	if !errors.Is(errors.Remote, err) || !errors.Is(errors.Precondition, errors.Recover(err).Err) {
+		t.Errorf("error %v is not a remote precondition error", err)
+	}
+	err = client.Call(ctx, httpsrv.URL, "Test.Echo", strings.Repeat("x", 2<<10), nil)
+	if !errors.Is(errors.Precondition, err) {
+		t.Errorf("error %v is not a precondition error", err)
+	}
+
+	// The client's reply limit is enforced by the server.
+	client, err = NewClient(func() *http.Client { return httpsrv.Client() }, testPrefix, ClientLimits(512, 32<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Call(ctx, httpsrv.URL, "Test.Bytes", 64<<10, &reply)
+	if !errors.Is(errors.Remote, err) || !errors.Is(errors.Precondition, errors.Recover(err).Err) {
+		t.Errorf("error %v is not a remote precondition error", err)
+	}
+	err = client.Call(ctx, httpsrv.URL, "Test.Echo", strings.Repeat("x", 1<<10), nil)
+	if !errors.Is(errors.Precondition, err) || errors.Is(errors.Remote, err) {
+		t.Errorf("error %v is not a local precondition error", err)
+	}
+}
+
 type TestStreamService struct{}
 
 func (s *TestStreamService) Echo(ctx context.Context, arg io.Reader, reply *io.ReadCloser) error {
@@ -141,6 +514,173 @@ func (s *TestStreamService) Digest(ctx context.Context, arg io.Reader, reply *di
 	return nil
 }
 
+func (s *TestStreamService) Upper(ctx context.Context, arg io.Reader, reply *io.ReadCloser) error {
+	r, w := io.Pipe()
+	go func() {
+		scan := bufio.NewScanner(arg)
+		for scan.Scan() {
+			if _, err := io.WriteString(w, strings.ToUpper(scan.Text())+"\n"); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+		}
+		w.CloseWithError(scan.Err())
+	}()
+	*reply = Flush(r)
+	return nil
+}
+
+// TestDuplex verifies that duplex streams are interactive when
+// served over HTTP/2.
+func TestCodecs(t *testing.T) {
+	srv := NewServer()
+	srv.streamThreshold = 1 << 10
+	if err := srv.Register("Test", new(TestService)); err != nil {
+		t.Fatal(err)
+	}
+	httpsrv := httptest.NewServer(srv)
+	defer httpsrv.Close()
+	client, err := NewClient(func() *http.Client { return httpsrv.Client() }, testPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, codec := range []Codec{Gob, JSON} {
+		for _, compress := range []bool{false, true} {
+			ctx := WithCodec(context.Background(), codec)
+			if compress {
+				ctx = WithCompression(ctx)
+			}
+			var reply string
+			if err = client.Call(ctx, httpsrv.URL, "Test.Echo", "hello world", &reply); err != nil {
+				t.Fatal(codec, compress, err)
+			}
+			if got, want := reply, "hello world"; got != want {
+				t.Errorf("%v, %v: got %v, want %v", codec, compress, got, want)
+			}
+			err = client.Call(ctx, httpsrv.URL, "Test.Error", "the error message", nil)
+			if !errors.Is(errors.Remote, err) {
+				t.Errorf("%v, %v: expected remote error, got %v", codec, compress, err)
+			}
+			// The reply is streamed.
+			var bytes []byte
+			if err = client.Call(ctx, httpsrv.URL, "Test.Bytes", 64<<10, &bytes); err != nil {
+				t.Fatal(codec, err)
+			}
+			if got, want := len(bytes), 64<<10; got != want {
+				t.Fatalf("%v: got %v, want %v", codec, got, want)
+			}
+			for i := range bytes {
+				if got, want := bytes[i], byte(i); got != want {
+					t.Fatalf("%v: byte %d: got %v, want %v", codec, i, got, want)
+				}
+			}
+		}
+	}
+}
+
+// TestCompressionLimits verifies that size limits apply to compressed
+// values once they are decompressed, so that small, highly
+// compressible values cannot exceed them.
+func TestCompressionLimits(t *testing.T) {
+	srv := NewServer(ServerLimits(1<<10, 16<<10))
+	if err := srv.Register("Test", new(TestService)); err != nil {
+		t.Fatal(err)
+	}
+	httpsrv := httptest.NewServer(srv)
+	defer httpsrv.Close()
+	client, err := NewClient(func() *http.Client { return httpsrv.Client() }, testPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := WithCompression(context.Background())
+	err = client.Call(ctx, httpsrv.URL, "Test.Echo", strings.Repeat("x", 1<<20), nil)
+	if !errors.Is(errors.Precondition, err) {
+		t.Errorf("error %v is not a precondition error", err)
+	}
+	var reply []byte
+	err = client.Call(ctx, httpsrv.URL, "Test.Bytes", 1<<20, &reply)
+	if !errors.Is(errors.Remote, err) || !errors.Is(errors.Precondition, errors.Recover(err).Err) {
+		t.Errorf("error %v is not a remote precondition error", err)
+	}
+
+	// A server that ignores the client's reply limit cannot exceed it
+	// by compressing its reply.
+	bomb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", gobContentType)
+		w.Header().Set(bigmachineCompressionHeader, gzipCompression)
+		gz := gzip.NewWriter(w)
+		if err := gob.NewEncoder(gz).Encode(make([]byte, 1<<20)); err != nil {
+			t.Error(err)
+		}
+		if err := gz.Close(); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer bomb.Close()
+	client, err = NewClient(func() *http.Client { return bomb.Client() }, testPrefix, ClientLimits(1<<10, 16<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Call(ctx, bomb.URL, "Test.Echo", strings.Repeat("x", 1<<20), nil)
+	if !errors.Is(errors.Precondition, err) {
+		t.Errorf("error %v is not a precondition error", err)
+	}
+	err = client.Call(ctx, bomb.URL, "Test.Bytes", 1<<20, &reply)
+	if !errors.Is(errors.Precondition, err) || errors.Is(errors.Remote, err) {
+		t.Errorf("error %v is not a local precondition error", err)
+	}
+}
+
+func TestDuplex(t *testing.T) {
+	srv := NewServer()
+	if err := srv.Register("Test", new(TestStreamService)); err != nil {
+		t.Fatal(err)
+	}
+	httpsrv := httptest.NewUnstartedServer(srv)
+	if err := http2.ConfigureServer(httpsrv.Config, nil); err != nil {
+		t.Fatal(err)
+	}
+	httpsrv.TLS = httpsrv.Config.TLSConfig
+	httpsrv.StartTLS()
+	defer httpsrv.Close()
+	transport := &http.Transport{
+		TLSClientConfig: httpsrv.Client().Transport.(*http.Transport).TLSClientConfig,
+	}
+	if err := http2.ConfigureTransport(transport); err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(func() *http.Client { return &http.Client{Transport: transport} }, testPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	d, err := client.Duplex(ctx, httpsrv.URL, "Test.Upper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	r := bufio.NewReader(d)
+	for _, line := range []string{"hello", "world"} {
+		if _, err = io.WriteString(d, line+"\n"); err != nil {
+			t.Fatal(err)
+		}
+		got, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := strings.ToUpper(line) + "\n"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	if err = d.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.ReadString('\n'); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+}
+
 func TestStream(t *testing.T) {
 	srv := NewServer()
 	if err := srv.Register("Stream", new(TestStreamService)); err != nil {
@@ -203,3 +743,228 @@ func TestStream(t *testing.T) {
 		t.Errorf("got %v, want %v", got, want)
 	}
 }
+
+func (s *TestService) Hang(ctx context.Context, _ struct{}, _ *struct{}) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestCancel(t *testing.T) {
+	srv := NewServer()
+	if err := srv.Register("Test", new(TestService)); err != nil {
+		t.Fatal(err)
+	}
+	httpsrv := httptest.NewServer(srv)
+	defer httpsrv.Close()
+	url := httpsrv.URL + testPrefix + "Test.Hang"
+
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", url, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", gobContentType)
+	const id = "hung"
+	req.Header.Set(bigmachineCallIDHeader, id)
+	errc := make(chan error)
+	go func() {
+		resp, err := httpsrv.Client().Do(req)
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != methodErrorCode {
+			errc <- fmt.Errorf("unexpected status %s", resp.Status)
+			return
+		}
+		errc <- decodeError("Test.Hang", gob.NewDecoder(resp.Body))
+	}()
+	for {
+		srv.active.mu.Lock()
+		active := srv.active.cancels[id] != nil
+		srv.active.mu.Unlock()
+		if active {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	sendCancel(httpsrv.Client(), url, id)
+	err = <-errc
+	if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
+
+type versionedService struct{ version string }
+
+func (s versionedService) ServiceVersion() string { return s.version }
+
+func (s versionedService) Version(ctx context.Context, _ struct{}, reply *string) error {
+	*reply = s.version
+	return nil
+}
+
+func TestServiceVersion(t *testing.T) {
+	srv := NewServer()
+	if err := srv.Register("Versioned", versionedService{"v2"}); err != nil {
+		t.Fatal(err)
+	}
+	httpsrv := httptest.NewServer(srv)
+	defer httpsrv.Close()
+	client, err := NewClient(func() *http.Client { return httpsrv.Client() }, testPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, version := range []string{"", "v2"} {
+		var reply string
+		if err = client.Call(WithServiceVersion(ctx, version), httpsrv.URL, "Versioned.Version", struct{}{}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := reply, "v2"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	err = client.Call(WithServiceVersion(ctx, "v1"), httpsrv.URL, "Versioned.Version", struct{}{}, nil)
+	if !errors.Is(errors.Precondition, err) {
+		t.Errorf("error %v is not a precondition error", err)
+	}
+	if got, want := srv.Services()[0].Version, "v2"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+type panicService struct{}
+
+func (panicService) Panic(ctx context.Context, _ struct{}, _ *struct{}) error {
+	panic("oops")
+}
+
+func TestSuspendAndPanics(t *testing.T) {
+	srv := NewServer()
+	if err := srv.Register("Panic", panicService{}); err != nil {
+		t.Fatal(err)
+	}
+	var panics int32
+	srv.HandlePanics(func(service, method string, e interface{}) {
+		if service == "Panic" && method == "Panic" && e == "oops" {
+			atomic.AddInt32(&panics, 1)
+		}
+	})
+	httpsrv := httptest.NewServer(srv)
+	defer httpsrv.Close()
+	client, err := NewClient(func() *http.Client { return httpsrv.Client() }, testPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = client.Call(ctx, httpsrv.URL, "Panic.Panic", struct{}{}, nil); err == nil {
+		t.Fatal("expected error")
+	}
+	if got, want := atomic.LoadInt32(&panics), int32(1); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	srv.Suspend("Panic", "restarting")
+	err = client.Call(ctx, httpsrv.URL, "Panic.Panic", struct{}{}, nil)
+	if !errors.Is(errors.Unavailable, err) || !strings.Contains(err.Error(), "restarting") {
+		t.Errorf("got %v, want unavailable error", err)
+	}
+	if got, want := atomic.LoadInt32(&panics), int32(1); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	srv.Resume("Panic")
+	if err = client.Call(ctx, httpsrv.URL, "Panic.Panic", struct{}{}, nil); errors.Is(errors.Unavailable, err) {
+		t.Errorf("service was not resumed: %v", err)
+	}
+	if got, want := atomic.LoadInt32(&panics), int32(2); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestStatsInterval(t *testing.T) {
+	SetStatsInterval(time.Hour)
+	defer SetStatsInterval(0)
+	var stats rpcstats
+	count := func() string {
+		v := stats.Path("machine", "addr", "method", "Svc.Method").Get("count")
+		if v == nil {
+			return "0"
+		}
+		return v.String()
+	}
+	stats.Start("addr", "Svc.Method")(10, 20, nil)
+	stats.Start("addr", "Svc.Method")(30, -1, errors.E("failed"))
+	if got, want := count(), "0"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	stats.Flush()
+	if got, want := count(), "2"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := stats.Path("method", "Svc.Method").Get("errors").String(), "1"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := stats.Path("method", "Svc.Method").Get("maxrequestbytes").String(), "30"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	SetStatsInterval(0)
+	stats.Start("addr", "Svc.Method")(10, 20, nil)
+	if got, want := count(), "3"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	methods := stats.methodStats()
+	if got, want := len(methods), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	// The durations of the calls are not deterministic.
+	methods[0].Time = 0
+	if got, want := methods[0], (MethodStats{Method: "Svc.Method", Calls: 3, Errors: 1, RequestBytes: 50, ReplyBytes: 40}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestTraffic(t *testing.T) {
+	srv := NewServer()
+	if err := srv.Register("Stream", new(TestStreamService)); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Register("Test", new(TestService)); err != nil {
+		t.Fatal(err)
+	}
+	httpsrv := httptest.NewServer(srv)
+	defer httpsrv.Close()
+	client, err := NewClient(func() *http.Client { return httpsrv.Client() }, testPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if got, want := client.Traffic(httpsrv.URL), (Traffic{}); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	var reply []byte
+	if err = client.Call(ctx, httpsrv.URL, "Test.Bytes", 1<<20, &reply); err != nil {
+		t.Fatal(err)
+	}
+	traffic := client.Traffic(httpsrv.URL)
+	if traffic.Sent <= 0 || traffic.Sent > 100 {
+		t.Errorf("sent %d bytes", traffic.Sent)
+	}
+	if traffic.Received < 1<<20 {
+		t.Errorf("received %d bytes, want at least %d", traffic.Received, 1<<20)
+	}
+	var rc io.ReadCloser
+	if err = client.Call(ctx, httpsrv.URL, "Stream.Echo", bytes.NewReader(make([]byte, 1024)), &rc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.Copy(ioutil.Discard, rc); err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+	if got, want := client.Traffic(httpsrv.URL), traffic.Add(Traffic{1024, 1024}); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
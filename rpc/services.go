@@ -0,0 +1,119 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/grailbio/base/errors"
+)
+
+// MethodInfo describes a method served by a Server.
+type MethodInfo struct {
+	// Name is the method's name.
+	Name string
+	// Arg and Reply are the names of the method's argument and reply
+	// types. Reply is the type of the value to which the method's
+	// reply argument points.
+	Arg, Reply string
+}
+
+// ServiceInfo describes a service registered with a Server.
+type ServiceInfo struct {
+	// Name is the name under which the service is registered.
+	Name string
+	// Type is the name of the service's type.
+	Type string
+	// Version is the service's version, if it declares one (see
+	// Versioned).
+	Version string
+	// Methods are the service's methods, ordered by name.
+	Methods []MethodInfo
+}
+
+// Services returns descriptions of the services registered with the
+// server, ordered by name. Services may be used by tools and clients
+// to discover a server's capabilities, or to detect version skew.
+func (s *Server) Services() []ServiceInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	infos := make([]ServiceInfo, 0, len(s.services))
+	for _, svc := range s.services {
+		info := ServiceInfo{
+			Name:    svc.name,
+			Type:    svc.typ.String(),
+			Version: svc.version,
+			Methods: make([]MethodInfo, 0, len(svc.methods)),
+		}
+		for name, m := range svc.methods {
+			info.Methods = append(info.Methods, MethodInfo{
+				Name:  name,
+				Arg:   m.arg.String(),
+				Reply: m.reply.Elem().String(),
+			})
+		}
+		sort.Slice(info.Methods, func(i, j int) bool {
+			return info.Methods[i].Name < info.Methods[j].Name
+		})
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// CheckService checks that the argument and reply types of the
+// methods that a server would serve for iface (see Server.Register)
+// can be encoded by gob, by encoding their zero values. It returns
+// an error of kind errors.Invalid that lists the methods whose types
+// cannot be encoded. Streamed arguments and replies, and interface
+// types, whose encodability depends on their dynamic values, are not
+// checked.
+func CheckService(iface interface{}) error {
+	svc := &service{recv: reflect.ValueOf(iface), typ: reflect.TypeOf(iface)}
+	if err := svc.Init(); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(svc.methods))
+	for name := range svc.methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var problems []string
+	for _, name := range names {
+		m := svc.methods[name]
+		if m.arg != typeOfReader {
+			if err := encodeZero(m.arg); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: argument %s: %v", name, m.arg, err))
+			}
+		}
+		if reply := m.reply.Elem(); reply != typeOfReadCloser {
+			if err := encodeZero(reply); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: reply %s: %v", name, reply, err))
+			}
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.E(errors.Invalid, fmt.Sprintf("%s: %s", svc.typ, strings.Join(problems, "; ")))
+}
+
+// EncodeZero gob-encodes the zero value of the provided type.
+func encodeZero(t reflect.Type) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Interface {
+		return nil
+	}
+	return gob.NewEncoder(ioutil.Discard).EncodeValue(reflect.New(t))
+}
@@ -7,11 +7,58 @@ package rpc
 import (
 	"expvar"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var serverstats, clientstats rpcstats
 
+var (
+	// statsInterval is the interval at which pre-aggregated call
+	// statistics are published (see SetStatsInterval); statsStop stops
+	// the goroutine that publishes them.
+	statsInterval int64
+	statsMu       sync.Mutex
+	statsStop     chan struct{}
+)
+
+// SetStatsInterval bounds the overhead of the package's per-call
+// statistics, which are published as expvars: when the interval is
+// positive, statistics are pre-aggregated in memory by address and
+// method, and published at the provided interval, instead of updating
+// the expvars on every call. Calls are then counted once they
+// complete. A zero interval publishes statistics on every call, the
+// default.
+func SetStatsInterval(interval time.Duration) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	if statsStop != nil {
+		close(statsStop)
+		statsStop = nil
+	}
+	atomic.StoreInt64(&statsInterval, int64(interval))
+	if interval <= 0 {
+		serverstats.Flush()
+		clientstats.Flush()
+		return
+	}
+	stop := make(chan struct{})
+	statsStop = stop
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+			case <-stop:
+				return
+			}
+			serverstats.Flush()
+			clientstats.Flush()
+		}
+	}()
+}
+
 func init() {
 	expvar.Publish("server", &serverstats)
 	expvar.Publish("client", &clientstats)
@@ -54,6 +101,63 @@ func (t *treestats) Child(name string) *treestats {
 // and method.
 type rpcstats struct {
 	treestats
+
+	// pending are the statistics that have been pre-aggregated but not
+	// yet published (see SetStatsInterval).
+	pendingMu sync.Mutex
+	pending   map[callKey]*callStats
+}
+
+// A callKey is the key by which call statistics are aggregated.
+type callKey struct{ addr, method string }
+
+// CallStats are aggregated statistics of the calls to a method.
+type callStats struct {
+	count, time, errors                     int64
+	requestBytes, replyBytes                int64
+	maxTime, maxRequestBytes, maxReplyBytes int64
+}
+
+// Add adds the statistics of a single call to s.
+func (s *callStats) add(elapsed, requestBytes, replyBytes int64, err error) {
+	s.count++
+	s.time += elapsed
+	if elapsed > s.maxTime {
+		s.maxTime = elapsed
+	}
+	if requestBytes > 0 {
+		s.requestBytes += requestBytes
+		if requestBytes > s.maxRequestBytes {
+			s.maxRequestBytes = requestBytes
+		}
+	}
+	if replyBytes > 0 {
+		s.replyBytes += replyBytes
+		if replyBytes > s.maxReplyBytes {
+			s.maxReplyBytes = replyBytes
+		}
+	}
+	if err != nil {
+		s.errors++
+	}
+}
+
+// Merge merges the statistics t into s.
+func (s *callStats) merge(t *callStats) {
+	s.count += t.count
+	s.time += t.time
+	s.errors += t.errors
+	s.requestBytes += t.requestBytes
+	s.replyBytes += t.replyBytes
+	if t.maxTime > s.maxTime {
+		s.maxTime = t.maxTime
+	}
+	if t.maxRequestBytes > s.maxRequestBytes {
+		s.maxRequestBytes = t.maxRequestBytes
+	}
+	if t.maxReplyBytes > s.maxReplyBytes {
+		s.maxReplyBytes = t.maxReplyBytes
+	}
 }
 
 // Start starts an RPC stat with the provided address and method. It returns a
@@ -62,32 +166,147 @@ type rpcstats struct {
 // sizes of the RPC payloads. They may be -1 if the size is unknown (e.g., when
 // the RPC is streaming). Arg err is the result of the RPC.
 func (r *rpcstats) Start(addr, method string) (done func(requestBytes, replyBytes int64, err error)) {
-	r.Path("method", method).Add("count", 1)
-	if addr != "" {
-		r.Path("machine", addr, "method", method).Add("count", 1)
+	key := callKey{addr, method}
+	aggregated := atomic.LoadInt64(&statsInterval) > 0
+	if !aggregated {
+		r.Path("method", method).Add("count", 1)
+		if addr != "" {
+			r.Path("machine", addr, "method", method).Add("count", 1)
+		}
 	}
 	now := time.Now()
 	return func(requestBytes, replyBytes int64, err error) {
-		elapsed := int64(time.Since(now).Nanoseconds()) / 1e6
-		r.Path("method", method).Add("time", elapsed)
-		if requestBytes > 0 {
-			r.Path("method", method).Add("requestbytes", requestBytes)
-			r.max(requestBytes, "method", method, "maxrequestbytes")
-		}
-		if replyBytes > 0 {
-			r.Path("method", method).Add("replybytes", replyBytes)
-			r.max(replyBytes, "method", method, "maxreplybytes")
+		var s callStats
+		s.add(int64(time.Since(now).Nanoseconds())/1e6, requestBytes, replyBytes, err)
+		if aggregated && r.aggregate(key, &s) {
+			return
 		}
-		if err != nil {
-			r.Path("method", method).Add("errors", 1)
-		}
-		r.max(elapsed, "method", method, "maxtime")
+		r.publish(key, &s, aggregated)
+	}
+}
+
+// Aggregate adds the statistics of a completed call to the pending
+// statistics. It returns false if statistics are no longer
+// pre-aggregated, in which case they must be published directly.
+func (r *rpcstats) aggregate(key callKey, s *callStats) bool {
+	r.pendingMu.Lock()
+	defer r.pendingMu.Unlock()
+	// The interval is checked while holding the lock so that calls do
+	// not aggregate statistics after the final Flush.
+	if atomic.LoadInt64(&statsInterval) <= 0 {
+		return false
+	}
+	if r.pending == nil {
+		r.pending = make(map[callKey]*callStats)
+	}
+	if p := r.pending[key]; p != nil {
+		p.merge(s)
+	} else {
+		r.pending[key] = s
+	}
+	return true
+}
+
+// Flush publishes the pending statistics.
+func (r *rpcstats) Flush() {
+	r.pendingMu.Lock()
+	pending := r.pending
+	r.pending = nil
+	r.pendingMu.Unlock()
+	for key, s := range pending {
+		r.publish(key, s, true)
+	}
+}
 
+// Publish publishes the provided statistics of calls with the given key
+// to the expvars. Calls are counted only if count is true; they are
+// otherwise counted as they start.
+func (r *rpcstats) publish(key callKey, s *callStats, count bool) {
+	addr, method := key.addr, key.method
+	if count {
+		r.Path("method", method).Add("count", s.count)
 		if addr != "" {
-			r.Path("machine", addr, "method", method).Add("time", elapsed)
-			r.max(elapsed, "machine", addr, "method", method, "maxtime")
+			r.Path("machine", addr, "method", method).Add("count", s.count)
 		}
 	}
+	r.Path("method", method).Add("time", s.time)
+	if s.requestBytes > 0 {
+		r.Path("method", method).Add("requestbytes", s.requestBytes)
+		r.max(s.maxRequestBytes, "method", method, "maxrequestbytes")
+	}
+	if s.replyBytes > 0 {
+		r.Path("method", method).Add("replybytes", s.replyBytes)
+		r.max(s.maxReplyBytes, "method", method, "maxreplybytes")
+	}
+	if s.errors > 0 {
+		r.Path("method", method).Add("errors", s.errors)
+	}
+	r.max(s.maxTime, "method", method, "maxtime")
+
+	if addr != "" {
+		r.Path("machine", addr, "method", method).Add("time", s.time)
+		r.max(s.maxTime, "machine", addr, "method", method, "maxtime")
+	}
+}
+
+// MethodStats are the statistics of the calls to a method, as
+// published by the package's expvars.
+type MethodStats struct {
+	// Method is the name of the method.
+	Method string
+	// Calls is the number of calls to the method, and Errors the
+	// number of calls that failed.
+	Calls, Errors int64
+	// Time is the total duration of the calls.
+	Time time.Duration
+	// RequestBytes and ReplyBytes are the total sizes of the calls'
+	// requests and replies, where they are known.
+	RequestBytes, ReplyBytes int64
+}
+
+// ClientStats returns the statistics of the calls made by the
+// process's clients, ordered by method. Pre-aggregated statistics (see
+// SetStatsInterval) are included once they are published.
+func ClientStats() []MethodStats {
+	return clientstats.methodStats()
+}
+
+// ServerStats returns the statistics of the calls served by the
+// process's servers, ordered by method. Pre-aggregated statistics (see
+// SetStatsInterval) are included once they are published.
+func ServerStats() []MethodStats {
+	return serverstats.methodStats()
+}
+
+// MethodStats returns the published statistics of r, by method.
+func (r *rpcstats) methodStats() []MethodStats {
+	methods, ok := r.Map.Get("method").(*treestats)
+	if !ok {
+		return nil
+	}
+	var stats []MethodStats
+	// Do visits the methods in order.
+	methods.Do(func(kv expvar.KeyValue) {
+		t, ok := kv.Value.(*treestats)
+		if !ok {
+			return
+		}
+		get := func(name string) int64 {
+			if v, ok := t.Get(name).(*expvar.Int); ok {
+				return v.Value()
+			}
+			return 0
+		}
+		stats = append(stats, MethodStats{
+			Method:       kv.Key,
+			Calls:        get("count"),
+			Errors:       get("errors"),
+			Time:         time.Duration(get("time")) * time.Millisecond,
+			RequestBytes: get("requestbytes"),
+			ReplyBytes:   get("replybytes"),
+		})
+	})
+	return stats
 }
 
 func (r *rpcstats) max(val int64, path ...string) {
@@ -0,0 +1,81 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// Traffic is the amount of call data that a client has exchanged with
+// a server: the sizes of arguments and replies, including streamed
+// ones. HTTP framing and headers are not accounted.
+type Traffic struct {
+	// Sent is the number of bytes sent to the server.
+	Sent int64
+	// Received is the number of bytes received from the server.
+	Received int64
+}
+
+// Add returns the sum of t and u.
+func (t Traffic) Add(u Traffic) Traffic {
+	return Traffic{t.Sent + u.Sent, t.Received + u.Received}
+}
+
+// Total returns the total number of bytes exchanged.
+func (t Traffic) Total() int64 {
+	return t.Sent + t.Received
+}
+
+// Traffic returns the amount of call data that the client has
+// exchanged with the server at the provided address.
+func (c *Client) Traffic(addr string) Traffic {
+	v, ok := c.traffic.Load(addr)
+	if !ok {
+		return Traffic{}
+	}
+	t := v.(*trafficCounter)
+	return Traffic{atomic.LoadInt64(&t.sent), atomic.LoadInt64(&t.received)}
+}
+
+// GetTraffic returns the traffic counter for the provided address.
+func (c *Client) getTraffic(addr string) *trafficCounter {
+	v, _ := c.traffic.LoadOrStore(addr, new(trafficCounter))
+	return v.(*trafficCounter)
+}
+
+// A trafficCounter counts the bytes exchanged with an address. Its
+// fields are accessed atomically.
+type trafficCounter struct {
+	sent, received int64
+}
+
+// A countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	n *int64
+}
+
+// Read implements io.Reader.
+func (r countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return
+}
+
+// A countingReadCloser counts the bytes read through it.
+type countingReadCloser struct {
+	countingReader
+	io.Closer
+}
+
+// CountReader returns a reader that counts the bytes read from r in
+// n. The returned reader is an io.ReadCloser if r is.
+func countReader(r io.Reader, n *int64) io.Reader {
+	if rc, ok := r.(io.ReadCloser); ok {
+		return countingReadCloser{countingReader{rc, n}, rc}
+	}
+	return countingReader{r, n}
+}
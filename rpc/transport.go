@@ -0,0 +1,260 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// DefaultDialTimeout is the default timeout for establishing
+// connections, including TLS handshakes.
+const defaultDialTimeout = 30 * time.Second
+
+// TransportOptions configures the HTTP transports created by
+// NewTransport. The zero value uses Go's defaults.
+type TransportOptions struct {
+	// DialTimeout is the timeout for establishing a connection,
+	// including its TLS handshake. It defaults to 30 seconds.
+	DialTimeout time.Duration
+	// KeepAlive is the TCP keep-alive period. If zero, Go's default is
+	// used; if negative, TCP keep-alives are disabled.
+	KeepAlive time.Duration
+	// MaxConnsPerHost limits the number of connections to each host.
+	// It applies only to HTTP/1.x connections: HTTP/2 multiplexes
+	// calls over a single connection per host. Zero means no limit.
+	MaxConnsPerHost int
+	// MaxIdleConnsPerHost is the maximum number of idle HTTP/1.x
+	// connections kept for reuse per host. If zero, Go's default of 2
+	// is used.
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout is the amount of time after which idle
+	// connections are closed. Zero means no limit.
+	IdleConnTimeout time.Duration
+	// DisableKeepAlives disables connection reuse: each call is made
+	// on a new connection. It should be used only for debugging.
+	DisableKeepAlives bool
+}
+
+// NewTransport returns an HTTP transport suitable for RPC clients
+// (see NewClient), configured by opts. Connections are established
+// by dial, or over TCP if dial is nil.
+//
+// If config is not nil, the transport uses TLS and negotiates
+// HTTP/2, falling back to HTTP/1.1 for servers that do not support
+// it. If config is nil, the transport speaks HTTP/2 in cleartext
+// (h2c) with prior knowledge, and thus may be used only with servers
+// that support h2c, such as those whose handlers are wrapped by
+// H2CHandler.
+func NewTransport(opts TransportOptions, config *tls.Config, dial func(ctx context.Context, network, addr string) (net.Conn, error)) (http.RoundTripper, error) {
+	timeout := opts.DialTimeout
+	if timeout == 0 {
+		timeout = defaultDialTimeout
+	}
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: timeout, KeepAlive: opts.KeepAlive}).DialContext
+	}
+	if config == nil {
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				defer cancel()
+				return dial(ctx, network, addr)
+			},
+		}, nil
+	}
+	transport := &http.Transport{
+		DialContext:         dial,
+		TLSClientConfig:     config,
+		TLSHandshakeTimeout: timeout,
+		MaxConnsPerHost:     opts.MaxConnsPerHost,
+		MaxIdleConnsPerHost: opts.MaxIdleConnsPerHost,
+		IdleConnTimeout:     opts.IdleConnTimeout,
+		DisableKeepAlives:   opts.DisableKeepAlives,
+	}
+	if err := http2.ConfigureTransport(transport); err != nil {
+		return nil, err
+	}
+	return transport, nil
+}
+
+// H2CHandler wraps the provided handler so that it also serves
+// HTTP/2 in cleartext (h2c), as used by transports created by
+// NewTransport without a TLS configuration. Requests over HTTP/1.x
+// are passed through.
+func H2CHandler(handler http.Handler, server *http2.Server) http.Handler {
+	if server == nil {
+		server = new(http2.Server)
+	}
+	return h2c.NewHandler(handler, server)
+}
+
+// UnixHostSuffix is the suffix of host names that name unix-domain
+// sockets in a UnixNetwork.
+const unixHostSuffix = ".unix"
+
+// A UnixNetwork is a network of servers that listen on unix-domain
+// sockets in a directory. Servers are addressed by host names of the
+// form NAME.unix, which name the socket NAME.sock in the network's
+// directory. Unix-domain sockets avoid TCP overhead and port
+// allocation for servers that run on the same host.
+//
+// Clients use the network by setting their transport's DialContext
+// to the network's DialContext; since addresses remain URLs, Call
+// semantics are unchanged.
+type UnixNetwork struct {
+	// Dir is the directory that contains the network's sockets.
+	Dir string
+}
+
+// Host returns the host name of the server with the provided name.
+func (n UnixNetwork) Host(name string) string {
+	return name + unixHostSuffix
+}
+
+// Path returns the path of the socket named by the provided host
+// (which may include a port), and whether the host names a socket
+// in the network.
+func (n UnixNetwork) Path(host string) (string, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if !strings.HasSuffix(host, unixHostSuffix) {
+		return "", false
+	}
+	return filepath.Join(n.Dir, strings.TrimSuffix(host, unixHostSuffix)+".sock"), true
+}
+
+// Listen listens on the socket named by the provided host. Stale
+// sockets are removed.
+func (n UnixNetwork) Listen(host string) (net.Listener, error) {
+	path, ok := n.Path(host)
+	if !ok {
+		return nil, errors.E(errors.Invalid, fmt.Sprintf("%s is not a unix network host", host))
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+// DialContext dials the provided address. Addresses in the network
+// are dialed through their unix-domain sockets; other addresses are
+// dialed normally. DialContext is suitable for use in
+// http.Transport.
+func (n UnixNetwork) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	if path, ok := n.Path(addr); ok {
+		return d.DialContext(ctx, "unix", path)
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// A PipeNetwork is an in-memory network of servers. Connections
+// are established through net.Pipe, so that clients and servers in
+// the same process can communicate without using the host's
+// network stack. Clients use the network by setting their
+// transport's DialContext to the network's DialContext.
+type PipeNetwork struct {
+	mu        sync.Mutex
+	next      int
+	listeners map[string]*pipeListener
+}
+
+// NewPipeNetwork returns a new, empty pipe network.
+func NewPipeNetwork() *PipeNetwork {
+	return &PipeNetwork{listeners: make(map[string]*pipeListener)}
+}
+
+// Listen returns a new listener in the network. The listener's
+// address is a unique host name that may be used in URLs.
+func (n *PipeNetwork) Listen() net.Listener {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	l := &pipeListener{
+		network: n,
+		addr:    pipeAddr(fmt.Sprintf("pipe-%d", n.next)),
+		conns:   make(chan net.Conn),
+		closed:  make(chan struct{}),
+	}
+	n.next++
+	n.listeners[string(l.addr)] = l
+	return l
+}
+
+// DialContext connects to the listener named by the provided
+// address. Ports are ignored.
+func (n *PipeNetwork) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	n.mu.Lock()
+	l := n.listeners[host]
+	n.mu.Unlock()
+	if l == nil {
+		return nil, &net.OpError{Op: "dial", Net: "pipe", Err: errors.New("connection refused")}
+	}
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, &net.OpError{Op: "dial", Net: "pipe", Err: errors.New("connection refused")}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type pipeAddr string
+
+func (pipeAddr) Network() string  { return "pipe" }
+func (a pipeAddr) String() string { return string(a) }
+
+type pipeListener struct {
+	network *PipeNetwork
+	addr    pipeAddr
+	conns   chan net.Conn
+
+	once   sync.Once
+	closed chan struct{}
+}
+
+// Accept implements net.Listener.
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, &net.OpError{Op: "accept", Net: "pipe", Addr: l.addr, Err: errors.New("listener closed")}
+	}
+}
+
+// Close implements net.Listener.
+func (l *pipeListener) Close() error {
+	l.once.Do(func() {
+		l.network.mu.Lock()
+		delete(l.network.listeners, string(l.addr))
+		l.network.mu.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+// Addr implements net.Listener.
+func (l *pipeListener) Addr() net.Addr { return l.addr }
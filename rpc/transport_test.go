@@ -0,0 +1,164 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/base/errors"
+)
+
+func testTransport(t *testing.T, l net.Listener, addr string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	t.Helper()
+	srv := NewServer()
+	if err := srv.Register("Test", new(TestService)); err != nil {
+		t.Fatal(err)
+	}
+	httpsrv := &http.Server{Handler: srv}
+	go httpsrv.Serve(l)
+	transport := &http.Transport{DialContext: dial}
+	client, err := NewClient(func() *http.Client { return &http.Client{Transport: transport} }, testPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	var reply string
+	if err = client.Call(ctx, addr, "Test.Echo", "hello world", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reply, "hello world"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	httpsrv.Close()
+	transport.CloseIdleConnections()
+	err = client.Call(ctx, addr, "Test.Echo", "hello world", &reply)
+	if !errors.Is(errors.Net, err) {
+		t.Errorf("error %v is not a network error", err)
+	}
+}
+
+// TestH2C verifies that cleartext transports use HTTP/2.
+func TestH2C(t *testing.T) {
+	srv := NewServer()
+	if err := srv.Register("Test", new(TestService)); err != nil {
+		t.Fatal(err)
+	}
+	httpsrv := httptest.NewServer(H2CHandler(srv, nil))
+	defer httpsrv.Close()
+	transport, err := NewTransport(TransportOptions{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err = gob.NewEncoder(&b).Encode("hello world"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: transport}).Post(httpsrv.URL+testPrefix+"Test.Echo", gobContentType, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, 200; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := resp.ProtoMajor, 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	client, err := NewClient(func() *http.Client { return &http.Client{Transport: transport} }, testPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply string
+	if err = client.Call(context.Background(), httpsrv.URL, "Test.Echo", "hello world", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reply, "hello world"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPipeNetwork(t *testing.T) {
+	network := NewPipeNetwork()
+	l := network.Listen()
+	testTransport(t, l, "http://"+l.Addr().String(), network.DialContext)
+}
+
+func TestUnixNetwork(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	network := UnixNetwork{dir}
+	host := network.Host("test")
+	l, err := network.Listen(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTransport(t, l, "http://"+host, network.DialContext)
+}
+
+func TestMemoryNetwork(t *testing.T) {
+	srv := NewServer()
+	if err := srv.Register("Test", new(TestService)); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Register("Stream", new(TestStreamService)); err != nil {
+		t.Fatal(err)
+	}
+	network := NewMemoryNetwork()
+	addr := "http://" + network.Handle(srv)
+	client, err := NewClient(func() *http.Client { return &http.Client{Transport: network} }, testPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	var reply string
+	if err = client.Call(ctx, addr, "Test.Echo", "hello world", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reply, "hello world"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err = client.Call(ctx, addr, "Test.Error", "oops", &reply); err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("bad error %v", err)
+	}
+	var rc io.ReadCloser
+	if err = client.Call(ctx, addr, "Stream.Echo", strings.NewReader("hello stream"), &rc); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+	if got, want := string(b), "hello stream"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Errors in streams are propagated through trailers.
+	if err = client.Call(ctx, addr, "Stream.StreamWithError", "a series of unfortunate events", &rc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.Copy(ioutil.Discard, rc); err == nil || !strings.Contains(err.Error(), "a series of unfortunate events") {
+		t.Errorf("bad error %v", err)
+	}
+	rc.Close()
+
+	network.Remove(strings.TrimPrefix(addr, "http://"))
+	err = client.Call(ctx, addr, "Test.Echo", "hello world", &reply)
+	if !errors.Is(errors.Net, err) {
+		t.Errorf("error %v is not a network error", err)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import "context"
+
+// BigmachineServiceVersionHeader is the HTTP header used to transmit
+// the version of the called service that the caller expects.
+const bigmachineServiceVersionHeader = "x-bigmachine-service-version"
+
+// A Versioned service declares its version. Servers record the
+// versions of registered services, and refuse calls that expect a
+// different version (see WithServiceVersion), so that callers and
+// servers built from different versions of a service's code fail
+// clearly instead of with confusing decoding errors.
+type Versioned interface {
+	// ServiceVersion returns the version of the service.
+	ServiceVersion() string
+}
+
+// VersionOf returns the version of the provided service, or "" if
+// the service does not declare a version.
+func VersionOf(iface interface{}) string {
+	if v, ok := iface.(Versioned); ok {
+		return v.ServiceVersion()
+	}
+	return ""
+}
+
+type serviceVersionKey struct{}
+
+// WithServiceVersion returns a context that carries the version of
+// the called service that the caller expects. Calls made with the
+// returned context to a service whose version differs fail with an
+// error of kind errors.Precondition, without invoking the method.
+// Calls to services that do not declare a version are not checked.
+func WithServiceVersion(ctx context.Context, version string) context.Context {
+	return context.WithValue(ctx, serviceVersionKey{}, version)
+}
+
+func serviceVersionFromContext(ctx context.Context) string {
+	version, _ := ctx.Value(serviceVersionKey{}).(string)
+	return version
+}
@@ -0,0 +1,159 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"time"
+
+	"github.com/grailbio/base/log"
+)
+
+const (
+	// ScoreSmoothing is the weight of each new sample in a machine's
+	// (exponentially weighted) score.
+	scoreSmoothing = 0.3
+	// ErrorRateSmoothing is the weight of each call in a machine's
+	// (exponentially weighted) call error rate.
+	errorRateSmoothing = 0.05
+	// DegradedScore is the score below which a machine becomes
+	// degraded; RecoveredScore is the score at or above which a
+	// degraded machine recovers. The gap between them keeps machines
+	// whose scores hover around a threshold from flapping.
+	degradedScore  = 0.5
+	recoveredScore = 0.7
+	// SlowKeepalive is the keepalive round-trip time below which
+	// latency does not affect a machine's score.
+	slowKeepalive = 100 * time.Millisecond
+)
+
+// Score returns the machine's health score, between 0 (worst) and 1
+// (best). The score combines the machine's health as reported by its
+// supervisor (see Healthy), the round-trip times of its keepalives and
+// their trend, the error rate of calls to it, and whether it crosses
+// memory thresholds (see MemoryWatchdog). It is smoothed over
+// successive keepalives, so that it reflects the machine's recent
+// quality rather than momentary blips. Scores are maintained only for
+// owned machines; others score 1.
+//
+// Scores give placement decisions a shared notion of machine quality:
+// they are used by Query.MinScore and B.Best to select machines, and
+// by the idle reaper to reap degraded machines (see
+// Lifetime.ReapDegraded).
+func (m *Machine) Score() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.scored {
+		return 1
+	}
+	return m.score
+}
+
+// Degraded tells whether the machine is degraded: its score fell below
+// 0.5, and has not since recovered to 0.7 (see Score).
+func (m *Machine) Degraded() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.degraded
+}
+
+// Best returns the machine with the highest score among the running
+// machines selected by the provided query, or nil if there are none.
+// Ties are broken by address.
+func (b *B) Best(q Query) *Machine {
+	var (
+		best      *Machine
+		bestScore float64
+	)
+	for _, m := range b.Query(q) {
+		if m.State() != Running {
+			continue
+		}
+		if score := m.Score(); best == nil || score > bestScore {
+			best, bestScore = m, score
+		}
+	}
+	return best
+}
+
+// RecordCallError records the outcome of a call to the machine in its
+// call error rate.
+func (m *Machine) recordCallError(err error) {
+	var sample float64
+	if err != nil {
+		sample = 1
+	}
+	m.mu.Lock()
+	m.errorRate += errorRateSmoothing * (sample - m.errorRate)
+	m.mu.Unlock()
+}
+
+// SampleScore computes a sample of the machine's score from its
+// current health, keepalive round-trip times, call error rate, and
+// memory thresholds.
+func (m *Machine) sampleScore() float64 {
+	if !m.Healthy() {
+		return 0
+	}
+	sample := 1.0
+	if times := m.KeepaliveReplyTimes(); len(times) > 0 && m.keepaliveRpcTimeout > 0 {
+		latest := times[0]
+		// Round trips that approach the RPC timeout score 0.
+		if latest > slowKeepalive {
+			sample *= 1 - minFloat(1, float64(latest-slowKeepalive)/float64(m.keepaliveRpcTimeout))
+		}
+		// Penalize round trips that are trending upward.
+		if len(times) > 1 {
+			var sum time.Duration
+			for _, t := range times[1:] {
+				sum += t
+			}
+			if mean := sum / time.Duration(len(times)-1); latest > slowKeepalive && latest > 2*mean {
+				sample *= 0.8
+			}
+		}
+	}
+	m.mu.Lock()
+	sample *= 1 - m.errorRate
+	if len(m.memTrips) > 0 {
+		sample *= 0.5
+	}
+	m.mu.Unlock()
+	return sample
+}
+
+// UpdateScore folds the provided sample into the machine's score, and
+// updates whether the machine is degraded.
+func (m *Machine) updateScore(sample float64) {
+	m.mu.Lock()
+	if !m.scored {
+		m.score, m.scored = 1, true
+	}
+	m.score += scoreSmoothing * (sample - m.score)
+	score, wasDegraded := m.score, m.degraded
+	switch {
+	case !m.degraded && score < degradedScore:
+		m.degraded = true
+	case m.degraded && score >= recoveredScore:
+		m.degraded = false
+	}
+	degraded := m.degraded
+	m.mu.Unlock()
+	if degraded == wasDegraded {
+		return
+	}
+	if degraded {
+		log.Printf("%s: machine degraded (score %.2f)", m.Name(), score)
+	} else {
+		log.Printf("%s: machine recovered (score %.2f)", m.Name(), score)
+	}
+	m.changed(m)
+}
+
+func minFloat(x, y float64) float64 {
+	if x < y {
+		return x
+	}
+	return y
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigmachine/rpc"
+)
+
+// Eot is the terminal's end-of-file character (^D).
+const eot = 0x04
+
+// Shell runs an interactive shell on the machine, attached to a
+// pseudo-terminal, so that operators may debug a wedged worker over
+// the machine's authenticated RPC channel without distributing SSH
+// keys to every instance. The shell reads from stdin, and its terminal
+// output is written to stdout. Since the remote side is a terminal,
+// callers that attach a local terminal should put it in raw mode.
+// Shell returns once the shell exits. When stdin reaches EOF, the
+// current line is terminated and an end-of-file character is sent to
+// the terminal, so that the shell exits once it has consumed its
+// input; the shell is killed if the context is canceled. Shell is supported only on Linux machines.
+func (m *Machine) Shell(ctx context.Context, stdin io.Reader, stdout io.Writer) error {
+	d, err := m.Duplex(ctx, "Supervisor.Shell")
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	go func() {
+		io.Copy(d, stdin)
+		d.CloseWrite()
+	}()
+	_, err = io.Copy(stdout, d)
+	return err
+}
+
+// Shell runs an interactive shell attached to a pseudo-terminal: the
+// argument stream is written to the terminal, and the terminal's
+// output is replied (see Machine.Shell). The shell is the one named
+// by $SHELL, or /bin/sh. When the argument stream ends, a newline and
+// an end-of-file character are written to the terminal: the terminal
+// signals end-of-file only at the start of a line. If the argument
+// stream fails, the shell is hung up (SIGHUP). The shell is killed
+// when the call is canceled.
+func (s *Supervisor) Shell(ctx context.Context, arg io.Reader, reply *io.ReadCloser) error {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	cmd := exec.CommandContext(ctx, shell)
+	cmd.Env = os.Environ()
+	if os.Getenv("TERM") == "" {
+		cmd.Env = append(cmd.Env, "TERM=xterm")
+	}
+	tty, err := startPTY(cmd)
+	if err != nil {
+		return errors.E("Supervisor.Shell", err)
+	}
+	go func() {
+		if _, err := io.Copy(tty, arg); err != nil {
+			cmd.Process.Signal(syscall.SIGHUP)
+			return
+		}
+		tty.Write([]byte{'\n', eot})
+	}()
+	go cmd.Wait()
+	*reply = rpc.Flush(tty)
+	return nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/fatbin"
+	"github.com/grailbio/base/log"
+)
+
+// A fetchBinaryRequest is the argument of Supervisor.FetchBinary.
+type fetchBinaryRequest struct {
+	// URL is the URL from which the binary is fetched.
+	URL string
+	// Digest and Size are the binary's expected digest (see
+	// DigestPolicy) and size.
+	Digest digest.Digest
+	Size   int64
+}
+
+// FetchBinary fetches, with an HTTP GET request, the binary that is
+// run by Supervisor.Exec from the URL provided in the request, for
+// example a presigned URL of an object store, and verifies that it has
+// the expected size and digest. FetchBinary lets machines download
+// binaries that are staged by the driver's System (see
+// binaryStager), instead of the driver uploading the binary to each
+// machine.
+func (s *Supervisor) FetchBinary(ctx context.Context, req fetchBinaryRequest, _ *struct{}) error {
+	httpReq, err := http.NewRequest("GET", req.URL, nil)
+	if err != nil {
+		return errors.E(errors.Invalid, "Supervisor.FetchBinary", err)
+	}
+	resp, err := http.DefaultClient.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return errors.E(errors.Net, "Supervisor.FetchBinary", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.E(fmt.Sprintf("Supervisor.FetchBinary: GET: %s", resp.Status))
+	}
+	return s.installBinary("Supervisor.FetchBinary", resp.Body, req.Digest, req.Size)
+}
+
+// InstallBinary writes the binary read from r to a temporary file
+// and, if it has the provided digest and size, sets it as the binary
+// that is run by Supervisor.Exec, and adds it to the binary cache.
+// Method names the supervisor method, for errors.
+func (s *Supervisor) installBinary(method string, r io.Reader, d digest.Digest, size int64) error {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		return err
+	}
+	path := f.Name()
+	n, err := io.Copy(f, r)
+	if err == nil && n != size {
+		err = errors.E(errors.Integrity, fmt.Sprintf("%s: fetched %d bytes, expected %d", method, n, size))
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		var fetched digest.Digest
+		if fetched, err = digestPolicy.digest(f, n); err == nil && fetched != d {
+			err = errors.E(errors.Integrity, fmt.Sprintf("%s: fetched binary %s, expected %s", method, fetched.Short(), d.Short()))
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(path, 0755)
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	cacheBinary(path, n)
+	s.mu.Lock()
+	s.binaryPath, s.execDigest = path, d
+	s.mu.Unlock()
+	return nil
+}
+
+// FetchStagedBinary stages the provided binary image with the
+// machine's System, if the system supports staging, and tells the
+// machine's supervisor to fetch it. It returns false if the binary
+// must be uploaded instead, including if the staging or the fetch
+// failed.
+func (m *Machine) fetchStagedBinary(ctx context.Context, bin *fatbin.Reader, info fatbin.Info) bool {
+	if m.stager == nil {
+		return false
+	}
+	d, err := cachedImageDigest(bin, info.Goos, info.Goarch)
+	if err != nil {
+		log.Error.Printf("%s: digest binary: %v", m.Name(), err)
+		return false
+	}
+	url, err := m.stager.StageBinary(ctx, bin, info, d)
+	if errors.Is(errors.NotSupported, err) {
+		return false
+	} else if err != nil {
+		log.Error.Printf("%s: stage binary: %v; uploading binary", m.Name(), err)
+		return false
+	}
+	req := fetchBinaryRequest{URL: url, Digest: d, Size: info.Size}
+	if err := m.retryCall(ctx, 10*time.Minute, 5*time.Minute, "Supervisor.FetchBinary", req, nil); err != nil {
+		log.Error.Printf("%s: fetch staged binary: %v; uploading binary", m.Name(), err)
+		return false
+	}
+	return true
+}
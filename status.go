@@ -17,6 +17,7 @@ import (
 
 	"github.com/grailbio/base/data"
 	"github.com/grailbio/base/diagnostic/dump"
+	"github.com/grailbio/bigmachine/rpc"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -58,7 +59,7 @@ var statusTemplate = template.Must(template.New("status").
 			}
 		},
 	}).
-	Parse(`{{.machine.Addr}}
+	Parse(`{{.machine.Name}}{{if ne .machine.Name .machine.Addr}} ({{.machine.Addr}}){{end}}
 {{if .machine.Owned}}	keepalive:
 		next:	{{.info.NextKeepalive}} (in {{until .info.NextKeepalive}})
 		reply times:	{{roundjoindur .info.KeepaliveReplyTimes}}
@@ -78,7 +79,8 @@ var statusTemplate = template.Must(template.New("status").
 		available:	{{human .info.DiskInfo.Usage.Free}}
 		used:	{{human .info.DiskInfo.Usage.Used}}
 		(percent):	{{printf "%.1f%%" .info.DiskInfo.Usage.UsedPercent}}
-	load: {{printf "%.1f %.1f %.1f" .info.LoadInfo.Averages.Load1 .info.LoadInfo.Averages.Load5 .info.LoadInfo.Averages.Load15}}
+{{range .info.DiskInfo.Volumes}}		{{.Path}}:	{{printf "%.1f%%" .UsedPercent}} of {{human .Total}}
+{{end}}	load: {{printf "%.1f %.1f %.1f" .info.LoadInfo.Averages.Load1 .info.LoadInfo.Averages.Load5 .info.LoadInfo.Averages.Load15}}
 `))
 
 func makeStatusDumpFunc(b *B) dump.Func {
@@ -114,7 +116,7 @@ func writeStatus(ctx context.Context, b *B, w io.Writer) error {
 	for i, info := range infos {
 		m := machines[i]
 		if info.err != nil {
-			fmt.Fprintln(&tw, m.Addr, ":", info.err)
+			fmt.Fprintln(&tw, m.Name(), ":", info.err)
 			continue
 		}
 		err := statusTemplate.Execute(&tw, map[string]interface{}{
@@ -141,6 +143,55 @@ func (s *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// ServicesHandler implements an HTTP handler that lists the services
+// registered on each machine, together with their methods.
+type servicesHandler struct{ *B }
+
+func (s *servicesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	machines := s.Machines()
+	sort.Slice(machines, func(i, j int) bool {
+		return machines[i].Addr < machines[j].Addr
+	})
+	services := make([][]rpc.ServiceInfo, len(machines))
+	errs := make([]error, len(machines))
+	g, ctx := errgroup.WithContext(r.Context())
+	for i, m := range machines {
+		if state := m.State(); state != Running {
+			errs[i] = fmt.Errorf("machine state %s", state)
+			continue
+		}
+		i, m := i, m
+		g.Go(func() error {
+			ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			services[i], errs[i] = m.Services(ctx)
+			return nil
+		})
+	}
+	_ = g.Wait()
+	var tw tabwriter.Writer
+	tw.Init(w, 4, 4, 1, ' ', 0)
+	defer tw.Flush()
+	for i, m := range machines {
+		if errs[i] != nil {
+			fmt.Fprintln(&tw, m.Name(), ":", errs[i])
+			continue
+		}
+		fmt.Fprintln(&tw, m.Name())
+		for _, svc := range services[i] {
+			if svc.Version != "" {
+				fmt.Fprintf(&tw, "\t%s\t%s\tversion %s\n", svc.Name, svc.Type, svc.Version)
+			} else {
+				fmt.Fprintf(&tw, "\t%s\t%s\n", svc.Name, svc.Type)
+			}
+			for _, method := range svc.Methods {
+				fmt.Fprintf(&tw, "\t\t%s(%s)\t%s\n", method.Name, method.Arg, method.Reply)
+			}
+		}
+	}
+}
+
 type machineInfo struct {
 	err error
 	MemInfo
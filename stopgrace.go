@@ -0,0 +1,51 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"time"
+
+	"github.com/grailbio/base/log"
+)
+
+// StopGrace is a machine parameter that gives the calls in flight to a
+// machine a grace period to complete before the machine is stopped by
+// Machine.Cancel or torn down by B.Shutdown, so that, for example,
+// canceling a machine on behalf of one computation does not fail the
+// unrelated calls that share it. During the grace period the machine
+// is draining (see Machine.Draining): it accepts no new calls. The
+// machine is stopped as soon as its calls in flight complete, or once
+// the grace period elapses, whichever is first.
+type StopGrace struct {
+	// Period is the maximum amount of time for which calls in flight
+	// are awaited. Zero means that machines are stopped immediately.
+	Period time.Duration
+}
+
+func (g StopGrace) applyParam(m *Machine) {
+	m.stopGrace = g.Period
+}
+
+// AwaitCalls marks a running machine with a stop grace period as
+// draining, so that it accepts no new calls, and waits for its calls
+// in flight to complete, for at most the grace period. It returns
+// immediately if the machine has no grace period or is not running.
+func (m *Machine) awaitCalls() {
+	if m.stopGrace <= 0 || m.State() != Running {
+		return
+	}
+	drained := m.beginDrain()
+	if n := m.InFlight(); n > 0 {
+		log.Printf("%s: waiting up to %s for %d calls in flight before stopping", m.Name(), m.stopGrace, n)
+	}
+	timer := time.NewTimer(m.stopGrace)
+	defer timer.Stop()
+	select {
+	case <-drained:
+	case <-m.Wait(Stopped):
+	case <-timer.C:
+		log.Error.Printf("%s: stop grace period of %s elapsed with %d calls in flight", m.Name(), m.stopGrace, m.InFlight())
+	}
+}
@@ -6,7 +6,6 @@ package bigmachine
 
 import (
 	"context"
-	"crypto"
 	"encoding/json"
 	"expvar"
 	"fmt"
@@ -24,6 +23,7 @@ import (
 	"github.com/grailbio/base/digest"
 	"github.com/grailbio/base/errors"
 	"github.com/grailbio/base/log"
+	"github.com/grailbio/bigmachine/internal/tee"
 	"github.com/grailbio/bigmachine/rpc"
 	"github.com/shirou/gopsutil/disk"
 	"github.com/shirou/gopsutil/load"
@@ -35,12 +35,11 @@ const (
 )
 
 var (
-	digester     = digest.Digester(crypto.SHA256)
 	binaryDigest digest.Digest
 	digestOnce   sync.Once
 )
 
-func binary() (io.ReadCloser, error) {
+func binary() (*os.File, error) {
 	// TODO(marius): use /proc/self/exe on Linux
 	path, err := os.Executable()
 	if err != nil {
@@ -61,7 +60,64 @@ type Supervisor struct {
 	// binaryPath contains the path of the last
 	// binary uploaded in preparation for Exec.
 	binaryPath string
+	// execDigest is the digest of the binary at binaryPath, if it is
+	// known; the binary is verified against it before it is run by
+	// Exec.
+	execDigest digest.Digest
 	environ    []string
+	// upload is the file to which a chunked binary upload is written;
+	// uploadSize is the number of bytes written to it so far.
+	upload     *os.File
+	uploadSize int64
+	// uploadDigest is the digest of the upload, once it is verified
+	// by Verifybinary.
+	uploadDigest digest.Digest
+
+	// services are the services registered with the supervisor,
+	// keyed by name.
+	servicesMu sync.Mutex
+	services   map[string]interface{}
+
+	// healthErr is the error of the most recent failed health checks.
+	healthMu  sync.Mutex
+	healthErr error
+
+	// memWatchdog is the memory watchdog, if any (see
+	// SetMemoryWatchdog); memTrips are the memory thresholds currently
+	// crossed, as determined by the watchdog; memUnhealthy is set when
+	// they render the process unhealthy.
+	memWatchMu     sync.Mutex
+	memWatchCancel func()
+	memWatchdog    *MemoryWatchdog
+	memTrips       []MemoryTrip
+	memUnhealthy   bool
+
+	// diskErr describes the monitored volumes that are above their
+	// usage threshold (see DiskWatchdog).
+	diskMu       sync.Mutex
+	diskWatchdog DiskWatchdog
+	diskErr      error
+
+	// output is the process's captured log output, if any (see
+	// Supervisor.Tail).
+	output *tee.Writer
+	// history is the process's retained log output, if any (see
+	// LogRotation).
+	history *outputLog
+
+	// serviceRestart configures the restarts of the supervisor's
+	// services; panics are the times of the recent panics of each
+	// service, and serviceStatus the statuses of the services that
+	// have panicked (see ServiceRestart).
+	restartMu      sync.Mutex
+	serviceRestart ServiceRestart
+	panics         map[string][]time.Time
+	serviceStatus  map[string]*ServiceStatus
+
+	// logLevelTimer restores the process's previous log level, if it
+	// was set temporarily (see Supervisor.SetLogLevel).
+	logLevelMu    sync.Mutex
+	logLevelTimer *time.Timer
 }
 
 // StartSupervisor starts a new supervisor based on the provided arguments.
@@ -73,7 +129,14 @@ func StartSupervisor(ctx context.Context, b *B, system System, server *rpc.Serve
 	}
 	s.healthy = 1
 	s.nextc = make(chan time.Time)
+	if server != nil {
+		server.HandlePanics(s.handlePanic)
+		// Streams that last until they are canceled would otherwise
+		// hold up every shutdown for the full drain timeout.
+		server.Undrained("Supervisor.Tail", "Supervisor.Logs", "Supervisor.WatchFiles")
+	}
 	go s.watchdog(ctx)
+	go s.checkHealthLoop(ctx)
 	return s
 }
 
@@ -83,30 +146,39 @@ type Info struct {
 	// as reported by the Go runtime.
 	Goos, Goarch string
 	// Digest is the fingerprint of the currently running binary on the machine.
+	// It is computed according to the digest policy (see SetDigestPolicy).
 	Digest digest.Digest
+	// Tmpfs lists the tmpfs file systems mounted on the machine
+	// through Tmpfs parameters, with their sizes.
+	Tmpfs []Tmpfs
 	// TODO: resources
 }
 
 // LocalInfo returns system information for this process.
 func LocalInfo() Info {
 	digestOnce.Do(func() {
-		r, err := binary()
+		f, err := binary()
 		if err != nil {
 			log.Error.Printf("could not read local binary: %v", err)
 			return
 		}
-		defer r.Close()
-		dw := digester.NewWriter()
-		if _, err := io.Copy(dw, r); err != nil {
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			log.Error.Print(err)
+			return
+		}
+		binaryDigest, err = digestPolicy.digest(f, info.Size())
+		if err != nil {
 			log.Error.Print(err)
 			return
 		}
-		binaryDigest = dw.Digest()
 	})
 	return Info{
 		Goos:   runtime.GOOS,
 		Goarch: runtime.GOARCH,
 		Digest: binaryDigest,
+		Tmpfs:  localTmpfs(),
 	}
 }
 
@@ -119,10 +191,27 @@ type service struct {
 // this supervisor. After registration, the service is also initialized if it implements
 // the method
 //	Init(*B) error
+// Services that depend on other services (see Services) must be
+// registered after them.
 func (s *Supervisor) Register(ctx context.Context, svc service, _ *struct{}) error {
+	s.servicesMu.Lock()
+	for _, dep := range initAfter(svc.Instance) {
+		if _, ok := s.services[dep]; !ok {
+			s.servicesMu.Unlock()
+			return errors.E(errors.Precondition,
+				fmt.Sprintf("service %s depends on service %s, which is not registered", svc.Name, dep))
+		}
+	}
+	s.servicesMu.Unlock()
 	if err := s.server.Register(svc.Name, svc.Instance); err != nil {
 		return err
 	}
+	s.servicesMu.Lock()
+	if s.services == nil {
+		s.services = make(map[string]interface{})
+	}
+	s.services[svc.Name] = svc.Instance
+	s.servicesMu.Unlock()
 	return maybeInit(svc.Instance, s.b)
 }
 
@@ -152,7 +241,8 @@ func (s *Supervisor) Setbinary(ctx context.Context, binary io.Reader, _ *struct{
 	if err != nil {
 		return err
 	}
-	if _, err := io.Copy(f, binary); err != nil {
+	size, err := io.Copy(f, binary)
+	if err != nil {
 		return err
 	}
 	path := f.Name()
@@ -164,12 +254,86 @@ func (s *Supervisor) Setbinary(ctx context.Context, binary io.Reader, _ *struct{
 		os.Remove(path)
 		return err
 	}
+	cacheBinary(path, size)
 	s.mu.Lock()
-	s.binaryPath = path
+	s.binaryPath, s.execDigest = path, digest.Digest{}
 	s.mu.Unlock()
 	return nil
 }
 
+// SetbinaryChunk writes a chunk of a new binary to replace the
+// current binary when Supervisor.Exec is called. Chunks are written
+// in order: a chunk at offset 0 begins a new upload, and each
+// subsequent chunk must begin at or before the end of the data
+// written so far, so that chunks may safely be resent. Chunks that
+// begin past the end of the written data are ignored. The reply is
+// the number of bytes written so far, which is the offset from which
+// the caller should continue the upload. Once all chunks have been
+// written, the upload is completed by Supervisor.Commitbinary.
+func (s *Supervisor) SetbinaryChunk(ctx context.Context, chunk rpc.Chunk, size *int64) error {
+	if err := chunk.Verify(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if chunk.Offset == 0 {
+		if s.upload != nil {
+			s.upload.Close()
+			os.Remove(s.upload.Name())
+		}
+		f, err := ioutil.TempFile("", "")
+		if err != nil {
+			return err
+		}
+		s.upload, s.uploadSize, s.uploadDigest = f, 0, digest.Digest{}
+	}
+	if s.upload == nil || chunk.Offset > s.uploadSize {
+		*size = s.uploadSize
+		return nil
+	}
+	if _, err := s.upload.WriteAt(chunk.Data, chunk.Offset); err != nil {
+		return err
+	}
+	s.uploadSize = chunk.End()
+	*size = s.uploadSize
+	return nil
+}
+
+// Commitbinary completes a chunked upload begun by
+// Supervisor.SetbinaryChunk. The provided size must match the size
+// of the uploaded data. If the upload was verified by
+// Supervisor.Verifybinary, the binary is verified again before it is
+// run by Supervisor.Exec.
+func (s *Supervisor) Commitbinary(ctx context.Context, size int64, _ *struct{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.upload == nil {
+		return errors.E(errors.Invalid, "Supervisor.Commitbinary: no upload in progress")
+	}
+	if size != s.uploadSize {
+		return errors.E(errors.Precondition, fmt.Sprintf("Supervisor.Commitbinary: uploaded %d bytes, expected %d", s.uploadSize, size))
+	}
+	f, d := s.upload, s.uploadDigest
+	s.upload, s.uploadSize, s.uploadDigest = nil, 0, digest.Digest{}
+	path := f.Name()
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return err
+	}
+	if err := os.Chmod(path, 0755); err != nil {
+		os.Remove(path)
+		return err
+	}
+	cacheBinary(path, size)
+	s.binaryPath, s.execDigest = path, d
+	return nil
+}
+
 // GetBinary retrieves the last binary uploaded via Setbinary.
 func (s *Supervisor) GetBinary(ctx context.Context, _ struct{}, rc *io.ReadCloser) error {
 	s.mu.Lock()
@@ -183,21 +347,70 @@ func (s *Supervisor) GetBinary(ctx context.Context, _ struct{}, rc *io.ReadClose
 	return err
 }
 
+// GetBinaryChunk retrieves the chunk of the last uploaded binary
+// that begins at the provided offset. An empty chunk is returned at
+// the end of the binary. GetBinaryChunk allows callers to resume
+// interrupted downloads.
+func (s *Supervisor) GetBinaryChunk(ctx context.Context, offset int64, chunk *rpc.Chunk) error {
+	s.mu.Lock()
+	path := s.binaryPath
+	s.mu.Unlock()
+	if path == "" {
+		return errors.E(errors.Invalid, "Supervisor.GetBinaryChunk: no binary set")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data := make([]byte, binaryChunkSize)
+	n, err := f.ReadAt(data, offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	*chunk = rpc.NewChunk(offset, data[:n])
+	return nil
+}
+
 // Exec reads a new image from its argument and replaces the current
 // process with it. As a consequence, the currently running machine will
-// die. It is up to the caller to manage this interaction.
+// die. It is up to the caller to manage this interaction. Listeners
+// created by Listen are inherited by the new image. Binaries whose
+// digests are known are verified before they are run.
 func (s *Supervisor) Exec(ctx context.Context, _ struct{}, _ *struct{}) error {
 	s.mu.Lock()
 	var (
 		environ = append(os.Environ(), s.environ...)
 		path    = s.binaryPath
+		d       = s.execDigest
 	)
 	s.mu.Unlock()
 	if path == "" {
 		return errors.E(errors.Invalid, "Supervisor.Exec: no binary set")
 	}
+	if !d.IsZero() {
+		if err := verifyExecBinary(path, d); err != nil {
+			return err
+		}
+	}
+	// Pass listeners created by Listen to the new binary.
+	environ, err := inheritListeners(environ)
+	if err != nil {
+		return err
+	}
 	log.Printf("exec %s %s", path, strings.Join(os.Args, " "))
-	return syscall.Exec(path, os.Args, environ)
+	// Arguments that exceed the limits of exec are spilled to a file.
+	args, environ, err := execArgs(os.Args, environ)
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(path, args, environ)
+}
+
+// Services describes the services registered on the machine.
+func (s *Supervisor) Services(ctx context.Context, _ struct{}, services *[]rpc.ServiceInfo) error {
+	*services = s.server.Services()
+	return nil
 }
 
 // Ping replies immediately with the sequence number provided.
@@ -227,14 +440,16 @@ func (s *Supervisor) MemInfo(ctx context.Context, readMemStats bool, info *MemIn
 }
 
 // DiskInfo returns disk usage information on the disk where the
-// temporary directory resides.
+// temporary directory resides, and on the volumes monitored for disk
+// pressure (see DiskWatchdog).
 func (s *Supervisor) DiskInfo(ctx context.Context, _ struct{}, info *DiskInfo) error {
 	disk, err := disk.Usage(os.TempDir())
 	if err != nil {
 		return err
 	}
 	info.Usage = *disk
-	return nil
+	info.Volumes, err = s.diskVolumeUsage()
+	return err
 }
 
 // LoadInfo returns system load information.
@@ -281,6 +496,9 @@ type profileRequest struct {
 	Name  string
 	Debug int
 	GC    bool
+	// Sample is the duration for which block or mutex events are
+	// sampled before the profile is taken.
+	Sample time.Duration
 }
 
 // Profile returns the named pprof profile for the current process.
@@ -293,6 +511,11 @@ func (s *Supervisor) Profile(ctx context.Context, req profileRequest, prof *io.R
 	if p == nil {
 		return fmt.Errorf("no such profile %s", req.Name)
 	}
+	if req.Sample > 0 && (req.Name == "block" || req.Name == "mutex") {
+		if err := sampleContention(ctx, req.Name, req.Sample); err != nil {
+			return err
+		}
+	}
 	r, w := io.Pipe()
 	*prof = r
 	go func() {
@@ -321,6 +544,14 @@ type keepaliveReply struct {
 	// Healthy indicates whether the supervisor believes the process to
 	// be healthy. An unhealthy process may soon die.
 	Healthy bool
+	// Reason describes why the process is unhealthy.
+	Reason string
+	// MemoryTrips are the memory thresholds currently crossed by the
+	// process (see MemoryWatchdog).
+	MemoryTrips []MemoryTrip
+	// Services are the statuses of the process's services that have
+	// panicked (see ServiceRestart).
+	Services []ServiceStatus
 }
 
 // Keepalive maintains the machine keepalive. The next argument
@@ -339,7 +570,23 @@ func (s *Supervisor) Keepalive(ctx context.Context, next time.Duration, reply *k
 	select {
 	case s.nextc <- t:
 		reply.Next = time.Until(t)
-		reply.Healthy = atomic.LoadUint32(&s.healthy) != 0
+		reply.Healthy = true
+		var memUnhealthy bool
+		reply.MemoryTrips, memUnhealthy = s.memoryStatus()
+		reply.Services = s.serviceStatuses()
+		if atomic.LoadUint32(&s.healthy) == 0 {
+			reply.Healthy = false
+			reply.Reason = "system memory is nearly exhausted"
+		} else if memUnhealthy {
+			reply.Healthy = false
+			reply.Reason = "memory threshold " + reply.MemoryTrips[0].String()
+		} else if err := s.diskError(); err != nil {
+			reply.Healthy = false
+			reply.Reason = err.Error()
+		} else if err := s.healthError(); err != nil {
+			reply.Healthy = false
+			reply.Reason = err.Error()
+		}
 		return nil
 	case <-ctx.Done():
 		return ctx.Err()
@@ -357,15 +604,30 @@ type shutdownRequest struct {
 	Message string
 }
 
+// shutdownDrainTimeout is the amount of time for which Shutdown
+// waits for in-flight calls to complete before exiting.
+const shutdownDrainTimeout = 10 * time.Second
+
 // Shutdown will cause the process to exit asynchronously at a point
-// in the future no sooner than the specified delay.
+// in the future no sooner than the specified delay. Before exiting,
+// the machine logs the request's message, and its server then stops
+// accepting calls and waits (for a limited time) for calls in flight
+// to complete. Log streams (Tail, Logs) and file watches are not
+// waited for.
 func (s *Supervisor) Shutdown(ctx context.Context, req shutdownRequest, _ *struct{}) error {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		wg.Done()
 		time.Sleep(req.Delay)
+		// The message is logged first, so that it reaches log streams
+		// without waiting for calls to drain.
 		log.Print(req.Message)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownDrainTimeout)
+		if err := s.server.Shutdown(ctx); err != nil {
+			log.Error.Printf("shutdown: in-flight calls did not complete: %v", err)
+		}
+		cancel()
 		s.system.Exit(1)
 	}()
 	// Ensure the go routine is scheduled so that the delay is
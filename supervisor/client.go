@@ -0,0 +1,217 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package supervisor provides a low-level client of the bigmachine
+// supervisor, the agent that runs on every bigmachine machine (see
+// bigmachine.Supervisor). The client may be used against any
+// reachable supervisor, without a bigmachine.B, to build custom
+// provisioning tools on top of the supervisor protocol: for example,
+// to upload and exec a binary on a machine that was booted by other
+// means.
+package supervisor
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigmachine"
+	"github.com/grailbio/bigmachine/rpc"
+)
+
+// A Client is a client of a single machine's supervisor. Clients are
+// safe for concurrent use.
+type Client struct {
+	client *rpc.Client
+	addr   string
+}
+
+// New returns a client of the supervisor at the provided address
+// (for example, "https://10.0.0.1:2000/"). Calls are made with the
+// HTTP clients returned by the provided factory, which must be
+// configured to authenticate with the machine: typically, it is the
+// HTTPClient method of the System with which the machine was booted.
+func New(clientFactory func() *http.Client, addr string, opts ...rpc.ClientOption) (*Client, error) {
+	client, err := rpc.NewClient(clientFactory, bigmachine.RpcPrefix, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{client: client, addr: addr}, nil
+}
+
+// Addr returns the address of the client's supervisor.
+func (c *Client) Addr() string {
+	return c.addr
+}
+
+// Call calls the supervisor's method with the provided name (for
+// example, "Swapon"), for methods that are not otherwise wrapped by
+// the client. See bigmachine.Supervisor for the methods' arguments
+// and replies.
+func (c *Client) Call(ctx context.Context, method string, arg, reply interface{}) error {
+	return c.client.Call(ctx, c.addr, "Supervisor."+method, arg, reply)
+}
+
+// Ping checks that the supervisor is reachable.
+func (c *Client) Ping(ctx context.Context) error {
+	return c.Call(ctx, "Ping", 0, nil)
+}
+
+// Info returns system information about the machine, including the
+// OS, architecture, and digest of its running binary.
+func (c *Client) Info(ctx context.Context) (bigmachine.Info, error) {
+	var info bigmachine.Info
+	err := c.Call(ctx, "Info", struct{}{}, &info)
+	return info, err
+}
+
+// Setargs sets the arguments with which the binary is run by Exec.
+func (c *Client) Setargs(ctx context.Context, args []string) error {
+	return c.Call(ctx, "Setargs", args, nil)
+}
+
+// Setenv sets environment variables, of the form "key=value", with
+// which the binary is run by Exec, in addition to the supervisor's
+// environment.
+func (c *Client) Setenv(ctx context.Context, env []string) error {
+	return c.Call(ctx, "Setenv", env, nil)
+}
+
+// Setbinary uploads the binary that is run by Exec. The binary must
+// be built for the machine's OS and architecture (see Info).
+func (c *Client) Setbinary(ctx context.Context, binary io.Reader) error {
+	return c.Call(ctx, "Setbinary", binary, nil)
+}
+
+// Exec replaces the supervisor's process with the binary uploaded by
+// Setbinary. Since the process is replaced before it can reply, the
+// resulting network error is not reported; the caller should ping the
+// machine (see Ping) to determine that the binary is running.
+func (c *Client) Exec(ctx context.Context) error {
+	err := c.Call(ctx, "Exec", struct{}{}, nil)
+	if err != nil && errors.Is(errors.Net, err) {
+		err = nil
+	}
+	return err
+}
+
+// A tailRequest is the argument of Supervisor.Tail.
+type tailRequest struct {
+	Compressors []string
+}
+
+// Tail returns a reader that follows the log output of the machine's
+// process from the time of the call, until the reader is closed or
+// the context is canceled (see bigmachine.Machine.Tail). The stream
+// is gzip-compressed in transit if the supervisor supports it.
+func (c *Client) Tail(ctx context.Context) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	if err := c.Call(ctx, "Tail", tailRequest{[]string{"gzip"}}, &rc); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(rc)
+	name, err := br.ReadString('\n')
+	if err != nil {
+		rc.Close()
+		return nil, errors.E(fmt.Sprintf("%s: tail", c.addr), err)
+	}
+	switch name = strings.TrimSuffix(name, "\n"); name {
+	case "":
+		return struct {
+			io.Reader
+			io.Closer
+		}{br, rc}, nil
+	case "gzip":
+		r, err := gzip.NewReader(br)
+		if err != nil {
+			rc.Close()
+			return nil, errors.E(fmt.Sprintf("%s: tail", c.addr), err)
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{r, rc}, nil
+	default:
+		rc.Close()
+		return nil, errors.E(errors.NotSupported, fmt.Sprintf("%s: tail: unknown compressor %s", c.addr, name))
+	}
+}
+
+// A commandFrame is a frame of the stream with which
+// Supervisor.Command replies.
+type commandFrame struct {
+	Stream int
+	Data   []byte
+	Exited bool
+	Code   int
+	Err    string
+}
+
+// Run runs the provided command on the machine, streaming its
+// standard output and standard error to the provided writers, which
+// may be nil to discard output, and returns its exit code (see
+// bigmachine.Machine.Command). A nonzero exit code is not an error.
+func (c *Client) Run(ctx context.Context, cmd bigmachine.Command, stdout, stderr io.Writer) (code int, err error) {
+	if len(cmd.Args) == 0 {
+		return -1, errors.E(errors.Invalid, "command has no arguments")
+	}
+	var rc io.ReadCloser
+	if err = c.Call(ctx, "Command", cmd, &rc); err != nil {
+		return -1, err
+	}
+	defer rc.Close()
+	dec := gob.NewDecoder(rc)
+	for {
+		var frame commandFrame
+		if err = dec.Decode(&frame); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return -1, errors.E(fmt.Sprintf("command %s", cmd.Args[0]), err)
+		}
+		if frame.Exited {
+			if frame.Err != "" {
+				return -1, errors.E(fmt.Sprintf("command %s", cmd.Args[0]), frame.Err)
+			}
+			return frame.Code, nil
+		}
+		w := stdout
+		if frame.Stream == 2 {
+			w = stderr
+		}
+		if w == nil {
+			continue
+		}
+		if _, err = w.Write(frame.Data); err != nil {
+			return -1, err
+		}
+	}
+}
+
+// Stats describes the resource usage of a machine.
+type Stats struct {
+	Mem  bigmachine.MemInfo
+	Disk bigmachine.DiskInfo
+	Load bigmachine.LoadInfo
+}
+
+// Stats returns the machine's memory, disk, and load statistics. Go
+// runtime memory statistics are included if readMemStats is true.
+func (c *Client) Stats(ctx context.Context, readMemStats bool) (Stats, error) {
+	var stats Stats
+	if err := c.Call(ctx, "MemInfo", readMemStats, &stats.Mem); err != nil {
+		return stats, err
+	}
+	if err := c.Call(ctx, "DiskInfo", struct{}{}, &stats.Disk); err != nil {
+		return stats, err
+	}
+	err := c.Call(ctx, "LoadInfo", struct{}{}, &stats.Load)
+	return stats, err
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package supervisor_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/bigmachine"
+	"github.com/grailbio/bigmachine/supervisor"
+	"github.com/grailbio/bigmachine/testsystem"
+)
+
+type nopService struct{}
+
+func init() {
+	gob.Register(nopService{})
+}
+
+func TestClient(t *testing.T) {
+	system := testsystem.New()
+	b := bigmachine.Start(system)
+	defer b.Shutdown()
+	ctx := context.Background()
+	machines, err := b.Start(ctx, 1, bigmachine.Services{"Nop": nopService{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := machines[0]
+	<-m.Wait(bigmachine.Running)
+
+	c, err := supervisor.New(system.HTTPClient, m.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	info, err := c.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.Goos, runtime.GOOS; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	var stdout bytes.Buffer
+	code, err := c.Run(ctx, bigmachine.Command{Args: []string{"sh", "-c", "echo hello; exit 2"}}, &stdout, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := code, 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := stdout.String(), "hello\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	stats, err := c.Stats(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Mem.System.Total == 0 || stats.Mem.Runtime.Sys == 0 {
+		t.Errorf("missing memory stats: %+v", stats.Mem)
+	}
+	if err = c.Setbinary(ctx, strings.NewReader("#!/bin/sh\n")); err != nil {
+		t.Fatal(err)
+	}
+	// The testsystem does not capture machines' log output.
+	if _, err = c.Tail(ctx); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/grailbio/base/data"
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+)
+
+// Swap is a machine parameter that configures swap space on the
+// machine before its binary is executed. Swap is meant as a
+// survivability backstop for workloads with rare memory spikes: with
+// swap, such a spike slows the machine down instead of causing it to
+// be killed by the kernel's out-of-memory killer, losing its work.
+//
+// The swap space is allocated as a file in Dir, which should reside
+// on fast local storage, such as an instance store. Swap is supported
+// only on Linux, and requires that the machine's supervisor run with
+// the privileges to enable swap.
+type Swap struct {
+	// Size is the size of the swap space, in bytes.
+	Size int64
+	// Dir is the directory in which the swap file is allocated. If
+	// empty, the machine's temporary directory is used; on EC2, this
+	// is the data disk, if one is configured.
+	Dir string
+	// Swappiness sets the kernel's vm.swappiness parameter, between 1
+	// and 100. Lower values make the kernel less inclined to swap;
+	// values near 1 use swap only to avoid running out of memory. If
+	// zero, the system's setting is retained.
+	Swappiness int
+}
+
+func (s Swap) applyParam(m *Machine) {
+	m.swap = &s
+}
+
+// String returns a summary of the swap configuration.
+func (s Swap) String() string {
+	str := fmt.Sprintf("swap %s", data.Size(s.Size))
+	if s.Swappiness > 0 {
+		str += fmt.Sprintf(" (swappiness %d)", s.Swappiness)
+	}
+	return str
+}
+
+// swapFile is the name of the swap file allocated by Swapon.
+const swapFile = "bigmachine.swap"
+
+// Swapon configures and enables the swap space described by its
+// argument. It should be called before Exec.
+func (s *Supervisor) Swapon(ctx context.Context, swap Swap, _ *struct{}) error {
+	if swap.Size <= 0 {
+		return errors.E(errors.Invalid, fmt.Sprintf("invalid swap size %d", swap.Size))
+	}
+	if swap.Swappiness < 0 || swap.Swappiness > 100 {
+		return errors.E(errors.Invalid, fmt.Sprintf("invalid swappiness %d", swap.Swappiness))
+	}
+	dir := swap.Dir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	path := filepath.Join(dir, swapFile)
+	if err := swapon(path, swap.Size); err != nil {
+		return errors.E("swapon", path, err)
+	}
+	if swap.Swappiness > 0 {
+		if err := setSwappiness(swap.Swappiness); err != nil {
+			return errors.E("set swappiness", err)
+		}
+	}
+	log.Printf("enabled %s at %s", swap, path)
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package bigmachine
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/grailbio/base/errors"
+)
+
+func swapon(path string, size int64) error {
+	active, err := swapActive(path)
+	if err != nil {
+		return err
+	}
+	if active {
+		// The swap file was enabled by a previous incarnation of this
+		// machine's binary.
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	err = syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	if out, err := exec.Command("mkswap", path).CombinedOutput(); err != nil {
+		os.Remove(path)
+		return errors.E(fmt.Sprintf("mkswap: %s", strings.TrimSpace(string(out))), err)
+	}
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_SWAPON, uintptr(unsafe.Pointer(p)), 0, 0); errno != 0 {
+		os.Remove(path)
+		return errno
+	}
+	return nil
+}
+
+// SwapActive tells whether swap is enabled on the provided file.
+func swapActive(path string) (bool, error) {
+	f, err := os.Open("/proc/swaps")
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		if fields := strings.Fields(scan.Text()); len(fields) > 0 && fields[0] == path {
+			return true, nil
+		}
+	}
+	return false, scan.Err()
+}
+
+func setSwappiness(swappiness int) error {
+	return ioutil.WriteFile("/proc/sys/vm/swappiness", []byte(fmt.Sprintf("%d\n", swappiness)), 0644)
+}
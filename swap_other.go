@@ -0,0 +1,18 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package bigmachine
+
+import "github.com/grailbio/base/errors"
+
+func swapon(path string, size int64) error {
+	return errors.E(errors.NotSupported, "swap is supported only on linux")
+}
+
+func setSwappiness(swappiness int) error {
+	return errors.E(errors.NotSupported, "swap is supported only on linux")
+}
@@ -13,6 +13,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/base/fatbin"
 	"github.com/grailbio/base/must"
 )
 
@@ -69,6 +71,78 @@ type System interface {
 	Read(ctx context.Context, m *Machine, filename string) (io.Reader, error)
 }
 
+// A machineNamer is a System that labels machines with their names
+// (see Machine.Name) in the underlying infrastructure, for example as
+// cloud instance tags. B.Start calls NameMachines, asynchronously,
+// once it has named the machines started by the system. Errors are
+// the system's to log.
+type machineNamer interface {
+	NameMachines(ctx context.Context, machines []*Machine)
+}
+
+// A specStarter is a System that can start machines of different
+// shapes (for example, different cloud instance types) within the same
+// session. B.Start calls StartSpec instead of Start when it is
+// provided a MachineSpec.
+type specStarter interface {
+	StartSpec(ctx context.Context, n int, spec MachineSpec) ([]*Machine, error)
+}
+
+// A machinePricer is a System that can report the prices of its
+// machines, for cost accounting (see B.CostReport). B calls
+// MachinePricing once for each machine that it manages; ok is false if
+// the machine's price is unknown.
+type machinePricer interface {
+	MachinePricing(m *Machine) (pricing Pricing, ok bool)
+}
+
+// A machineLocator is a System that can report the locations of the
+// driver and of its machines, for traffic accounting (see
+// Machine.TrafficScope). B calls MachineLocation once for each machine
+// that it manages; ok is false if the location is unknown.
+type machineLocator interface {
+	DriverLocation() (loc Location, ok bool)
+	MachineLocation(m *Machine) (loc Location, ok bool)
+}
+
+// A machineExiter is a System that can report how the processes of
+// its machines exited, for crash reports (see Machine.CrashReport).
+// MachineExit waits for the process of machine m to exit, or for the
+// context to be done.
+type machineExiter interface {
+	MachineExit(ctx context.Context, m *Machine) (ExitStatus, error)
+}
+
+// A machineRebooter is a System that can reboot the instances of its
+// machines (see Machine.Reboot). RebootMachine returns once the
+// reboot has been initiated; the machine's supervisor must be started
+// again when the instance boots.
+type machineRebooter interface {
+	RebootMachine(ctx context.Context, m *Machine) error
+}
+
+// A binaryStager is a System that can stage binaries in a store from
+// which machines fetch them directly (see Supervisor.FetchBinary), so
+// that the driver uploads each binary once, instead of once for each
+// machine. StageBinary stages the image of the provided binary that is
+// described by info, and whose digest is provided, unless it was
+// staged before, and returns a URL from which machines may fetch it
+// with an HTTP GET request. It returns an error of kind
+// errors.NotSupported if the system is not configured to stage
+// binaries.
+type binaryStager interface {
+	StageBinary(ctx context.Context, bin *fatbin.Reader, info fatbin.Info, d digest.Digest) (url string, err error)
+}
+
+// A machineSelector is a System that can find running machines that
+// were launched outside of bigmachine, for example by infrastructure
+// tooling, by their tags in the underlying infrastructure. The
+// returned machines need only have their addresses set. B.Attach
+// calls SelectMachines.
+type machineSelector interface {
+	SelectMachines(ctx context.Context, tags Labels) ([]*Machine, error)
+}
+
 var (
 	systemsMu sync.Mutex
 	systems   = make(map[string]System)
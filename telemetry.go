@@ -0,0 +1,54 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"math/rand"
+	"time"
+)
+
+// SampledEvents are the types of the high-frequency events logged
+// through System.Event that are subject to sampling (see Telemetry).
+// Other events, such as machine errors and stops, are always logged.
+var sampledEvents = map[string]bool{
+	"bigmachine:machineAlive": true,
+}
+
+// Telemetry configures the overhead of a B's telemetry, so that it
+// stays bounded under high call rates.
+type Telemetry struct {
+	// EventSampleRate is the fraction, between 0 and 1, of
+	// high-frequency events (for example, the event logged for each
+	// keepalive) that are logged through System.Event. The decision is
+	// made as each event is produced. Zero logs all events.
+	EventSampleRate float64
+	// StatsInterval, if positive, pre-aggregates per-call RPC
+	// statistics in memory and publishes them at the provided interval
+	// (see rpc.SetStatsInterval), instead of updating them on every
+	// call. It applies to the driver and its machines.
+	StatsInterval time.Duration
+}
+
+// LimitTelemetry is an option that bounds the overhead of the B's
+// telemetry according to the provided configuration.
+func LimitTelemetry(t Telemetry) Option {
+	return func(b *B) {
+		b.telemetry = t
+	}
+}
+
+// SampleEvents returns an event logger that logs the events logged by
+// event, sampling high-frequency events at the provided rate.
+func sampleEvents(event func(typ string, fieldPairs ...interface{}), rate float64) func(typ string, fieldPairs ...interface{}) {
+	if rate <= 0 || rate >= 1 {
+		return event
+	}
+	return func(typ string, fieldPairs ...interface{}) {
+		if sampledEvents[typ] && rand.Float64() >= rate {
+			return
+		}
+		event(typ, fieldPairs...)
+	}
+}
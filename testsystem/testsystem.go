@@ -5,7 +5,10 @@
 // Package testsystem implements a bigmachine system that's useful
 // for testing. Unlike other system implementations,
 // testsystem.System does not spawn new processes: instead, machines
-// are launched inside of the same process.
+// are launched inside of the same process. Machines communicate
+// through an in-memory network (see rpc.PipeNetwork), or, if
+// System.Memory is set, through a pure in-memory transport that
+// bypasses HTTP altogether (see rpc.MemoryNetwork).
 package testsystem
 
 import (
@@ -13,8 +16,8 @@ import (
 	"encoding/gob"
 	"io"
 	"math/rand"
+	"net"
 	"net/http"
-	"net/http/httptest"
 	"os"
 	"sync"
 	"time"
@@ -36,15 +39,14 @@ type closeIdleTransport interface {
 type machine struct {
 	*bigmachine.Machine
 	Cancel func()
-	Server *httptest.Server
+	Close  func()
+	// Tags are the tags of machines that were launched by Launch.
+	Tags bigmachine.Labels
 }
 
 func (m *machine) Kill() {
 	m.Cancel()
-	m.Server.CloseClientConnections()
-	m.Server.Close()
-	m.Server.Listener.Close()
-	m.Server.Config.SetKeepAlivesEnabled(false)
+	m.Close()
 }
 
 // System implements a bigmachine System for testing.
@@ -57,23 +59,50 @@ type System struct {
 	// of Bigmachine's keepalive mechanism.
 	KeepalivePeriod, KeepaliveTimeout, KeepaliveRpcTimeout time.Duration
 
+	// Memory selects a pure in-memory transport, which dispatches calls
+	// directly to machines' RPC servers without HTTP or connections
+	// (see rpc.MemoryNetwork). This makes machines very cheap to start
+	// and call, which is useful for test suites that start many
+	// machines. Memory must be set before the system is used.
+	Memory bool
+
+	// Pricing, if not nil, is reported as the pricing of every machine
+	// (see bigmachine.B.CostReport).
+	Pricing *bigmachine.Pricing
+
+	// Locations, if not empty, are the locations in which machines are
+	// placed, in turn; the driver is placed in the first location (see
+	// bigmachine.Machine.TrafficScope).
+	Locations []bigmachine.Location
+
 	done   chan struct{}
 	b      *bigmachine.B
 	exited bool
 
-	client *http.Client
+	network *rpc.PipeNetwork
+	client  *http.Client
+
+	memory       *rpc.MemoryNetwork
+	memoryClient *http.Client
 
 	mu       sync.Mutex
 	cond     *sync.Cond
 	machines []*machine
+	// nextLocation is the index of the location of the next machine.
+	nextLocation int
 }
 
 // New creates a new System that is ready for use.
 func New() *System {
+	network := rpc.NewPipeNetwork()
+	memory := rpc.NewMemoryNetwork()
 	s := &System{
 		Machineprocs: 1,
 		done:         make(chan struct{}),
-		client:       &http.Client{Transport: &http.Transport{}},
+		network:      network,
+		client:       &http.Client{Transport: &http.Transport{DialContext: network.DialContext}},
+		memory:       memory,
+		memoryClient: &http.Client{Transport: memory},
 	}
 	s.cond = sync.NewCond(&s.mu)
 	return s
@@ -171,6 +200,9 @@ func (*System) Event(_ string, _ ...interface{}) {}
 // HTTPClient returns an http.Client that can converse with
 // servers created by this test system.
 func (s *System) HTTPClient() *http.Client {
+	if s.Memory {
+		return s.memoryClient
+	}
 	return s.client
 }
 
@@ -189,30 +221,146 @@ func (s *System) Start(_ context.Context, count int) ([]*bigmachine.Machine, err
 	s.mu.Lock()
 	machines := make([]*bigmachine.Machine, count)
 	for i := range machines {
-		ctx, cancel := context.WithCancel(context.Background())
-		server := rpc.NewServer()
-		supervisor := bigmachine.StartSupervisor(ctx, s.b, s, server)
-		if err := server.Register("Supervisor", supervisor); err != nil {
-			// Something is broken if we can't register the supervisor in the
-			// testsystem.
-			panic(err)
+		machines[i] = s.launch(nil)
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	return machines, nil
+}
+
+// Launch starts count machines with the provided tags, simulating
+// machines that are launched by tooling external to bigmachine. The
+// machines are not managed by any B; they may be adopted by B.Attach.
+// Launch returns the machines' addresses.
+func (s *System) Launch(count int, tags bigmachine.Labels) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addrs := make([]string, count)
+	for i := range addrs {
+		addrs[i] = s.launch(tags).Addr
+	}
+	s.cond.Broadcast()
+	return addrs
+}
+
+// SelectMachines returns new machines with the addresses of the live
+// machines that were launched by Launch with each of the provided
+// tags.
+func (s *System) SelectMachines(_ context.Context, tags bigmachine.Labels) ([]*bigmachine.Machine, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var machines []*bigmachine.Machine
+	for _, sm := range s.machines {
+		if sm.Tags == nil || !sm.Tags.Match(tags) {
+			continue
 		}
-		mux := http.NewServeMux()
-		mux.Handle(bigmachine.RpcPrefix, server)
-		httpServer := httptest.NewServer(mux)
-		m := &bigmachine.Machine{
-			Addr:     httpServer.URL,
-			Maxprocs: s.Machineprocs,
+		machines = append(machines, &bigmachine.Machine{
+			Addr:     sm.Addr,
+			Maxprocs: sm.Maxprocs,
 			NoExec:   true,
+		})
+	}
+	return machines, nil
+}
+
+// Launch starts a new machine with the provided tags. It must be
+// called with s.mu held.
+func (s *System) launch(tags bigmachine.Labels) *bigmachine.Machine {
+	ctx, cancel := context.WithCancel(context.Background())
+	limits := s.b.MessageLimits()
+	server := rpc.NewServer(rpc.ServerLimits(limits.MaxArg, limits.MaxReply))
+	supervisor := bigmachine.StartSupervisor(ctx, s.b, s, server)
+	if err := server.Register("Supervisor", supervisor); err != nil {
+		// Something is broken if we can't register the supervisor in the
+		// testsystem.
+		panic(err)
+	}
+	if err := server.Register("Blobs", bigmachine.NewBlobs()); err != nil {
+		panic(err)
+	}
+	if err := server.Register("Barriers", bigmachine.NewBarriers()); err != nil {
+		panic(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(bigmachine.RpcPrefix, server)
+	var (
+		host     string
+		shutdown func()
+	)
+	if s.Memory {
+		host = s.memory.Handle(mux)
+		shutdown = func() { s.memory.Remove(host) }
+	} else {
+		listener := s.network.Listen()
+		httpServer := &http.Server{Handler: mux}
+		go func(l net.Listener) {
+			_ = httpServer.Serve(l)
+		}(listener)
+		host = listener.Addr().String()
+		shutdown = func() {
+			httpServer.SetKeepAlivesEnabled(false)
+			httpServer.Close()
 		}
-		s.machines = append(s.machines, &machine{m, cancel, httpServer})
-		machines[i] = m
 	}
-	s.cond.Broadcast()
-	s.mu.Unlock()
+	m := &bigmachine.Machine{
+		Addr:     "http://" + host,
+		Maxprocs: s.Machineprocs,
+		NoExec:   true,
+	}
+	s.machines = append(s.machines, &machine{m, cancel, shutdown, tags})
+	return m
+}
+
+// DiscoverMachines returns new machines with the addresses of the
+// live machines that belong to the provided persistent cluster, so
+// that a B may reattach to machines that were started by another B
+// of the same test system.
+func (s *System) DiscoverMachines(_ context.Context, cluster string) ([]*bigmachine.Machine, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var machines []*bigmachine.Machine
+	for _, sm := range s.machines {
+		if sm.Cluster() != cluster {
+			continue
+		}
+		machines = append(machines, &bigmachine.Machine{
+			Addr:     sm.Addr,
+			Maxprocs: sm.Maxprocs,
+			NoExec:   true,
+		})
+	}
 	return machines, nil
 }
 
+// MachinePricing returns the system's Pricing, if it is set.
+func (s *System) MachinePricing(*bigmachine.Machine) (bigmachine.Pricing, bool) {
+	if s.Pricing == nil {
+		return bigmachine.Pricing{}, false
+	}
+	return *s.Pricing, true
+}
+
+// DriverLocation returns the first of the system's Locations, if
+// any.
+func (s *System) DriverLocation() (bigmachine.Location, bool) {
+	if len(s.Locations) == 0 {
+		return bigmachine.Location{}, false
+	}
+	return s.Locations[0], true
+}
+
+// MachineLocation returns the next of the system's Locations, if any.
+func (s *System) MachineLocation(*bigmachine.Machine) (bigmachine.Location, bool) {
+	if len(s.Locations) == 0 {
+		return bigmachine.Location{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	loc := s.Locations[s.nextLocation%len(s.Locations)]
+	s.nextLocation++
+	return loc, true
+}
+
 // Exit marks the system as exited.
 func (s *System) Exit(int) {
 	s.exited = true
@@ -5,16 +5,46 @@
 package testsystem
 
 import (
+	"bytes"
 	"context"
+	"crypto"
 	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/google/pprof/profile"
+	"github.com/grailbio/base/digest"
 	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/retry"
 	"github.com/grailbio/bigmachine"
+	"github.com/grailbio/bigmachine/rpc"
 )
 
 func init() {
 	gob.Register(&testService{})
+	gob.Register(&drainService{})
+	gob.Register(&optService{})
+	gob.Register(&quorumService{})
+	gob.Register(&logService{})
+	gob.Register(&readyService{})
+	gob.Register(&notReadyService{})
+	gob.Register(&panickyService{})
+	gob.Register(&phaseService{})
+	gob.Register(&graceService{})
+	gob.Register(&lostService{})
 }
 
 type testService struct {
@@ -27,7 +57,17 @@ func (t *testService) Method(ctx context.Context, arg int, reply *int) error {
 }
 
 func TestTestSystem(t *testing.T) {
+	testTestSystem(t, New())
+}
+
+func TestTestSystemMemory(t *testing.T) {
 	test := New()
+	test.Memory = true
+	testTestSystem(t, test)
+}
+
+func testTestSystem(t *testing.T, test *System) {
+	t.Helper()
 	b := bigmachine.Start(test)
 	defer b.Shutdown()
 	ctx := context.Background()
@@ -61,3 +101,2058 @@ func TestTestSystem(t *testing.T) {
 	}
 	m.Wait(bigmachine.Stopped)
 }
+
+func TestQuerySubscribe(t *testing.T) {
+	test := New()
+	test.KeepalivePeriod = time.Second
+	test.KeepaliveTimeout = 2 * time.Second
+	test.KeepaliveRpcTimeout = time.Second
+	b := bigmachine.Start(test, bigmachine.Name("test"))
+	defer b.Shutdown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := b.Subscribe(ctx)
+	machines, err := b.Start(ctx, 2, bigmachine.Services{
+		"Service": &testService{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range machines {
+		if got, want := m.Name(), fmt.Sprintf("test-%04d", i); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	running := make(map[*bigmachine.Machine]bool)
+	for len(running) < len(machines) {
+		update := <-updates
+		if update.State == bigmachine.Running {
+			running[update.Machine] = true
+		}
+	}
+	if got, want := len(b.Query(bigmachine.Query{States: []bigmachine.State{bigmachine.Running}, Healthy: true})), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(b.Query(bigmachine.Query{MinAge: time.Hour})), 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if !test.Kill(machines[0]) {
+		t.Fatal("failed to kill machine")
+	}
+	for update := range updates {
+		if update.Machine == machines[0] && update.State == bigmachine.Stopped {
+			break
+		}
+	}
+	stopped := b.Query(bigmachine.Query{States: []bigmachine.State{bigmachine.Stopped}})
+	if got, want := len(stopped), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := stopped[0], machines[0]; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	cancel()
+	for range updates {
+	}
+}
+
+func TestAbortOnErrors(t *testing.T) {
+	test := New()
+	test.KeepalivePeriod = time.Second
+	test.KeepaliveTimeout = 2 * time.Second
+	test.KeepaliveRpcTimeout = time.Second
+	b := bigmachine.Start(test, bigmachine.AbortOnErrors(bigmachine.ErrorBudget{MaxMachineFailures: 1}))
+	defer b.Shutdown()
+	ctx := context.Background()
+	machines, err := b.Start(ctx, 3, bigmachine.Services{
+		"Service": &testService{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range machines {
+		<-m.Wait(bigmachine.Running)
+	}
+	if !test.Kill(machines[0]) {
+		t.Fatal("failed to kill machine")
+	}
+	<-machines[0].Wait(bigmachine.Stopped)
+	if err := b.Err(); err != nil {
+		t.Fatalf("aborted after a single failure: %v", err)
+	}
+	if !test.Kill(machines[1]) {
+		t.Fatal("failed to kill machine")
+	}
+	select {
+	case <-b.Aborted():
+	case <-time.After(time.Minute):
+		t.Fatal("failed to abort")
+	}
+	if err := b.Err(); err == nil || !strings.Contains(err.Error(), "error budget exceeded") {
+		t.Errorf("bad error %v", err)
+	}
+	var reply int
+	if err := machines[2].Call(ctx, "Service.Method", 0, &reply); err != b.Err() {
+		t.Errorf("got %v, want %v", err, b.Err())
+	}
+	if _, err := b.Start(ctx, 1, bigmachine.Services{"Service": &testService{}}); err != b.Err() {
+		t.Errorf("got %v, want %v", err, b.Err())
+	}
+}
+
+func TestEvents(t *testing.T) {
+	test := New()
+	test.KeepalivePeriod = time.Second
+	test.KeepaliveTimeout = 2 * time.Second
+	test.KeepaliveRpcTimeout = time.Second
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := b.Events(ctx)
+	machines, err := b.Start(ctx, 1, bigmachine.Services{
+		"Service": &testService{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := machines[0]
+	<-m.Wait(bigmachine.Running)
+	if !test.Kill(m) {
+		t.Fatal("failed to kill machine")
+	}
+	var types []bigmachine.MachineEventType
+	for event := range events {
+		if event.Machine != m {
+			t.Fatalf("got event for machine %s, want %s", event.Machine.Name(), m.Name())
+		}
+		types = append(types, event.Type)
+		if event.Type == bigmachine.MachineStopped {
+			if event.Err == nil {
+				t.Error("missing stop cause")
+			}
+			break
+		}
+	}
+	want := []bigmachine.MachineEventType{
+		bigmachine.MachineBooting,
+		bigmachine.MachineRunning,
+		bigmachine.MachineKeepaliveLost,
+		bigmachine.MachineStopped,
+	}
+	if got := types; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	cancel()
+	for range events {
+	}
+}
+
+func TestAutoscale(t *testing.T) {
+	test := New()
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var (
+		mu   sync.Mutex
+		load float64
+	)
+	setLoad := func(l float64) {
+		mu.Lock()
+		load = l
+		mu.Unlock()
+	}
+	setLoad(2.5)
+	a, err := b.Autoscale(ctx, bigmachine.AutoscalePolicy{
+		Min: 1,
+		Max: 4,
+		Load: func() float64 {
+			mu.Lock()
+			defer mu.Unlock()
+			return load
+		},
+		Period:         10 * time.Millisecond,
+		ScaleDownDelay: 50 * time.Millisecond,
+		WarmTime:       time.Hour,
+	}, bigmachine.Services{"Service": &testService{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitTarget := func(n int) {
+		t.Helper()
+		for i := 0; len(a.Machines()) != n; i++ {
+			if i == 1000 {
+				t.Fatalf("got %v machines, want %v", len(a.Machines()), n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitTarget(3)
+	for _, m := range a.Machines() {
+		<-m.Wait(bigmachine.Running)
+	}
+	setLoad(0)
+	waitTarget(1)
+	// The retired machines are warm, and are reused.
+	setLoad(3)
+	waitTarget(3)
+	if got, want := len(b.Machines()), 3; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	setLoad(100)
+	waitTarget(4)
+	if got, want := a.Target(), 4; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// DrainService is a service whose methods coordinate with TestDrain
+// through package variables, since services are copied to machines.
+type drainService struct {
+	Name string
+}
+
+var (
+	drainMu      sync.Mutex
+	drained      bool
+	drainBlocked = make(chan struct{}, 1)
+	drainRelease = make(chan struct{})
+)
+
+func (s *drainService) Drain(ctx context.Context) error {
+	drainMu.Lock()
+	drained = true
+	drainMu.Unlock()
+	return nil
+}
+
+func (s *drainService) Block(ctx context.Context, arg int, reply *int) error {
+	drainBlocked <- struct{}{}
+	<-drainRelease
+	return nil
+}
+
+func TestDrain(t *testing.T) {
+	test := New()
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	ctx := context.Background()
+	machines, err := b.Start(ctx, 1, bigmachine.Services{"Drain": &drainService{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := machines[0]
+	<-m.Wait(bigmachine.Running)
+	blocked := make(chan error)
+	go func() {
+		blocked <- m.Call(ctx, "Drain.Block", 0, nil)
+	}()
+	<-drainBlocked
+	drainc := make(chan error)
+	go func() {
+		drainc <- m.Drain(ctx)
+	}()
+	for !m.Draining() {
+		time.Sleep(time.Millisecond)
+	}
+	if err := m.Call(ctx, "Drain.Block", 0, nil); err == nil || !errors.Is(errors.Unavailable, err) {
+		t.Errorf("bad error %v", err)
+	}
+	select {
+	case err := <-drainc:
+		t.Fatalf("drain returned early: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(drainRelease)
+	if err := <-blocked; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-drainc; err != nil {
+		t.Fatal(err)
+	}
+	drainMu.Lock()
+	if !drained {
+		t.Error("service was not drained")
+	}
+	drainMu.Unlock()
+	if got, want := m.State(), bigmachine.Stopped; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// GraceService is a service whose calls block until graceRelease is
+// closed, to test StopGrace.
+type graceService struct {
+	Name string
+}
+
+var (
+	graceBlocked = make(chan struct{}, 1)
+	graceRelease = make(chan struct{})
+)
+
+func (s *graceService) Block(ctx context.Context, arg int, reply *int) error {
+	graceBlocked <- struct{}{}
+	select {
+	case <-graceRelease:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestStopGrace(t *testing.T) {
+	b := bigmachine.Start(New())
+	defer b.Shutdown()
+	ctx := context.Background()
+	start := func(grace time.Duration) (*bigmachine.Machine, chan error) {
+		t.Helper()
+		machines, err := b.Start(ctx, 1,
+			bigmachine.Services{"Grace": &graceService{}},
+			bigmachine.StopGrace{Period: grace})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := machines[0]
+		<-m.Wait(bigmachine.Running)
+		blocked := make(chan error, 1)
+		go func() {
+			blocked <- m.Call(ctx, "Grace.Block", 0, nil)
+		}()
+		<-graceBlocked
+		return m, blocked
+	}
+
+	// Calls that do not complete within the grace period fail.
+	m, blocked := start(50 * time.Millisecond)
+	m.Cancel()
+	if err := <-blocked; err == nil {
+		t.Error("expected error")
+	}
+	<-m.Wait(bigmachine.Stopped)
+
+	m, blocked = start(time.Minute)
+	m.Cancel()
+	select {
+	case err := <-blocked:
+		t.Fatalf("call returned early: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if got, want := m.State(), bigmachine.Running; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if err := m.Call(ctx, "Grace.Block", 0, nil); err == nil || !errors.Is(errors.Unavailable, err) {
+		t.Errorf("bad error %v", err)
+	}
+	close(graceRelease)
+	if err := <-blocked; err != nil {
+		t.Fatal(err)
+	}
+	<-m.Wait(bigmachine.Stopped)
+	if !m.Canceled() {
+		t.Error("machine was not canceled")
+	}
+}
+
+// LostService is a service whose first call blocks until it is
+// canceled, to test calls that are in flight when their machine is
+// lost.
+type lostService struct {
+	Name string
+}
+
+var (
+	lostCalls   int32
+	lostBlocked = make(chan struct{}, 1)
+)
+
+func (s *lostService) Block(ctx context.Context, arg int, reply *int) error {
+	if atomic.AddInt32(&lostCalls, 1) == 1 {
+		lostBlocked <- struct{}{}
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	*reply = 1
+	return nil
+}
+
+func TestMachineLost(t *testing.T) {
+	b := bigmachine.Start(New())
+	defer b.Shutdown()
+	ctx := context.Background()
+	machines, err := b.Start(ctx, 3, bigmachine.Services{"Lost": &lostService{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range machines {
+		<-m.Wait(bigmachine.Running)
+	}
+
+	m := machines[0]
+	errc := make(chan error, 1)
+	go func() {
+		var reply int
+		errc <- m.Call(ctx, "Lost.Block", 0, &reply)
+	}()
+	<-lostBlocked
+	calls := m.InFlightCalls()
+	if got, want := len(calls), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := calls[0].ServiceMethod, "Lost.Block"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	m.Cancel()
+	err = <-errc
+	if !bigmachine.IsMachineLost(err) || !errors.Is(errors.Unavailable, err) {
+		t.Errorf("bad error %v", err)
+	}
+	if got, want := len(m.InFlightCalls()), 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Calls to stopped machines are not lost.
+	if err := m.Call(ctx, "Lost.Block", 0, nil); err == nil || bigmachine.IsMachineLost(err) {
+		t.Errorf("bad error %v", err)
+	}
+
+	atomic.StoreInt32(&lostCalls, 0)
+	m = machines[1]
+	go func() {
+		var reply int
+		err := m.Call(ctx, "Lost.Block", 0, &reply, bigmachine.CallRedispatch(1, b.RedispatchLeastLoaded()))
+		if err == nil && reply != 1 {
+			err = fmt.Errorf("got reply %v, want 1", reply)
+		}
+		errc <- err
+	}()
+	<-lostBlocked
+	m.Cancel()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if got, want := atomic.LoadInt32(&lostCalls), int32(2); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// ReadyService is a service that is ready once readyc is closed.
+type readyService struct{}
+
+var readyc = make(chan struct{})
+
+func (readyService) Ready(ctx context.Context) error {
+	select {
+	case <-readyc:
+		return nil
+	default:
+		return errors.New("loading")
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	test := New()
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	ctx := context.Background()
+	machines, err := b.Start(ctx, 1,
+		bigmachine.Services{"Ready": readyService{}},
+		bigmachine.Readiness{Period: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := machines[0]
+	waitCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if state, err := m.WaitFor(waitCtx, bigmachine.Running, bigmachine.Stopped); err != context.DeadlineExceeded {
+		t.Fatalf("machine %v before its services are ready: %v", state, err)
+	}
+	if got, want := m.State(), bigmachine.Starting; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	close(readyc)
+	if state, err := m.WaitFor(ctx, bigmachine.Running, bigmachine.Stopped); state != bigmachine.Running {
+		t.Errorf("got %v, want %v (%v)", state, bigmachine.Running, err)
+	}
+}
+
+func TestReadinessTimeout(t *testing.T) {
+	test := New()
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	ctx := context.Background()
+	machines, err := b.Start(ctx, 1,
+		bigmachine.Services{"Ready": notReadyService{}},
+		bigmachine.Readiness{Timeout: 100 * time.Millisecond, Period: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := machines[0]
+	<-m.Wait(bigmachine.Stopped)
+	if err := m.Err(); !errors.Is(errors.Unavailable, err) {
+		t.Errorf("got %v, want unavailable error", err)
+	}
+}
+
+// NotReadyService is a service that is never ready.
+type notReadyService struct{}
+
+func (notReadyService) Ready(ctx context.Context) error {
+	return errors.New("loading forever")
+}
+
+// PanickyService is a service whose Panic method panics.
+type panickyService struct{}
+
+var panickyInits int32
+
+func (*panickyService) Init(b *bigmachine.B) error {
+	atomic.AddInt32(&panickyInits, 1)
+	return nil
+}
+
+func (*panickyService) Panic(ctx context.Context, _ struct{}, _ *struct{}) error {
+	panic("oops")
+}
+
+func (*panickyService) Ok(ctx context.Context, _ struct{}, _ *struct{}) error {
+	return nil
+}
+
+func TestServiceRestart(t *testing.T) {
+	test := New()
+	test.KeepalivePeriod = time.Second
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := b.Events(ctx)
+	machines, err := b.Start(ctx, 1,
+		bigmachine.Services{"Panicky": &panickyService{}, "Test": &testService{}},
+		bigmachine.ServiceRestart{Panics: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := machines[0]
+	<-m.Wait(bigmachine.Running)
+	for i := 0; i < 2; i++ {
+		if err = m.Call(ctx, "Panicky.Panic", struct{}{}, nil); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+	// Other services keep serving.
+	if err = m.Call(ctx, "Test.Method", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	for event := range events {
+		if event.Type == bigmachine.MachineServiceRestarted {
+			if got, want := event.Reason, "Panicky"; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			break
+		}
+	}
+	if got, want := atomic.LoadInt32(&panickyInits), int32(2); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err = m.Call(ctx, "Panicky.Ok", struct{}{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	statuses := m.ServiceStatuses()
+	if len(statuses) != 1 || statuses[0].Name != "Panicky" || statuses[0].Quarantined || statuses[0].Restarts != 1 {
+		t.Errorf("bad statuses %+v", statuses)
+	}
+}
+
+func TestAutoReplace(t *testing.T) {
+	test := New()
+	test.KeepalivePeriod = time.Second
+	test.KeepaliveTimeout = 2 * time.Second
+	test.KeepaliveRpcTimeout = time.Second
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	events := b.Events(ctx)
+	machines, err := b.Start(ctx, 1,
+		bigmachine.AutoReplace{Max: 1},
+		bigmachine.Services{"Service": &testService{Index: 7}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := machines[0]
+	if state, err := m.WaitFor(ctx, bigmachine.Running); err != nil || state != bigmachine.Running {
+		t.Fatalf("machine state %v, error %v", state, err)
+	}
+	if !test.Kill(m) {
+		t.Fatal("failed to kill machine")
+	}
+	// Events is closed if the context expires before the machine is
+	// replaced.
+	var replacement *bigmachine.Machine
+	for event := range events {
+		if event.Type == bigmachine.MachineReplaced {
+			if got, want := event.Machine, m; got != want {
+				t.Errorf("got %v, want %v", got.Name(), want.Name())
+			}
+			replacement = event.Replacement
+			break
+		}
+	}
+	if replacement == nil {
+		t.Fatal("machine was not replaced")
+	}
+	if state, err := replacement.WaitFor(ctx, bigmachine.Running); err != nil || state != bigmachine.Running {
+		t.Fatalf("replacement state %v, error %v", state, err)
+	}
+	var reply int
+	if err := replacement.Call(ctx, "Service.Method", 0, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reply, 7; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The replacement is not itself replaced. Machines are replaced as
+	// soon as they stop, so we watch for a replacement for a while
+	// after the replacement's stop is reported.
+	if !test.Kill(replacement) {
+		t.Fatal("failed to kill machine")
+	}
+	var timeout <-chan time.Time
+watch:
+	for {
+		select {
+		case event, ok := <-events:
+			switch {
+			case !ok:
+				t.Fatal("replacement did not stop")
+			case event.Type == bigmachine.MachineReplaced:
+				t.Fatalf("replacement %s was replaced by %s", event.Machine.Name(), event.Replacement.Name())
+			case event.Type == bigmachine.MachineStopped && event.Machine == replacement:
+				timeout = time.After(time.Second)
+			}
+		case <-timeout:
+			break watch
+		}
+	}
+	if got, want := len(b.Machines()), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestStartStream(t *testing.T) {
+	test := New()
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	ctx := context.Background()
+	c, err := b.StartStream(ctx, 3, bigmachine.Services{"Service": &testService{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for m := range c {
+		if got, want := m.State(), bigmachine.Running; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		n++
+	}
+	if got, want := n, 3; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := b.StartStream(ctx, 1); err == nil || !errors.Is(errors.Invalid, err) {
+		t.Errorf("bad error %v", err)
+	}
+}
+
+func TestMachineSpecNotSupported(t *testing.T) {
+	test := New()
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	_, err := b.Start(context.Background(), 1,
+		bigmachine.MachineSpec{InstanceType: "large"},
+		bigmachine.Services{"Service": &testService{}})
+	if err == nil || !errors.Is(errors.NotSupported, err) {
+		t.Errorf("bad error %v", err)
+	}
+}
+
+// OptService is a service whose methods coordinate with TestCallOpts
+// through package variables, since services are copied to machines.
+type optService struct {
+	Name string
+}
+
+var (
+	optMu    sync.Mutex
+	optCalls = make(map[string]int)
+)
+
+func optCall(method string) int {
+	optMu.Lock()
+	defer optMu.Unlock()
+	optCalls[method]++
+	return optCalls[method]
+}
+
+func (s *optService) Hang(ctx context.Context, arg int, reply *int) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (s *optService) Slow(ctx context.Context, arg int, reply *int) error {
+	n := optCall("Slow")
+	if n == 1 {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	*reply = n
+	return nil
+}
+
+func (s *optService) FlakyReader(ctx context.Context, arg io.Reader, reply *int) error {
+	if _, err := io.Copy(ioutil.Discard, arg); err != nil {
+		return err
+	}
+	*reply = optCall("FlakyReader")
+	return errors.E(errors.Temporary, "flaky")
+}
+
+func (s *optService) Bytes(ctx context.Context, n int, reply *[]byte) error {
+	*reply = make([]byte, n)
+	return nil
+}
+
+func (s *optService) Echo(ctx context.Context, arg string, reply *string) error {
+	*reply = arg
+	return nil
+}
+
+func (s *optService) Flaky(ctx context.Context, arg int, reply *int) error {
+	n := optCall("Flaky")
+	if n < 3 {
+		return errors.E(errors.Temporary, "flaky")
+	}
+	*reply = n
+	return nil
+}
+
+func TestCallOpts(t *testing.T) {
+	test := New()
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	ctx := context.Background()
+	machines, err := b.Start(ctx, 1, bigmachine.Services{"Opt": &optService{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := machines[0]
+	<-m.Wait(bigmachine.Running)
+
+	err = m.Call(ctx, "Opt.Hang", 0, nil, bigmachine.CallTimeout(50*time.Millisecond))
+	if err == nil {
+		t.Error("expected timeout")
+	}
+
+	var reply int
+	if err = m.Call(ctx, "Opt.Slow", 0, &reply, bigmachine.CallHedge(10*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reply, 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if err = m.Call(ctx, "Opt.Flaky", 0, &reply); err == nil || !errors.IsTemporary(err) {
+		t.Errorf("bad error %v", err)
+	}
+	policy := retry.Backoff(time.Millisecond, 10*time.Millisecond, 2)
+	if err = m.Call(ctx, "Opt.Flaky", 0, &reply, bigmachine.CallRetry(policy)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reply, 3; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Calls with streamed arguments are not retried.
+	err = m.Call(ctx, "Opt.FlakyReader", strings.NewReader("hello"), &reply, bigmachine.CallRetry(policy))
+	if err == nil || !errors.IsTemporary(err) {
+		t.Errorf("bad error %v", err)
+	}
+	optMu.Lock()
+	calls := optCalls["FlakyReader"]
+	optMu.Unlock()
+	if got, want := calls, 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	var echo string
+	if err = m.Call(ctx, "Opt.Echo", "hello", &echo, bigmachine.CallCodec(rpc.JSON), bigmachine.CallCompression()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := echo, "hello"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMessageLimits(t *testing.T) {
+	b := bigmachine.Start(New())
+	if got, want := b.MessageLimits(), (bigmachine.MessageLimits{MaxArg: 1 << 30, MaxReply: 1 << 30}); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	b.Shutdown()
+
+	b = bigmachine.Start(New(), bigmachine.LimitMessages(bigmachine.MessageLimits{MaxArg: 1 << 10, MaxReply: 1 << 10}))
+	defer b.Shutdown()
+	ctx := context.Background()
+	machines, err := b.Start(ctx, 1, bigmachine.Services{"Opt": &optService{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := machines[0]
+	<-m.Wait(bigmachine.Running)
+	var reply []byte
+	if err = m.Call(ctx, "Opt.Bytes", 100, &reply); err != nil {
+		t.Fatal(err)
+	}
+	err = m.Call(ctx, "Opt.Bytes", 1<<20, &reply)
+	if !errors.Is(errors.Remote, err) || !errors.Is(errors.Precondition, errors.Recover(err).Err) {
+		t.Errorf("error %v is not a remote precondition error", err)
+	}
+	var echo string
+	if err = m.Call(ctx, "Opt.Echo", strings.Repeat("x", 1<<20), &echo); !errors.Is(errors.Precondition, err) {
+		t.Errorf("error %v is not a precondition error", err)
+	}
+}
+
+func TestCallLimit(t *testing.T) {
+	test := New()
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	ctx := context.Background()
+	machines, err := b.Start(ctx, 2, bigmachine.Services{"Opt": &optService{}}, bigmachine.CallLimit{Max: 1, FailFast: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := machines[0]
+	<-m.Wait(bigmachine.Running)
+	hangCtx, cancel := context.WithCancel(ctx)
+	hung := make(chan error)
+	go func() {
+		hung <- m.Call(hangCtx, "Opt.Hang", 0, nil)
+	}()
+	for m.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := m.Call(ctx, "Opt.Hang", 0, nil); err == nil || !errors.Is(errors.Unavailable, err) {
+		t.Errorf("bad error %v", err)
+	}
+	if got, want := m.InFlight(), 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	cancel()
+	<-hung
+	if got, want := m.InFlight(), 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	var reply int
+	if err := m.Call(ctx, "Opt.Flaky", 0, &reply, bigmachine.CallRetry(retry.Backoff(time.Millisecond, time.Millisecond, 1))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReattach(t *testing.T) {
+	test := New()
+	ctx := context.Background()
+	b1 := bigmachine.Start(test, bigmachine.Cluster("test", time.Hour))
+	machines, err := b1.Start(ctx, 2, bigmachine.Services{"Service": &testService{Index: 7}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range machines {
+		<-m.Wait(bigmachine.Running)
+		if got, want := m.Cluster(), "test"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		// Simulate the death of the driver: the machines are no longer
+		// maintained, but they are not shut down.
+		m.Cancel()
+		<-m.Wait(bigmachine.Stopped)
+	}
+	b2 := bigmachine.Start(test, bigmachine.Cluster("test", time.Hour))
+	defer b2.Shutdown()
+	reattached, err := b2.Reattach(ctx, bigmachine.Services{"Service": &testService{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(reattached), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for _, m := range reattached {
+		<-m.Wait(bigmachine.Running)
+		if !m.Owned() {
+			t.Errorf("machine %s not owned", m.Addr)
+		}
+		var reply int
+		if err := m.Call(ctx, "Service.Method", 0, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := reply, 7; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	// Machines that are already managed are not reattached again.
+	reattached, err = b2.Reattach(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(reattached), 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	b3 := bigmachine.Start(test)
+	if _, err := b3.Reattach(ctx); err == nil || !errors.Is(errors.Invalid, err) {
+		t.Errorf("bad error %v", err)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	test := New()
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	ctx := context.Background()
+	services := bigmachine.Services{"Service": &testService{}}
+	mappers, err := b.Start(ctx, 2, services, bigmachine.Labels{"role": "mapper", "zone": "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reducers, err := b.Start(ctx, 1, services, bigmachine.Labels{"role": "reducer", "zone": "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reducers[0].Label("role"), "reducer"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := reducers[0].Labels().String(), "role=reducer,zone=a"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(b.Query(bigmachine.Query{Labels: bigmachine.Labels{"role": "mapper"}})), len(mappers); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	selector, err := bigmachine.ParseLabels("zone=a, role=reducer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	selected := b.Query(bigmachine.Query{Labels: selector})
+	if got, want := len(selected), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := selected[0], reducers[0]; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(b.Query(bigmachine.Query{Labels: bigmachine.Labels{"zone": "b"}})), 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := bigmachine.ParseLabels("role"); err == nil || !errors.Is(errors.Invalid, err) {
+		t.Errorf("bad error %v", err)
+	}
+}
+
+func TestAttach(t *testing.T) {
+	test := New()
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	ctx := context.Background()
+	addrs := test.Launch(2, bigmachine.Labels{"role": "worker"})
+	test.Launch(1, bigmachine.Labels{"role": "other"})
+	machines, err := b.Attach(ctx, bigmachine.Labels{"role": "worker"}, bigmachine.Services{"Service": &testService{Index: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(machines), len(addrs); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for _, m := range machines {
+		<-m.Wait(bigmachine.Running)
+		if !m.Owned() {
+			t.Errorf("machine %s not owned", m.Addr)
+		}
+		var reply int
+		if err := m.Call(ctx, "Service.Method", 0, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := reply, 3; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	if got, want := len(b.Machines()), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The machines are already managed.
+	_, err = b.Attach(ctx, bigmachine.Labels{"role": "worker"}, bigmachine.Services{"Service": &testService{}})
+	if err == nil || !errors.Is(errors.NotExist, err) {
+		t.Errorf("bad error %v", err)
+	}
+}
+
+func TestLifetime(t *testing.T) {
+	test := New()
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	ctx := context.Background()
+	services := bigmachine.Services{"Service": &testService{}}
+	idle, err := b.Start(ctx, 1, services, bigmachine.Lifetime{IdleTimeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := b.Start(ctx, 1, services, bigmachine.Lifetime{MaxLifetime: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keep, err := b.Start(ctx, 1, services)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-old[0].Wait(bigmachine.Running)
+	// Keep the old machine busy: it is reaped regardless.
+	start := time.Now()
+	for old[0].State() == bigmachine.Running {
+		var reply int
+		_ = old[0].Call(ctx, "Service.Method", 0, &reply)
+		time.Sleep(10 * time.Millisecond)
+	}
+	<-old[0].Wait(bigmachine.Stopped)
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("machine reaped too early, after %s", elapsed)
+	}
+	<-idle[0].Wait(bigmachine.Stopped)
+	if !idle[0].Draining() {
+		t.Error("idle machine was not drained")
+	}
+	<-keep[0].Wait(bigmachine.Running)
+	if keep[0].Draining() {
+		t.Error("machine without a lifetime was drained")
+	}
+}
+
+func TestCostReport(t *testing.T) {
+	test := New()
+	test.Pricing = &bigmachine.Pricing{InstanceType: "test", HourlyPrice: 3600}
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	ctx := context.Background()
+	machines, err := b.Start(ctx, 2, bigmachine.Services{"Service": &testService{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-machines[0].Wait(bigmachine.Running)
+	machines[0].Cancel()
+	<-machines[0].Wait(bigmachine.Stopped)
+	report := b.CostReport()
+	if got, want := len(report.Machines), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := report.Unpriced, 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	var stopped bigmachine.MachineCost
+	for _, c := range report.Machines {
+		if c.Addr == machines[0].Addr {
+			stopped = c
+		}
+		if got, want := c.InstanceType, "test"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	if stopped.Stop.IsZero() {
+		t.Fatal("stopped machine has no stop time")
+	}
+	// The price is a dollar per second.
+	if got, want := stopped.Cost, stopped.Runtime.Seconds(); got < want*0.999 || got > want*1.001 {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, c := range b.CostReport().Machines {
+		if c.Addr == stopped.Addr && c.Runtime != stopped.Runtime {
+			t.Errorf("stopped machine's runtime changed from %v to %v", stopped.Runtime, c.Runtime)
+		}
+	}
+	if report.Cost < stopped.Cost {
+		t.Errorf("total cost %v less than machine's cost %v", report.Cost, stopped.Cost)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	type call struct {
+		hook string
+		m    *bigmachine.Machine
+	}
+	calls := make(chan call, 10)
+	test := New()
+	test.KeepalivePeriod = time.Second
+	test.KeepaliveTimeout = 2 * time.Second
+	test.KeepaliveRpcTimeout = time.Second
+	b := bigmachine.Start(test, bigmachine.MachineHooks(bigmachine.Hooks{
+		OnRunning: func(m *bigmachine.Machine) { calls <- call{"B.OnRunning", m} },
+	}))
+	defer b.Shutdown()
+	ctx := context.Background()
+	machines, err := b.Start(ctx, 1,
+		bigmachine.Services{"Service": &testService{}},
+		bigmachine.Hooks{
+			OnStopped: func(m *bigmachine.Machine, err error) {
+				if err == nil {
+					t.Error("no stop cause")
+				}
+				calls <- call{"OnStopped", m}
+			},
+			OnRunning: func(*bigmachine.Machine) { panic("hook panic") },
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := machines[0]
+	if got, want := <-calls, (call{"B.OnRunning", m}); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	test.Kill(m)
+	if got, want := <-calls, (call{"OnStopped", m}); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestUpgradeNoExec(t *testing.T) {
+	test := New()
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	ctx := context.Background()
+	machines, err := b.Start(ctx, 2, bigmachine.Services{"Service": &testService{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range machines {
+		<-m.Wait(bigmachine.Running)
+	}
+	// Test machines do not exec binaries, and thus cannot be upgraded.
+	err = b.Upgrade(ctx, bigmachine.UpgradeOptions{BatchSize: 2})
+	if err == nil || !errors.Is(errors.Precondition, err) {
+		t.Errorf("bad error %v", err)
+	}
+	for _, m := range machines {
+		if m.Draining() {
+			t.Errorf("machine %s left draining", m.Name())
+		}
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	b := bigmachine.Start(New())
+	defer b.Shutdown()
+	ctx := context.Background()
+	machines, err := b.Start(ctx, 1,
+		bigmachine.Services{"Service": &testService{}},
+		bigmachine.Environ{"PIPELINE=test", "AWS_SECRET_ACCESS_KEY=hunter2"},
+		bigmachine.Labels{"stage": "align"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-machines[0].Wait(bigmachine.Running)
+	input := digest.Digester(crypto.SHA256).FromString("reference")
+	b.RecordInput("reference", input)
+
+	var buf bytes.Buffer
+	if err := b.Provenance().WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var p bigmachine.Provenance
+	if err := json.Unmarshal(buf.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := p.Binary, bigmachine.LocalInfo().Digest.String(); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := p.Inputs["reference"], input.String(); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(p.Machines), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	m := p.Machines[0]
+	if got, want := m.Addr, machines[0].Addr; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := m.Labels["stage"], "align"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := m.Environ, []string{"PIPELINE=test", "AWS_SECRET_ACCESS_KEY=<scrubbed>"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMaxMachines(t *testing.T) {
+	b := bigmachine.Start(New(), bigmachine.MaxMachines(bigmachine.MachineQuota{Max: 2, Wait: true}))
+	defer b.Shutdown()
+	ctx := context.Background()
+	_, err := b.Start(ctx, 3, bigmachine.Services{"Service": &testService{}})
+	if err == nil || !errors.Is(errors.Unavailable, err) {
+		t.Fatalf("bad error %v", err)
+	}
+	if _, ok := errors.Recover(err).Err.(*bigmachine.QuotaError); !ok {
+		t.Errorf("error %v is not a quota error", err)
+	}
+	machines, err := b.Start(ctx, 2, bigmachine.Services{"Service": &testService{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(b.QuotaUsage()), "2 2"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	started := make(chan error)
+	go func() {
+		_, err := b.Start(ctx, 1, bigmachine.Services{"Service": &testService{}})
+		started <- err
+	}()
+	select {
+	case err := <-started:
+		t.Fatalf("start did not wait for quota: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	machines[0].Cancel()
+	if err := <-started; err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(b.QuotaUsage()), "2 2"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestWatchFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b := bigmachine.Start(New())
+	defer b.Shutdown()
+	ctx := context.Background()
+	machines, err := b.Start(ctx, 1, bigmachine.Services{"Service": &testService{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := machines[0]
+	<-m.Wait(bigmachine.Running)
+	watch, err := m.WatchFiles(ctx, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watch.Close()
+	path := filepath.Join(dir, "output")
+	if err := ioutil.WriteFile(path, []byte("done"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		event, err := watch.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Path != path {
+			continue
+		}
+		if got, want := event.Type, bigmachine.FileCreated; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := event.Size, int64(4); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		break
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		event, err := watch.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Path == path {
+			if got, want := event.Type, bigmachine.FileRemoved; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			break
+		}
+	}
+}
+
+func TestCopyFiles(t *testing.T) {
+	b := bigmachine.Start(New())
+	defer b.Shutdown()
+	ctx := context.Background()
+	machines, err := b.Start(ctx, 1, bigmachine.Services{"Service": &testService{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := machines[0]
+	<-m.Wait(bigmachine.Running)
+	defer os.RemoveAll(filepath.Join(bigmachine.FileRoot(), "testcopy"))
+	const config = "threads: 8\n"
+	if err := m.CopyTo(ctx, "testcopy/config.yaml", strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+	p, err := ioutil.ReadFile(filepath.Join(bigmachine.FileRoot(), "testcopy/config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(p), config; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	rc, err := m.CopyFrom(ctx, "testcopy/config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(p), config; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, path := range []string{"/etc/passwd", "../escape", "testcopy/../../escape"} {
+		if err := m.CopyTo(ctx, path, strings.NewReader("x")); err == nil {
+			t.Errorf("copied to %s outside of the file root", path)
+		}
+		if _, err := m.CopyFrom(ctx, path); err == nil {
+			t.Errorf("copied from %s outside of the file root", path)
+		}
+	}
+	if _, err := m.CopyFrom(ctx, "testcopy/missing"); err == nil {
+		t.Error("copied missing file")
+	}
+	// Symbolic links may not be used to escape the file root.
+	outside, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(bigmachine.FileRoot(), "testcopy/link")); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"testcopy/link/secret", "testcopy/link/new/file"} {
+		if err := m.CopyTo(ctx, path, strings.NewReader("x")); err == nil || !errors.Is(errors.Invalid, errors.Recover(err).Err) {
+			t.Errorf("copy to %s: bad error %v", path, err)
+		}
+	}
+	if _, err := m.CopyFrom(ctx, "testcopy/link/secret"); err == nil || !errors.Is(errors.Invalid, errors.Recover(err).Err) {
+		t.Errorf("bad error %v", err)
+	}
+	if p, err := ioutil.ReadFile(filepath.Join(outside, "secret")); err != nil || string(p) != "secret" {
+		t.Errorf("file outside of the file root was modified: %q, %v", p, err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new")); !os.IsNotExist(err) {
+		t.Errorf("directory was created outside of the file root: %v", err)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	b := bigmachine.Start(New())
+	defer b.Shutdown()
+	ctx := context.Background()
+	_, err := b.Start(ctx, 1,
+		bigmachine.Services{"Service": &testService{}},
+		bigmachine.Credentials{Scopes: []string{"ingest"}, TTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var token string
+	for {
+		if token, err = b.Token("ingest"); err == nil {
+			break
+		}
+		if !errors.Is(errors.NotExist, err) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := b.VerifyToken(token, "ingest"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.VerifyCall(rpc.WithCredential(ctx, token), "ingest"); err != nil {
+		t.Fatal(err)
+	}
+	other := bigmachine.Start(New())
+	defer other.Shutdown()
+	for _, c := range []struct{ token, scope string }{
+		{token, "admin"},
+		{token + "x", "ingest"},
+		{b.VendToken("ingest", -time.Second), "ingest"},
+		{other.VendToken("ingest", time.Minute), "ingest"},
+		{"", "ingest"},
+	} {
+		if err := b.VerifyToken(c.token, c.scope); err == nil || !errors.Is(errors.NotAllowed, err) {
+			t.Errorf("token %q, scope %s: bad error %v", c.token, c.scope, err)
+		}
+	}
+	handler := b.RequireToken("ingest", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, c := range []struct {
+		auth string
+		code int
+	}{
+		{"Bearer " + token, http.StatusOK},
+		{"Bearer bogus", http.StatusUnauthorized},
+		{token, http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", "/ingest", nil)
+		req.Header.Set("Authorization", c.auth)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if got, want := w.Code, c.code; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestCommand(t *testing.T) {
+	b := bigmachine.Start(New())
+	defer b.Shutdown()
+	ctx := context.Background()
+	machines, err := b.Start(ctx, 1, bigmachine.Services{"Service": &testService{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := machines[0]
+	<-m.Wait(bigmachine.Running)
+	var stdout, stderr bytes.Buffer
+	code, err := m.Command(ctx, bigmachine.Command{
+		Args: []string{"sh", "-c", "echo $GREETING; echo oops >&2; exit 3"},
+		Env:  []string{"GREETING=hello"},
+	}, &stdout, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := code, 3; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := stdout.String(), "hello\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := stderr.String(), "oops\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := m.Command(ctx, bigmachine.Command{Args: []string{"/nonexistent/command"}}, nil, nil); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestTraffic(t *testing.T) {
+	test := New()
+	test.Locations = []bigmachine.Location{
+		{Region: "us-west-2", Zone: "us-west-2a"},
+		{Region: "us-west-2", Zone: "us-west-2b"},
+		{Region: "us-east-1", Zone: "us-east-1a"},
+	}
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	ctx := context.Background()
+	machines, err := b.Start(ctx, 3, bigmachine.Services{"Service": &testService{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scopes := make(map[bigmachine.TrafficScope]bool)
+	for _, m := range machines {
+		<-m.Wait(bigmachine.Running)
+		if err := m.Call(ctx, "Service.Method", 0, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m.Location(); !ok {
+			t.Errorf("%s: no location", m.Name())
+		}
+		scopes[m.TrafficScope()] = true
+		if m.Traffic().Total() == 0 {
+			t.Errorf("%s: no traffic", m.Name())
+		}
+	}
+	want := map[bigmachine.TrafficScope]bool{
+		bigmachine.TrafficSameZone:    true,
+		bigmachine.TrafficCrossZone:   true,
+		bigmachine.TrafficCrossRegion: true,
+	}
+	if got := scopes; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	report := b.CostReport()
+	for scope := range want {
+		if report.Traffic[scope].Total() == 0 {
+			t.Errorf("no %s traffic in cost report", scope)
+		}
+	}
+	if !strings.Contains(report.String(), "cross-region traffic") {
+		t.Errorf("report %q does not report cross-region traffic", report)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	b := bigmachine.Start(New())
+	defer b.Shutdown()
+	ctx := context.Background()
+	for _, role := range []string{"a", "b"} {
+		machines, err := b.Start(ctx, 1, bigmachine.Services{"Service": &testService{}}, bigmachine.Labels{"role": role})
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-machines[0].Wait(bigmachine.Running)
+	}
+	for _, which := range []string{"goroutine", "mutex"} {
+		var buf bytes.Buffer
+		opts := bigmachine.ProfileOptions{
+			Duration: 10 * time.Millisecond,
+			Query:    bigmachine.Query{Labels: bigmachine.Labels{"role": "a"}},
+		}
+		if err := b.Profile(ctx, which, opts, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := profile.Parse(&buf); err != nil {
+			t.Errorf("%s: %v", which, err)
+		}
+	}
+	opts := bigmachine.ProfileOptions{Query: bigmachine.Query{Labels: bigmachine.Labels{"role": "c"}}}
+	if err := b.Profile(ctx, "heap", opts, ioutil.Discard); !errors.Is(errors.NotExist, err) {
+		t.Errorf("got %v, want NotExist", err)
+	}
+
+	mux := http.NewServeMux()
+	b.HandleDebug(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	for _, test := range []struct {
+		query string
+		code  int
+	}{
+		{"which=heap&gc=1", http.StatusOK},
+		{"which=goroutine&labels=role=b", http.StatusOK},
+		{"which=heap&machines=https://nonexistent", http.StatusNotFound},
+		{"which=heap&labels=role", http.StatusBadRequest},
+	} {
+		resp, err := http.Get(srv.URL + "/debug/bigmachine/profile?" + test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := resp.StatusCode, test.code; got != want {
+			t.Errorf("%s: got %v, want %v: %s", test.query, got, want, body)
+			continue
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		if _, err := profile.ParseData(body); err != nil {
+			t.Errorf("%s: %v", test.query, err)
+		}
+	}
+}
+
+// A quorumRound is a round of quorum service initializations.
+type quorumRound struct {
+	inits   int32
+	release chan struct{}
+}
+
+var (
+	quorumMu     sync.Mutex
+	quorumRounds []*quorumRound
+)
+
+// NewQuorumRound returns a quorum service for a new round, and the
+// round's release channel.
+func newQuorumRound() (*quorumService, chan struct{}) {
+	quorumMu.Lock()
+	defer quorumMu.Unlock()
+	r := &quorumRound{release: make(chan struct{})}
+	quorumRounds = append(quorumRounds, r)
+	return &quorumService{Round: len(quorumRounds) - 1}, r.release
+}
+
+// QuorumService fails its first initialization in its round, and
+// blocks its second until the round is released.
+type quorumService struct{ Round int }
+
+func (s quorumService) Init(*bigmachine.B) error {
+	quorumMu.Lock()
+	r := quorumRounds[s.Round]
+	quorumMu.Unlock()
+	switch atomic.AddInt32(&r.inits, 1) {
+	case 1:
+		return errors.E("first init fails")
+	case 2:
+		<-r.release
+	}
+	return nil
+}
+
+func (quorumService) Method(ctx context.Context, arg int, reply *int) error {
+	return nil
+}
+
+func TestStartQuorum(t *testing.T) {
+	b := bigmachine.Start(New())
+	defer b.Shutdown()
+	ctx := context.Background()
+
+	svc, release := newQuorumRound()
+	_, _, err := b.StartQuorum(ctx, 3, bigmachine.Quorum{Timeout: time.Second, Retries: 1}, bigmachine.Services{"Quorum": svc})
+	if !errors.Is(errors.Unavailable, err) {
+		t.Fatalf("got %v, want Unavailable", err)
+	}
+	close(release)
+
+	svc, release = newQuorumRound()
+	ready, stragglers, err := b.StartQuorum(ctx, 3, bigmachine.Quorum{Fraction: 0.6, Retries: 1}, bigmachine.Services{"Quorum": svc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(ready), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for _, m := range ready {
+		if got, want := m.State(), bigmachine.Running; got != want {
+			t.Errorf("%s: got %v, want %v", m.Name(), got, want)
+		}
+	}
+	if got, want := stragglers.Pending(), 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	close(release)
+	var late []*bigmachine.Machine
+	for m := range stragglers.C() {
+		late = append(late, m)
+	}
+	if got, want := len(late), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if err := late[0].Call(ctx, "Quorum.Method", 0, nil); err != nil {
+		t.Error(err)
+	}
+	if got, want := stragglers.Pending(), 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	b := bigmachine.Start(New())
+	defer b.Shutdown()
+	ctx := context.Background()
+	watchdog := bigmachine.MemoryWatchdog{Period: time.Minute}
+	machines, err := b.Start(ctx, 1, bigmachine.Services{"Service": &testService{}}, watchdog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := machines[0]
+	<-m.Wait(bigmachine.Running)
+	d, err := m.Describe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := d.Pid, os.Getpid(); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := d.GoVersion, runtime.Version(); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	var names []string
+	for _, svc := range d.Services {
+		names = append(names, svc.Name)
+	}
+	if got, want := names, []string{"Barriers", "Blobs", "Service", "Supervisor"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if d.MemoryWatchdog == nil || d.MemoryWatchdog.Period != watchdog.Period {
+		t.Errorf("got memory watchdog %+v, want %+v", d.MemoryWatchdog, watchdog)
+	}
+	if d.DiskWatchdog == nil || len(d.DiskWatchdog.Paths) == 0 {
+		t.Errorf("missing disk watchdog: %+v", d.DiskWatchdog)
+	}
+
+	mux := http.NewServeMux()
+	b.HandleDebug(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/debug/bigmachine/describe?machine=" + m.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var results map[string]struct {
+		Description *bigmachine.Description
+		Error       string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(results), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if res := results[m.Name()]; res.Description == nil || res.Description.Pid != d.Pid {
+		t.Errorf("bad result %+v", res)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	b := bigmachine.Start(New())
+	defer b.Shutdown()
+	ctx := context.Background()
+	machines, err := b.Start(ctx, 1, bigmachine.Services{"Service": &testService{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := machines[0]
+	var reply int
+	if err = m.Call(ctx, "Service.Method", 0, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	b.HandleDebug(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/debug/bigmachine/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got, want := resp.Header.Get("Content-Type"), "text/plain; version=0.0.4"; !strings.HasPrefix(got, want) {
+		t.Errorf("got content type %q, want %q", got, want)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := string(body)
+	for _, want := range []string{
+		"# TYPE bigmachine_machines gauge\n",
+		`bigmachine_machines{state="RUNNING"} 1` + "\n",
+		`bigmachine_machines{state="STOPPED"} 0` + "\n",
+		`bigmachine_machine_memory_total_bytes{machine="` + m.Name() + `"} `,
+		`bigmachine_machine_load1{machine="` + m.Name() + `"} `,
+		`bigmachine_rpc_calls_total{side="client",method="Service.Method"} `,
+		"# TYPE bigmachine_machine_boot_duration_seconds histogram\n",
+		`bigmachine_machine_boot_duration_seconds_bucket{le="+Inf"} 1` + "\n",
+		"bigmachine_machine_boot_duration_seconds_count 1\n",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, metrics)
+		}
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	b := bigmachine.Start(New())
+	defer b.Shutdown()
+	ctx := context.Background()
+	machines, err := b.Start(ctx, 2, bigmachine.Services{"Service": &testService{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range machines {
+		<-m.Wait(bigmachine.Running)
+	}
+	machines[1].Cancel()
+	<-machines[1].Wait(bigmachine.Stopped)
+
+	mux := http.NewServeMux()
+	b.HandleDebug(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/debug/bigmachine/" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(body)
+	}
+	for _, path := range []string{"dashboard", "dashboard?sort=memory&desc=1", "dashboard?sort=bogus&refresh=0"} {
+		code, body := get(path)
+		if got, want := code, http.StatusOK; got != want {
+			t.Fatalf("%s: got %v, want %v", path, got, want)
+		}
+		for _, want := range []string{
+			machines[0].Name(),
+			machines[1].Name(),
+			"1 running",
+			"1 stopped",
+			"context canceled",
+			`href="output?machine=` + machines[0].Name() + `"`,
+			"<svg",
+		} {
+			if !strings.Contains(body, want) {
+				t.Errorf("%s: dashboard does not contain %q:\n%s", path, want, body)
+			}
+		}
+		if strings.Contains(body, `href="output?machine=`+machines[1].Name()+`"`) {
+			t.Errorf("%s: stopped machine %s has output link", path, machines[1].Name())
+		}
+	}
+	_, body := get("dashboard?sort=name&desc=1")
+	if i, j := strings.Index(body, machines[0].Name()), strings.Index(body, machines[1].Name()); i < j {
+		t.Errorf("machines are not sorted in descending order")
+	}
+	if code, _ := get("output?machine=nonexistent"); code != http.StatusNotFound {
+		t.Errorf("got %v, want %v", code, http.StatusNotFound)
+	}
+}
+
+func TestMaxBinarySize(t *testing.T) {
+	b := bigmachine.Start(New(), bigmachine.MaxBinarySize(1<<10))
+	defer b.Shutdown()
+	ctx := context.Background()
+	_, err := b.Start(ctx, 1, bigmachine.Services{"Service": &testService{}})
+	if err == nil || !errors.Is(errors.Invalid, err) {
+		t.Fatalf("bad error %v", err)
+	}
+	if !strings.Contains(err.Error(), "MaxBinarySize") {
+		t.Errorf("error %v does not mention MaxBinarySize", err)
+	}
+	if got, want := len(b.Machines()), 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	b = bigmachine.Start(New(), bigmachine.MaxBinarySize(1<<40))
+	defer b.Shutdown()
+	if _, err = b.Start(ctx, 1, bigmachine.Services{"Service": &testService{}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMachineBlobs(t *testing.T) {
+	b := bigmachine.Start(New())
+	defer b.Shutdown()
+	ctx := context.Background()
+	machines, err := b.Start(ctx, 1, bigmachine.Services{"Service": &testService{}}, bigmachine.BlobCache{MaxBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := machines[0]
+	<-m.Wait(bigmachine.Running)
+	content := fmt.Sprintf("blob %d", time.Now().UnixNano())
+	d := digest.Digester(crypto.SHA256).FromString(content)
+	ok, err := m.HasBlob(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("unexpected blob")
+	}
+	put, err := m.PutBlob(ctx, strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := put, d; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if ok, err = m.HasBlob(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("blob not stored")
+	}
+	rc, err := m.GetBlob(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != content {
+		t.Errorf("got %q, want %q", got, content)
+	}
+	if err = m.Call(ctx, "Blobs.Delete", d, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type logService struct{}
+
+var serviceLog = bigmachine.NewLogger("logService").With("service", "test")
+
+func (logService) Log(ctx context.Context, message string, _ *struct{}) error {
+	serviceLog.Debugf("debug: %s", message)
+	serviceLog.Infof("info: %s", message)
+	return nil
+}
+
+func TestLogs(t *testing.T) {
+	b := bigmachine.Start(New())
+	defer b.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	machines, err := b.Start(ctx, 1, bigmachine.Services{"Log": &logService{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := machines[0]
+	<-m.Wait(bigmachine.Running)
+	records := b.Logs(ctx, bigmachine.LogFilter{Level: bigmachine.LogInfo, Source: "logService"})
+	// The log stream is established asynchronously, so we log until a
+	// record is delivered.
+	var record bigmachine.LogRecord
+	for delivered := false; !delivered; {
+		if err = m.Call(ctx, "Log.Log", "hello", nil); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case record = <-records:
+			delivered = true
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		}
+	}
+	if got, want := record.Machine, m.Name(); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := record.Level, bigmachine.LogInfo; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := record.Message, "info: hello"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := record.Fields["service"], "test"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if record.Time.IsZero() {
+		t.Error("missing record time")
+	}
+	cancel()
+	for range records {
+	}
+}
+
+func TestWaitFor(t *testing.T) {
+	b := bigmachine.Start(New())
+	defer b.Shutdown()
+	ctx := context.Background()
+	machines, err := b.Start(ctx, 1, bigmachine.Services{"Log": &logService{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := machines[0]
+	if state, err := m.WaitFor(ctx, bigmachine.Running, bigmachine.Stopped); state != bigmachine.Running || err != nil {
+		t.Fatalf("got %v, %v, want %v", state, err, bigmachine.Running)
+	}
+	m.Cancel()
+	state, err := m.WaitFor(ctx, bigmachine.Stopped)
+	if got, want := state, bigmachine.Stopped; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := err, m.Err(); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Machines that pass a state have reached it.
+	state, err = m.WaitFor(ctx, bigmachine.Starting, bigmachine.Running)
+	if got, want := state, bigmachine.Running; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := err, m.Err(); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := m.WaitFor(ctx); !errors.Is(errors.Invalid, err) {
+		t.Errorf("got %v, want Invalid", err)
+	}
+}
+
+// phaseService joins barriers at the request of the driver.
+type phaseService struct {
+	Index int
+	b     *bigmachine.B
+}
+
+func (s *phaseService) Init(b *bigmachine.B) error {
+	s.b = b
+	return nil
+}
+
+type joinRequest struct {
+	Barrier bigmachine.Barrier
+	Phase   int
+}
+
+func (s *phaseService) Join(ctx context.Context, req joinRequest, _ *struct{}) error {
+	if err := req.Barrier.Wait(ctx, s.b, req.Phase); err != nil {
+		return errors.E(fmt.Sprintf("service %d: phase %d", s.Index, req.Phase), err)
+	}
+	return nil
+}
+
+func TestBarrier(t *testing.T) {
+	b := bigmachine.Start(New())
+	defer b.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	machines, err := b.Start(ctx, 3, bigmachine.Services{"Phase": &phaseService{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.WaitAll(ctx, bigmachine.Running); err != nil {
+		t.Fatal(err)
+	}
+	// The machines' services and the driver are the barrier's parties.
+	barrier := bigmachine.NewBarrier(machines[0], "test", len(machines)+1)
+	for phase := 0; phase < 3; phase++ {
+		var (
+			wg     sync.WaitGroup
+			joined int32
+		)
+		for _, m := range machines {
+			m := m
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := m.Call(ctx, "Phase.Join", joinRequest{barrier, phase}, nil); err != nil {
+					t.Error(err)
+				}
+				atomic.AddInt32(&joined, 1)
+			}()
+		}
+		time.Sleep(50 * time.Millisecond)
+		if n := atomic.LoadInt32(&joined); n != 0 {
+			t.Fatalf("phase %d: %d parties released before the driver joined", phase, n)
+		}
+		if err = barrier.Wait(ctx, b, phase); err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+	}
+	// Completed phases are not waited on.
+	if err = barrier.Wait(ctx, b, 0); err != nil {
+		t.Error(err)
+	}
+	bad := bigmachine.NewBarrier(machines[0], "test", 2)
+	if err = bad.Wait(ctx, b, 3); !errors.Is(errors.Invalid, err) {
+		t.Errorf("got %v, want Invalid", err)
+	}
+	// A party that leaves a phase is not counted.
+	waitCtx, waitCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer waitCancel()
+	if err = barrier.Wait(waitCtx, b, 3); err == nil {
+		t.Error("expected error")
+	}
+
+	machines[1].Cancel()
+	err = b.WaitAll(ctx, bigmachine.Stopped, machines[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.WaitAll(ctx, bigmachine.Running); !errors.Is(errors.Unavailable, err) {
+		t.Errorf("got %v, want Unavailable", err)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/grailbio/base/data"
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+	"github.com/shirou/gopsutil/disk"
+)
+
+// TmpfsEnv is the environment variable that lists the paths of the
+// tmpfs file systems mounted on a machine through Tmpfs parameters.
+const tmpfsEnv = "BIGMACHINE_TMPFS"
+
+// Tmpfs is a machine parameter that mounts a fixed-size, memory-backed
+// tmpfs file system at Path before the machine's binary is
+// executed. Tmpfs provides fast scratch space whose memory use is
+// bounded by Size, so that scratch data cannot exhaust the machine's
+// memory unpredictably. Multiple Tmpfs parameters may be passed to
+// mount multiple file systems.
+//
+// Tmpfs file systems are supported only on Linux, and require that
+// the machine's supervisor run with the privileges to mount file
+// systems. If a file system is already mounted at Path, it is
+// resized.
+type Tmpfs struct {
+	// Path is the absolute path at which the file system is mounted.
+	// It is created if it does not exist.
+	Path string
+	// Size is the size of the file system, in bytes.
+	Size int64
+}
+
+func (t Tmpfs) applyParam(m *Machine) {
+	m.tmpfs = append(m.tmpfs, t)
+}
+
+// String returns a summary of the tmpfs file system.
+func (t Tmpfs) String() string {
+	return fmt.Sprintf("tmpfs %s (%s)", t.Path, data.Size(t.Size))
+}
+
+// MountTmpfs mounts the tmpfs file system described by its argument.
+// It should be called before Exec.
+func (s *Supervisor) MountTmpfs(ctx context.Context, t Tmpfs, _ *struct{}) error {
+	if !filepath.IsAbs(t.Path) {
+		return errors.E(errors.Invalid, fmt.Sprintf("tmpfs path %s is not absolute", t.Path))
+	}
+	if t.Size <= 0 {
+		return errors.E(errors.Invalid, fmt.Sprintf("invalid tmpfs size %d", t.Size))
+	}
+	if err := os.MkdirAll(t.Path, 0777); err != nil {
+		return err
+	}
+	if err := mountTmpfs(t.Path, t.Size); err != nil {
+		return errors.E("mount", t.String(), err)
+	}
+	log.Printf("mounted %s", t)
+	return nil
+}
+
+// TmpfsEnviron returns the environment variable definition that
+// communicates the provided tmpfs file systems to the exec'd binary,
+// so that they may be reported by LocalInfo.
+func tmpfsEnviron(tmpfs []Tmpfs) string {
+	paths := make([]string, len(tmpfs))
+	for i, t := range tmpfs {
+		paths[i] = t.Path
+	}
+	return tmpfsEnv + "=" + strings.Join(paths, string(filepath.ListSeparator))
+}
+
+// LocalTmpfs returns the tmpfs file systems mounted for this process,
+// with their actual sizes.
+func localTmpfs() []Tmpfs {
+	env := os.Getenv(tmpfsEnv)
+	if env == "" {
+		return nil
+	}
+	var tmpfs []Tmpfs
+	for _, path := range filepath.SplitList(env) {
+		usage, err := disk.Usage(path)
+		if err != nil {
+			log.Error.Printf("tmpfs %s: %v", path, err)
+			continue
+		}
+		tmpfs = append(tmpfs, Tmpfs{Path: path, Size: int64(usage.Total)})
+	}
+	return tmpfs
+}
@@ -0,0 +1,29 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package bigmachine
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const tmpfsMagic = 0x01021994
+
+func mountTmpfs(path string, size int64) error {
+	var (
+		flags uintptr
+		st    syscall.Statfs_t
+	)
+	if err := syscall.Statfs(path, &st); err != nil {
+		return err
+	}
+	if st.Type == tmpfsMagic {
+		flags |= syscall.MS_REMOUNT
+	}
+	return syscall.Mount("tmpfs", path, "tmpfs", flags, fmt.Sprintf("size=%d", size))
+}
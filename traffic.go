@@ -0,0 +1,126 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"github.com/grailbio/bigmachine/rpc"
+)
+
+// A Location is the placement of the driver or of a machine in the
+// infrastructure of a cloud provider, as reported by the B's System.
+type Location struct {
+	// Region is the location's region, for example "us-west-2".
+	Region string
+	// Zone is the location's availability zone, for example
+	// "us-west-2a".
+	Zone string
+}
+
+// A TrafficScope classifies the traffic between the driver and a
+// machine by their relative locations, which determine the cost of
+// data transfer in most cloud providers.
+type TrafficScope int
+
+const (
+	// TrafficUnknown is the scope of traffic with machines whose
+	// location, or the driver's, is unknown.
+	TrafficUnknown TrafficScope = iota
+	// TrafficSameZone is the scope of traffic within an availability
+	// zone.
+	TrafficSameZone
+	// TrafficCrossZone is the scope of traffic across availability
+	// zones of a region.
+	TrafficCrossZone
+	// TrafficCrossRegion is the scope of traffic across regions.
+	TrafficCrossRegion
+)
+
+var trafficScopeStrings = [...]string{
+	TrafficUnknown:     "unknown",
+	TrafficSameZone:    "same-zone",
+	TrafficCrossZone:   "cross-zone",
+	TrafficCrossRegion: "cross-region",
+}
+
+// String returns a string representation of the scope.
+func (s TrafficScope) String() string {
+	if s < 0 || int(s) >= len(trafficScopeStrings) {
+		return "invalid"
+	}
+	return trafficScopeStrings[s]
+}
+
+// MarshalText implements encoding.TextMarshaler, so that scopes are
+// rendered by name, for example as keys of JSON objects.
+func (s TrafficScope) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// TrafficScopeBetween returns the scope of traffic between the
+// provided locations.
+func trafficScopeBetween(a, b Location) TrafficScope {
+	switch {
+	case a.Region == "" || b.Region == "":
+		return TrafficUnknown
+	case a.Region != b.Region:
+		return TrafficCrossRegion
+	case a.Zone == "" || b.Zone == "":
+		return TrafficUnknown
+	case a.Zone != b.Zone:
+		return TrafficCrossZone
+	default:
+		return TrafficSameZone
+	}
+}
+
+// Locate determines the locations of the provided machines, and the
+// scope of their traffic with the driver, using the provided locator.
+func (b *B) locate(locator machineLocator, machines []*Machine) {
+	b.driverLocationOnce.Do(func() {
+		b.driverLocation, b.driverLocated = locator.DriverLocation()
+	})
+	for _, m := range machines {
+		m.location, m.located = locator.MachineLocation(m)
+		if m.located && b.driverLocated {
+			m.trafficScope = trafficScopeBetween(b.driverLocation, m.location)
+		}
+	}
+}
+
+// Location returns the machine's location, as reported by its System;
+// ok is false if the location is unknown.
+func (m *Machine) Location() (loc Location, ok bool) {
+	return m.location, m.located
+}
+
+// TrafficScope returns the scope of the traffic between the driver
+// and the machine, as determined by their locations.
+func (m *Machine) TrafficScope() TrafficScope {
+	return m.trafficScope
+}
+
+// Traffic returns the amount of call data that the driver has
+// exchanged with the machine, including streamed arguments and
+// replies.
+func (m *Machine) Traffic() rpc.Traffic {
+	if m.client == nil {
+		return rpc.Traffic{}
+	}
+	return m.client.Traffic(m.Addr)
+}
+
+// Traffic returns the amount of call data that the driver has
+// exchanged with b's machines, by traffic scope, so that users may
+// quantify the cost of data transfer across availability zones and
+// regions. It is also reported by B.CostReport, and published as the
+// expvar "traffic".
+func (b *B) Traffic() map[TrafficScope]rpc.Traffic {
+	traffic := make(map[TrafficScope]rpc.Traffic)
+	for _, m := range b.Machines() {
+		scope := m.TrafficScope()
+		traffic[scope] = traffic[scope].Add(m.Traffic())
+	}
+	return traffic
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"bytes"
+	"context"
+	encbinary "encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/bigmachine/rpc"
+)
+
+// TunnelDialTimeout is the amount of time for which a supervisor
+// attempts to connect to a tunneled port.
+const tunnelDialTimeout = 10 * time.Second
+
+// Tunnel returns a listener on a local port through which TCP
+// connections are forwarded to the provided port on the machine's
+// loopback interface. Connections are proxied through the machine's
+// authenticated RPC channel, each as a full-duplex stream (see
+// Duplex), so that users may reach servers embedded in workers (for
+// example, HTTP servers, debuggers, or databases) on machines in
+// private subnets, without opening the machines' ports to the
+// network. The tunnel is closed when the returned listener is closed
+// or the provided context is canceled; connections that are open at
+// that time are aborted.
+func (m *Machine) Tunnel(ctx context.Context, remotePort int) (net.Listener, error) {
+	if remotePort <= 0 || remotePort > 65535 {
+		return nil, errors.E(errors.Invalid, fmt.Sprintf("invalid port %d", remotePort))
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	go func() {
+		defer cancel()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go m.forward(ctx, conn, remotePort)
+		}
+	}()
+	return l, nil
+}
+
+// Forward forwards the provided connection to the provided port on
+// the machine, until either side closes its connection.
+func (m *Machine) forward(ctx context.Context, conn net.Conn, port int) {
+	defer conn.Close()
+	// The port precedes the connection's data in the streamed
+	// argument, since the stream's reply is available only once the
+	// supervisor has connected to the port.
+	var header bytes.Buffer
+	if err := encbinary.Write(&header, encbinary.BigEndian, uint16(port)); err != nil {
+		log.Error.Printf("%s: tunnel to port %d: %v", m.Name(), port, err)
+		return
+	}
+	d, err := rpc.OpenDuplex(func(arg io.Reader, reply *io.ReadCloser) error {
+		return m.Call(ctx, "Supervisor.Tunnel", io.MultiReader(&header, arg), reply)
+	})
+	if err != nil {
+		log.Error.Printf("%s: tunnel to port %d: %v", m.Name(), port, err)
+		return
+	}
+	defer d.Close()
+	done := make(chan struct{})
+	go func() {
+		io.Copy(d, conn)
+		d.CloseWrite()
+		close(done)
+	}()
+	io.Copy(conn, d)
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+	<-done
+}
+
+// Tunnel connects to a port on the machine's loopback interface, and
+// proxies data between the connection and a full-duplex stream (see
+// Machine.Tunnel). The argument's data is preceded by the port, as a
+// big-endian uint16.
+func (s *Supervisor) Tunnel(ctx context.Context, arg io.Reader, reply *io.ReadCloser) error {
+	var port uint16
+	if err := encbinary.Read(arg, encbinary.BigEndian, &port); err != nil {
+		return errors.E(errors.Invalid, "Supervisor.Tunnel: reading port", err)
+	}
+	addr := net.JoinHostPort("localhost", strconv.Itoa(int(port)))
+	conn, err := net.DialTimeout("tcp", addr, tunnelDialTimeout)
+	if err != nil {
+		return errors.E(errors.Unavailable, fmt.Sprintf("Supervisor.Tunnel: dial %s", addr), err)
+	}
+	go func() {
+		io.Copy(conn, arg)
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+	}()
+	*reply = rpc.Flush(conn)
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/fatbin"
+	"github.com/grailbio/base/log"
+)
+
+// UpgradeOptions configures a rolling upgrade (see B.Upgrade).
+type UpgradeOptions struct {
+	// Binary is the binary that is pushed to the machines. If nil,
+	// the driver's own binary is pushed.
+	Binary *fatbin.Reader
+	// BatchSize is the number of machines that are upgraded at once.
+	// It defaults to 1.
+	BatchSize int
+	// Query selects the machines that are upgraded, among the B's
+	// running machines. The zero Query selects all of them.
+	Query Query
+}
+
+// Upgrade performs a rolling upgrade of b's running machines, so that
+// long-lived clusters can pick up fixes without being torn down.
+// Machines are upgraded in batches: each machine in a batch is
+// drained of calls in flight (accepting no new calls meanwhile, as
+// with Machine.Drain, but without being shut down); the new binary is
+// uploaded to it and executed; and the machine is checked to run the
+// new binary, and its services are registered again, before it
+// accepts calls again. Upgrade stops after the first batch in which a
+// machine failed to upgrade, returning an error that lists the
+// failures; the machines of that batch that did upgrade, and the
+// machines that were not upgraded, keep running. Machines whose
+// binaries are not executed by bigmachine (see Machine.NoExec) cannot
+// be upgraded: Upgrade fails with an error of kind errors.Precondition
+// before upgrading any machine if such a machine is selected.
+func (b *B) Upgrade(ctx context.Context, opts UpgradeOptions) error {
+	binary := opts.Binary
+	if binary == nil {
+		var err error
+		if binary, err = fatbin.Self(); err != nil {
+			return err
+		}
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	var machines []*Machine
+	for _, m := range b.Query(opts.Query) {
+		if !m.Owned() || m.State() != Running {
+			continue
+		}
+		if m.NoExec {
+			return errors.E(errors.Precondition, fmt.Sprintf("upgrade: machine %s does not exec binaries", m.Name()))
+		}
+		machines = append(machines, m)
+	}
+	for len(machines) > 0 {
+		n := batchSize
+		if n > len(machines) {
+			n = len(machines)
+		}
+		var batch []*Machine
+		batch, machines = machines[:n], machines[n:]
+		var (
+			wg       sync.WaitGroup
+			mu       sync.Mutex
+			problems []string
+		)
+		for _, m := range batch {
+			wg.Add(1)
+			go func(m *Machine) {
+				defer wg.Done()
+				if err := m.upgrade(ctx, binary); err != nil {
+					mu.Lock()
+					problems = append(problems, fmt.Sprintf("%s: %v", m.Name(), err))
+					mu.Unlock()
+				}
+			}(m)
+		}
+		wg.Wait()
+		if len(problems) > 0 {
+			return errors.E("upgrade", strings.Join(problems, "; "))
+		}
+	}
+	return nil
+}
+
+// Upgrade upgrades the running machine m to the provided binary (see
+// B.Upgrade).
+func (m *Machine) upgrade(ctx context.Context, binary *fatbin.Reader) error {
+	if m.NoExec {
+		return errors.E(errors.Precondition, fmt.Sprintf("machine %s does not exec binaries", m.Addr))
+	}
+	if m.State() != Running {
+		return errors.E(errors.Precondition, fmt.Sprintf("machine %s is not running", m.Addr))
+	}
+	log.Printf("%s: upgrading", m.Name())
+	drained := m.beginDrain()
+	defer m.endDrain()
+	if err := m.call(ctx, "Supervisor.Drain", struct{}{}, nil); err != nil {
+		return errors.E("drain", err)
+	}
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return errors.E("waiting for calls in flight", ctx.Err())
+	}
+	// As at startup, we expect the exec call to fail, since the
+	// process is replaced before it can reply.
+	if err := m.execBinary(ctx, binary); err != nil && !errors.Is(errors.Net, err) {
+		return err
+	}
+	if err := m.ping(ctx); err != nil {
+		return err
+	}
+	var info Info
+	if err := m.retryCall(ctx, time.Minute, 10*time.Second, "Supervisor.Info", struct{}{}, &info); err != nil {
+		return err
+	}
+	want, err := binaryImageDigest(binary, info.Goos, info.Goarch)
+	if err != nil {
+		return err
+	}
+	if info.Digest != want {
+		return errors.E(errors.Precondition,
+			fmt.Sprintf("machine runs binary %s after upgrade; want %s", info.Digest.Short(), want.Short()))
+	}
+	if err := m.registerServices(ctx); err != nil {
+		return err
+	}
+	m.emit(MachineUpgraded, nil, "")
+	log.Printf("%s: upgraded to binary %s", m.Name(), want.Short())
+	return nil
+}